@@ -0,0 +1,130 @@
+package main
+
+import (
+	"common"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// AssetFetcher provides benchmark input files that are missing locally.
+// Files are downloaded to the cache directory and are used only if their
+// SHA-256 checksum matches the expected one, so the downloaded data is
+// guaranteed to be the same for all implementations. The checksum is taken
+// from the scene file or, if not specified there, from the manifest.
+type AssetFetcher struct {
+	CacheDir string
+	Manifest *AssetManifest // optional
+	Client   *http.Client
+}
+
+func NewAssetFetcher(cacheDir string, manifest *AssetManifest) *AssetFetcher {
+	return &AssetFetcher{
+		CacheDir: cacheDir,
+		Manifest: manifest,
+		Client:   &http.Client{Timeout: 30 * time.Minute},
+	}
+}
+
+// FetchSceneAssets replaces paths of missing mesh files and, if
+// checkKdTrees is true, kdtree files with paths of the cached copies,
+// downloading them if necessary. Existing local files are used as they are
+// and are verified against the manifest if it is provided.
+func (fetcher *AssetFetcher) FetchSceneAssets(scene *SceneFile, checkKdTrees bool) {
+	for i := range scene.Models {
+		model := &scene.Models[i]
+		if model.Mesh != "" {
+			fileName, err := fetcher.Fetch(model.Mesh, model.MeshURL, model.MeshSHA256)
+			common.Check(err)
+			model.Mesh = fileName
+		}
+		if checkKdTrees && model.KdTree != "" {
+			fileName, err := fetcher.Fetch(model.KdTree, model.KdTreeURL, model.KdTreeSHA256)
+			common.Check(err)
+			model.KdTree = fileName
+		}
+	}
+}
+
+// Fetch returns the path of the file to use instead of fileName. If the
+// file exists then fileName itself is returned. Otherwise the file is
+// looked up in the cache directory and is downloaded from the url if it is
+// not cached yet or the cached copy is corrupted.
+func (fetcher *AssetFetcher) Fetch(fileName, url, checksum string) (string, error) {
+	if checksum == "" && fetcher.Manifest != nil {
+		checksum = fetcher.Manifest.GetChecksum(fileName)
+	}
+
+	if _, err := os.Stat(fileName); err == nil {
+		if fetcher.Manifest != nil {
+			if err := fetcher.Manifest.Verify(fileName); err != nil {
+				return "", err
+			}
+		}
+		return fileName, nil
+	}
+
+	if url == "" {
+		return "", errors.New("file not found and download url is not specified: " + fileName)
+	}
+	if checksum == "" {
+		return "", errors.New("checksum for downloaded file is not specified: " + fileName)
+	}
+
+	cachedFileName := filepath.Join(fetcher.CacheDir, filepath.Base(fileName))
+	if verifyFileChecksum(cachedFileName, checksum) == nil {
+		return cachedFileName, nil
+	}
+
+	fmt.Printf("downloading %s\n", url)
+	if err := fetcher.download(url, cachedFileName, checksum); err != nil {
+		return "", err
+	}
+	return cachedFileName, nil
+}
+
+// download writes the content under temporary name and renames the file
+// only after the checksum is verified, so interrupted or corrupted
+// downloads never replace the cached file.
+func (fetcher *AssetFetcher) download(url, fileName, checksum string) error {
+	if err := os.MkdirAll(filepath.Dir(fileName), 0755); err != nil {
+		return err
+	}
+
+	response, err := fetcher.Client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to download %s: %s", url, response.Status)
+	}
+
+	file, err := os.CreateTemp(filepath.Dir(fileName), filepath.Base(fileName)+".*.download")
+	if err != nil {
+		return err
+	}
+	tempFileName := file.Name()
+	defer os.Remove(tempFileName)
+
+	hash := sha256.New()
+	_, err = io.Copy(io.MultiWriter(file, hash), response.Body)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to download %s: %v", url, err)
+	}
+
+	actual := hex.EncodeToString(hash.Sum(nil))
+	if err := verifyChecksum(actual, checksum); err != nil {
+		return fmt.Errorf("%s: %v", url, err)
+	}
+	return os.Rename(tempFileName, fileName)
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bufio"
+	"common"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// AssetManifest holds SHA-256 checksums of benchmark input files. The
+// manifest file has the format of sha256sum tool output, so it can be
+// created and checked with standard tools:
+//
+//	<64 hex digits> <space> <space or *> <file name>
+//
+// File names are relative to the manifest directory. Empty lines and lines
+// that start with # are ignored.
+type AssetManifest struct {
+	dir       string
+	checksums map[string]string // clean relative path -> lower case hex digest
+}
+
+func LoadAssetManifest(fileName string) *AssetManifest {
+	manifest, err := loadAssetManifest(fileName)
+	common.Check(err)
+	return manifest
+}
+
+// loadAssetManifest is the same as LoadAssetManifest but returns an error
+// instead of reporting it.
+func loadAssetManifest(fileName string) (*AssetManifest, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	manifest := &AssetManifest{
+		dir:       filepath.Dir(fileName),
+		checksums: make(map[string]string),
+	}
+
+	scanner := bufio.NewScanner(file)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		const digestLength = 2 * sha256.Size
+		if len(line) < digestLength+2 || line[digestLength] != ' ' ||
+			(line[digestLength+1] != ' ' && line[digestLength+1] != '*') {
+			return nil, fmt.Errorf("%s:%d: invalid manifest line", fileName, lineNumber)
+		}
+		digest := strings.ToLower(line[:digestLength])
+		if _, err := hex.DecodeString(digest); err != nil {
+			return nil, fmt.Errorf("%s:%d: invalid checksum", fileName, lineNumber)
+		}
+		name := filepath.Clean(filepath.FromSlash(line[digestLength+2:]))
+		manifest.checksums[name] = digest
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+// GetChecksum returns the expected checksum of the file or an empty string
+// if the file is not listed in the manifest.
+func (manifest *AssetManifest) GetChecksum(fileName string) string {
+	name, err := filepath.Rel(manifest.dir, fileName)
+	if err != nil {
+		return ""
+	}
+	return manifest.checksums[filepath.Clean(name)]
+}
+
+// Verify checks that the file is listed in the manifest and that its
+// content matches the checksum.
+func (manifest *AssetManifest) Verify(fileName string) error {
+	expected := manifest.GetChecksum(fileName)
+	if expected == "" {
+		return fmt.Errorf("file is not listed in the asset manifest: %s", fileName)
+	}
+	return verifyFileChecksum(fileName, expected)
+}
+
+// verifyFileChecksum compares SHA-256 checksum of the file with the
+// expected hex digest.
+func verifyFileChecksum(fileName, expected string) error {
+	actual, err := fileSHA256(fileName)
+	if err != nil {
+		return err
+	}
+	if err := verifyChecksum(actual, expected); err != nil {
+		return fmt.Errorf("%s: %v", fileName, err)
+	}
+	return nil
+}
+
+func verifyChecksum(actual, expected string) error {
+	if actual != strings.ToLower(expected) {
+		return fmt.Errorf("checksum mismatch: %s, expected %s", actual, expected)
+	}
+	return nil
+}
+
+// fileSHA256 returns SHA-256 checksum of the file content as hex string.
+// Compressed files are hashed as they are stored.
+func fileSHA256(fileName string) (string, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// VerifySceneAssets checks mesh files of the scene models and, if
+// checkKdTrees is true, their kdtree files. Generated models have no files
+// to check.
+func (manifest *AssetManifest) VerifySceneAssets(scene *SceneFile, checkKdTrees bool) {
+	for _, model := range scene.Models {
+		files := []string{model.Mesh}
+		if checkKdTrees {
+			files = append(files, model.KdTree)
+		}
+		for _, fileName := range files {
+			if fileName != "" {
+				common.Check(manifest.Verify(fileName))
+			}
+		}
+	}
+}
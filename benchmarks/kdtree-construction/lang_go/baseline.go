@@ -0,0 +1,91 @@
+package main
+
+import (
+	"common"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+)
+
+// Baseline stores reference results of a benchmark run for a single model.
+// Structural values (node/leaf counts) are compared exactly and reported
+// separately from timing regressions since they do not depend on timing noise.
+type Baseline struct {
+	TimeMsec             int   `json:"timeMsec"`
+	NodesCount           int32 `json:"nodesCount"`
+	LeafCount            int32 `json:"leafCount"`
+	TriangleIndicesCount int32 `json:"triangleIndicesCount"`
+}
+
+func NewBaseline(kdTree *KdTree, timeMsec int) Baseline {
+	leafCount := int32(0)
+	for _, n := range kdTree.nodes {
+		if n.isLeaf() {
+			leafCount++
+		}
+	}
+	return Baseline{
+		TimeMsec:             timeMsec,
+		NodesCount:           int32(len(kdTree.nodes)),
+		LeafCount:            leafCount,
+		TriangleIndicesCount: int32(len(kdTree.triangleIndices)),
+	}
+}
+
+// LoadBaseline reads the baseline stored by -update-baseline. The baselines
+// depend on the machine, so they are not a part of the repository and the
+// missing baseline is reported with the way to create it.
+func LoadBaseline(fileName string) Baseline {
+	data, err := os.ReadFile(fileName)
+	if errors.Is(err, fs.ErrNotExist) {
+		common.RuntimeError(fmt.Sprintf("no baseline %s, run with "+
+			"-update-baseline to create it", fileName))
+	}
+	common.Check(err)
+
+	var baseline Baseline
+	err = json.Unmarshal(data, &baseline)
+	common.Check(err)
+	return baseline
+}
+
+func (baseline Baseline) SaveToFile(fileName string) {
+	data, err := json.MarshalIndent(baseline, "", "    ")
+	common.Check(err)
+	err = os.WriteFile(fileName, append(data, '\n'), 0644)
+	common.Check(err)
+}
+
+// CheckBaseline compares actual results against the baseline and prints
+// detected differences. tolerancePercent is the allowed timing regression.
+// Returns false if the structure has changed or timing has regressed.
+func CheckBaseline(name string, actual, baseline Baseline,
+	tolerancePercent float64) bool {
+	passed := true
+
+	if actual.NodesCount != baseline.NodesCount ||
+		actual.LeafCount != baseline.LeafCount ||
+		actual.TriangleIndicesCount != baseline.TriangleIndicesCount {
+		fmt.Printf("baseline [%-6s]: kdtree structure changed: "+
+			"nodes %d (expected %d), leaves %d (expected %d), "+
+			"triangle indices %d (expected %d)\n",
+			name, actual.NodesCount, baseline.NodesCount,
+			actual.LeafCount, baseline.LeafCount,
+			actual.TriangleIndicesCount, baseline.TriangleIndicesCount)
+		passed = false
+	}
+
+	maxTime := float64(baseline.TimeMsec) * (1.0 + tolerancePercent/100.0)
+	if float64(actual.TimeMsec) > maxTime {
+		fmt.Printf("baseline [%-6s]: time regression: %d ms (baseline %d ms, "+
+			"tolerance %.1f%%)\n",
+			name, actual.TimeMsec, baseline.TimeMsec, tolerancePercent)
+		passed = false
+	} else {
+		fmt.Printf("baseline [%-6s]: %d ms (baseline %d ms)\n",
+			name, actual.TimeMsec, baseline.TimeMsec)
+	}
+	return passed
+}
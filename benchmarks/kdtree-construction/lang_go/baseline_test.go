@@ -0,0 +1,58 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCheckBaseline(t *testing.T) {
+	baseline := Baseline{TimeMsec: 100, NodesCount: 7, LeafCount: 4,
+		TriangleIndicesCount: 12}
+
+	withinTolerance := baseline
+	withinTolerance.TimeMsec = 110
+	if !CheckBaseline("within", withinTolerance, baseline, 10) {
+		t.Errorf("time %d ms is within the tolerance", withinTolerance.TimeMsec)
+	}
+
+	regression := baseline
+	regression.TimeMsec = 111
+	if CheckBaseline("slower", regression, baseline, 10) {
+		t.Errorf("time %d ms is not detected as regression", regression.TimeMsec)
+	}
+
+	// the structure is compared exactly even if the build is faster
+	for _, change := range []func(b *Baseline){
+		func(b *Baseline) { b.NodesCount++ },
+		func(b *Baseline) { b.LeafCount-- },
+		func(b *Baseline) { b.TriangleIndicesCount++ },
+	} {
+		changed := baseline
+		changed.TimeMsec = 50
+		change(&changed)
+		if CheckBaseline("changed", changed, baseline, 10) {
+			t.Errorf("structure change %+v is not detected", changed)
+		}
+	}
+}
+
+func TestLoadBaseline(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "teapot.baseline.json")
+	mesh := LoadTriangleMesh(teapotStl)
+	kdTree := NewKdTreeBuilder(mesh, NewBuildParams()).BuildKdTree()
+	baseline := NewBaseline(kdTree, 42)
+	if baseline.NodesCount != int32(len(kdTree.nodes)) || baseline.LeafCount == 0 {
+		t.Errorf("unexpected baseline %+v", baseline)
+	}
+	baseline.SaveToFile(fileName)
+	if loaded := LoadBaseline(fileName); loaded != baseline {
+		t.Errorf("loaded baseline %+v, expected %+v", loaded, baseline)
+	}
+
+	missingFileName := filepath.Join(os.TempDir(), "missing.baseline.json")
+	checkRuntimeError(t, "missing baseline", "no baseline "+missingFileName+
+		", run with -update-baseline", func() {
+		LoadBaseline(missingFileName)
+	})
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestBBox32Intersect(t *testing.T) {
+	bbox := NewBBox32FromPoints(Vector32{0, 0, 0}, Vector32{1, 1, 1})
+	for _, test := range bboxRayTests {
+		ray := RayFromOriginAndDirection(test.origin, test.direction)
+		t0, t1, hit := bbox.Intersect(&ray)
+		if hit != test.hit {
+			t.Errorf("%s: hit is %v, expected %v", test.name, hit, test.hit)
+		} else if hit && (t0 != test.expectedT0 || t1 != test.expectedT1) {
+			t.Errorf("%s: range is [%g, %g], expected [%g, %g]", test.name, t0, t1,
+				test.expectedT0, test.expectedT1)
+		}
+	}
+}
+
+func TestBBox32Methods(t *testing.T) {
+	bbox := NewBBox32FromPoints(Vector32{0, 0, 0}, Vector32{1, 2, 3})
+	if area := bbox.GetSurfaceArea(); area != 22 {
+		t.Errorf("surface area is %g, expected 22", area)
+	}
+	if center := bbox.GetCenter(); center != (Vector32{0.5, 1, 1.5}) {
+		t.Errorf("center is %v, expected (0.5, 1, 1.5)", center)
+	}
+	touching := NewBBox32FromPoints(Vector32{1, 2, 3}, Vector32{4, 4, 4})
+	if !bbox.Overlaps(touching) || !touching.Overlaps(bbox) {
+		t.Errorf("boxes with a common corner do not overlap")
+	}
+	separate := NewBBox32FromPoints(Vector32{1.5, 0, 0}, Vector32{2, 1, 1})
+	if bbox.Overlaps(separate) {
+		t.Errorf("separate boxes overlap")
+	}
+}
@@ -50,12 +50,37 @@ func (bbox *BBox64) Extend(point Vector64) {
 	bbox.maxPoint[2] = math.Max(bbox.maxPoint[2], point[2])
 }
 
+func (bbox *BBox64) GetSurfaceArea() float64 {
+	diag := VSub64(bbox.maxPoint, bbox.minPoint)
+	return 2.0 * (diag[0]*diag[1] + diag[0]*diag[2] + diag[1]*diag[2])
+}
+
+func (bbox *BBox64) GetCenter() Vector64 {
+	return VMul64(VAdd64(bbox.minPoint, bbox.maxPoint), 0.5)
+}
+
+// Overlaps returns true if bounding boxes have at least one common point.
+func (bbox *BBox64) Overlaps(bbox2 BBox64) bool {
+	for i := 0; i < 3; i++ {
+		if bbox.maxPoint[i] < bbox2.minPoint[i] ||
+			bbox.minPoint[i] > bbox2.maxPoint[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Intersect computes parametric range [t0, t1] of the ray inside the
+// bounding box using slab test. The range is clipped to t >= 0.
 func (bbox *BBox64) Intersect(ray *Ray) (t0, t1 float64, hitFound bool) {
 	t1 = math.Inf(+1)
 	for i := 0; i < 3; i++ {
 		tNear := (bbox.minPoint[i] - ray.GetOrigin()[i]) * ray.GetInvDirection()[i]
 		tFar := (bbox.maxPoint[i] - ray.GetOrigin()[i]) * ray.GetInvDirection()[i]
 
+		// for zero direction component the values are signed infinities or
+		// NaN if the origin lies in the slab plane, NaN does not pass the
+		// comparisons below so the slab boundary is inclusive
 		if tNear > tFar {
 			tNear, tFar = tFar, tNear
 		}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"testing"
+)
+
+type bboxRayTest struct {
+	name       string
+	origin     Vector64
+	direction  Vector64
+	hit        bool
+	expectedT0 float64
+	expectedT1 float64
+}
+
+// bboxRayTests use the unit box [0, 1]^3.
+var bboxRayTests = []bboxRayTest{
+	{"outside", Vector64{-1, 0.5, 0.5}, Vector64{1, 0, 0}, true, 1, 2},
+	{"diagonal", Vector64{-1, -1, -1}, Vector64{1, 1, 1}, true, 1, 2},
+	{"inside", Vector64{0.5, 0.5, 0.5}, Vector64{0, 0, -1}, true, 0, 0.5},
+	{"pointing away", Vector64{2, 0.5, 0.5}, Vector64{1, 0, 0}, false, 0, 0},
+	{"parallel to face outside slab", Vector64{-1, 2, 0.5}, Vector64{1, 0, 0}, false, 0, 0},
+	{"parallel in face plane", Vector64{-1, 1, 0.5}, Vector64{1, 0, 0}, true, 1, 2},
+	{"miss", Vector64{-1, 0.5, 0.5}, Vector64{1, 2, 0}, false, 0, 0},
+}
+
+func TestBBox64Intersect(t *testing.T) {
+	bbox := NewBBox64FromPoints(Vector64{0, 0, 0}, Vector64{1, 1, 1})
+	for _, test := range bboxRayTests {
+		ray := RayFromOriginAndDirection(test.origin, test.direction)
+		t0, t1, hit := bbox.Intersect(&ray)
+		if hit != test.hit {
+			t.Errorf("%s: hit is %v, expected %v", test.name, hit, test.hit)
+		} else if hit && (t0 != test.expectedT0 || t1 != test.expectedT1) {
+			t.Errorf("%s: range is [%g, %g], expected [%g, %g]", test.name, t0, t1,
+				test.expectedT0, test.expectedT1)
+		}
+	}
+}
+
+func TestBBox64Methods(t *testing.T) {
+	bbox := NewBBox64FromPoints(Vector64{0, 0, 0}, Vector64{1, 2, 3})
+	if area := bbox.GetSurfaceArea(); area != 22 {
+		t.Errorf("surface area is %g, expected 22", area)
+	}
+	if center := bbox.GetCenter(); center != (Vector64{0.5, 1, 1.5}) {
+		t.Errorf("center is %v, expected (0.5, 1, 1.5)", center)
+	}
+	touching := NewBBox64FromPoints(Vector64{1, 2, 3}, Vector64{4, 4, 4})
+	if !bbox.Overlaps(touching) || !touching.Overlaps(bbox) {
+		t.Errorf("boxes with a common corner do not overlap")
+	}
+	separate := NewBBox64FromPoints(Vector64{1.5, 0, 0}, Vector64{2, 1, 1})
+	if bbox.Overlaps(separate) {
+		t.Errorf("separate boxes overlap")
+	}
+}
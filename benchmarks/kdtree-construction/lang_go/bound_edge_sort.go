@@ -0,0 +1,136 @@
+package main
+
+import (
+	"math"
+	"sort"
+	"time"
+)
+
+const (
+	radixBits    = 11
+	radixBuckets = 1 << radixBits
+	radixMask    = radixBuckets - 1
+	radixPasses  = 3 // 33 bit keys
+
+	// 64 bit keys, see getCanonicalEdgeSortKey
+	canonicalRadixPasses = 6
+
+	// small arrays are sorted faster with comparison sort
+	radixSortMinEdges = 512
+)
+
+// getEdgeSortKey returns a key which unsigned order is the same as the order
+// defined by boundEdgeSorter.Less: edges are ordered by position and end
+// edges go before start edges at the same position.
+func getEdgeSortKey(e boundEdge) uint64 {
+	return getPositionSortKey(e.positionOnAxis, e.isStart())
+}
+
+// getPositionSortKey returns the sort key of the edge with the given
+// position and type, see getEdgeSortKey.
+func getPositionSortKey(position float32, isStart bool) uint64 {
+	if position == 0 {
+		position = 0 // -0 and +0 are equal positions
+	}
+	bits := math.Float32bits(position)
+	if bits&0x80000000 != 0 {
+		bits = ^bits
+	} else {
+		bits |= 0x80000000
+	}
+
+	key := uint64(bits) << 1
+	if isStart {
+		key |= 1
+	}
+	return key
+}
+
+// getCanonicalEdgeSortKey extends getEdgeSortKey with the triangle index in
+// the low 31 bits, the order is the same as canonicalBoundEdgeSorter.Less.
+func getCanonicalEdgeSortKey(e boundEdge) uint64 {
+	return getEdgeSortKey(e)<<31 | uint64(e.triangleIndex())
+}
+
+func getRadixSortKey(e boundEdge, canonical bool) uint64 {
+	if canonical {
+		return getCanonicalEdgeSortKey(e)
+	}
+	return getEdgeSortKey(e)
+}
+
+// radixSortEdges sorts edges with LSD radix sort. The sort is stable, so the
+// result is identical to sort.Stable(boundEdgeSorter(edges)), or to the
+// canonicalBoundEdgeSorter order if canonical is true. scratch should have
+// at least len(edges) elements.
+func radixSortEdges(edges, scratch []boundEdge, canonical bool) {
+	src := edges
+	dst := scratch[:len(edges)]
+	passes := uint(radixPasses)
+	if canonical {
+		passes = canonicalRadixPasses
+	}
+
+	var counts [radixBuckets]int
+	for pass := uint(0); pass < passes; pass++ {
+		shift := pass * radixBits
+
+		for i := range counts {
+			counts[i] = 0
+		}
+		for _, e := range src {
+			counts[(getRadixSortKey(e, canonical)>>shift)&radixMask]++
+		}
+
+		if !radixOffsets(&counts, (getRadixSortKey(src[0], canonical)>>shift)&radixMask,
+			len(src)) {
+			continue
+		}
+		for _, e := range src {
+			digit := (getRadixSortKey(e, canonical) >> shift) & radixMask
+			dst[counts[digit]] = e
+			counts[digit]++
+		}
+		src, dst = dst, src
+	}
+
+	if &src[0] != &edges[0] {
+		copy(edges, src)
+	}
+}
+
+// radixOffsets replaces the digit counts of the pass with the offsets of
+// the digits in the destination. It returns false if the pass can be
+// skipped since all keys have the same digit as the first key.
+func radixOffsets(counts *[radixBuckets]int, firstDigit uint64, count int) bool {
+	if counts[firstDigit] == count {
+		return false
+	}
+	offset := 0
+	for i, digitCount := range counts {
+		counts[i] = offset
+		offset += digitCount
+	}
+	return true
+}
+
+func (builder *KdTreeBuilder) sortEdges(edges []boundEdge) {
+	if len(edges) == 0 {
+		return
+	}
+	if builder.buildParams.CollectTimings {
+		start := time.Now()
+		defer func() {
+			builder.buildTimings.EdgeSort += time.Since(start)
+		}()
+	}
+	canonical := builder.buildParams.CanonicalEdgeOrder
+	if builder.buildParams.UseRadixSort && len(edges) >= radixSortMinEdges {
+		radixSortEdges(edges, builder.edgesScratchBuffer, canonical)
+	} else if canonical {
+		// the order is total, the sort does not have to be stable
+		sort.Sort(canonicalBoundEdgeSorter(edges))
+	} else {
+		sort.Stable(boundEdgeSorter(edges))
+	}
+}
@@ -0,0 +1,552 @@
+package main
+
+import (
+	"math"
+)
+
+type BVHBuildParams struct {
+	IntersectionCost   float32
+	TraversalCost      float32
+	BinCount           int
+	LeafTrianglesLimit int // leaves are never larger than this limit
+
+	// SpatialSplitAlpha enables spatial splits (SBVH). The spatial split is
+	// evaluated when the children of the best object split overlap and the
+	// overlap surface area relative to the root surface area is greater
+	// than alpha. Triangles that cross spatial split plane are referenced
+	// from both children. Zero disables spatial splits, small values like
+	// 1e-5 allow them almost everywhere.
+	SpatialSplitAlpha float32
+}
+
+func NewBVHBuildParams() BVHBuildParams {
+	return BVHBuildParams{
+		IntersectionCost:   80,
+		TraversalCost:      1,
+		BinCount:           16,
+		LeafTrianglesLimit: 8,
+	}
+}
+
+// bvhNode is either an interior node with two children or a leaf that
+// references a range of BVH.triangleIndices. The left child of the interior
+// node immediately follows its parent, index stores the right child.
+type bvhNode struct {
+	bounds         BBox32
+	index          int32 // right child for interior node, first triangle for leaf
+	trianglesCount int32 // 0 for interior node
+	axis           int32
+}
+
+func (n *bvhNode) isLeaf() bool {
+	return n.trianglesCount > 0
+}
+
+type BVH struct {
+	nodes           []bvhNode
+	triangleIndices []int32
+	mesh            *TriangleMesh
+}
+
+// bvhReference is the triangle as seen by the builder. Without spatial
+// splits the bounds are the triangle bounds, spatial splits produce
+// references with the bounds of the triangle part inside the node.
+type bvhReference struct {
+	bounds   BBox32
+	centroid Vector32
+	triangle int32
+}
+
+type bvhBuilder struct {
+	buildParams     BVHBuildParams
+	mesh            *TriangleMesh
+	minOverlapArea  float32 // spatial split is evaluated for larger overlaps
+	triangleIndices []int32
+	nodes           []bvhNode
+}
+
+// BuildBVH builds bounding volume hierarchy using binned SAH.
+func BuildBVH(mesh *TriangleMesh, buildParams BVHBuildParams) *BVH {
+	if buildParams.BinCount < 2 {
+		buildParams.BinCount = 2
+	}
+	if buildParams.LeafTrianglesLimit < 1 {
+		buildParams.LeafTrianglesLimit = 1
+	}
+
+	trianglesCount := mesh.GetTrianglesCount()
+	builder := &bvhBuilder{
+		buildParams:     buildParams,
+		mesh:            mesh,
+		triangleIndices: make([]int32, 0, trianglesCount),
+	}
+	references := make([]bvhReference, trianglesCount)
+	rootBounds := NewBBox32()
+	for i := int32(0); i < trianglesCount; i++ {
+		bounds := mesh.GetTriangleBounds(i)
+		references[i] = bvhReference{bounds, bounds.GetCenter(), i}
+		rootBounds = BBox32Union(rootBounds, bounds)
+	}
+	if buildParams.SpatialSplitAlpha > 0 {
+		builder.minOverlapArea = buildParams.SpatialSplitAlpha * rootBounds.GetSurfaceArea()
+	}
+
+	if trianglesCount == 0 {
+		builder.nodes = append(builder.nodes, bvhNode{bounds: NewBBox32()})
+	} else {
+		builder.buildNode(references)
+	}
+
+	return &BVH{
+		nodes:           builder.nodes,
+		triangleIndices: builder.triangleIndices,
+		mesh:            mesh,
+	}
+}
+
+// buildNode builds the subtree for the given references. Leaves are
+// created in depth-first order, so leaf triangles form consecutive ranges
+// of triangleIndices.
+func (builder *bvhBuilder) buildNode(references []bvhReference) {
+	bounds := NewBBox32()
+	centroidBounds := NewBBox32()
+	for i := range references {
+		bounds = BBox32Union(bounds, references[i].bounds)
+		centroidBounds.Extend(references[i].centroid)
+	}
+
+	nodeIndex := len(builder.nodes)
+	builder.nodes = append(builder.nodes, bvhNode{bounds: bounds})
+
+	left, right, axis := builder.partition(references, bounds, centroidBounds)
+	if left == nil {
+		builder.nodes[nodeIndex].index = int32(len(builder.triangleIndices))
+		builder.nodes[nodeIndex].trianglesCount = int32(len(references))
+		for i := range references {
+			builder.triangleIndices = append(builder.triangleIndices,
+				references[i].triangle)
+		}
+		return
+	}
+
+	builder.nodes[nodeIndex].axis = int32(axis)
+	builder.buildNode(left)
+	builder.nodes[nodeIndex].index = int32(len(builder.nodes))
+	builder.buildNode(right)
+}
+
+// partition selects the split using binned SAH and returns references of
+// the children. Object split reorders the references in place, spatial
+// split creates new slices. Returns nil slices if a leaf should be created.
+func (builder *bvhBuilder) partition(references []bvhReference, bounds,
+	centroidBounds BBox32) (left, right []bvhReference, axis int) {
+	buildParams := &builder.buildParams
+	count := int32(len(references))
+	if count == 1 {
+		return nil, nil, 0
+	}
+
+	type bin struct {
+		bounds BBox32
+		count  int32
+	}
+	binCount := buildParams.BinCount
+	bins := make([]bin, binCount)
+	rightBounds := make([]BBox32, binCount)
+	rightCount := make([]int32, binCount)
+
+	bestCost := float32(math.Inf(+1))
+	bestAxis := -1
+	bestBin := 0
+	var bestLeftBounds, bestRightBounds BBox32
+
+	for axis := 0; axis < 3; axis++ {
+		extent := centroidBounds.maxPoint[axis] - centroidBounds.minPoint[axis]
+		if extent <= 0 {
+			continue
+		}
+		scale := float32(binCount) / extent
+
+		for i := range bins {
+			bins[i] = bin{NewBBox32(), 0}
+		}
+		for i := range references {
+			b := builder.getBin(references[i].centroid[axis],
+				centroidBounds.minPoint[axis], scale)
+			bins[b].bounds = BBox32Union(bins[b].bounds, references[i].bounds)
+			bins[b].count++
+		}
+
+		// sweep from the right to accumulate right side bounds
+		accumBounds := NewBBox32()
+		accumCount := int32(0)
+		for i := binCount - 1; i > 0; i-- {
+			accumBounds = BBox32Union(accumBounds, bins[i].bounds)
+			accumCount += bins[i].count
+			rightBounds[i] = accumBounds
+			rightCount[i] = accumCount
+		}
+
+		// sweep from the left and evaluate split after bin i-1
+		accumBounds = NewBBox32()
+		accumCount = 0
+		for i := 1; i < binCount; i++ {
+			accumBounds = BBox32Union(accumBounds, bins[i-1].bounds)
+			accumCount += bins[i-1].count
+			if accumCount == 0 || rightCount[i] == 0 {
+				continue
+			}
+			cost := accumBounds.GetSurfaceArea()*float32(accumCount) +
+				rightBounds[i].GetSurfaceArea()*float32(rightCount[i])
+			if cost < bestCost {
+				bestCost = cost
+				bestAxis = axis
+				bestBin = i
+				bestLeftBounds, bestRightBounds = accumBounds, rightBounds[i]
+			}
+		}
+	}
+
+	// spatial split is evaluated only if object split children overlap
+	// significantly, otherwise it hardly can be better
+	objectCost := bestCost
+	spatialSplit := false
+	var spatialAxis int
+	var spatialPosition float32
+	if builder.minOverlapArea > 0 && bestAxis != -1 {
+		overlap := bboxIntersection32(bestLeftBounds, bestRightBounds)
+		if !overlap.isEmpty() && overlap.GetSurfaceArea() > builder.minOverlapArea {
+			cost, axis, position := builder.findSpatialSplit(references, bounds)
+			if cost < bestCost {
+				bestCost = cost
+				spatialSplit = true
+				spatialAxis, spatialPosition = axis, position
+			}
+		}
+	}
+
+	leafCost := buildParams.IntersectionCost * float32(count)
+	if bestAxis != -1 {
+		bestCost = buildParams.TraversalCost +
+			buildParams.IntersectionCost*bestCost/bounds.GetSurfaceArea()
+		objectCost = buildParams.TraversalCost +
+			buildParams.IntersectionCost*objectCost/bounds.GetSurfaceArea()
+	}
+
+	if bestAxis == -1 || bestCost >= leafCost {
+		if count <= int32(buildParams.LeafTrianglesLimit) {
+			return nil, nil, 0
+		}
+		if bestAxis == -1 {
+			// all centroids are the same, split in the middle
+			return references[:count/2], references[count/2:], 0
+		}
+	}
+
+	if spatialSplit {
+		left, right := builder.splitReferences(references, spatialAxis, spatialPosition)
+		// each child should have less references than the parent, otherwise
+		// subdivision might never stop
+		if len(left) > 0 && len(right) > 0 && len(left) < len(references) &&
+			len(right) < len(references) {
+			return left, right, spatialAxis
+		}
+		if objectCost >= leafCost && count <= int32(buildParams.LeafTrianglesLimit) {
+			return nil, nil, 0
+		}
+	}
+
+	scale := float32(binCount) /
+		(centroidBounds.maxPoint[bestAxis] - centroidBounds.minPoint[bestAxis])
+	mid := int32(0)
+	for i := int32(0); i < count; i++ {
+		b := builder.getBin(references[i].centroid[bestAxis],
+			centroidBounds.minPoint[bestAxis], scale)
+		if b < bestBin {
+			references[i], references[mid] = references[mid], references[i]
+			mid++
+		}
+	}
+	return references[:mid], references[mid:], bestAxis
+}
+
+func (builder *bvhBuilder) getBin(position, minPosition, scale float32) int {
+	b := int((position - minPosition) * scale)
+	if b >= builder.buildParams.BinCount {
+		b = builder.buildParams.BinCount - 1
+	}
+	return b
+}
+
+// findSpatialSplit finds the best split plane among bin boundaries of the
+// node bounds. The references are clipped to the bins they overlap, so the
+// bin bounds are tight. The returned cost has the same units as the object
+// split cost: sum of children surface areas multiplied by references
+// counts.
+func (builder *bvhBuilder) findSpatialSplit(references []bvhReference,
+	bounds BBox32) (bestCost float32, bestAxis int, bestPosition float32) {
+
+	binCount := builder.buildParams.BinCount
+	binBounds := make([]BBox32, binCount)
+	entries := make([]int32, binCount)
+	exits := make([]int32, binCount)
+	rightBounds := make([]BBox32, binCount)
+	rightCount := make([]int32, binCount)
+
+	bestCost = float32(math.Inf(+1))
+	for axis := 0; axis < 3; axis++ {
+		minPosition := bounds.minPoint[axis]
+		extent := bounds.maxPoint[axis] - minPosition
+		if extent <= 0 {
+			continue
+		}
+		scale := float32(binCount) / extent
+		binPosition := func(b int) float32 {
+			if b == binCount {
+				return bounds.maxPoint[axis]
+			}
+			return minPosition + extent*float32(b)/float32(binCount)
+		}
+
+		for i := range binBounds {
+			binBounds[i] = NewBBox32()
+			entries[i] = 0
+			exits[i] = 0
+		}
+		for i := range references {
+			reference := &references[i]
+			firstBin := builder.getBin(reference.bounds.minPoint[axis], minPosition, scale)
+			lastBin := builder.getBin(reference.bounds.maxPoint[axis], minPosition, scale)
+			if firstBin == lastBin {
+				binBounds[firstBin] = BBox32Union(binBounds[firstBin], reference.bounds)
+			} else {
+				vertices := builder.getTriangleVertices(reference.triangle)
+				for b := firstBin; b <= lastBin; b++ {
+					clipped := clipTriangleBounds(&vertices, reference.bounds, axis,
+						binPosition(b), binPosition(b+1))
+					if !clipped.isEmpty() {
+						binBounds[b] = BBox32Union(binBounds[b], clipped)
+					}
+				}
+			}
+			entries[firstBin]++
+			exits[lastBin]++
+		}
+
+		accumBounds := NewBBox32()
+		accumCount := int32(0)
+		for i := binCount - 1; i > 0; i-- {
+			accumBounds = BBox32Union(accumBounds, binBounds[i])
+			accumCount += exits[i]
+			rightBounds[i] = accumBounds
+			rightCount[i] = accumCount
+		}
+
+		accumBounds = NewBBox32()
+		accumCount = 0
+		for i := 1; i < binCount; i++ {
+			accumBounds = BBox32Union(accumBounds, binBounds[i-1])
+			accumCount += entries[i-1]
+			if accumCount == 0 || rightCount[i] == 0 {
+				continue
+			}
+			cost := accumBounds.GetSurfaceArea()*float32(accumCount) +
+				rightBounds[i].GetSurfaceArea()*float32(rightCount[i])
+			if cost < bestCost {
+				bestCost = cost
+				bestAxis = axis
+				bestPosition = binPosition(i)
+			}
+		}
+	}
+	return bestCost, bestAxis, bestPosition
+}
+
+// splitReferences distributes references between the sides of the split
+// plane. References that cross the plane are clipped and added to both
+// sides.
+func (builder *bvhBuilder) splitReferences(references []bvhReference, axis int,
+	position float32) (left, right []bvhReference) {
+
+	negInf, posInf := float32(math.Inf(-1)), float32(math.Inf(+1))
+	for i := range references {
+		reference := &references[i]
+		if reference.bounds.maxPoint[axis] <= position {
+			left = append(left, *reference)
+		} else if reference.bounds.minPoint[axis] >= position {
+			right = append(right, *reference)
+		} else {
+			if b := builder.clipReference(reference, axis, negInf, position); !b.isEmpty() {
+				left = append(left, bvhReference{b, b.GetCenter(), reference.triangle})
+			}
+			if b := builder.clipReference(reference, axis, position, posInf); !b.isEmpty() {
+				right = append(right, bvhReference{b, b.GetCenter(), reference.triangle})
+			}
+		}
+	}
+	return left, right
+}
+
+// clipReference returns the bounds of the part of the reference triangle
+// between the planes minPosition and maxPosition orthogonal to the axis.
+// The result is also limited by the reference bounds.
+func (builder *bvhBuilder) clipReference(reference *bvhReference, axis int,
+	minPosition, maxPosition float32) BBox32 {
+	vertices := builder.getTriangleVertices(reference.triangle)
+	return clipTriangleBounds(&vertices, reference.bounds, axis, minPosition, maxPosition)
+}
+
+func (builder *bvhBuilder) getTriangleVertices(triangle int32) [3]Vector64 {
+	v0, v1, v2 := builder.mesh.GetTriangle(triangle)
+	return [3]Vector64{
+		NewVector64FromVector32(v0),
+		NewVector64FromVector32(v1),
+		NewVector64FromVector32(v2),
+	}
+}
+
+func clipTriangleBounds(vertices *[3]Vector64, bounds BBox32, axis int,
+	minPosition, maxPosition float32) BBox32 {
+	planes := [2]float64{float64(minPosition), float64(maxPosition)}
+
+	clipped := NewBBox32()
+	for i := 0; i < 3; i++ {
+		a, b := vertices[i], vertices[(i+1)%3]
+		if a[axis] >= planes[0] && a[axis] <= planes[1] {
+			clipped.Extend(toVector32(a))
+		}
+		for _, plane := range planes {
+			if (a[axis] < plane && b[axis] > plane) || (a[axis] > plane && b[axis] < plane) {
+				t := (plane - a[axis]) / (b[axis] - a[axis])
+				p := VAdd64(a, VMul64(VSub64(b, a), t))
+				p[axis] = plane
+				clipped.Extend(toVector32(p))
+			}
+		}
+	}
+	clipped = bboxIntersection32(clipped, bounds)
+	clipped.minPoint[axis] = f32Max(clipped.minPoint[axis], minPosition)
+	clipped.maxPoint[axis] = f32Min(clipped.maxPoint[axis], maxPosition)
+	return clipped
+}
+
+// bboxIntersection32 returns the common part of the bounding boxes, the
+// result is empty if the boxes do not overlap.
+func bboxIntersection32(bbox, bbox2 BBox32) BBox32 {
+	return BBox32{
+		minPoint: Vector32{
+			f32Max(bbox.minPoint[0], bbox2.minPoint[0]),
+			f32Max(bbox.minPoint[1], bbox2.minPoint[1]),
+			f32Max(bbox.minPoint[2], bbox2.minPoint[2]),
+		},
+		maxPoint: Vector32{
+			f32Min(bbox.maxPoint[0], bbox2.maxPoint[0]),
+			f32Min(bbox.maxPoint[1], bbox2.maxPoint[1]),
+			f32Min(bbox.maxPoint[2], bbox2.maxPoint[2]),
+		},
+	}
+}
+
+func (bbox *BBox32) isEmpty() bool {
+	return bbox.minPoint[0] > bbox.maxPoint[0] || bbox.minPoint[1] > bbox.maxPoint[1] ||
+		bbox.minPoint[2] > bbox.maxPoint[2]
+}
+
+func (bvh *BVH) GetNodesCount() int {
+	return len(bvh.nodes)
+}
+
+// GetReferencesCount returns the number of triangle references stored in
+// the leaves. It is greater than the triangles count if spatial splits
+// duplicate triangles.
+func (bvh *BVH) GetReferencesCount() int {
+	return len(bvh.triangleIndices)
+}
+
+// Refit updates node bounds after mesh vertices are moved. The tree
+// structure is kept, so the BVH stays valid for the new vertex positions
+// while its quality degrades with deformation. The leaf bounds are the
+// full bounds of leaf triangles, also for references created by spatial
+// splits.
+func (bvh *BVH) Refit() {
+	if len(bvh.triangleIndices) == 0 {
+		return
+	}
+	// children are stored after their parent
+	for i := len(bvh.nodes) - 1; i >= 0; i-- {
+		n := &bvh.nodes[i]
+		if n.isLeaf() {
+			bounds := NewBBox32()
+			for _, triangle := range bvh.triangleIndices[n.index : n.index+n.trianglesCount] {
+				bounds = BBox32Union(bounds, bvh.mesh.GetTriangleBounds(triangle))
+			}
+			n.bounds = bounds
+		} else {
+			n.bounds = BBox32Union(bvh.nodes[i+1].bounds, bvh.nodes[n.index].bounds)
+		}
+	}
+}
+
+func (bvh *BVH) Intersect(ray *Ray) (bool, KdTreeIntersection) {
+	if len(bvh.triangleIndices) == 0 || !ray.HasValidDirection() {
+		return false, KdTreeIntersection{t: math.Inf(+1)}
+	}
+
+	stack := make([]int32, 0, 64)
+
+	closestIntersection := TriangleIntersection{t: math.Inf(+1)}
+	vertices := bvh.mesh.vertices
+	triangles := bvh.mesh.triangles
+
+	nodeIndex := int32(0)
+	for {
+		n := &bvh.nodes[nodeIndex]
+
+		t0, _, hit := n.bounds.Intersect(ray)
+		if hit && t0 <= closestIntersection.t {
+			if n.isLeaf() {
+				for i := n.index; i < n.index+n.trianglesCount; i++ {
+					triangleIndex := bvh.triangleIndices[i]
+					indices := triangles[triangleIndex]
+					triangle := Triangle{[3]Vector64{
+						NewVector64FromVector32(vertices[indices[0]]),
+						NewVector64FromVector32(vertices[indices[1]]),
+						NewVector64FromVector32(vertices[indices[2]]),
+					}}
+					hitFound, intersection := IntersectTriangle(ray, &triangle)
+					if hitFound && intersection.t < closestIntersection.t {
+						closestIntersection = intersection
+						closestIntersection.triangleIndex = triangleIndex
+					}
+				}
+			} else {
+				// visit the child that is closer along the ray first
+				first, second := nodeIndex+1, n.index
+				if ray.GetDirection()[n.axis] < 0 {
+					first, second = second, first
+				}
+				stack = append(stack, second)
+				nodeIndex = first
+				continue
+			}
+		}
+
+		if len(stack) == 0 {
+			break
+		}
+		nodeIndex = stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+	}
+
+	if closestIntersection.t == math.Inf(+1) {
+		return false, KdTreeIntersection{t: math.Inf(+1)}
+	}
+	return true, KdTreeIntersection{
+		t:             closestIntersection.t,
+		epsilon:       closestIntersection.epsilon,
+		b1:            closestIntersection.b1,
+		b2:            closestIntersection.b2,
+		triangleIndex: closestIntersection.triangleIndex,
+		materialID:    bvh.mesh.GetMaterialID(closestIntersection.triangleIndex),
+	}
+}
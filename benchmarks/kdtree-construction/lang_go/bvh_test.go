@@ -0,0 +1,51 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestBVHAgreesWithKdTree(t *testing.T) {
+	mesh := LoadTriangleMesh(teapotStl)
+	kdTree := NewKdTreeBuilder(mesh, NewBuildParams()).BuildKdTree()
+
+	spatialSplitParams := NewBVHBuildParams()
+	spatialSplitParams.SpatialSplitAlpha = 1e-5
+	for _, test := range []struct {
+		name        string
+		buildParams BVHBuildParams
+	}{
+		{"object splits", NewBVHBuildParams()},
+		{"spatial splits", spatialSplitParams},
+	} {
+		bvh := BuildBVH(mesh, test.buildParams)
+		camera := NewCameraForBounds(kdTree.meshBounds)
+		const width, height = 64, 64
+		hitsCount := 0
+		for y := 0; y < height; y++ {
+			for x := 0; x < width; x++ {
+				ray := camera.GenerateRay(x, y, width, height)
+				hitFound, intersection := kdTree.Intersect(&ray)
+				bvhHitFound, bvhIntersection := bvh.Intersect(&ray)
+				if hitFound != bvhHitFound {
+					t.Errorf("%s: pixel (%d, %d): bvh hit is %v, kdtree hit is %v",
+						test.name, x, y, bvhHitFound, hitFound)
+					continue
+				}
+				if !hitFound {
+					continue
+				}
+				hitsCount++
+				// several triangles can share the closest hit on edges, so
+				// only the distance is compared
+				if math.Abs(bvhIntersection.t-intersection.t) > 1e-9*intersection.t {
+					t.Errorf("%s: pixel (%d, %d): bvh hit at t = %g, kdtree hit at t = %g",
+						test.name, x, y, bvhIntersection.t, intersection.t)
+				}
+			}
+		}
+		if hitsCount == 0 {
+			t.Fatalf("%s: no rays hit the mesh", test.name)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"math"
+	"time"
+)
+
+// DynamicSceneStats are collected by RunDynamicScene. Times are averages
+// per frame, references are counted on the last frame.
+type DynamicSceneStats struct {
+	KdTreeRefitTime       time.Duration
+	KdTreeBuildTime       time.Duration
+	KdTreeRefitReferences int
+	KdTreeBuildReferences int
+	BVHRefitTime          time.Duration
+	BVHBuildTime          time.Duration
+}
+
+// deformMesh displaces rest vertex positions with a sine wave that travels
+// along the longest axis of the bounds. The displacement is perpendicular
+// to that axis and its amplitude is 2% of the bounds diagonal.
+func deformMesh(vertices, restVertices []Vector32, bounds BBox32, frame int) {
+	axis := getLongestAxis(bounds)
+	displacementAxis := (axis + 1) % 3
+	extent := float64(bounds.maxPoint[axis] - bounds.minPoint[axis])
+	diagonal := VLength64(NewVector64FromVector32(
+		VSub32(bounds.maxPoint, bounds.minPoint)))
+	amplitude := 0.02 * diagonal
+	phase := 0.25 * float64(frame)
+
+	for i, v := range restVertices {
+		u := 0.0
+		if extent > 0 {
+			u = float64(v[axis]-bounds.minPoint[axis]) / extent
+		}
+		v[displacementAxis] += float32(amplitude * math.Sin(4.0*math.Pi*u+phase))
+		vertices[i] = v
+	}
+}
+
+// RunDynamicScene animates the copy of the mesh for the given number of
+// frames. The kdtree and BVH are built for the rest pose, on each frame
+// they are refitted to the deformed mesh and for comparison are also
+// built from scratch.
+func RunDynamicScene(mesh *TriangleMesh, frames int) DynamicSceneStats {
+	restVertices := mesh.vertices
+	bounds := mesh.GetBounds()
+	animated := &TriangleMesh{
+		vertices:  append([]Vector32(nil), restVertices...),
+		triangles: mesh.triangles,
+	}
+	vertices := make([]Vector32, len(restVertices))
+
+	kdTree := NewKdTreeBuilder(animated, NewBuildParams()).BuildKdTree()
+	bvh := BuildBVH(animated, NewBVHBuildParams())
+
+	var stats DynamicSceneStats
+	for frame := 1; frame <= frames; frame++ {
+		deformMesh(vertices, restVertices, bounds, frame)
+		animated.SetVertices(vertices)
+
+		start := time.Now()
+		kdTree.Refit()
+		stats.KdTreeRefitTime += time.Since(start)
+
+		start = time.Now()
+		rebuiltKdTree := NewKdTreeBuilder(animated, NewBuildParams()).BuildKdTree()
+		stats.KdTreeBuildTime += time.Since(start)
+
+		start = time.Now()
+		bvh.Refit()
+		stats.BVHRefitTime += time.Since(start)
+
+		start = time.Now()
+		BuildBVH(animated, NewBVHBuildParams())
+		stats.BVHBuildTime += time.Since(start)
+
+		if frame == frames {
+			stats.KdTreeRefitReferences = kdTree.Stats().ReferencesCount
+			stats.KdTreeBuildReferences = rebuiltKdTree.Stats().ReferencesCount
+		}
+	}
+
+	if frames > 0 {
+		stats.KdTreeRefitTime /= time.Duration(frames)
+		stats.KdTreeBuildTime /= time.Duration(frames)
+		stats.BVHRefitTime /= time.Duration(frames)
+		stats.BVHBuildTime /= time.Duration(frames)
+	}
+	return stats
+}
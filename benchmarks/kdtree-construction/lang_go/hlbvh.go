@@ -0,0 +1,163 @@
+package main
+
+import (
+	"runtime"
+	"sync"
+)
+
+// Triangles with the same highest bits of Morton code form a treelet.
+const hlbvhTreeletBits = 12
+
+// hlbvhTreelet is a range of Morton sorted triangles and its SAH BVH.
+type hlbvhTreelet struct {
+	prefix          uint32 // the highest hlbvhTreeletBits of Morton code
+	first, last     int    // range of sorted triangles
+	nodes           []bvhNode
+	triangleIndices []int32
+}
+
+type hlbvhBuilder struct {
+	treelets        []hlbvhTreelet
+	nodes           []bvhNode
+	triangleIndices []int32
+}
+
+// BuildHLBVH builds hierarchical linear BVH. Triangles are sorted by Morton
+// code and grouped into treelets by the highest bits of the code. The
+// upper levels of the hierarchy split the treelets at the highest
+// differing bit of the code like LBVH does. Each treelet gets its own
+// binned SAH BVH, treelets are built in parallel. The build is slower than
+// LBVH but the tree inside the treelets has SAH quality. SpatialSplitAlpha
+// is not used.
+func BuildHLBVH(mesh *TriangleMesh, buildParams BVHBuildParams) *BVH {
+	if buildParams.BinCount < 2 {
+		buildParams.BinCount = 2
+	}
+	if buildParams.LeafTrianglesLimit < 1 {
+		buildParams.LeafTrianglesLimit = 1
+	}
+	buildParams.SpatialSplitAlpha = 0
+
+	trianglesCount := int(mesh.GetTrianglesCount())
+	if trianglesCount == 0 {
+		return &BVH{
+			nodes: []bvhNode{{bounds: NewBBox32()}},
+			mesh:  mesh,
+		}
+	}
+
+	keys, sortedTriangles, sortedBounds := sortTrianglesByMortonCode(mesh)
+
+	builder := &hlbvhBuilder{
+		nodes:           make([]bvhNode, 0, 2*trianglesCount),
+		triangleIndices: make([]int32, 0, trianglesCount),
+	}
+	for i := 0; i < trianglesCount; {
+		prefix := getTreeletPrefix(keys[i])
+		end := i + 1
+		for end < trianglesCount && getTreeletPrefix(keys[end]) == prefix {
+			end++
+		}
+		builder.treelets = append(builder.treelets,
+			hlbvhTreelet{prefix: prefix, first: i, last: end - 1})
+		i = end
+	}
+
+	// build treelets
+	treeletIndices := make(chan int)
+	var wg sync.WaitGroup
+	for worker := 0; worker < runtime.NumCPU(); worker++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for treeletIndex := range treeletIndices {
+				treelet := &builder.treelets[treeletIndex]
+				treeletBuilder := &bvhBuilder{
+					buildParams: buildParams,
+					mesh:        mesh,
+					triangleIndices: make([]int32, 0,
+						treelet.last-treelet.first+1),
+				}
+				references := make([]bvhReference, 0, treelet.last-treelet.first+1)
+				for i := treelet.first; i <= treelet.last; i++ {
+					bounds := sortedBounds[i]
+					references = append(references,
+						bvhReference{bounds, bounds.GetCenter(), sortedTriangles[i]})
+				}
+				treeletBuilder.buildNode(references)
+				treelet.nodes = treeletBuilder.nodes
+				treelet.triangleIndices = treeletBuilder.triangleIndices
+			}
+		}()
+	}
+	for treeletIndex := range builder.treelets {
+		treeletIndices <- treeletIndex
+	}
+	close(treeletIndices)
+	wg.Wait()
+
+	builder.buildUpperNode(0, len(builder.treelets)-1)
+
+	return &BVH{
+		nodes:           builder.nodes,
+		triangleIndices: builder.triangleIndices,
+		mesh:            mesh,
+	}
+}
+
+func getTreeletPrefix(key uint64) uint32 {
+	return uint32(key>>32) >> (3*mortonBitsPerAxis - hlbvhTreeletBits)
+}
+
+// buildUpperNode builds the hierarchy over treelets [first, last] and
+// returns the bounds of the subtree. Treelet prefixes are sorted and
+// unique, so they are split at the highest bit that differs between the
+// first and the last treelet.
+func (builder *hlbvhBuilder) buildUpperNode(first, last int) BBox32 {
+	if first == last {
+		return builder.appendTreelet(&builder.treelets[first])
+	}
+
+	differentBits := builder.treelets[first].prefix ^ builder.treelets[last].prefix
+	bit := uint32(31)
+	for differentBits&(1<<bit) == 0 {
+		bit--
+	}
+	split := first + 1
+	for builder.treelets[split].prefix&(1<<bit) == 0 {
+		split++
+	}
+
+	// x/y/z bits alternate from the highest bit of the code
+	codeBit := bit + 3*mortonBitsPerAxis - hlbvhTreeletBits
+	axis := 2 - int32(codeBit%3)
+
+	nodeIndex := len(builder.nodes)
+	builder.nodes = append(builder.nodes, bvhNode{axis: axis})
+	bounds0 := builder.buildUpperNode(first, split-1)
+	builder.nodes[nodeIndex].index = int32(len(builder.nodes))
+	bounds1 := builder.buildUpperNode(split, last)
+	builder.nodes[nodeIndex].bounds = BBox32Union(bounds0, bounds1)
+	return builder.nodes[nodeIndex].bounds
+}
+
+// appendTreelet copies treelet nodes to the end of the nodes array and
+// adjusts node and triangle indices.
+func (builder *hlbvhBuilder) appendTreelet(treelet *hlbvhTreelet) BBox32 {
+	nodesOffset := int32(len(builder.nodes))
+	trianglesOffset := int32(len(builder.triangleIndices))
+	for _, n := range treelet.nodes {
+		if n.isLeaf() {
+			n.index += trianglesOffset
+		} else {
+			n.index += nodesOffset
+		}
+		builder.nodes = append(builder.nodes, n)
+	}
+	builder.triangleIndices = append(builder.triangleIndices, treelet.triangleIndices...)
+
+	bounds := treelet.nodes[0].bounds
+	treelet.nodes = nil
+	treelet.triangleIndices = nil
+	return bounds
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"math"
+	"runtime"
+	"sync"
+)
+
+// HybridTree is a two-level acceleration structure: a coarse uniform grid
+// partitions mesh triangles into cells and each non-empty cell has its own
+// kdtree. The per-cell kdtrees are built in parallel.
+type HybridTree struct {
+	gridRes    int
+	bounds     BBox64
+	cellSize   Vector64
+	cellTrees  []*KdTree // nil for empty cells
+	totalNodes int
+
+	// maps triangle indices of the cell mesh to the original mesh
+	cellTriangleIndices [][]int32
+}
+
+func BuildHybrid(mesh *TriangleMesh, gridRes int,
+	buildParams BuildParams) *HybridTree {
+	if gridRes < 1 {
+		gridRes = 1
+	}
+	meshBounds := mesh.GetBounds()
+
+	tree := &HybridTree{
+		gridRes:   gridRes,
+		bounds:    NewBBox64FromBBox32(meshBounds),
+		cellTrees: make([]*KdTree, gridRes*gridRes*gridRes),
+	}
+	diag := VSub64(tree.bounds.maxPoint, tree.bounds.minPoint)
+	tree.cellSize = VMul64(diag, 1.0/float64(gridRes))
+
+	// distribute triangles between cells that overlap triangle bounds
+	cellTriangles := make([][][3]int32, len(tree.cellTrees))
+	tree.cellTriangleIndices = make([][]int32, len(tree.cellTrees))
+	for i := int32(0); i < mesh.GetTrianglesCount(); i++ {
+		bounds := NewBBox64FromBBox32(mesh.GetTriangleBounds(i))
+		minCell := tree.getCell(bounds.minPoint)
+		maxCell := tree.getCell(bounds.maxPoint)
+
+		for x := minCell[0]; x <= maxCell[0]; x++ {
+			for y := minCell[1]; y <= maxCell[1]; y++ {
+				for z := minCell[2]; z <= maxCell[2]; z++ {
+					cellIndex := tree.getCellIndex([3]int{x, y, z})
+					cellTriangles[cellIndex] =
+						append(cellTriangles[cellIndex], mesh.triangles[i])
+					tree.cellTriangleIndices[cellIndex] =
+						append(tree.cellTriangleIndices[cellIndex], i)
+				}
+			}
+		}
+	}
+
+	// build per-cell kdtrees
+	cellIndices := make(chan int)
+	var wg sync.WaitGroup
+	for worker := 0; worker < runtime.NumCPU(); worker++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for cellIndex := range cellIndices {
+				// cell mesh shares vertices with the original mesh
+				cellMesh := &TriangleMesh{
+					vertices:  mesh.vertices,
+					triangles: cellTriangles[cellIndex],
+				}
+				if mesh.materialIDs != nil {
+					materialIDs := make([]int32, len(cellMesh.triangles))
+					for i, triangleIndex := range tree.cellTriangleIndices[cellIndex] {
+						materialIDs[i] = mesh.materialIDs[triangleIndex]
+					}
+					cellMesh.materialIDs = materialIDs
+				}
+				builder := NewKdTreeBuilder(cellMesh, buildParams)
+				tree.cellTrees[cellIndex] = builder.BuildKdTree()
+			}
+		}()
+	}
+	for cellIndex, triangles := range cellTriangles {
+		if len(triangles) > 0 {
+			cellIndices <- cellIndex
+		}
+	}
+	close(cellIndices)
+	wg.Wait()
+
+	for _, cellTree := range tree.cellTrees {
+		if cellTree != nil {
+			tree.totalNodes += len(cellTree.nodes)
+		}
+	}
+	return tree
+}
+
+// GetNodesCount returns the total number of nodes in all per-cell kdtrees.
+func (tree *HybridTree) GetNodesCount() int {
+	return tree.totalNodes
+}
+
+func (tree *HybridTree) getCell(point Vector64) [3]int {
+	var cell [3]int
+	for i := 0; i < 3; i++ {
+		c := 0
+		if tree.cellSize[i] > 0 {
+			c = int((point[i] - tree.bounds.minPoint[i]) / tree.cellSize[i])
+		}
+		if c < 0 {
+			c = 0
+		} else if c >= tree.gridRes {
+			c = tree.gridRes - 1
+		}
+		cell[i] = c
+	}
+	return cell
+}
+
+func (tree *HybridTree) getCellIndex(cell [3]int) int {
+	return (cell[2]*tree.gridRes+cell[1])*tree.gridRes + cell[0]
+}
+
+// Intersect walks grid cells along the ray using 3D-DDA and intersects
+// per-cell kdtrees. Since a triangle can span multiple cells the hit found
+// in the cell is accepted only if it lies inside that cell, otherwise it is
+// kept as a candidate while traversal continues.
+func (tree *HybridTree) Intersect(ray *Ray) (bool, KdTreeIntersection) {
+	tMin, tMax, hitFound := tree.bounds.Intersect(ray)
+	if !hitFound || !ray.HasValidDirection() {
+		return false, KdTreeIntersection{t: math.Inf(+1)}
+	}
+
+	cell := tree.getCell(ray.GetPoint(tMin))
+
+	var step [3]int
+	var tNext, tDelta [3]float64
+	for i := 0; i < 3; i++ {
+		direction := ray.GetDirection()[i]
+		if direction > 0 {
+			step[i] = 1
+			boundary := tree.bounds.minPoint[i] + float64(cell[i]+1)*tree.cellSize[i]
+			tNext[i] = (boundary - ray.GetOrigin()[i]) * ray.GetInvDirection()[i]
+			tDelta[i] = tree.cellSize[i] * ray.GetInvDirection()[i]
+		} else if direction < 0 {
+			step[i] = -1
+			boundary := tree.bounds.minPoint[i] + float64(cell[i])*tree.cellSize[i]
+			tNext[i] = (boundary - ray.GetOrigin()[i]) * ray.GetInvDirection()[i]
+			tDelta[i] = -tree.cellSize[i] * ray.GetInvDirection()[i]
+		} else {
+			tNext[i] = math.Inf(+1)
+			tDelta[i] = math.Inf(+1)
+		}
+	}
+
+	closestHit := false
+	closestIntersection := KdTreeIntersection{t: math.Inf(+1)}
+
+	for {
+		// select axis of the next cell boundary
+		axis := 0
+		if tNext[1] < tNext[axis] {
+			axis = 1
+		}
+		if tNext[2] < tNext[axis] {
+			axis = 2
+		}
+		tCellExit := math.Min(tNext[axis], tMax)
+
+		cellIndex := tree.getCellIndex(cell)
+		cellTree := tree.cellTrees[cellIndex]
+		if cellTree != nil {
+			hit, intersection := cellTree.Intersect(ray)
+			if hit && intersection.t < closestIntersection.t {
+				closestHit = true
+				closestIntersection = intersection
+				closestIntersection.triangleIndex =
+					tree.cellTriangleIndices[cellIndex][intersection.triangleIndex]
+			}
+		}
+
+		if closestIntersection.t <= tCellExit || tCellExit >= tMax {
+			break
+		}
+
+		cell[axis] += step[axis]
+		if cell[axis] < 0 || cell[axis] >= tree.gridRes {
+			break
+		}
+		tNext[axis] += tDelta[axis]
+	}
+	return closestHit, closestIntersection
+}
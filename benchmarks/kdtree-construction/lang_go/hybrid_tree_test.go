@@ -0,0 +1,59 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestHybridTreeAgreesWithKdTree(t *testing.T) {
+	mesh := LoadTriangleMesh(teapotStl)
+	kdTree := NewKdTreeBuilder(mesh, NewBuildParams()).BuildKdTree()
+	camera := NewCameraForBounds(kdTree.meshBounds)
+	const width, height = 64, 64
+
+	// the single cell grid is the kdtree of the whole mesh
+	for _, gridRes := range []int{1, 2, 3, 8} {
+		tree := BuildHybrid(mesh, gridRes, NewBuildParams())
+		hitsCount := 0
+		for y := 0; y < height; y++ {
+			for x := 0; x < width; x++ {
+				ray := camera.GenerateRay(x, y, width, height)
+				hitFound, intersection := kdTree.Intersect(&ray)
+				hybridHitFound, hybridIntersection := tree.Intersect(&ray)
+				if hitFound != hybridHitFound {
+					t.Errorf("grid %d: pixel (%d, %d): hybrid tree hit is %v, kdtree hit is %v",
+						gridRes, x, y, hybridHitFound, hitFound)
+					continue
+				}
+				if !hitFound {
+					continue
+				}
+				hitsCount++
+				// several triangles can share the closest hit on edges, so
+				// only the distance is compared
+				if math.Abs(hybridIntersection.t-intersection.t) > 1e-9*intersection.t {
+					t.Errorf("grid %d: pixel (%d, %d): hybrid tree hit at t = %g, kdtree hit at t = %g",
+						gridRes, x, y, hybridIntersection.t, intersection.t)
+					continue
+				}
+
+				// the cell triangle index is mapped back to the mesh triangle
+				v0, v1, v2 := mesh.GetTriangle(hybridIntersection.triangleIndex)
+				triangle := Triangle{[3]Vector64{
+					NewVector64FromVector32(v0),
+					NewVector64FromVector32(v1),
+					NewVector64FromVector32(v2),
+				}}
+				triangleHitFound, triangleIntersection := IntersectTriangle(&ray, &triangle)
+				if !triangleHitFound ||
+					math.Abs(triangleIntersection.t-intersection.t) > 1e-9*intersection.t {
+					t.Errorf("grid %d: pixel (%d, %d): triangle %d is not hit at t = %g",
+						gridRes, x, y, hybridIntersection.triangleIndex, intersection.t)
+				}
+			}
+		}
+		if hitsCount == 0 {
+			t.Fatalf("grid %d: no rays hit the mesh", gridRes)
+		}
+	}
+}
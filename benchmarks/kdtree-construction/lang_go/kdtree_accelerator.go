@@ -0,0 +1,30 @@
+package main
+
+// Build implements Accelerator, the tree is built with default build
+// parameters.
+func (kdTree *KdTree) Build(mesh *TriangleMesh) {
+	*kdTree = *NewKdTreeBuilder(mesh, NewBuildParams()).BuildKdTree()
+}
+
+// linearBVH is Accelerator for LBVH and HLBVH builders. They create a BVH,
+// so only Build differs from the BVH accelerator.
+type linearBVH struct {
+	*BVH
+	hierarchical bool
+}
+
+func (lbvh *linearBVH) Build(mesh *TriangleMesh) {
+	if lbvh.hierarchical {
+		lbvh.BVH = BuildHLBVH(mesh, NewBVHBuildParams())
+	} else {
+		lbvh.BVH = BuildLBVH(mesh, NewBVHBuildParams())
+	}
+}
+
+// registerBuilderAccelerators registers accelerators which builders are
+// available only in the construction benchmark.
+func registerBuilderAccelerators() {
+	RegisterAccelerator("kdtree", func() Accelerator { return new(KdTree) })
+	RegisterAccelerator("lbvh", func() Accelerator { return &linearBVH{} })
+	RegisterAccelerator("hlbvh", func() Accelerator { return &linearBVH{hierarchical: true} })
+}
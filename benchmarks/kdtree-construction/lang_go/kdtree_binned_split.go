@@ -0,0 +1,109 @@
+package main
+
+// selectBinnedSplit selects split using binned SAH. Triangle bounds are
+// distributed between binCount bins along each axis and the split cost
+// is evaluated at bin boundaries. The cost formula is the same as in
+// findSplitForAxis, triangle counts are approximate only for triangles
+// which bounds end exactly at bin boundary.
+//
+// On return edgesBuffer contains unsorted start/end edge pairs of the node
+// triangles for the split axis, they are used by classifySplitByPosition.
+func (builder *KdTreeBuilder) selectBinnedSplit(nodeBounds BBox32,
+	nodeTriangles []int32, emptyBonus float32, binCount int) split {
+	buildParams := &builder.buildParams
+
+	// startBins[i] is the number of triangles with bounds start in bin i,
+	// endBins[i] is the number of triangles with bounds end in bin i
+	startBins := make([]int32, binCount)
+	endBins := make([]int32, binCount)
+
+	diag := VSub32(nodeBounds.maxPoint, nodeBounds.minPoint)
+	invTotalS := 1.0 /
+		(2.0 * (float32(diag[0]*diag[1]) + float32(diag[0]*diag[2]) +
+			float32(diag[1]*diag[2])))
+
+	nodeTrianglesCount := int32(len(nodeTriangles))
+	leafCost := buildParams.IntersectionCost * float32(nodeTrianglesCount)
+	bestSplit := split{edge: -1, axis: -1, cost: leafCost, byPosition: true}
+
+	for _, axis := range builder.getSplitAxes(nodeBounds) {
+		if diag[axis] <= 0 {
+			continue
+		}
+		binSize := diag[axis] / float32(binCount)
+		scale := float32(binCount) / diag[axis]
+
+		for i := range startBins {
+			startBins[i] = 0
+			endBins[i] = 0
+		}
+		for _, triangle := range nodeTriangles {
+			bounds := &builder.splitBounds[triangle]
+			startBins[getBin(bounds.minPoint[axis], nodeBounds.minPoint[axis],
+				scale, binCount)]++
+			endBins[getBin(bounds.maxPoint[axis], nodeBounds.minPoint[axis],
+				scale, binCount)]++
+		}
+
+		otherAxis0 := otherAxis[axis][0]
+		otherAxis1 := otherAxis[axis][1]
+		s0 := 2.0 * (diag[otherAxis0] * diag[otherAxis1])
+		d0 := 2.0 * (diag[otherAxis0] + diag[otherAxis1])
+
+		numBelow := int32(0)
+		numAbove := nodeTrianglesCount
+
+		axisBestSplit := split{edge: -1, axis: axis, cost: leafCost, byPosition: true}
+
+		// evaluate split at the boundary between bins i-1 and i
+		for i := 1; i < binCount; i++ {
+			numBelow += startBins[i-1]
+			numAbove -= endBins[i-1]
+
+			t := nodeBounds.minPoint[axis] + float32(float32(i)*binSize)
+			if t <= nodeBounds.minPoint[axis] || t >= nodeBounds.maxPoint[axis] {
+				continue
+			}
+
+			belowS := s0 + float32(d0*(t-nodeBounds.minPoint[axis]))
+			aboveS := s0 + float32(d0*(nodeBounds.maxPoint[axis]-t))
+
+			pBelow := belowS * invTotalS
+			pAbove := aboveS * invTotalS
+
+			cost := builder.getSplitCost(pBelow, pAbove, int64(numBelow),
+				int64(numAbove), emptyBonus)
+
+			if cost < axisBestSplit.cost {
+				axisBestSplit.edge = i
+				axisBestSplit.cost = cost
+				axisBestSplit.position = t
+			}
+		}
+
+		if axisBestSplit.edge != -1 {
+			if buildParams.SplitAlongTheLongestAxis {
+				bestSplit = axisBestSplit
+				break
+			}
+			if axisBestSplit.cost < bestSplit.cost {
+				bestSplit = axisBestSplit
+			}
+		}
+	}
+
+	if bestSplit.edge != -1 {
+		builder.initEdgePairs(nodeTriangles, bestSplit.axis)
+	}
+	return bestSplit
+}
+
+func getBin(position, minPosition, scale float32, binCount int) int {
+	bin := int((position - minPosition) * scale)
+	if bin < 0 {
+		bin = 0
+	} else if bin >= binCount {
+		bin = binCount - 1
+	}
+	return bin
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"common"
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+)
+
+// Environment variables with this prefix override build parameters of all
+// models, the rest of the name is the upper case json name of the
+// parameter, e.g. KDTREE_INTERSECTION_COST=40 or KDTREE_SPLIT_STRATEGY=binned.
+const buildParamsEnvPrefix = "KDTREE_"
+
+// BuildParamsConfig lists build parameters that can be set by the file,
+// parameters that are not specified keep the values of the preset.
+type BuildParamsConfig struct {
+	Preset                     *string  `json:"preset,omitempty"` // see NewBuildParamsPreset
+	IntersectionCost           *float32 `json:"intersection_cost,omitempty"`
+	TraversalCost              *float32 `json:"traversal_cost,omitempty"`
+	EmptyBonus                 *float32 `json:"empty_bonus,omitempty"`
+	MaxDepth                   *int     `json:"max_depth,omitempty"`
+	SplitAlongTheLongestAxis   *bool    `json:"split_along_the_longest_axis,omitempty"`
+	LeafTrianglesLimit         *int     `json:"leaf_triangles_limit,omitempty"`
+	LeafTrianglesLimitSchedule []int    `json:"leaf_triangles_limit_schedule,omitempty"`
+	BalanceTieBreak            *bool    `json:"balance_tie_break,omitempty"`
+	UseRadixSort               *bool    `json:"use_radix_sort,omitempty"`
+	CanonicalEdgeOrder         *bool    `json:"canonical_edge_order,omitempty"`
+	MaxNodes                   *int     `json:"max_nodes,omitempty"`
+	CompactLargeLeaves         *bool    `json:"compact_large_leaves,omitempty"`
+	CompactLeafTrianglesLimit  *int     `json:"compact_leaf_triangles_limit,omitempty"`
+	SAHBinCount                *int     `json:"sah_bin_count,omitempty"`
+	SplitStrategy              *string  `json:"split_strategy,omitempty"` // see NewSplitStrategy
+	ClipTriangles              *bool    `json:"clip_triangles,omitempty"`
+	PresortEdges               *bool    `json:"presort_edges,omitempty"`
+	OptimizeTree               *bool    `json:"optimize_tree,omitempty"`
+}
+
+// BuildParamsFile describes build parameters per model:
+//
+//	{
+//	    "defaults": {"preset": "balanced", "intersection_cost": 60},
+//	    "models": {
+//	        "teapot": {"leaf_triangles_limit": 4},
+//	        "dragon": {"preset": "fast", "split_strategy": "binned"}
+//	    }
+//	}
+//
+// The parameters of the model are the preset parameters overridden by the
+// defaults, by the model section and by the environment variables, see
+// buildParamsEnvPrefix. Unknown parameters are reported as errors.
+type BuildParamsFile struct {
+	Defaults BuildParamsConfig            `json:"defaults"`
+	Models   map[string]BuildParamsConfig `json:"models"`
+
+	env BuildParamsConfig // environment overrides
+}
+
+func LoadBuildParamsFile(fileName string) *BuildParamsFile {
+	file, err := loadBuildParamsFile(fileName)
+	common.Check(err)
+	return file
+}
+
+// loadBuildParamsFile is the same as LoadBuildParamsFile but returns an
+// error instead of reporting it.
+func loadBuildParamsFile(fileName string) (*BuildParamsFile, error) {
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	file := new(BuildParamsFile)
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(file); err != nil {
+		return nil, fmt.Errorf("%s: %v", fileName, err)
+	}
+	if err := file.env.loadFromEnvironment(os.Environ()); err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+// loadFromEnvironment sets the parameters given by the environment
+// variables in the "NAME=value" form. Values are parsed as json, string
+// values can be given without quotes.
+func (config *BuildParamsConfig) loadFromEnvironment(environment []string) error {
+	fields := reflect.ValueOf(config).Elem()
+	fieldTypes := fields.Type()
+	for _, variable := range environment {
+		name, value, found := strings.Cut(variable, "=")
+		if !found || !strings.HasPrefix(name, buildParamsEnvPrefix) {
+			continue
+		}
+		jsonName := strings.ToLower(strings.TrimPrefix(name, buildParamsEnvPrefix))
+
+		index := -1
+		for i := 0; i < fieldTypes.NumField(); i++ {
+			tag := strings.Split(fieldTypes.Field(i).Tag.Get("json"), ",")[0]
+			if tag == jsonName {
+				index = i
+				break
+			}
+		}
+		if index == -1 {
+			return fmt.Errorf("%s: unknown build parameter %q", name, jsonName)
+		}
+
+		field := fields.Field(index).Addr().Interface()
+		if s, ok := field.(**string); ok && !strings.HasPrefix(value, `"`) {
+			*s = &value
+		} else if err := json.Unmarshal([]byte(value), field); err != nil {
+			return fmt.Errorf("%s: invalid value %q: %v", name, value, err)
+		}
+	}
+	return nil
+}
+
+// merge sets the parameters specified by other.
+func (config *BuildParamsConfig) merge(other *BuildParamsConfig) {
+	fields := reflect.ValueOf(config).Elem()
+	otherFields := reflect.ValueOf(other).Elem()
+	for i := 0; i < fields.NumField(); i++ {
+		if !otherFields.Field(i).IsNil() {
+			fields.Field(i).Set(otherFields.Field(i))
+		}
+	}
+}
+
+// GetBuildParams returns build parameters of the model. The mesh is used by
+// the auto preset.
+func (file *BuildParamsFile) GetBuildParams(modelName string,
+	mesh *TriangleMesh) (BuildParams, error) {
+	config := file.Defaults
+	if modelConfig, ok := file.Models[modelName]; ok {
+		config.merge(&modelConfig)
+	}
+	config.merge(&file.env)
+
+	preset := "balanced"
+	if config.Preset != nil {
+		preset = *config.Preset
+	}
+	buildParams, err := NewBuildParamsPreset(preset, mesh)
+	if err != nil {
+		return BuildParams{}, fmt.Errorf("model %s: %v", modelName, err)
+	}
+
+	if config.IntersectionCost != nil {
+		buildParams.IntersectionCost = *config.IntersectionCost
+	}
+	if config.TraversalCost != nil {
+		buildParams.TraversalCost = *config.TraversalCost
+	}
+	if config.EmptyBonus != nil {
+		buildParams.EmptyBonus = *config.EmptyBonus
+	}
+	if config.MaxDepth != nil {
+		buildParams.MaxDepth = *config.MaxDepth
+	}
+	if config.SplitAlongTheLongestAxis != nil {
+		buildParams.SplitAlongTheLongestAxis = *config.SplitAlongTheLongestAxis
+	}
+	if config.LeafTrianglesLimit != nil {
+		buildParams.LeafTrianglesLimit = *config.LeafTrianglesLimit
+	}
+	if config.LeafTrianglesLimitSchedule != nil {
+		if len(config.LeafTrianglesLimitSchedule) == 0 {
+			return BuildParams{}, fmt.Errorf("model %s: leaf triangles limit schedule is empty",
+				modelName)
+		}
+		buildParams.LeafTrianglesLimitFn =
+			NewLeafTrianglesLimitSchedule(config.LeafTrianglesLimitSchedule)
+	}
+	if config.BalanceTieBreak != nil {
+		buildParams.BalanceTieBreak = *config.BalanceTieBreak
+	}
+	if config.UseRadixSort != nil {
+		buildParams.UseRadixSort = *config.UseRadixSort
+	}
+	if config.CanonicalEdgeOrder != nil {
+		buildParams.CanonicalEdgeOrder = *config.CanonicalEdgeOrder
+	}
+	if config.MaxNodes != nil {
+		buildParams.MaxNodes = *config.MaxNodes
+	}
+	if config.CompactLargeLeaves != nil {
+		buildParams.CompactLargeLeaves = *config.CompactLargeLeaves
+	}
+	if config.CompactLeafTrianglesLimit != nil {
+		buildParams.CompactLeafTrianglesLimit = *config.CompactLeafTrianglesLimit
+	}
+	if config.SAHBinCount != nil {
+		buildParams.SAHBinCount = *config.SAHBinCount
+	}
+	if config.SplitStrategy != nil {
+		binCount := buildParams.SAHBinCount
+		if binCount <= 0 {
+			binCount = 32
+		}
+		strategy, err := NewSplitStrategy(*config.SplitStrategy, binCount)
+		if err != nil {
+			return BuildParams{}, fmt.Errorf("model %s: %v", modelName, err)
+		}
+		buildParams.SplitStrategy = strategy
+	}
+	if config.ClipTriangles != nil {
+		buildParams.ClipTriangles = *config.ClipTriangles
+	}
+	if config.PresortEdges != nil {
+		buildParams.PresortEdges = *config.PresortEdges
+	}
+	if config.OptimizeTree != nil {
+		buildParams.OptimizeTree = *config.OptimizeTree
+	}
+	return buildParams, nil
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Meshes up to this size are built with the quality preset in auto mode,
+// larger meshes up to autoFastTrianglesCount use the balanced preset and
+// the rest use the fast preset.
+const (
+	autoQualityTrianglesCount = 1 << 16
+	autoFastTrianglesCount    = 1 << 21
+)
+
+// GetBuildPresetNames returns names accepted by NewBuildParamsPreset.
+func GetBuildPresetNames() []string {
+	return []string{"fast", "balanced", "quality", "auto"}
+}
+
+// NewBuildParamsPreset returns build parameters by preset name: fast,
+// balanced, quality or auto. The fast preset uses binned SAH and larger
+// leaves for quick rebuilds, balanced is NewBuildParams, quality enables
+// triangle clipping and the post-build optimization, the build is several
+// times slower but the tree is cheaper to traverse. The auto preset uses
+// the mesh triangles count: small meshes get the quality preset since the
+// build is cheap anyway, large meshes get the fast preset with lower
+// intersection cost that gives smaller trees. The mesh is used only by the
+// auto preset.
+func NewBuildParamsPreset(name string, mesh *TriangleMesh) (BuildParams, error) {
+	buildParams := NewBuildParams()
+	switch name {
+	case "fast":
+		buildParams.SAHBinCount = 16
+		buildParams.LeafTrianglesLimit = 4
+	case "balanced":
+	case "quality":
+		buildParams.ClipTriangles = true
+		buildParams.OptimizeTree = true
+	case "auto":
+		trianglesCount := len(mesh.triangles)
+		if trianglesCount <= autoQualityTrianglesCount {
+			return NewBuildParamsPreset("quality", mesh)
+		}
+		if trianglesCount <= autoFastTrianglesCount {
+			return buildParams, nil
+		}
+		buildParams, _ = NewBuildParamsPreset("fast", mesh)
+		buildParams.IntersectionCost = 40
+	default:
+		return BuildParams{}, fmt.Errorf("unknown build preset %q, available presets: %s",
+			name, strings.Join(GetBuildPresetNames(), ", "))
+	}
+	return buildParams, nil
+}
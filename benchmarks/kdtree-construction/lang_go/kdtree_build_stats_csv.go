@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/csv"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Formatting functions do not depend on locale and use the shortest
+// representation that round-trips, so rows are stable between runs.
+func formatFloat32(v float32) string {
+	return strconv.FormatFloat(float64(v), 'g', -1, 32)
+}
+
+func formatFloat64(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// formatHistogram returns non-empty buckets as "value:count" pairs. The
+// bucket with openBucket index is printed as "value+:count", -1 means that
+// all buckets are exact.
+func formatHistogram(histogram []int32, openBucket int) string {
+	var pairs []string
+	for value, count := range histogram {
+		if count == 0 {
+			continue
+		}
+		pair := strconv.Itoa(value)
+		if value == openBucket {
+			pair += "+"
+		}
+		pairs = append(pairs, pair+":"+strconv.Itoa(int(count)))
+	}
+	return strings.Join(pairs, " ")
+}
+
+// WriteBuildStatsCSVHeader writes the header row for AppendCSVRow output.
+func WriteBuildStatsCSVHeader(w io.Writer) error {
+	return writeCSVRecord(w, []string{
+		"IntersectionCost",
+		"TraversalCost",
+		"EmptyBonus",
+		"MaxDepth",
+		"SplitAlongTheLongestAxis",
+		"LeafTrianglesLimit",
+		"BalanceTieBreak",
+		"LeafCount",
+		"EmptyLeafCount",
+		"TrianglesPerLeaf",
+		"PerfectDepth",
+		"AverageDepth",
+		"DepthStandardDeviation",
+		"FailedSplitCount",
+		"NodesBytes",
+		"TriangleIndicesBytes",
+		"PeakWorkingBytes",
+		"SAHCost",
+	})
+}
+
+// AppendCSVRow writes a row that combines build parameters and the
+// resulting build statistics.
+func (stats BuildStats) AppendCSVRow(w io.Writer, buildParams BuildParams) error {
+	return writeCSVRecord(w, []string{
+		formatFloat32(buildParams.IntersectionCost),
+		formatFloat32(buildParams.TraversalCost),
+		formatFloat32(buildParams.EmptyBonus),
+		strconv.Itoa(buildParams.MaxDepth),
+		strconv.FormatBool(buildParams.SplitAlongTheLongestAxis),
+		strconv.Itoa(buildParams.LeafTrianglesLimit),
+		strconv.FormatBool(buildParams.BalanceTieBreak),
+		strconv.Itoa(int(stats.LeafCount)),
+		strconv.Itoa(int(stats.EmptyLeafCount)),
+		formatFloat64(stats.TrianglesPerLeaf),
+		strconv.Itoa(int(stats.PerfectDepth)),
+		formatFloat64(stats.AverageDepth),
+		formatFloat64(stats.DepthStandardDeviation),
+		strconv.Itoa(int(stats.FailedSplitCount)),
+		strconv.FormatInt(stats.NodesBytes, 10),
+		strconv.FormatInt(stats.TriangleIndicesBytes, 10),
+		strconv.FormatInt(stats.PeakWorkingBytes, 10),
+		formatFloat64(stats.SAHCost),
+	})
+}
+
+func writeCSVRecord(w io.Writer, record []string) error {
+	writer := csv.NewWriter(w)
+	if err := writer.Write(record); err != nil {
+		return err
+	}
+	writer.Flush()
+	return writer.Error()
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"testing"
+)
+
+func TestBuildStatsCSV(t *testing.T) {
+	mesh := LoadTriangleMesh(teapotStl)
+	var buffer bytes.Buffer
+	if err := WriteBuildStatsCSVHeader(&buffer); err != nil {
+		t.Fatal(err)
+	}
+	intersectionCosts := []float32{20, 40.5, 80}
+	var allStats []BuildStats
+	for _, intersectionCost := range intersectionCosts {
+		buildParams := NewBuildParams()
+		buildParams.IntersectionCost = intersectionCost
+		builder := NewKdTreeBuilder(mesh, buildParams)
+		builder.BuildKdTree()
+		stats := builder.GetBuildStats()
+		allStats = append(allStats, stats)
+		if err := stats.AppendCSVRow(&buffer, builder.GetBuildParams()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	records, err := csv.NewReader(&buffer).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != len(intersectionCosts)+1 {
+		t.Fatalf("csv has %d rows, expected %d", len(records), len(intersectionCosts)+1)
+	}
+	header := records[0]
+	column := make(map[string]int)
+	for i, name := range header {
+		column[name] = i
+	}
+	for i, record := range records[1:] {
+		if len(record) != len(header) {
+			t.Fatalf("row %d has %d columns, header has %d", i, len(record), len(header))
+		}
+		if value := record[column["IntersectionCost"]]; value != formatFloat32(intersectionCosts[i]) {
+			t.Errorf("row %d: IntersectionCost is %q, expected %v", i, value,
+				intersectionCosts[i])
+		}
+		if value := record[column["EmptyBonus"]]; value != "0.3" {
+			t.Errorf("row %d: EmptyBonus is %q, expected \"0.3\"", i, value)
+		}
+		if value := record[column["AverageDepth"]]; value != formatFloat64(allStats[i].AverageDepth) {
+			t.Errorf("row %d: AverageDepth is %q, expected %v", i, value,
+				allStats[i].AverageDepth)
+		}
+	}
+}
@@ -2,9 +2,12 @@ package main
 
 import (
 	"common"
+	"context"
 	"fmt"
 	"math"
-	"sort"
+	"strings"
+	"time"
+	"unsafe"
 )
 
 type BuildParams struct {
@@ -15,27 +18,213 @@ type BuildParams struct {
 	SplitAlongTheLongestAxis bool
 	LeafTrianglesLimit       int
 	CollectStats             bool
+
+	// BalanceTieBreak selects the split with the most balanced number of
+	// triangles on both sides among the splits which cost is within
+	// balanceTieBreakEpsilon of the best cost.
+	BalanceTieBreak bool
+
+	// EmptyBonusFn returns empty bonus for the node at the given depth
+	// (root node has depth 0). If nil then EmptyBonus is used for all nodes.
+	EmptyBonusFn func(depth int) float32
+
+	// LeafTrianglesLimitFn returns leaf triangles limit for the node at the
+	// given depth (root node has depth 0). If nil then LeafTrianglesLimit is
+	// used for all nodes. Lower limit at the top levels and higher limit
+	// deeper in the tree split shallow nodes aggressively and terminate deep
+	// nodes earlier, see also NewLeafTrianglesLimitSchedule.
+	LeafTrianglesLimitFn func(depth int) int
+
+	// UseRadixSort sorts bound edges with radix sort instead of sort.Stable.
+	// It is enabled by default, the comparison sort is kept to verify that
+	// the resulting tree is identical.
+	UseRadixSort bool
+
+	// MaxNodes limits the number of nodes created by the build. When the
+	// limit is reached the remaining nodes become leaves, so the build
+	// completes with larger leaves instead of failing, the number of such
+	// leaves is reported in BuildStats.NodeBudgetLeafCount. The post-build
+	// passes (OptimizeTree, CompactLargeLeaves) are not limited. Zero means
+	// the limit of the node encoding, maxNodesCount.
+	MaxNodes int
+
+	// ProgressFn is called periodically during the node build and once
+	// when it is completed, see BuildProgress. It is called from the build
+	// goroutine, the build waits for it to return.
+	ProgressFn func(progress BuildProgress)
+
+	// ExpectedNodes is initial capacity of nodes array. If zero then the
+	// capacity is estimated from the number of triangles.
+	ExpectedNodes int
+
+	// CompactLargeLeaves enables post-build pass that splits leaves with
+	// more than CompactLeafTrianglesLimit triangles using median split.
+	CompactLargeLeaves        bool
+	CompactLeafTrianglesLimit int
+
+	// MaxScratchBytes limits the size of the triangles buffer which grows
+	// linearly with MaxDepth. If the buffer does not fit then MaxDepth is
+	// reduced. Zero means no limit.
+	MaxScratchBytes int64
+
+	// MaxMemoryBytes limits the estimated working set of the build: the
+	// triangle bounds, the edge buffers, the triangles buffer, the presorted
+	// edge lists and the expected size of the tree. The build options are
+	// reduced to fit the limit or the builder reports runtime error, see
+	// fitMemoryBudget. The post-build passes are not included. Zero means
+	// no limit.
+	MaxMemoryBytes int64
+
+	// BoundsPadding enlarges triangle bounds by the given fraction of the
+	// coordinate magnitude on each axis. Small padding prevents triangles
+	// that lie near the split plane from being lost due to float32 rounding
+	// at the cost of a slightly larger tree. Zero disables padding.
+	BoundsPadding float32
+
+	// SAHBinCount enables binned SAH split selection with the given number
+	// of bins per axis. Split cost is evaluated only at bin boundaries which
+	// avoids sorting of bound edges. Zero selects the exact SAH split.
+	// BalanceTieBreak is not used with binned splits. It is a shortcut for
+	// SplitStrategy set to BinnedSAHSplit.
+	SAHBinCount int
+
+	// SplitStrategy selects node splits. If nil then SAHSplit is used or
+	// BinnedSAHSplit if SAHBinCount is not zero.
+	SplitStrategy SplitStrategy
+
+	// ShuffleSeed is a seed for deterministic permutation of the root node
+	// triangles. It allows to study how the tree depends on the order of
+	// input triangles. Zero disables shuffling.
+	ShuffleSeed uint64
+
+	// CollectTimings enables measurement of build phases, the result is
+	// available with KdTreeBuilder.GetBuildTimings.
+	CollectTimings bool
+
+	// CollectTreeCost enables computation of BuildStats.SAHCost. It needs
+	// a traversal of the finished tree, so it is not a part of CollectStats.
+	CollectTreeCost bool
+
+	// ClipTriangles enables perfect splits: split candidates are computed
+	// from the bounds of the triangle part inside the node instead of the
+	// full triangle bounds, and triangles that do not intersect the node
+	// are removed from it. This improves the tree for long thin triangles
+	// at the cost of clipping every triangle in every node.
+	ClipTriangles bool
+
+	// PresortEdges sorts bound edges along each axis once for the root node
+	// and keeps sorted edge lists for each node by filtering the lists of
+	// the parent, which makes the build O(N log N) instead of sorting edges
+	// in every node. It is used only with SAHSplit and without
+	// ClipTriangles, otherwise it is ignored. The nodes are the same as
+	// with sorting, only the order of triangles in leaves may differ unless
+	// CanonicalEdgeOrder is enabled. The edge lists need additional memory
+	// which is not limited by MaxScratchBytes.
+	PresortEdges bool
+
+	// CanonicalEdgeOrder orders bound edges with the same position and type
+	// by triangle index. By default such edges keep the order of the node
+	// triangles, which is the order the reference implementations use and
+	// the standard model hashes are computed for. With canonical order the
+	// order of the edges, and so the tree, does not depend on how the node
+	// triangles were produced, e.g. PresortEdges builds exactly the same
+	// tree as sorting in every node.
+	CanonicalEdgeOrder bool
+
+	// OptimizeTree enables post-build pass that evaluates the SAH cost of
+	// every subtree, collapses subtrees that are more expensive than a leaf
+	// and splits large leaves again with lookahead, see optimizeTree. The
+	// cost before and after the pass is reported in BuildStats.
+	OptimizeTree bool
+}
+
+// NewLeafTrianglesLimitSchedule returns LeafTrianglesLimitFn that uses
+// limits[depth] for the nodes at the given depth and the last limit for the
+// deeper nodes.
+func NewLeafTrianglesLimitSchedule(limits []int) func(depth int) int {
+	if len(limits) == 0 {
+		common.RuntimeError("leaf triangles limit schedule is empty")
+	}
+	limits = append([]int(nil), limits...)
+	return func(depth int) int {
+		if depth >= len(limits) {
+			return limits[len(limits)-1]
+		}
+		return limits[depth]
+	}
+}
+
+// getLeafTrianglesLimit returns leaf triangles limit for the node at the
+// given depth.
+func (buildParams *BuildParams) getLeafTrianglesLimit(depth int) int {
+	if buildParams.LeafTrianglesLimitFn != nil {
+		return buildParams.LeafTrianglesLimitFn(depth)
+	}
+	return buildParams.LeafTrianglesLimit
 }
 
 func NewBuildParams() BuildParams {
 	return BuildParams{
-		IntersectionCost:         80,
-		TraversalCost:            1,
-		EmptyBonus:               0.3,
-		MaxDepth:                 -1,
-		SplitAlongTheLongestAxis: false,
-		LeafTrianglesLimit:       2, // the actual amout of leaf triangles can be larger
-		CollectStats:             true,
+		IntersectionCost:          80,
+		TraversalCost:             1,
+		EmptyBonus:                0.3,
+		MaxDepth:                  -1,
+		SplitAlongTheLongestAxis:  false,
+		LeafTrianglesLimit:        2, // the actual amout of leaf triangles can be larger
+		CollectStats:              true,
+		BalanceTieBreak:           false,
+		UseRadixSort:              true,
+		CompactLargeLeaves:        false,
+		CompactLeafTrianglesLimit: 16,
 	}
 }
 
+// Size of BuildStats.LeafTrianglesHistogram.
+const leafTrianglesHistogramSize = 33
+
 type BuildStats struct {
-	LeafCount                   int32
-	EmptyLeafCount              int32
-	TrianglesPerLeaf            float64
-	PerfectDepth                int32
-	AverageDepth                float64
-	DepthStandardDeviation      float64
+	LeafCount              int32
+	EmptyLeafCount         int32
+	TrianglesPerLeaf       float64
+	PerfectDepth           int32
+	AverageDepth           float64
+	DepthStandardDeviation float64
+	FailedSplitCount       int32 // leaves forced by absence of cost-improving split
+	NodeBudgetLeafCount    int32 // leaves forced by BuildParams.MaxNodes
+
+	// filled if BuildParams.LeafTrianglesLimitFn is set: leaves that would be
+	// split with LeafTrianglesLimit and nodes that would be leaves with it
+	AdaptiveLeafCount  int32
+	AdaptiveSplitCount int32
+
+	// filled if BuildParams.OptimizeTree is enabled
+	CostBeforeOptimization float64
+	CostAfterOptimization  float64
+	CollapsedSubtreeCount  int32
+	ResplitLeafCount       int32
+
+	// memory in bytes: the finished tree arrays and the largest working set
+	// of the builder, measured at the end of the node build when all
+	// buffers have their final size
+	NodesBytes           int64
+	TriangleIndicesBytes int64
+	PeakWorkingBytes     int64
+
+	// filled if BuildParams.CollectTreeCost is enabled
+	SAHCost float64
+
+	// filled regardless of BuildParams.CollectStats: the tree is built with
+	// the wide index path, see KdTreeBuilder, and the names of the requested
+	// options that the path does not implement and ignores
+	WideIndices    bool
+	IgnoredOptions []string
+
+	// number of leaves by triangles count and by depth, empty leaves are
+	// included in both. The last bucket of LeafTrianglesHistogram counts
+	// all leaves with at least leafTrianglesHistogramSize-1 triangles.
+	LeafTrianglesHistogram []int32
+	LeafDepthHistogram     []int32
+
 	enabled                     bool
 	trianglesPerLeafAccumulated int64
 	leafDepthValues             []uint8
@@ -48,6 +237,19 @@ func (stats *BuildStats) newLeaf(leafTriangles, depth int) {
 
 	stats.LeafCount++
 
+	bucket := leafTriangles
+	if bucket >= leafTrianglesHistogramSize {
+		bucket = leafTrianglesHistogramSize - 1
+	}
+	for len(stats.LeafTrianglesHistogram) <= bucket {
+		stats.LeafTrianglesHistogram = append(stats.LeafTrianglesHistogram, 0)
+	}
+	stats.LeafTrianglesHistogram[bucket]++
+	for len(stats.LeafDepthHistogram) <= depth {
+		stats.LeafDepthHistogram = append(stats.LeafDepthHistogram, 0)
+	}
+	stats.LeafDepthHistogram[depth]++
+
 	if leafTriangles == 0 {
 		stats.EmptyLeafCount++
 	} else { // not empty leaf
@@ -56,12 +258,56 @@ func (stats *BuildStats) newLeaf(leafTriangles, depth int) {
 	}
 }
 
+// resetLeafStats clears leaf statistics before they are collected again
+// for the modified tree.
+func (stats *BuildStats) resetLeafStats() {
+	stats.LeafCount = 0
+	stats.EmptyLeafCount = 0
+	stats.trianglesPerLeafAccumulated = 0
+	stats.leafDepthValues = stats.leafDepthValues[:0]
+	stats.LeafTrianglesHistogram = stats.LeafTrianglesHistogram[:0]
+	stats.LeafDepthHistogram = stats.LeafDepthHistogram[:0]
+}
+
+func (stats *BuildStats) failedSplit() {
+	if !stats.enabled {
+		return
+	}
+	stats.FailedSplitCount++
+}
+
+func (stats *BuildStats) nodeBudgetLeaf() {
+	if !stats.enabled {
+		return
+	}
+	stats.NodeBudgetLeafCount++
+}
+
+// leafLimitDecision counts the nodes where the triangles limit at the node
+// depth changes the decision made with the fixed limit.
+func (stats *BuildStats) leafLimitDecision(buildParams *BuildParams,
+	nodeTrianglesCount, leafTrianglesLimit int) {
+	if !stats.enabled || buildParams.LeafTrianglesLimitFn == nil {
+		return
+	}
+	isLeaf := nodeTrianglesCount <= leafTrianglesLimit
+	isFixedLimitLeaf := nodeTrianglesCount <= buildParams.LeafTrianglesLimit
+	if isLeaf && !isFixedLimitLeaf {
+		stats.AdaptiveLeafCount++
+	} else if !isLeaf && isFixedLimitLeaf {
+		stats.AdaptiveSplitCount++
+	}
+}
+
 func (stats *BuildStats) finalizeStats() {
 	if !stats.enabled {
 		return
 	}
 
 	notEmptyLeafCount := stats.LeafCount - stats.EmptyLeafCount
+	if notEmptyLeafCount == 0 { // mesh without triangles
+		return
+	}
 
 	stats.TrianglesPerLeaf =
 		float64(stats.trianglesPerLeafAccumulated) / float64(notEmptyLeafCount)
@@ -83,6 +329,18 @@ func (stats *BuildStats) finalizeStats() {
 	stats.DepthStandardDeviation = math.Sqrt(accum / float64(notEmptyLeafCount))
 }
 
+// BuildTimings contains duration of kdtree build phases. EdgeSort is a part
+// of NodesBuild time.
+type BuildTimings struct {
+	TriangleBounds time.Duration
+	BuffersInit    time.Duration
+	NodesBuild     time.Duration
+	EdgeSort       time.Duration
+	LeafCompaction time.Duration
+	Optimization   time.Duration
+	Total          time.Duration
+}
+
 const (
 	edgeEndMask      uint32 = 0x80000000
 	edgeTriangleMask uint32 = 0x7fffffff
@@ -123,167 +381,796 @@ func (s boundEdgeSorter) Less(i, j int) bool {
 	}
 }
 
+// canonicalBoundEdgeSorter defines total order of the edges, see
+// BuildParams.CanonicalEdgeOrder.
+type canonicalBoundEdgeSorter []boundEdge
+
+func (s canonicalBoundEdgeSorter) Len() int {
+	return len(s)
+}
+
+func (s canonicalBoundEdgeSorter) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
+
+func (s canonicalBoundEdgeSorter) Less(i, j int) bool {
+	if s[i].positionOnAxis != s[j].positionOnAxis {
+		return s[i].positionOnAxis < s[j].positionOnAxis
+	}
+	if s[i].isEnd() != s[j].isEnd() {
+		return s[i].isEnd()
+	}
+	return s[i].triangleIndex() < s[j].triangleIndex()
+}
+
 type KdTreeBuilder struct {
-	mesh            *TriangleMesh
-	buildParams     BuildParams
-	buildStats      BuildStats
-	triangleBounds  []BBox32
-	edgesBuffer     []boundEdge
-	trianglesBuffer []int32
-	nodes           []node
-	triangleIndices []int32
+	mesh               *TriangleMesh
+	buildParams        BuildParams
+	buildStats         BuildStats
+	buildTimings       BuildTimings
+	triangleBounds     []BBox32
+	clippedBounds      []BBox32 // bounds of triangles clipped to the current node
+	splitBounds        []BBox32 // either triangleBounds or clippedBounds
+	edgesBuffer        []boundEdge
+	edgesScratchBuffer []boundEdge
+	trianglesBuffer    []int32
+	nodes              []node
+	triangleIndices    []int32
+	droppedTriangles   []int32 // see KdTree.droppedTriangles
+
+	// nodes are stored in chunks during the node build and flattened to
+	// nodes after it
+	nodeChunks *nodeChunks
+
+	// presorted edges support
+	sortedEdgesArena sortedEdgesArena
+	triangleSides    []uint8
+
+	// wide index build support, see kdtree_builder_wide.go
+	requestedBuildParams   BuildParams
+	wideIndices            bool
+	wideEdgesBuffer        []wideBoundEdge
+	wideEdgesScratchBuffer []wideBoundEdge
+	wideTrianglesBuffer    []int64
+	wideLeafOffsets        []int64
+	wideTriangleIndices    []int64
+
+	// cancellation support, ctx is nil if the build can't be cancelled
+	ctx                  context.Context
+	workSinceCancelCheck int
+	cancelErr            error
 }
 
+// NewKdTreeBuilder creates the builder for the mesh. The packed bound edges
+// and the leaf offsets of the legacy tree are 32-bit, so the meshes with
+// more than maxNarrowTrianglesCount triangles are built with the wide index
+// path that uses 64-bit edges and triangle references and produces the wide
+// index tree. The build also switches to the wide path when the number of
+// leaf triangle references exceeds maxNarrowTriangleReferences. The options
+// that the wide index path does not implement are reported in
+// BuildStats.IgnoredOptions, see resolveBuildParams.
 func NewKdTreeBuilder(mesh *TriangleMesh, buildParams BuildParams) *KdTreeBuilder {
-	// max count is chosen such that maxTrianglesCount * 2 is still
-	// an int32, this simplifies implementation.
-	const maxTrianglesCount = 0x3fffffff // max ~ 1 billion triangles
-
-	if mesh.GetTrianglesCount() > maxTrianglesCount {
+	// The mesh addresses triangles with int32 indices. The slice length is
+	// checked since GetTrianglesCount wraps around for larger meshes.
+	if len(mesh.triangles) > maxWideTrianglesCount {
 		common.RuntimeError(fmt.Sprintf(
-			"exceeded the maximum number of mesh triangles: %d",
-			maxTrianglesCount))
+			"exceeded the maximum number of mesh triangles: %d, mesh triangles count: %d",
+			maxWideTrianglesCount, len(mesh.triangles)))
 	}
 
-	if buildParams.MaxDepth <= 0 {
+	builder := &KdTreeBuilder{
+		mesh:                 mesh,
+		requestedBuildParams: buildParams,
+		wideIndices:          len(mesh.triangles) > maxNarrowTrianglesCount,
+	}
+	var ignoredOptions []string
+	builder.buildParams, ignoredOptions = resolveBuildParams(mesh, buildParams,
+		builder.wideIndices)
+	if buildParams.CollectStats {
+		builder.buildStats.enabled = true
+	}
+	builder.buildStats.WideIndices = builder.wideIndices
+	builder.buildStats.IgnoredOptions = ignoredOptions
+	return builder
+}
+
+// resolveBuildParams replaces the default values of the build parameters
+// and adjusts them to the limits. The wide index path implements only the
+// exact SAH split with sorting of edges in every node, so SplitStrategy,
+// SAHBinCount, ClipTriangles, PresortEdges, OptimizeTree and
+// CompactLargeLeaves are ignored for it. The names of the ignored options
+// that differ from the defaults are printed and returned.
+func resolveBuildParams(mesh *TriangleMesh, buildParams BuildParams,
+	wideIndices bool) (BuildParams, []string) {
+	var ignoredOptions []string
+	if wideIndices {
+		ignoredOptions = ignoreWideIndexOptions(&buildParams)
+		if len(ignoredOptions) > 0 {
+			fmt.Printf("kdtree wide index build ignores options: %s\n",
+				strings.Join(ignoredOptions, ", "))
+		}
+	}
+	if mesh.GetTrianglesCount() == 0 {
+		// the tree consists of a single empty leaf
+		buildParams.MaxDepth = 0
+	} else if buildParams.MaxDepth <= 0 {
 		trianglesCountLog :=
 			math.Floor(math.Log2(float64(mesh.GetTrianglesCount())))
 		buildParams.MaxDepth =
 			int(math.Floor(0.5 + 8.0 + 1.3*trianglesCountLog))
 	}
+	if buildParams.SplitStrategy == nil {
+		if buildParams.SAHBinCount > 0 {
+			buildParams.SplitStrategy = BinnedSAHSplit{buildParams.SAHBinCount}
+		} else {
+			buildParams.SplitStrategy = SAHSplit{}
+		}
+	}
+	if _, ok := buildParams.SplitStrategy.(SAHSplit); !ok || buildParams.ClipTriangles {
+		buildParams.PresortEdges = false
+	}
+	if buildParams.MaxNodes <= 0 || buildParams.MaxNodes > maxNodesCount {
+		buildParams.MaxNodes = maxNodesCount
+	}
 	if buildParams.MaxDepth > maxTraversalDepth {
 		buildParams.MaxDepth = maxTraversalDepth
 	}
+	if buildParams.MaxScratchBytes > 0 {
+		// trianglesBuffer stores trianglesCount * (MaxDepth + 1) indices
+		indexSize := getBuildIndexSize(wideIndices)
+		trianglesBufferBytes := func(maxDepth int) int64 {
+			return int64(mesh.GetTrianglesCount()) * int64(maxDepth+1) * indexSize
+		}
+		maxDepth := buildParams.MaxDepth
+		for maxDepth > 0 &&
+			trianglesBufferBytes(maxDepth) > buildParams.MaxScratchBytes {
+			maxDepth--
+		}
+		if maxDepth != buildParams.MaxDepth {
+			fmt.Printf("kdtree max depth is reduced from %d to %d to fit "+
+				"scratch memory limit of %d bytes\n",
+				buildParams.MaxDepth, maxDepth, buildParams.MaxScratchBytes)
+			buildParams.MaxDepth = maxDepth
+		}
+	}
+	if buildParams.MaxMemoryBytes > 0 {
+		fitMemoryBudget(len(mesh.triangles), &buildParams, wideIndices)
+	}
+	return buildParams, ignoredOptions
+}
 
-	builder := &KdTreeBuilder{
-		mesh:        mesh,
-		buildParams: buildParams,
+// GetBuildParams returns build parameters with resolved default values.
+func (builder *KdTreeBuilder) GetBuildParams() BuildParams {
+	return builder.buildParams
+}
+
+// GetBuildStats returns statistics of the last build. Statistics are
+// collected only if BuildParams.CollectStats is set.
+func (builder *KdTreeBuilder) GetBuildStats() BuildStats {
+	return builder.buildStats
+}
+
+// GetBuildTimings returns duration of build phases of the last build.
+// Timings are collected only if BuildParams.CollectTimings is set.
+func (builder *KdTreeBuilder) GetBuildTimings() BuildTimings {
+	return builder.buildTimings
+}
+
+// phaseTimer measures consecutive build phases if timings are enabled.
+type phaseTimer struct {
+	enabled   bool
+	start     time.Time
+	lastPhase time.Time
+}
+
+func newPhaseTimer(enabled bool) phaseTimer {
+	timer := phaseTimer{enabled: enabled}
+	if enabled {
+		timer.start = time.Now()
+		timer.lastPhase = timer.start
 	}
-	if buildParams.CollectStats {
-		builder.buildStats.enabled = true
+	return timer
+}
+
+// endPhase adds duration since the end of the previous phase to the given
+// phase duration.
+func (timer *phaseTimer) endPhase(phaseDuration *time.Duration) {
+	if !timer.enabled {
+		return
 	}
-	return builder
+	now := time.Now()
+	*phaseDuration += now.Sub(timer.lastPhase)
+	timer.lastPhase = now
+}
+
+// finish stores duration since the timer creation.
+func (timer *phaseTimer) finish(totalDuration *time.Duration) {
+	if !timer.enabled {
+		return
+	}
+	*totalDuration = time.Since(timer.start)
+}
+
+// Context cancellation is checked after this number of node triangles has
+// been processed, so the check frequency is proportional to the build work.
+const cancelCheckInterval = 1 << 16
+
+// isCancelled adds the work of the node with the given number of triangles
+// and checks if the build is cancelled after cancelCheckInterval of work.
+func (builder *KdTreeBuilder) isCancelled(nodeTrianglesCount int) bool {
+	if builder.ctx == nil {
+		return builder.cancelErr != nil
+	}
+	if builder.cancelErr != nil {
+		return true
+	}
+	builder.workSinceCancelCheck += nodeTrianglesCount + 1
+	if builder.workSinceCancelCheck >= cancelCheckInterval {
+		builder.workSinceCancelCheck = 0
+		if err := builder.ctx.Err(); err != nil {
+			builder.cancelErr = err
+			return true
+		}
+	}
+	return false
+}
+
+// BuildParams.ProgressFn is called after this amount of work, measured as
+// in cancellation checks.
+const progressReportInterval = 1 << 20
+
+// BuildProgress is reported by BuildParams.ProgressFn. TrianglesRemaining is
+// the number of triangle references in the nodes that are not built yet.
+// Triangles that overlap the split are referenced by both children, so the
+// number can grow when large nodes are split, it is zero when the node
+// build is completed.
+type BuildProgress struct {
+	NodesCount         int
+	TrianglesRemaining int
 }
 
 func (builder *KdTreeBuilder) BuildKdTree() *KdTree {
+	kdTree, _ := builder.BuildKdTreeContext(context.Background())
+	return kdTree
+}
+
+// BuildKdTreeContext builds the kdtree and periodically checks if the
+// context is cancelled. In that case working memory is released and
+// the context error is returned.
+func (builder *KdTreeBuilder) BuildKdTreeContext(ctx context.Context) (*KdTree, error) {
+	builder.ctx = nil
+	if ctx.Done() != nil {
+		builder.ctx = ctx
+	}
+	builder.workSinceCancelCheck = 0
+	builder.cancelErr = nil
+	builder.droppedTriangles = nil
+
+	builder.buildTimings = BuildTimings{}
+	timer := newPhaseTimer(builder.buildParams.CollectTimings)
+	defer timer.finish(&builder.buildTimings.Total)
+
 	trianglesCount := builder.mesh.GetTrianglesCount()
 
 	// initialize bounding boxes
 	builder.triangleBounds = make([]BBox32, trianglesCount)
-	meshBounds := NewBBox32()
+	computeTriangleBoundsBatch(builder.mesh, builder.triangleBounds)
+	if builder.buildParams.BoundsPadding > 0 {
+		padTriangleBounds(builder.triangleBounds, builder.buildParams.BoundsPadding)
+	}
 
+	meshBounds := NewBBox32()
 	for i := int32(0); i < trianglesCount; i++ {
-		builder.triangleBounds[i] = builder.mesh.GetTriangleBounds(i)
 		meshBounds = BBox32Union(meshBounds, builder.triangleBounds[i])
 	}
+	if trianglesCount == 0 {
+		// degenerate but finite bounds for empty mesh
+		meshBounds = NewBBox32FromPoint(Vector32{})
+	}
+	timer.endPhase(&builder.buildTimings.TriangleBounds)
+
+	if builder.wideIndices {
+		return builder.buildWideKdTree(meshBounds, &timer)
+	}
 
 	// initialize working memory
+	builder.splitBounds = builder.triangleBounds
+	if builder.buildParams.ClipTriangles {
+		builder.clippedBounds = make([]BBox32, trianglesCount)
+		builder.splitBounds = builder.clippedBounds
+	}
 	builder.edgesBuffer = make([]boundEdge, 2*trianglesCount)
+	if builder.buildParams.UseRadixSort {
+		builder.edgesScratchBuffer = make([]boundEdge, 2*trianglesCount)
+	}
 	trianglesBufferSize := int(trianglesCount) * (builder.buildParams.MaxDepth + 1)
 	builder.trianglesBuffer = make([]int32, trianglesBufferSize)
 
+	// preallocate output arrays to reduce reallocations during the build
+	builder.nodes = nil
+	builder.nodeChunks = newNodeChunks(builder.buildParams.ExpectedNodes,
+		int(trianglesCount))
+	builder.triangleIndices = make([]int32, 0, trianglesCount)
+
 	// fill triangle indices for root node
 	for i := int32(0); i < trianglesCount; i++ {
 		builder.trianglesBuffer[i] = i
 	}
+	if builder.buildParams.ShuffleSeed != 0 {
+		shuffleTriangles(builder.trianglesBuffer[0:trianglesCount],
+			builder.buildParams.ShuffleSeed)
+	}
+
+	var rootEdges *[3][]boundEdge
+	if builder.buildParams.PresortEdges {
+		rootEdges = builder.initSortedEdges(builder.trianglesBuffer[0:trianglesCount])
+	}
 
-	// recursively build all nodes
-	builder.buildNode(meshBounds, builder.trianglesBuffer[0:trianglesCount],
-		builder.buildParams.MaxDepth, 0, int(trianglesCount))
+	timer.endPhase(&builder.buildTimings.BuffersInit)
+
+	// build all nodes
+	builder.buildNodes(buildTask{
+		nodeBounds:    meshBounds,
+		nodeTriangles: builder.trianglesBuffer[0:trianglesCount],
+		depth:         builder.buildParams.MaxDepth,
+		offset0:       0,
+		offset1:       int(trianglesCount),
+		sortedEdges:   rootEdges,
+		parentNode:    -1,
+	})
+	timer.endPhase(&builder.buildTimings.NodesBuild)
+	if builder.buildStats.enabled {
+		builder.buildStats.PeakWorkingBytes = builder.getWorkingMemoryBytes()
+	}
+
+	builder.clippedBounds = nil
+	builder.splitBounds = nil
+	builder.sortedEdgesArena = sortedEdgesArena{}
+	builder.triangleSides = nil
+	builder.nodes = builder.nodeChunks.flatten()
+	builder.nodeChunks = nil
+	if builder.cancelErr == errNarrowReferencesOverflow {
+		// the triangle bounds are reused by the wide build
+		builder.edgesBuffer = nil
+		builder.edgesScratchBuffer = nil
+		builder.trianglesBuffer = nil
+		builder.nodes = nil
+		builder.triangleIndices = nil
+		builder.droppedTriangles = nil
+		builder.cancelErr = nil
+		builder.switchToWideIndices()
+		return builder.buildWideKdTree(meshBounds, &timer)
+	}
+	if builder.cancelErr != nil {
+		builder.triangleBounds = nil
+		builder.edgesBuffer = nil
+		builder.edgesScratchBuffer = nil
+		builder.trianglesBuffer = nil
+		builder.nodes = nil
+		builder.triangleIndices = nil
+		return nil, builder.cancelErr
+	}
 
+	if builder.buildParams.OptimizeTree {
+		builder.optimizeTree(meshBounds)
+		timer.endPhase(&builder.buildTimings.Optimization)
+	}
+
+	if builder.buildParams.CompactLargeLeaves {
+		builder.compactLargeLeaves(meshBounds)
+		timer.endPhase(&builder.buildTimings.LeafCompaction)
+	}
+
+	builder.finishBuildStats(meshBounds,
+		int64(len(builder.triangleIndices))*int64(unsafe.Sizeof(int32(0))))
+	return &KdTree{
+		nodes:            builder.nodes,
+		triangleIndices:  builder.triangleIndices,
+		mesh:             builder.mesh,
+		meshBounds:       NewBBox64FromBBox32(meshBounds),
+		droppedTriangles: builder.droppedTriangles,
+	}, nil
+}
+
+// finishBuildStats adds the statistics of the finished tree.
+func (builder *KdTreeBuilder) finishBuildStats(meshBounds BBox32,
+	triangleIndicesBytes int64) {
+	if builder.buildStats.enabled {
+		builder.buildStats.NodesBytes = int64(len(builder.nodes)) * int64(unsafe.Sizeof(node{}))
+		builder.buildStats.TriangleIndicesBytes = triangleIndicesBytes
+		if builder.buildParams.CollectTreeCost {
+			builder.buildStats.SAHCost = builder.getSubtreeCost(builder.nodes, 0, meshBounds)
+		}
+	}
 	builder.buildStats.finalizeStats()
-	return &KdTree{builder.nodes, builder.triangleIndices, builder.mesh,
-		NewBBox64FromBBox32(meshBounds)}
 }
 
-func (builder *KdTreeBuilder) buildNode(nodeBounds BBox32, nodeTriangles []int32,
-	depth int, offset0 int, offset1 int) {
-	if len(builder.nodes) >= maxNodesCount {
-		common.RuntimeError(fmt.Sprintf(
-			"maximum number of KdTree nodes has been reached: %d",
-			maxNodesCount))
+// getWorkingMemoryBytes returns the memory allocated by the builder buffers
+// and the output arrays. The nodes are counted with the flattened copy
+// since flatten needs both.
+func (builder *KdTreeBuilder) getWorkingMemoryBytes() int64 {
+	bboxSize := int64(unsafe.Sizeof(BBox32{}))
+	edgeSize := int64(unsafe.Sizeof(boundEdge{}))
+	indexSize := int64(unsafe.Sizeof(int32(0)))
+	nodeSize := int64(unsafe.Sizeof(node{}))
+
+	bytes := int64(cap(builder.triangleBounds)+cap(builder.clippedBounds)) * bboxSize
+	bytes += int64(cap(builder.edgesBuffer)+cap(builder.edgesScratchBuffer)) * edgeSize
+	bytes += int64(cap(builder.sortedEdgesArena.buffer)) * edgeSize
+	bytes += int64(cap(builder.triangleSides))
+	bytes += int64(cap(builder.trianglesBuffer)+cap(builder.triangleIndices)) * indexSize
+	bytes += int64(cap(builder.wideEdgesBuffer)+cap(builder.wideEdgesScratchBuffer)) *
+		int64(unsafe.Sizeof(wideBoundEdge{}))
+	bytes += int64(cap(builder.wideTrianglesBuffer)+cap(builder.wideLeafOffsets)+
+		cap(builder.wideTriangleIndices)) * int64(unsafe.Sizeof(int64(0)))
+	for _, chunk := range builder.nodeChunks.chunks {
+		bytes += int64(cap(chunk)) * nodeSize
+	}
+	bytes += int64(builder.nodeChunks.len()) * nodeSize
+	return bytes
+}
+
+// computeTriangleBoundsBatch computes bounding boxes of all mesh triangles.
+// The result is the same as calling GetTriangleBounds for each triangle but
+// the loop works directly on mesh arrays without per-triangle call overhead.
+func computeTriangleBoundsBatch(mesh *TriangleMesh, out []BBox32) {
+	vertices := mesh.vertices
+	triangles := mesh.triangles[:len(out)]
+
+	for i, indices := range triangles {
+		v0 := &vertices[indices[0]]
+		v1 := &vertices[indices[1]]
+		v2 := &vertices[indices[2]]
+		bounds := &out[i]
+
+		// f32Min and f32Max select the same values as Extend also for
+		// signed zeros and NaNs
+		for k := 0; k < 3; k++ {
+			bounds.minPoint[k] = f32Min(f32Min(v0[k], v1[k]), v2[k])
+			bounds.maxPoint[k] = f32Max(f32Max(v0[k], v1[k]), v2[k])
+		}
+	}
+}
+
+// shuffleTriangles permutes triangle indices using Fisher-Yates shuffle.
+func shuffleTriangles(triangles []int32, seed uint64) {
+	shuffle(len(triangles), seed, func(i, k int) {
+		triangles[i], triangles[k] = triangles[k], triangles[i]
+	})
+}
+
+// shuffle is the Fisher-Yates shuffle of n elements swapped by swap, the
+// narrow and the wide index builds get the same permutation.
+func shuffle(n int, seed uint64, swap func(i, k int)) {
+	r := &splitMix64{seed}
+	for i := n - 1; i > 0; i-- {
+		k := int(r.next() % uint64(i+1))
+		swap(i, k)
+	}
+}
+
+func padTriangleBounds(bounds []BBox32, padding float32) {
+	for i := range bounds {
+		for k := 0; k < 3; k++ {
+			magnitude := float32(math.Max(math.Abs(float64(bounds[i].minPoint[k])),
+				math.Abs(float64(bounds[i].maxPoint[k]))))
+			delta := padding * magnitude
+			bounds[i].minPoint[k] -= delta
+			bounds[i].maxPoint[k] += delta
+		}
 	}
+}
 
-	// check if leaf node should be created
-	if len(nodeTriangles) <= builder.buildParams.LeafTrianglesLimit || depth == 0 {
-		builder.createLeaf(nodeTriangles)
-		builder.buildStats.newLeaf(len(nodeTriangles),
-			builder.buildParams.MaxDepth-depth)
+// buildTask describes the node to build. nodeTriangles is a part of
+// trianglesBuffer, the children triangles are written to the buffer at
+// offset0 (below child) and offset1 (above child). The wide index build
+// uses wideNodeTriangles and wideTrianglesBuffer instead. depth is the
+// number of levels left until MaxDepth. sortedEdges contains sorted edge
+// lists of the node triangles if BuildParams.PresortEdges is enabled,
+// otherwise it is nil.
+type buildTask struct {
+	nodeBounds        BBox32
+	nodeTriangles     []int32
+	wideNodeTriangles []int64
+	depth             int
+	offset0           int
+	offset1           int
+	sortedEdges       *[3][]boundEdge
+
+	// the above child is linked to its interior parent node when the task
+	// starts, since the below subtree has to be built first. parentNode is
+	// -1 for the root and below children. arenaMark is the state of
+	// sortedEdgesArena before the below child edges were allocated.
+	parentNode    int32
+	splitAxis     int
+	splitPosition float32
+	arenaMark     sortedEdgesArena
+}
+
+func (task *buildTask) trianglesCount() int {
+	return len(task.nodeTriangles) + len(task.wideNodeTriangles)
+}
+
+// buildNodes builds the subtree of the root task. The tasks are processed
+// in depth-first order with an explicit stack, the below child is built
+// before the above child like in the recursive build, so the layout of
+// the nodes and the use of the buffers do not change, but the goroutine
+// stack does not grow with the tree depth.
+func (builder *KdTreeBuilder) buildNodes(root buildTask) {
+	progressFn := builder.buildParams.ProgressFn
+	trianglesRemaining := root.trianglesCount()
+	workSinceProgress := 0
+
+	tasks := []buildTask{root}
+	for len(tasks) > 0 {
+		task := tasks[len(tasks)-1]
+		tasks = tasks[:len(tasks)-1]
+		trianglesRemaining -= task.trianglesCount()
+
+		if task.parentNode >= 0 {
+			builder.nodeChunks.at(int(task.parentNode)).initInteriorNode(task.splitAxis,
+				int32(builder.nodeChunks.len()), task.splitPosition)
+			if task.sortedEdges != nil {
+				builder.sortedEdgesArena = task.arenaMark
+			}
+		}
+
+		var below, above buildTask
+		var isInterior bool
+		if builder.wideIndices {
+			below, above, isInterior = builder.buildWideNode(&task, len(tasks))
+		} else {
+			below, above, isInterior = builder.buildNode(&task, len(tasks))
+		}
+		if builder.cancelErr != nil {
+			return
+		}
+		if isInterior {
+			tasks = append(tasks, above, below)
+			trianglesRemaining += below.trianglesCount() + above.trianglesCount()
+		}
+
+		if progressFn != nil {
+			workSinceProgress += task.trianglesCount() + 1
+			if workSinceProgress >= progressReportInterval {
+				workSinceProgress = 0
+				progressFn(BuildProgress{builder.nodeChunks.len(), trianglesRemaining})
+			}
+		}
+	}
+	if progressFn != nil {
+		progressFn(BuildProgress{builder.nodeChunks.len(), 0})
+	}
+}
+
+// buildNode creates the node of the task. For interior node it returns the
+// tasks of the children which should be built in the order below, above.
+// pendingTasks is the number of tasks waiting in the stack, each of them
+// needs at least one node.
+func (builder *KdTreeBuilder) buildNode(task *buildTask, pendingTasks int) (below,
+	above buildTask, isInterior bool) {
+	nodeBounds := task.nodeBounds
+	nodeTriangles := task.nodeTriangles
+	depth := task.depth
+	offset0, offset1 := task.offset0, task.offset1
+	sortedEdges := task.sortedEdges
+
+	if builder.isCancelled(len(nodeTriangles)) {
+		return
+	}
+
+	if builder.buildParams.ClipTriangles {
+		nodeTriangles = builder.clipNodeTriangles(nodeBounds, nodeTriangles)
+	}
+
+	if builder.isLeafNode(len(nodeTriangles), depth, pendingTasks) {
+		builder.appendLeaf(builder.newLeaf(nodeTriangles), len(nodeTriangles), depth)
 		return
 	}
 
 	// select split position
-	split := builder.selectSplit(nodeBounds, nodeTriangles)
+	emptyBonus := builder.getEmptyBonus(depth)
+	var split split
+	if sortedEdges != nil {
+		split = builder.selectPresortedSplit(nodeBounds, sortedEdges, emptyBonus)
+	} else {
+		split = builder.buildParams.SplitStrategy.selectSplit(builder, nodeBounds,
+			nodeTriangles, emptyBonus)
+	}
 	if split.edge == -1 {
-		builder.createLeaf(nodeTriangles)
-		builder.buildStats.newLeaf(len(nodeTriangles),
-			builder.buildParams.MaxDepth-depth)
+		builder.buildStats.failedSplit()
+		builder.appendLeaf(builder.newLeaf(nodeTriangles), len(nodeTriangles), depth)
 		return
 	}
-	splitPosition := builder.edgesBuffer[split.edge].positionOnAxis
+	var splitPosition float32
+	var n0, n1 int
+	if split.byPosition {
+		splitPosition = split.position
+		n0, n1 = builder.classifySplitByPosition(splitPosition,
+			len(nodeTriangles), offset0, offset1)
+	} else {
+		edges := builder.edgesBuffer[:2*len(nodeTriangles)]
+		if sortedEdges != nil {
+			edges = sortedEdges[split.axis]
+		}
+		splitPosition = edges[split.edge].positionOnAxis
 
-	// classify triangles with respect to split
-	n0 := 0
-	for i := int32(0); i < split.edge; i++ {
-		if builder.edgesBuffer[i].isStart() {
-			builder.trianglesBuffer[offset0+n0] =
-				builder.edgesBuffer[i].triangleIndex()
-			n0++
+		// classify triangles with respect to split
+		for i := 0; i < split.edge; i++ {
+			if edges[i].isStart() {
+				builder.trianglesBuffer[offset0+n0] = edges[i].triangleIndex()
+				n0++
+			}
 		}
-	}
 
-	n1 := 0
-	for i := split.edge + 1; i < int32(2*len(nodeTriangles)); i++ {
-		if builder.edgesBuffer[i].isEnd() {
-			builder.trianglesBuffer[offset1+n1] =
-				builder.edgesBuffer[i].triangleIndex()
-			n1++
+		for i := split.edge + 1; i < len(edges); i++ {
+			if edges[i].isEnd() {
+				builder.trianglesBuffer[offset1+n1] = edges[i].triangleIndex()
+				n1++
+			}
 		}
+
+		// the triangles that lie in the split plane have the start edges
+		// after the split edge in the group of edges at the split position
+		for i := split.edge; i < len(edges) && edges[i].positionOnAxis == splitPosition; i++ {
+			if edges[i].isStart() {
+				builder.recordDroppedTriangle(edges[i].triangleIndex(), split.axis,
+					splitPosition)
+			}
+		}
+	}
+
+	// the above lists are allocated first, so the below lists can be
+	// released before the above child is built
+	var belowEdges, aboveEdges *[3][]boundEdge
+	var belowArenaMark sortedEdgesArena
+	if sortedEdges != nil {
+		aboveEdges = builder.sortedEdgesArena.allocAxes(n1)
+		belowArenaMark = builder.sortedEdgesArena
+		belowEdges = builder.sortedEdgesArena.allocAxes(n0)
+		builder.partitionSortedEdges(sortedEdges, builder.trianglesBuffer[0:n0],
+			builder.trianglesBuffer[offset1:offset1+n1], belowEdges, aboveEdges)
 	}
 
-	// add interior node and recursively create children nodes
-	thisNodeIndex := len(builder.nodes)
-	builder.nodes = append(builder.nodes, node{})
+	below, above = builder.newChildTasks(task, split.axis, splitPosition, n0, n1)
+	below.sortedEdges = belowEdges
+	above.sortedEdges = aboveEdges
+	above.arenaMark = belowArenaMark
+	return below, above, true
+}
 
-	bounds0 := nodeBounds
-	bounds0.maxPoint[split.axis] = splitPosition
-	builder.buildNode(bounds0, builder.trianglesBuffer[0:n0], depth-1, 0,
-		offset1+n1)
+// isLeafNode checks if the node of the task at the given depth with the
+// given number of triangles should be a leaf. pendingTasks is the number of
+// tasks waiting in the stack as in buildNode.
+func (builder *KdTreeBuilder) isLeafNode(nodeTrianglesCount, depth,
+	pendingTasks int) bool {
+	leafTrianglesLimit :=
+		builder.buildParams.getLeafTrianglesLimit(builder.buildParams.MaxDepth - depth)
+	if depth != 0 {
+		builder.buildStats.leafLimitDecision(&builder.buildParams, nodeTrianglesCount,
+			leafTrianglesLimit)
+	}
+	if nodeTrianglesCount <= leafTrianglesLimit || depth == 0 {
+		return true
+	}
 
-	aboveChild := int32(len(builder.nodes))
-	builder.nodes[thisNodeIndex].initInteriorNode(split.axis, aboveChild,
-		splitPosition)
+	// interior node and its two children should fit the node budget
+	if builder.nodeChunks.len()+pendingTasks+3 > builder.buildParams.MaxNodes {
+		builder.buildStats.nodeBudgetLeaf()
+		return true
+	}
+	return false
+}
 
-	bounds1 := nodeBounds
-	bounds1.minPoint[split.axis] = splitPosition
-	builder.buildNode(bounds1, builder.trianglesBuffer[offset1:offset1+n1],
-		depth-1, 0, offset1)
+// appendLeaf adds the leaf created at the given depth to the nodes and to
+// the statistics.
+func (builder *KdTreeBuilder) appendLeaf(leaf node, nodeTrianglesCount, depth int) {
+	builder.nodeChunks.append(leaf)
+	builder.buildStats.newLeaf(nodeTrianglesCount, builder.buildParams.MaxDepth-depth)
+}
+
+func (builder *KdTreeBuilder) getEmptyBonus(depth int) float32 {
+	if builder.buildParams.EmptyBonusFn != nil {
+		return builder.buildParams.EmptyBonusFn(builder.buildParams.MaxDepth - depth)
+	}
+	return builder.buildParams.EmptyBonus
+}
+
+// newChildTasks adds the interior node of the task and returns the tasks of
+// its children. The above child is linked to the node by the above task.
+// The n0 below and n1 above triangles are already written to the triangles
+// buffer at the task offsets.
+func (builder *KdTreeBuilder) newChildTasks(task *buildTask, axis int,
+	splitPosition float32, n0, n1 int) (below, above buildTask) {
+	thisNodeIndex := builder.nodeChunks.len()
+	builder.nodeChunks.append(node{})
+
+	bounds0 := task.nodeBounds
+	bounds0.maxPoint[axis] = splitPosition
+	below = buildTask{
+		nodeBounds: bounds0,
+		depth:      task.depth - 1,
+		offset0:    0,
+		offset1:    task.offset1 + n1,
+		parentNode: -1,
+	}
+
+	bounds1 := task.nodeBounds
+	bounds1.minPoint[axis] = splitPosition
+	above = buildTask{
+		nodeBounds:    bounds1,
+		depth:         task.depth - 1,
+		offset0:       0,
+		offset1:       task.offset1,
+		parentNode:    int32(thisNodeIndex),
+		splitAxis:     axis,
+		splitPosition: splitPosition,
+	}
+
+	if builder.wideIndices {
+		below.wideNodeTriangles = builder.wideTrianglesBuffer[task.offset0 : task.offset0+n0]
+		above.wideNodeTriangles = builder.wideTrianglesBuffer[task.offset1 : task.offset1+n1]
+	} else {
+		below.nodeTriangles = builder.trianglesBuffer[task.offset0 : task.offset0+n0]
+		above.nodeTriangles = builder.trianglesBuffer[task.offset1 : task.offset1+n1]
+	}
+	return below, above
+}
+
+// recordDroppedTriangle records the triangle that lies in the split plane,
+// it is added to neither child of the edge split.
+func (builder *KdTreeBuilder) recordDroppedTriangle(triangleIndex int32, axis int,
+	splitPosition float32) {
+	if builder.splitBounds[triangleIndex].maxPoint[axis] == splitPosition {
+		builder.droppedTriangles = append(builder.droppedTriangles, triangleIndex)
+	}
 }
 
 func (builder *KdTreeBuilder) createLeaf(nodeTriangles []int32) {
+	builder.nodes = append(builder.nodes, builder.newLeaf(nodeTriangles))
+}
+
+// newLeaf returns the leaf node for the triangles, the triangles of the leaf
+// with multiple triangles are added to triangleIndices.
+func (builder *KdTreeBuilder) newLeaf(nodeTriangles []int32) node {
 	var n node
 	if len(nodeTriangles) == 0 {
 		n.initEmptyLeaf()
 	} else if len(nodeTriangles) == 1 {
 		n.initLeafWithSingleTriangle(nodeTriangles[0])
 	} else {
+		// the offset of leaf triangles is stored as int32, the node build
+		// continues with the wide index path
+		if len(builder.triangleIndices) > maxNarrowTriangleReferences-len(nodeTriangles) {
+			if builder.nodeChunks != nil {
+				builder.cancelErr = errNarrowReferencesOverflow
+				return n
+			}
+			common.RuntimeError(fmt.Sprintf(
+				"maximum number of KdTree triangle references has been reached: %d",
+				maxNarrowTriangleReferences))
+		}
 		n.initLeafWithMultipleTriangles(int32(len(nodeTriangles)),
 			int32(len(builder.triangleIndices)))
 		builder.triangleIndices = append(builder.triangleIndices,
 			nodeTriangles...)
 	}
-	builder.nodes = append(builder.nodes, n)
+	return n
 }
 
 type split struct {
-	edge int32
+	edge int
 	axis int
 	cost float32
+
+	// binned and median splits are defined by position, edge is not -1
+	// for valid split
+	byPosition bool
+	position   float32
 }
 
-func (builder *KdTreeBuilder) selectSplit(nodeBounds BBox32,
-	nodeTriangles []int32) split {
-	// Determine axes iteration order.
+// getSplitAxes determines axes iteration order for split selection.
+func (builder *KdTreeBuilder) getSplitAxes(nodeBounds BBox32) [3]int {
 	var axes [3]int
 	if builder.buildParams.SplitAlongTheLongestAxis {
 		diag := VSub32(nodeBounds.maxPoint, nodeBounds.minPoint)
@@ -313,130 +1200,227 @@ func (builder *KdTreeBuilder) selectSplit(nodeBounds BBox32,
 	} else {
 		axes = [3]int{0, 1, 2}
 	}
+	return axes
+}
 
-	// Select spliting axis and position. If buildParams.SplitAlongTheLongestAxis
-	// is true then we stop at the first axis that gives a valid split.
-	bestSplit := split{-1, -1, float32(math.Inf(+1))}
-
-	for _, axis := range axes {
-		// initialize edges
-		for i, triangle := range nodeTriangles {
-			builder.edgesBuffer[2*i+0] = boundEdge{
-				builder.triangleBounds[triangle].minPoint[axis],
-				uint32(triangle) | 0}
-
-			builder.edgesBuffer[2*i+1] = boundEdge{
-				builder.triangleBounds[triangle].maxPoint[axis],
-				uint32(triangle) | edgeEndMask}
-		}
-		sort.Stable(boundEdgeSorter(
-			builder.edgesBuffer[0 : len(nodeTriangles)*2]))
-
-		// select split position
-		currentSplit := builder.selectSplitForAxis(nodeBounds,
-			int32(len(nodeTriangles)), axis)
+func (builder *KdTreeBuilder) selectSplit(nodeBounds BBox32,
+	nodeTriangles []int32, emptyBonus float32) split {
+	edges := builder.edgesBuffer[0 : len(nodeTriangles)*2]
+	bestSplit, lastAxis := builder.selectSplitOverAxes(nodeBounds, func(axis int) split {
+		builder.initEdgePairs(nodeTriangles, axis)
+		builder.sortEdges(edges)
+		return builder.selectSplitForAxis(edges, nodeBounds, len(nodeTriangles),
+			axis, emptyBonus)
+	})
+
+	// If split axis is not the last evaluated axis then we should
+	// reinitialize edgesBuffer to contain data for split axis since
+	// edgesBuffer will be used later.
+	if bestSplit.edge != -1 && bestSplit.axis != lastAxis {
+		builder.initEdgePairs(nodeTriangles, bestSplit.axis)
+		builder.sortEdges(edges)
+	}
+	return bestSplit
+}
 
+// selectSplitOverAxes returns the split with the lowest cost from the
+// splits found by findAxisSplit for the axes in the order of getSplitAxes
+// and the last axis passed to findAxisSplit. If
+// buildParams.SplitAlongTheLongestAxis is true then we stop at the first
+// axis that gives a valid split.
+func (builder *KdTreeBuilder) selectSplitOverAxes(nodeBounds BBox32,
+	findAxisSplit func(axis int) split) (bestSplit split, lastAxis int) {
+	bestSplit = split{edge: -1, axis: -1, cost: float32(math.Inf(+1))}
+	for _, axis := range builder.getSplitAxes(nodeBounds) {
+		lastAxis = axis
+		currentSplit := findAxisSplit(axis)
 		if currentSplit.edge != -1 {
 			if builder.buildParams.SplitAlongTheLongestAxis {
-				return currentSplit
+				return currentSplit, lastAxis
 			}
+			// the first axis wins if the costs are equal
 			if currentSplit.cost < bestSplit.cost {
 				bestSplit = currentSplit
 			}
 		}
 	}
+	return bestSplit, lastAxis
+}
 
-	// If split axis is not the last axis (2) then we should reinitialize
-	// edgesBuffer to contain data for split axis since edgesBuffer will be
-	// used later.
-	if bestSplit.axis == 0 || bestSplit.axis == 1 {
-		for i, triangle := range nodeTriangles {
+var otherAxis = [3][2]int{{1, 2}, {0, 2}, {0, 1}}
 
-			builder.edgesBuffer[2*i+0] = boundEdge{
-				builder.triangleBounds[triangle].minPoint[bestSplit.axis],
-				uint32(triangle) | 0}
+// Relative cost difference for two splits to be considered equally good.
+const balanceTieBreakEpsilon = 1e-4
 
-			builder.edgesBuffer[2*i+1] = boundEdge{
-				builder.triangleBounds[triangle].maxPoint[bestSplit.axis],
-				uint32(triangle) | edgeEndMask}
+// selectSplitForAxis selects split from sorted edges of the node triangles.
+func (builder *KdTreeBuilder) selectSplitForAxis(edges []boundEdge, nodeBounds BBox32,
+	nodeTrianglesCount int, axis int, emptyBonus float32) split {
+	return builder.selectBalancedSplit(func(maxTieCost float32) split {
+		return builder.findSplitForAxis(edges, nodeBounds, nodeTrianglesCount,
+			axis, emptyBonus, maxTieCost)
+	})
+}
+
+// selectBalancedSplit returns the split with the lowest cost found by
+// findSplit, or the most balanced split with almost the same cost if
+// BalanceTieBreak is enabled, see findSplitForAxis.
+func (builder *KdTreeBuilder) selectBalancedSplit(
+	findSplit func(maxTieCost float32) split) split {
+	bestSplit := findSplit(-1)
+
+	if builder.buildParams.BalanceTieBreak && bestSplit.edge != -1 {
+		maxCost := bestSplit.cost * (1.0 + balanceTieBreakEpsilon)
+		balancedSplit := findSplit(maxCost)
+		if balancedSplit.edge != -1 {
+			bestSplit = balancedSplit
 		}
-		sort.Stable(boundEdgeSorter(
-			builder.edgesBuffer[0 : len(nodeTriangles)*2]))
 	}
 	return bestSplit
 }
 
-var otherAxis = [3][2]int{{1, 2}, {0, 2}, {0, 1}}
-
-func (builder *KdTreeBuilder) selectSplitForAxis(nodeBounds BBox32,
-	nodeTrianglesCount int32, axis int) split {
+// getSplitCost returns SAH cost of the split. The products are rounded to
+// float32 explicitly since the compiler can fuse multiply-add operations on
+// some platforms (e.g. arm64), the rounding makes the costs and so the
+// selected splits the same on all platforms.
+func (builder *KdTreeBuilder) getSplitCost(pBelow, pAbove float32,
+	numBelow, numAbove int64, emptyBonus float32) float32 {
 	buildParams := &builder.buildParams
+	bonus := float32(0.0)
+	if numBelow == 0 || numAbove == 0 {
+		bonus = emptyBonus
+	}
+	sum := float32(pBelow*float32(numBelow)) + float32(pAbove*float32(numAbove))
+	return buildParams.TraversalCost +
+		float32((1.0-bonus)*buildParams.IntersectionCost*sum)
+}
 
-	otherAxis0 := otherAxis[axis][0]
-	otherAxis1 := otherAxis[axis][1]
-	diag := VSub32(nodeBounds.maxPoint, nodeBounds.minPoint)
-
-	s0 := 2.0 * (diag[otherAxis0] * diag[otherAxis1])
-	d0 := 2.0 * (diag[otherAxis0] + diag[otherAxis1])
-
-	invTotalS := 1.0 /
-		(2.0 * (diag[0]*diag[1] + diag[0]*diag[2] + diag[1]*diag[2]))
-
+// findSplitForAxis returns the split with the lowest cost if maxTieCost is
+// negative. Otherwise it returns the most balanced split from the splits
+// which cost does not exceed maxTieCost. In both cases the split with the
+// lowest position wins if the costs (or imbalances) are equal.
+func (builder *KdTreeBuilder) findSplitForAxis(edges []boundEdge, nodeBounds BBox32,
+	nodeTrianglesCount int, axis int, emptyBonus float32,
+	maxTieCost float32) split {
+	sweep := builder.newSplitSweep(nodeBounds, nodeTrianglesCount, axis,
+		emptyBonus, maxTieCost)
 	numEdges := nodeTrianglesCount * 2
-
-	bestSplit := split{-1, axis,
-		buildParams.IntersectionCost * float32(nodeTrianglesCount)}
-
-	numBelow := int32(0)
+	numBelow := 0
 	numAbove := nodeTrianglesCount
 
-	for i := int32(0); i < numEdges; {
-		edge := builder.edgesBuffer[i]
+	for i := 0; i < numEdges; {
+		edge := edges[i]
 
 		// find group of edges with the same axis position: [i, groupEnd)
 		groupEnd := i + 1
 		for groupEnd < numEdges &&
-			edge.positionOnAxis == builder.edgesBuffer[groupEnd].positionOnAxis {
+			edge.positionOnAxis == edges[groupEnd].positionOnAxis {
 			groupEnd++
 		}
 
 		// [i, middleEdge) - edges End points.
 		// [middleEdge, groupEnd) - edges Start points.
 		middleEdge := i
-		for middleEdge != groupEnd && builder.edgesBuffer[middleEdge].isEnd() {
+		for middleEdge != groupEnd && edges[middleEdge].isEnd() {
 			middleEdge++
 		}
 
 		numAbove -= middleEdge - i
+		sweep.addSplit(edge.positionOnAxis, numBelow, numAbove, middleEdge, groupEnd)
+		numBelow += groupEnd - middleEdge
+		i = groupEnd
+	}
+	return sweep.bestSplit
+}
 
-		t := edge.positionOnAxis
-		if t > nodeBounds.minPoint[axis] && t < nodeBounds.maxPoint[axis] {
-			belowS := s0 + d0*(t-nodeBounds.minPoint[axis])
-			aboveS := s0 + d0*(nodeBounds.maxPoint[axis]-t)
+// splitSweep finds the split of findSplitForAxis from the groups of the
+// sorted edges of the node that are added in the increasing position order.
+// The wide index build adds its groups in the same way, so both builds
+// select the same splits.
+type splitSweep struct {
+	builder    *KdTreeBuilder
+	nodeBounds BBox32
+	axis       int
+	emptyBonus float32
+	maxTieCost float32
+
+	s0        float32
+	d0        float32
+	invTotalS float32
+	leafCost  float32
+
+	bestSplit     split
+	bestImbalance int
+}
 
-			pBelow := belowS * invTotalS
-			pAbove := aboveS * invTotalS
+func (builder *KdTreeBuilder) newSplitSweep(nodeBounds BBox32, nodeTrianglesCount int,
+	axis int, emptyBonus, maxTieCost float32) splitSweep {
+	otherAxis0 := otherAxis[axis][0]
+	otherAxis1 := otherAxis[axis][1]
+	diag := VSub32(nodeBounds.maxPoint, nodeBounds.minPoint)
 
-			emptyBonus := float32(0.0)
-			if numBelow == 0 || numAbove == 0 {
-				emptyBonus = buildParams.EmptyBonus
-			}
+	leafCost := builder.buildParams.IntersectionCost * float32(nodeTrianglesCount)
+	return splitSweep{
+		builder:    builder,
+		nodeBounds: nodeBounds,
+		axis:       axis,
+		emptyBonus: emptyBonus,
+		maxTieCost: maxTieCost,
+
+		s0: 2.0 * (diag[otherAxis0] * diag[otherAxis1]),
+		d0: 2.0 * (diag[otherAxis0] + diag[otherAxis1]),
+		invTotalS: 1.0 /
+			(2.0 * (float32(diag[0]*diag[1]) + float32(diag[0]*diag[2]) +
+				float32(diag[1]*diag[2]))),
+		leafCost: leafCost,
+
+		bestSplit:     split{edge: -1, axis: axis, cost: leafCost},
+		bestImbalance: math.MaxInt,
+	}
+}
+
+// addSplit evaluates the split at the position t of the group of edges
+// that ends at groupEnd, the start edges of the group begin at middleEdge.
+// numBelow and numAbove are the triangles on both sides of the split.
+func (sweep *splitSweep) addSplit(t float32, numBelow, numAbove, middleEdge,
+	groupEnd int) {
+	nodeBounds := &sweep.nodeBounds
+	axis := sweep.axis
+	if !(t > nodeBounds.minPoint[axis] && t < nodeBounds.maxPoint[axis]) {
+		return
+	}
+	belowS := sweep.s0 + float32(sweep.d0*(t-nodeBounds.minPoint[axis]))
+	aboveS := sweep.s0 + float32(sweep.d0*(nodeBounds.maxPoint[axis]-t))
 
-			cost := buildParams.TraversalCost +
-				(1.0-emptyBonus)*buildParams.IntersectionCost*
-					(pBelow*float32(numBelow)+pAbove*float32(numAbove))
+	pBelow := belowS * sweep.invTotalS
+	pAbove := aboveS * sweep.invTotalS
 
-			if cost < bestSplit.cost {
-				bestSplit.edge = middleEdge
-				if middleEdge == groupEnd {
-					bestSplit.edge -= 1
-				}
-				bestSplit.cost = cost
-			}
+	cost := sweep.builder.getSplitCost(pBelow, pAbove, int64(numBelow),
+		int64(numAbove), sweep.emptyBonus)
+	if cost < sweep.bestSplit.cost || sweep.maxTieCost >= 0 {
+		sweep.updateBestSplit(cost, numBelow, numAbove, middleEdge, groupEnd)
+	}
+}
+
+func (sweep *splitSweep) updateBestSplit(cost float32, numBelow, numAbove, middleEdge,
+	groupEnd int) {
+	better := cost < sweep.bestSplit.cost
+	if sweep.maxTieCost >= 0 {
+		imbalance := numBelow - numAbove
+		if imbalance < 0 {
+			imbalance = -imbalance
+		}
+		better = cost <= sweep.maxTieCost && cost < sweep.leafCost &&
+			imbalance < sweep.bestImbalance
+		if better {
+			sweep.bestImbalance = imbalance
 		}
+	}
 
-		numBelow += groupEnd - middleEdge
-		i = groupEnd
+	if better {
+		sweep.bestSplit.edge = middleEdge
+		if middleEdge == groupEnd {
+			sweep.bestSplit.edge -= 1
+		}
+		sweep.bestSplit.cost = cost
 	}
-	return bestSplit
 }
@@ -0,0 +1,609 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// getSubtreeTriangles returns the set of triangles referenced by the leaves
+// of the subtree.
+func getSubtreeTriangles(kdTree *KdTree, nodeIndex int32) map[int32]bool {
+	triangles := make(map[int32]bool)
+	var collect func(nodeIndex int32)
+	collect = func(nodeIndex int32) {
+		n := kdTree.nodes[nodeIndex]
+		switch {
+		case n.isInteriorNode():
+			collect(nodeIndex + 1)
+			collect(n.aboveChild())
+		case n.trianglesCount() == 1:
+			triangles[n.index()] = true
+		default:
+			for _, triangleIndex := range kdTree.triangleIndices[n.index() : n.index()+n.trianglesCount()] {
+				triangles[triangleIndex] = true
+			}
+		}
+	}
+	collect(nodeIndex)
+	return triangles
+}
+
+func TestBalanceTieBreak(t *testing.T) {
+	// Three clusters of triangles parallel to the yz plane, the clusters
+	// have 1, 1 and 2 triangles and are located at x = 0, 0.5 + 2e-5 and
+	// 1. The split before the middle cluster (1 triangle below, 3 above)
+	// is cheaper than the split after it (2 and 2) by ~1e-5 of the cost.
+	const width = 1e-6
+	clusters := []struct {
+		x     float32
+		count int
+	}{{0, 1}, {0.5 + 2e-5, 1}, {1 - width, 2}}
+
+	mesh := &TriangleMesh{}
+	for _, cluster := range clusters {
+		for i := 0; i < cluster.count; i++ {
+			base := int32(len(mesh.vertices))
+			mesh.vertices = append(mesh.vertices,
+				Vector32{cluster.x, 0, 0},
+				Vector32{cluster.x + width, 1, 0},
+				Vector32{cluster.x + width/2, float32(i), 1})
+			mesh.triangles = append(mesh.triangles, [3]int32{base, base + 1, base + 2})
+		}
+	}
+
+	for _, balanceTieBreak := range []bool{false, true} {
+		buildParams := NewBuildParams()
+		buildParams.BalanceTieBreak = balanceTieBreak
+		kdTree := NewKdTreeBuilder(mesh, buildParams).BuildKdTree()
+
+		root := kdTree.nodes[0]
+		if !root.isInteriorNode() || root.splitAxis() != 0 {
+			t.Fatalf("balance tie break %v: root is not split along x", balanceTieBreak)
+		}
+		below := len(getSubtreeTriangles(kdTree, 1))
+		above := len(getSubtreeTriangles(kdTree, root.aboveChild()))
+		expectedBelow, expectedAbove := 1, 3
+		if balanceTieBreak {
+			expectedBelow, expectedAbove = 2, 2
+		}
+		if below != expectedBelow || above != expectedAbove {
+			t.Errorf("balance tie break %v: root split has %d triangles below and "+
+				"%d above, expected %d and %d", balanceTieBreak, below, above,
+				expectedBelow, expectedAbove)
+		}
+	}
+}
+
+func TestBalanceTieBreakCost(t *testing.T) {
+	opts := NewGenOpts()
+	opts.ClustersCount = 4
+	for seed := uint64(1); seed <= 3; seed++ {
+		mesh := GenerateRandomMesh(3000, seed, opts)
+		var costs [2]float64
+		for i, balanceTieBreak := range []bool{false, true} {
+			buildParams := NewBuildParams()
+			buildParams.BalanceTieBreak = balanceTieBreak
+			kdTree := NewKdTreeBuilder(mesh, buildParams).BuildKdTree()
+			costs[i] = kdTree.GetSAHCost(buildParams.IntersectionCost,
+				buildParams.TraversalCost)
+		}
+		if costs[1] > costs[0]*1.01 {
+			t.Errorf("seed %d: SAH cost with balance tie break is %g, without %g",
+				seed, costs[1], costs[0])
+		}
+	}
+}
+
+func TestBuildEmptyMesh(t *testing.T) {
+	mesh := &TriangleMesh{}
+	kdTree := NewKdTreeBuilder(mesh, NewBuildParams()).BuildKdTree()
+
+	if len(kdTree.nodes) != 1 || !kdTree.nodes[0].isLeaf() ||
+		kdTree.nodes[0].trianglesCount() != 0 {
+		t.Errorf("kdtree of empty mesh is not a single empty leaf: %d nodes",
+			len(kdTree.nodes))
+	}
+	for k := 0; k < 3; k++ {
+		if math.IsInf(kdTree.meshBounds.minPoint[k], 0) ||
+			math.IsInf(kdTree.meshBounds.maxPoint[k], 0) {
+			t.Fatalf("bounds of empty mesh are not finite: %v", kdTree.meshBounds)
+		}
+	}
+	if err := kdTree.Verify(); err != nil {
+		t.Errorf("kdtree of empty mesh is not valid: %v", err)
+	}
+
+	rays := []Ray{
+		RayFromOriginAndDirection(Vector64{-1, 0, 0}, Vector64{1, 0, 0}),
+		RayFromOriginAndDirection(Vector64{0, 0, 0}, Vector64{0, 1, 0}),
+	}
+	for i := range rays {
+		if hitFound, _ := kdTree.Intersect(&rays[i]); hitFound {
+			t.Errorf("ray %d hits empty mesh", i)
+		}
+		if kdTree.Occluded(&rays[i], 0, math.Inf(+1)) {
+			t.Errorf("ray %d is occluded by empty mesh", i)
+		}
+		if len(kdTree.IntersectAll(&rays[i], 0, math.Inf(+1))) != 0 {
+			t.Errorf("ray %d has intersections with empty mesh", i)
+		}
+	}
+}
+
+func TestExpectedNodesDoesNotChangeTree(t *testing.T) {
+	mesh := LoadTriangleMesh(teapotStl)
+	kdTree := NewKdTreeBuilder(mesh, NewBuildParams()).BuildKdTree()
+
+	for _, expectedNodes := range []int{1, len(kdTree.nodes), 10 * len(kdTree.nodes)} {
+		buildParams := NewBuildParams()
+		buildParams.ExpectedNodes = expectedNodes
+		hintedKdTree := NewKdTreeBuilder(mesh, buildParams).BuildKdTree()
+		if hintedKdTree.GetHash() != kdTree.GetHash() {
+			t.Errorf("expected nodes %d: kdtree hash is %x, expected %x", expectedNodes,
+				hintedKdTree.GetHash(), kdTree.GetHash())
+		}
+	}
+}
+
+func BenchmarkBuildKdTreeExpectedNodes(b *testing.B) {
+	mesh := LoadTriangleMesh(teapotStl)
+	nodesCount := len(NewKdTreeBuilder(mesh, NewBuildParams()).BuildKdTree().nodes)
+
+	for _, bm := range []struct {
+		name          string
+		expectedNodes int
+	}{
+		{"Estimated", 0},
+		{"Exact", nodesCount},
+		{"NoHint", 1},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			buildParams := NewBuildParams()
+			buildParams.ExpectedNodes = bm.expectedNodes
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				NewKdTreeBuilder(mesh, buildParams).BuildKdTree()
+			}
+		})
+	}
+}
+
+func TestBuildKdTreeContextCancelled(t *testing.T) {
+	mesh := GenerateRandomMesh(50000, 1, NewGenOpts())
+	goroutinesCount := runtime.NumGoroutine()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	kdTree, err := NewKdTreeBuilder(mesh, NewBuildParams()).BuildKdTreeContext(ctx)
+	if kdTree != nil || !errors.Is(err, context.Canceled) {
+		t.Errorf("build with cancelled context returned %v, expected context.Canceled", err)
+	}
+
+	start := time.Now()
+	_, err = NewKdTreeBuilder(mesh, NewBuildParams()).BuildKdTreeContext(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	buildTime := time.Since(start)
+
+	// cancel the build in the middle, it should stop soon after that
+	ctx, cancel = context.WithCancel(context.Background())
+	timer := time.AfterFunc(buildTime/10, cancel)
+	defer timer.Stop()
+	start = time.Now()
+	kdTree, err = NewKdTreeBuilder(mesh, NewBuildParams()).BuildKdTreeContext(ctx)
+	cancelledBuildTime := time.Since(start)
+	if kdTree != nil || !errors.Is(err, context.Canceled) {
+		t.Errorf("cancelled build returned %v, expected context.Canceled", err)
+	}
+	if cancelledBuildTime > buildTime/2 {
+		t.Errorf("cancelled build took %v, full build takes %v", cancelledBuildTime,
+			buildTime)
+	}
+
+	// the timer goroutine is finished after cancel returns
+	cancel()
+	time.Sleep(10 * time.Millisecond)
+	if count := runtime.NumGoroutine(); count > goroutinesCount {
+		t.Errorf("%d goroutines after cancelled builds, %d before", count,
+			goroutinesCount)
+	}
+}
+
+func TestFailedSplitCountWithLowIntersectionCost(t *testing.T) {
+	mesh := LoadTriangleMesh(teapotStl)
+	builder := NewKdTreeBuilder(mesh, NewBuildParams())
+	kdTree := builder.BuildKdTree()
+	stats := builder.GetBuildStats()
+
+	// with cheap intersection tests splitting rarely pays off
+	buildParams := NewBuildParams()
+	buildParams.IntersectionCost = 0.1
+	lowCostBuilder := NewKdTreeBuilder(mesh, buildParams)
+	lowCostKdTree := lowCostBuilder.BuildKdTree()
+	lowCostStats := lowCostBuilder.GetBuildStats()
+
+	// most of the leaves are created because no split reduces the cost
+	failedSplitFraction := func(stats BuildStats) float64 {
+		return float64(stats.FailedSplitCount) /
+			float64(stats.LeafCount-stats.EmptyLeafCount)
+	}
+	if failedSplitFraction(lowCostStats) < 0.9 ||
+		failedSplitFraction(lowCostStats) <= failedSplitFraction(stats) {
+		t.Errorf("%.2f of leaves are forced by failed split with low intersection cost, "+
+			"%.2f by default", failedSplitFraction(lowCostStats), failedSplitFraction(stats))
+	}
+	depth := len(kdTree.DepthHistogram()) - 1
+	lowCostDepth := len(lowCostKdTree.DepthHistogram()) - 1
+	if lowCostDepth >= depth || lowCostStats.AverageDepth >= stats.AverageDepth {
+		t.Errorf("depth is %d (average %.2f) with low intersection cost, %d (average %.2f) "+
+			"by default", lowCostDepth, lowCostStats.AverageDepth, depth, stats.AverageDepth)
+	}
+}
+
+func TestMaxScratchBytesReducesDepth(t *testing.T) {
+	mesh := LoadTriangleMesh("../data/dragon.stl")
+	defaultBuilder := NewKdTreeBuilder(mesh, NewBuildParams())
+
+	// the triangles buffer fits only 11 levels
+	const maxDepth = 10
+	buildParams := NewBuildParams()
+	buildParams.MaxScratchBytes = int64(mesh.GetTrianglesCount()) * (maxDepth + 1) * 4
+	builder := NewKdTreeBuilder(mesh, buildParams)
+	if builder.buildParams.MaxDepth != maxDepth {
+		t.Fatalf("max depth is %d, expected %d", builder.buildParams.MaxDepth, maxDepth)
+	}
+	if builder.buildParams.MaxDepth >= defaultBuilder.buildParams.MaxDepth {
+		t.Fatalf("max depth %d is not reduced, default max depth %d",
+			builder.buildParams.MaxDepth, defaultBuilder.buildParams.MaxDepth)
+	}
+
+	kdTree := builder.BuildKdTree()
+	if err := kdTree.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	if depth := len(kdTree.DepthHistogram()) - 1; depth > maxDepth {
+		t.Errorf("kdtree depth is %d, expected at most %d", depth, maxDepth)
+	}
+	if scratchBytes := int64(len(builder.trianglesBuffer)) * 4; scratchBytes >
+		buildParams.MaxScratchBytes {
+		t.Errorf("triangles buffer has %d bytes, the limit is %d", scratchBytes,
+			buildParams.MaxScratchBytes)
+	}
+}
+
+// intersectMeshBruteForce tests the ray against all mesh triangles.
+func intersectMeshBruteForce(mesh *TriangleMesh, ray *Ray) bool {
+	for i := int32(0); i < mesh.GetTrianglesCount(); i++ {
+		v0, v1, v2 := mesh.GetTriangle(i)
+		triangle := Triangle{[3]Vector64{
+			NewVector64FromVector32(v0),
+			NewVector64FromVector32(v1),
+			NewVector64FromVector32(v2),
+		}}
+		if hitFound, _ := IntersectTriangle(ray, &triangle); hitFound {
+			return true
+		}
+	}
+	return false
+}
+
+func TestBoundsPaddingGrazingRays(t *testing.T) {
+	mesh := GenerateRandomMesh(200, 1, NewGenOpts())
+	kdTree := NewKdTreeBuilder(mesh, NewBuildParams()).BuildKdTree()
+	buildParams := NewBuildParams()
+	buildParams.BoundsPadding = 1e-6
+	paddedKdTree := NewKdTreeBuilder(mesh, buildParams).BuildKdTree()
+
+	// The rays are aimed at triangle vertices, so they hit the triangle
+	// exactly at the face of its bounds. When the split plane is placed at
+	// that face the hit point is on the boundary of the child node and the
+	// traversal can skip the child that contains the triangle. Padded bounds
+	// put the triangle into both children.
+	r := &splitMix64{1}
+	missedCount, paddedMissedCount := 0, 0
+	for i := int32(0); i < mesh.GetTrianglesCount(); i++ {
+		v0, _, _ := mesh.GetTriangle(i)
+		target := NewVector64FromVector32(v0)
+		for k := 0; k < 20; k++ {
+			origin := NewVector64FromVector32(r.vector(100))
+			ray := RayFromOriginAndDirection(origin, VNormalized64(VSub64(target, origin)))
+			if !intersectMeshBruteForce(mesh, &ray) {
+				continue
+			}
+			if hitFound, _ := kdTree.Intersect(&ray); !hitFound {
+				missedCount++
+			}
+			if hitFound, _ := paddedKdTree.Intersect(&ray); !hitFound {
+				paddedMissedCount++
+			}
+		}
+	}
+	if missedCount == 0 {
+		t.Errorf("no grazing rays miss without padding, the test does not hit the crack")
+	}
+	if paddedMissedCount != 0 {
+		t.Errorf("%d grazing rays miss with padding, %d without", paddedMissedCount,
+			missedCount)
+	}
+}
+
+func TestBinnedSAHSplitQuality(t *testing.T) {
+	// The binned split can't place split planes exactly at triangle bounds,
+	// so on meshes with many vertices in common axis-aligned planes (the
+	// teapot) it duplicates more triangles. The uniform random mesh shows
+	// the approximation error itself.
+	mesh := GenerateRandomMesh(20000, 1, NewGenOpts())
+	kdTree := NewKdTreeBuilder(mesh, NewBuildParams()).BuildKdTree()
+	cost := kdTree.GetSAHCost(80, 1)
+	depth := len(kdTree.DepthHistogram()) - 1
+
+	for _, binCount := range []int{16, 32, 64} {
+		buildParams := NewBuildParams()
+		buildParams.SAHBinCount = binCount
+		binnedKdTree := NewKdTreeBuilder(mesh, buildParams).BuildKdTree()
+		if err := binnedKdTree.Verify(); err != nil {
+			t.Fatalf("%d bins: %v", binCount, err)
+		}
+
+		binnedCost := binnedKdTree.GetSAHCost(80, 1)
+		binnedDepth := len(binnedKdTree.DepthHistogram()) - 1
+		t.Logf("%d bins: SAH cost %.1f, exact %.1f, depth %d, exact %d", binCount,
+			binnedCost, cost, binnedDepth, depth)
+		if binnedCost > 1.15*cost {
+			t.Errorf("%d bins: SAH cost %.1f is more than 15%% above exact SAH cost %.1f",
+				binCount, binnedCost, cost)
+		}
+		if binnedDepth > depth {
+			t.Errorf("%d bins: depth %d is larger than exact SAH depth %d", binCount,
+				binnedDepth, depth)
+		}
+	}
+}
+
+func TestShuffleSeedKeepsHits(t *testing.T) {
+	mesh := LoadTriangleMesh(teapotStl)
+	kdTree := NewKdTreeBuilder(mesh, NewBuildParams()).BuildKdTree()
+	camera := NewCameraForBounds(kdTree.meshBounds)
+	const width, height = 32, 32
+
+	for _, seed := range []uint64{1, 2, 12345} {
+		buildParams := NewBuildParams()
+		buildParams.ShuffleSeed = seed
+		shuffledKdTree := NewKdTreeBuilder(mesh, buildParams).BuildKdTree()
+		if err := shuffledKdTree.Verify(); err != nil {
+			t.Fatalf("seed %d: %v", seed, err)
+		}
+		// the shuffle is deterministic
+		if hash := NewKdTreeBuilder(mesh, buildParams).BuildKdTree().GetHash(); hash !=
+			shuffledKdTree.GetHash() {
+			t.Errorf("seed %d: kdtrees built with the same seed differ", seed)
+		}
+
+		for y := 0; y < height; y++ {
+			for x := 0; x < width; x++ {
+				ray := camera.GenerateRay(x, y, width, height)
+				hitFound, intersection := kdTree.Intersect(&ray)
+				shuffledHitFound, shuffledIntersection := shuffledKdTree.Intersect(&ray)
+				if hitFound != shuffledHitFound || intersection.t != shuffledIntersection.t {
+					t.Errorf("seed %d, pixel (%d, %d): hit %v at t = %g, expected %v at t = %g",
+						seed, x, y, shuffledHitFound, shuffledIntersection.t, hitFound,
+						intersection.t)
+				}
+			}
+		}
+	}
+}
+
+func TestBuildTimingsSumToTotal(t *testing.T) {
+	mesh := LoadTriangleMesh(teapotStl)
+	buildParams := NewBuildParams()
+	buildParams.CollectTimings = true
+	buildParams.OptimizeTree = true
+	buildParams.CompactLargeLeaves = true
+	builder := NewKdTreeBuilder(mesh, buildParams)
+	builder.BuildKdTree()
+	timings := builder.GetBuildTimings()
+
+	phases := []time.Duration{timings.TriangleBounds, timings.BuffersInit,
+		timings.NodesBuild, timings.Optimization, timings.LeafCompaction}
+	sum := time.Duration(0)
+	for i, phase := range phases {
+		if phase <= 0 {
+			t.Errorf("phase %d duration is %v", i, phase)
+		}
+		sum += phase
+	}
+	// the phases follow each other, only the final bookkeeping is not
+	// included
+	if sum > timings.Total || timings.Total-sum > timings.Total/10+time.Millisecond {
+		t.Errorf("phases sum is %v, total build time is %v", sum, timings.Total)
+	}
+	// edge sorting is part of the nodes build
+	if timings.EdgeSort <= 0 || timings.EdgeSort > timings.NodesBuild {
+		t.Errorf("edge sort time is %v, nodes build time is %v", timings.EdgeSort,
+			timings.NodesBuild)
+	}
+
+	builder = NewKdTreeBuilder(mesh, NewBuildParams())
+	builder.BuildKdTree()
+	if timings := builder.GetBuildTimings(); timings != (BuildTimings{}) {
+		t.Errorf("timings are collected when disabled: %+v", timings)
+	}
+}
+
+func TestComputeTriangleBoundsBatch(t *testing.T) {
+	nan := float32(math.NaN())
+	negativeZero := float32(math.Copysign(0, -1))
+	mesh := GenerateRandomMesh(1000, 1, NewGenOpts())
+	// signed zeros and NaNs in every vertex position of the triangle
+	special := []Vector32{
+		{0, negativeZero, nan},
+		{negativeZero, 0, 1},
+		{nan, negativeZero, 0},
+		{negativeZero, nan, negativeZero},
+	}
+	base := int32(len(mesh.vertices))
+	mesh.vertices = append(mesh.vertices, special...)
+	for _, triangle := range [][3]int32{{0, 1, 2}, {1, 0, 3}, {2, 3, 0},
+		{3, 2, 1}, {1, 1, 0}} {
+		mesh.triangles = append(mesh.triangles,
+			[3]int32{base + triangle[0], base + triangle[1], base + triangle[2]})
+	}
+
+	bounds := make([]BBox32, mesh.GetTrianglesCount())
+	computeTriangleBoundsBatch(mesh, bounds)
+	for i := range bounds {
+		expected := mesh.GetTriangleBounds(int32(i))
+		for k := 0; k < 3; k++ {
+			if math.Float32bits(bounds[i].minPoint[k]) != math.Float32bits(expected.minPoint[k]) ||
+				math.Float32bits(bounds[i].maxPoint[k]) != math.Float32bits(expected.maxPoint[k]) {
+				t.Errorf("triangle %d: batch bounds are %v, expected %v",
+					i, bounds[i], expected)
+				break
+			}
+		}
+	}
+}
+
+func BenchmarkTriangleBoundsBatch(b *testing.B) {
+	mesh := LoadTriangleMesh("../data/dragon.stl")
+	bounds := make([]BBox32, mesh.GetTrianglesCount())
+	for i := 0; i < b.N; i++ {
+		computeTriangleBoundsBatch(mesh, bounds)
+	}
+}
+
+func BenchmarkTriangleBoundsPerTriangle(b *testing.B) {
+	mesh := LoadTriangleMesh("../data/dragon.stl")
+	bounds := make([]BBox32, mesh.GetTrianglesCount())
+	for i := 0; i < b.N; i++ {
+		for k := range bounds {
+			bounds[k] = mesh.GetTriangleBounds(int32(k))
+		}
+	}
+}
+
+func TestEmptyBonusFn(t *testing.T) {
+	// sparse mesh where empty space is cut off from most triangles
+	mesh := GenerateRandomMesh(2000, 7, NewGenOpts())
+	build := func(emptyBonusFn func(depth int) float32) (*KdTree, BuildStats) {
+		buildParams := NewBuildParams()
+		buildParams.CollectStats = true
+		buildParams.EmptyBonusFn = emptyBonusFn
+		builder := NewKdTreeBuilder(mesh, buildParams)
+		kdTree := builder.BuildKdTree()
+		if err := kdTree.Verify(); err != nil {
+			t.Fatal(err)
+		}
+		return kdTree, builder.GetBuildStats()
+	}
+
+	kdTree, stats := build(nil)
+	emptyBonus := NewBuildParams().EmptyBonus
+	constantKdTree, _ := build(func(depth int) float32 { return emptyBonus })
+	if constantKdTree.GetHash() != kdTree.GetHash() {
+		t.Errorf("constant empty bonus function builds kdtree with hash %x, expected %x",
+			constantKdTree.GetHash(), kdTree.GetHash())
+	}
+
+	// the bonus decays below the levels that separate the clusters
+	decayingKdTree, decayingStats := build(func(depth int) float32 {
+		if depth < 12 {
+			return emptyBonus
+		}
+		return emptyBonus * float32(math.Pow(0.7, float64(depth-12)))
+	})
+	if decayingStats.EmptyLeafCount >= stats.EmptyLeafCount {
+		t.Errorf("%d empty leaves with decaying empty bonus, %d with constant bonus",
+			decayingStats.EmptyLeafCount, stats.EmptyLeafCount)
+	}
+	cost := kdTree.GetSAHCost(80, 1)
+	decayingCost := decayingKdTree.GetSAHCost(80, 1)
+	if decayingCost > cost*1.05 {
+		t.Errorf("SAH cost is %.2f with decaying empty bonus, %.2f with constant bonus",
+			decayingCost, cost)
+	}
+}
+
+// newNestedTrianglesMesh returns triangles on the diagonal of the unit cube,
+// each triangle is at 0.7 of the distance to the origin and of the size of
+// the previous one. Every split separates only a few triangles from the
+// rest, so the tree is very deep.
+func newNestedTrianglesMesh(trianglesCount int) *TriangleMesh {
+	mesh := &TriangleMesh{}
+	scale := float32(1)
+	for i := 0; i < trianglesCount; i++ {
+		size := 0.1 * scale
+		base := int32(len(mesh.vertices))
+		mesh.vertices = append(mesh.vertices,
+			Vector32{scale, scale, scale},
+			Vector32{scale + size, scale, scale},
+			Vector32{scale, scale + size, scale + size})
+		mesh.triangles = append(mesh.triangles, [3]int32{base, base + 1, base + 2})
+		scale *= 0.7
+	}
+	return finishGeneratedMesh(mesh)
+}
+
+func TestBuildDeepKdTree(t *testing.T) {
+	mesh := newNestedTrianglesMesh(120)
+	buildParams := NewBuildParams()
+	buildParams.MaxDepth = maxTraversalDepth
+	kdTree := NewKdTreeBuilder(mesh, buildParams).BuildKdTree()
+	if err := kdTree.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if depth := len(kdTree.DepthHistogram()) - 1; depth < 48 || depth > maxTraversalDepth {
+		t.Errorf("kdtree depth is %d, expected deep tree within the traversal limit %d",
+			depth, maxTraversalDepth)
+	}
+
+	// the ray along the triangle normal hits only that triangle
+	for i := int32(0); i < mesh.GetTrianglesCount(); i++ {
+		v0, v1, v2 := mesh.GetTriangle(i)
+		centroid := VMul64(VAdd64(VAdd64(NewVector64FromVector32(v0),
+			NewVector64FromVector32(v1)), NewVector64FromVector32(v2)), 1.0/3.0)
+		size := float64(v1[0] - v0[0])
+		ray := RayFromOriginAndDirection(VAdd64(centroid, Vector64{0, -size, size}),
+			Vector64{0, size, -size})
+		hitFound, intersection := kdTree.Intersect(&ray)
+		if !hitFound || intersection.triangleIndex != i ||
+			math.Abs(intersection.t-1) > 1e-6 {
+			t.Errorf("ray to triangle %d: hit %v, triangle %d at t = %g", i, hitFound,
+				intersection.triangleIndex, intersection.t)
+		}
+	}
+}
+
+func TestExplicitStackBuildOrder(t *testing.T) {
+	// the hash of the teapot kdtree built by the recursive builder, the
+	// explicit task stack creates the nodes in the same order
+	mesh := LoadTriangleMesh(teapotStl)
+	kdTree := NewKdTreeBuilder(mesh, NewBuildParams()).BuildKdTree()
+	if hash := kdTree.GetHash(); hash != 0xe044c3a15bbf0fe4 {
+		t.Errorf("teapot kdtree hash is %#x, expected %#x", hash, uint64(0xe044c3a15bbf0fe4))
+	}
+}
+
+func TestMaxNodes(t *testing.T) {
+	mesh := LoadTriangleMesh(teapotStl)
+	buildParams := NewBuildParams()
+	buildParams.MaxNodes = 500
+	builder := NewKdTreeBuilder(mesh, buildParams)
+	kdTree := builder.BuildKdTree()
+	if len(kdTree.nodes) > buildParams.MaxNodes {
+		t.Errorf("kdtree has %d nodes, the limit is %d", len(kdTree.nodes),
+			buildParams.MaxNodes)
+	}
+	if builder.GetBuildStats().NodeBudgetLeafCount == 0 {
+		t.Errorf("no leaves are forced by the node budget")
+	}
+	if err := kdTree.Validate(); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,419 @@
+package main
+
+import (
+	"common"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+	"unsafe"
+)
+
+// Limits of the narrow index build: the edge stores the triangle index in
+// 31 bits and 2 * trianglesCount edges of the node are addressed by int32,
+// the legacy tree stores the offset of leaf triangles as int32. They are
+// variables, so the tests can select the wide index path for small meshes.
+var (
+	maxNarrowTrianglesCount     = 0x3fffffff // max ~ 1 billion triangles
+	maxNarrowTriangleReferences = math.MaxInt32
+)
+
+// The wide index build is limited only by the mesh which addresses
+// triangles with int32 indices.
+const maxWideTrianglesCount = math.MaxInt32
+
+// The node triangles count is stored in the remaining 30 bits of n[0].
+const maxLeafTrianglesCount = 0x3fffffff
+
+// errNarrowReferencesOverflow stops the narrow node build when the leaf
+// triangle references do not fit int32, the build is restarted with the
+// wide index path.
+var errNarrowReferencesOverflow = errors.New(
+	"kdtree triangle references exceed the narrow index limit")
+
+func getBuildIndexSize(wideIndices bool) int64 {
+	if wideIndices {
+		return int64(unsafe.Sizeof(int64(0)))
+	}
+	return int64(unsafe.Sizeof(int32(0)))
+}
+
+const (
+	wideEdgeEndMask      uint64 = 1 << 63
+	wideEdgeTriangleMask uint64 = wideEdgeEndMask - 1
+)
+
+// wideBoundEdge is boundEdge of the wide index build.
+type wideBoundEdge struct {
+	positionOnAxis  float32
+	triangleAndFlag uint64
+}
+
+func (e wideBoundEdge) isStart() bool {
+	return e.triangleAndFlag&wideEdgeEndMask == 0
+}
+
+func (e wideBoundEdge) isEnd() bool {
+	return !e.isStart()
+}
+
+func (e wideBoundEdge) triangleIndex() int64 {
+	return int64(e.triangleAndFlag & wideEdgeTriangleMask)
+}
+
+// wideBoundEdgeSorter defines the same order as boundEdgeSorter.
+type wideBoundEdgeSorter []wideBoundEdge
+
+func (s wideBoundEdgeSorter) Len() int {
+	return len(s)
+}
+
+func (s wideBoundEdgeSorter) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
+
+func (s wideBoundEdgeSorter) Less(i, j int) bool {
+	if s[i].positionOnAxis == s[j].positionOnAxis {
+		return s[i].isEnd() && s[j].isStart()
+	} else {
+		return s[i].positionOnAxis < s[j].positionOnAxis
+	}
+}
+
+// canonicalWideBoundEdgeSorter defines the same order as
+// canonicalBoundEdgeSorter.
+type canonicalWideBoundEdgeSorter []wideBoundEdge
+
+func (s canonicalWideBoundEdgeSorter) Len() int {
+	return len(s)
+}
+
+func (s canonicalWideBoundEdgeSorter) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
+
+func (s canonicalWideBoundEdgeSorter) Less(i, j int) bool {
+	if s[i].positionOnAxis != s[j].positionOnAxis {
+		return s[i].positionOnAxis < s[j].positionOnAxis
+	}
+	if s[i].isEnd() != s[j].isEnd() {
+		return s[i].isEnd()
+	}
+	return s[i].triangleIndex() < s[j].triangleIndex()
+}
+
+// radixSortWideEdges is radixSortEdges for the default order of the wide
+// edges, the canonical order needs more than 64 key bits with the wide
+// triangle index.
+func radixSortWideEdges(edges, scratch []wideBoundEdge) {
+	src := edges
+	dst := scratch[:len(edges)]
+	key := func(e wideBoundEdge) uint64 {
+		return getPositionSortKey(e.positionOnAxis, e.isStart())
+	}
+
+	var counts [radixBuckets]int
+	for pass := uint(0); pass < radixPasses; pass++ {
+		shift := pass * radixBits
+
+		for i := range counts {
+			counts[i] = 0
+		}
+		for _, e := range src {
+			counts[(key(e)>>shift)&radixMask]++
+		}
+		if !radixOffsets(&counts, (key(src[0])>>shift)&radixMask, len(src)) {
+			continue
+		}
+		for _, e := range src {
+			digit := (key(e) >> shift) & radixMask
+			dst[counts[digit]] = e
+			counts[digit]++
+		}
+		src, dst = dst, src
+	}
+
+	if &src[0] != &edges[0] {
+		copy(edges, src)
+	}
+}
+
+func (builder *KdTreeBuilder) sortWideEdges(edges []wideBoundEdge) {
+	if len(edges) == 0 {
+		return
+	}
+	if builder.buildParams.CollectTimings {
+		start := time.Now()
+		defer func() {
+			builder.buildTimings.EdgeSort += time.Since(start)
+		}()
+	}
+	if builder.buildParams.CanonicalEdgeOrder {
+		// the order is total, the sort does not have to be stable
+		sort.Sort(canonicalWideBoundEdgeSorter(edges))
+	} else if builder.buildParams.UseRadixSort && len(edges) >= radixSortMinEdges {
+		radixSortWideEdges(edges, builder.wideEdgesScratchBuffer)
+	} else {
+		sort.Stable(wideBoundEdgeSorter(edges))
+	}
+}
+
+// ignoreWideIndexOptions resets the options that the wide index path does
+// not implement and returns the names of the options that differ from the
+// defaults.
+func ignoreWideIndexOptions(buildParams *BuildParams) []string {
+	var ignoredOptions []string
+	if _, ok := buildParams.SplitStrategy.(SAHSplit); buildParams.SplitStrategy != nil && !ok {
+		ignoredOptions = append(ignoredOptions, "SplitStrategy")
+	}
+	if buildParams.SAHBinCount > 0 {
+		ignoredOptions = append(ignoredOptions, "SAHBinCount")
+	}
+	options := []struct {
+		name  string
+		value *bool
+	}{
+		{"ClipTriangles", &buildParams.ClipTriangles},
+		{"PresortEdges", &buildParams.PresortEdges},
+		{"OptimizeTree", &buildParams.OptimizeTree},
+		{"CompactLargeLeaves", &buildParams.CompactLargeLeaves},
+	}
+	for _, option := range options {
+		if *option.value {
+			ignoredOptions = append(ignoredOptions, option.name)
+			*option.value = false
+		}
+	}
+	buildParams.SplitStrategy = SAHSplit{}
+	buildParams.SAHBinCount = 0
+	return ignoredOptions
+}
+
+// switchToWideIndices selects the wide index path for the next build,
+// the statistics of the stopped narrow build are discarded and the options
+// ignored by the wide index path are reported again.
+func (builder *KdTreeBuilder) switchToWideIndices() {
+	builder.wideIndices = true
+	var ignoredOptions []string
+	builder.buildParams, ignoredOptions = resolveBuildParams(builder.mesh,
+		builder.requestedBuildParams, true)
+	builder.buildStats = BuildStats{
+		enabled:        builder.buildStats.enabled,
+		WideIndices:    true,
+		IgnoredOptions: ignoredOptions,
+	}
+}
+
+// buildWideKdTree is the wide index variant of BuildKdTreeContext after the
+// triangle bounds are computed. The nodes are built by buildNodes with
+// buildWideNode, they are the same as the narrow build creates with the
+// same options, only the leaves reference the triangles through the wide
+// leaf offsets.
+func (builder *KdTreeBuilder) buildWideKdTree(meshBounds BBox32,
+	timer *phaseTimer) (*KdTree, error) {
+	trianglesCount := len(builder.triangleBounds)
+
+	// initialize working memory
+	builder.splitBounds = builder.triangleBounds
+	builder.wideEdgesBuffer = make([]wideBoundEdge, 2*trianglesCount)
+	if builder.buildParams.UseRadixSort {
+		builder.wideEdgesScratchBuffer = make([]wideBoundEdge, 2*trianglesCount)
+	}
+	trianglesBufferSize := trianglesCount * (builder.buildParams.MaxDepth + 1)
+	builder.wideTrianglesBuffer = make([]int64, trianglesBufferSize)
+
+	builder.nodes = nil
+	builder.nodeChunks = newNodeChunks(builder.buildParams.ExpectedNodes, trianglesCount)
+	builder.wideLeafOffsets = nil
+	builder.wideTriangleIndices = make([]int64, 0, trianglesCount)
+
+	// fill triangle indices for root node
+	rootTriangles := builder.wideTrianglesBuffer[0:trianglesCount]
+	for i := range rootTriangles {
+		rootTriangles[i] = int64(i)
+	}
+	if builder.buildParams.ShuffleSeed != 0 {
+		shuffle(len(rootTriangles), builder.buildParams.ShuffleSeed, func(i, k int) {
+			rootTriangles[i], rootTriangles[k] = rootTriangles[k], rootTriangles[i]
+		})
+	}
+	timer.endPhase(&builder.buildTimings.BuffersInit)
+
+	// build all nodes
+	builder.buildNodes(buildTask{
+		nodeBounds:        meshBounds,
+		wideNodeTriangles: rootTriangles,
+		depth:             builder.buildParams.MaxDepth,
+		offset0:           0,
+		offset1:           trianglesCount,
+		parentNode:        -1,
+	})
+	timer.endPhase(&builder.buildTimings.NodesBuild)
+	if builder.buildStats.enabled {
+		builder.buildStats.PeakWorkingBytes = builder.getWorkingMemoryBytes()
+	}
+
+	// there are no post-build passes that need the buffers
+	builder.splitBounds = nil
+	builder.wideEdgesBuffer = nil
+	builder.wideEdgesScratchBuffer = nil
+	builder.wideTrianglesBuffer = nil
+	builder.nodes = builder.nodeChunks.flatten()
+	builder.nodeChunks = nil
+	if builder.cancelErr != nil {
+		builder.triangleBounds = nil
+		builder.nodes = nil
+		builder.wideLeafOffsets = nil
+		builder.wideTriangleIndices = nil
+		return nil, builder.cancelErr
+	}
+
+	builder.finishBuildStats(meshBounds,
+		int64(len(builder.wideLeafOffsets)+len(builder.wideTriangleIndices))*
+			int64(unsafe.Sizeof(int64(0))))
+	return &KdTree{
+		nodes:               builder.nodes,
+		mesh:                builder.mesh,
+		meshBounds:          NewBBox64FromBBox32(meshBounds),
+		wide:                true,
+		wideLeafOffsets:     builder.wideLeafOffsets,
+		wideTriangleIndices: builder.wideTriangleIndices,
+		droppedTriangles:    builder.droppedTriangles,
+	}, nil
+}
+
+// buildWideNode is buildNode of the wide index build with the exact SAH
+// split, the node decisions and the split costs are shared with buildNode.
+func (builder *KdTreeBuilder) buildWideNode(task *buildTask, pendingTasks int) (below,
+	above buildTask, isInterior bool) {
+	nodeTriangles := task.wideNodeTriangles
+	offset0, offset1 := task.offset0, task.offset1
+
+	if builder.isCancelled(len(nodeTriangles)) {
+		return
+	}
+	if builder.isLeafNode(len(nodeTriangles), task.depth, pendingTasks) {
+		builder.appendLeaf(builder.newWideLeaf(nodeTriangles), len(nodeTriangles),
+			task.depth)
+		return
+	}
+
+	// select split position
+	split := builder.selectWideSplit(task.nodeBounds, nodeTriangles,
+		builder.getEmptyBonus(task.depth))
+	if split.edge == -1 {
+		builder.buildStats.failedSplit()
+		builder.appendLeaf(builder.newWideLeaf(nodeTriangles), len(nodeTriangles),
+			task.depth)
+		return
+	}
+
+	// classify triangles with respect to split, see buildNode
+	edges := builder.wideEdgesBuffer[:2*len(nodeTriangles)]
+	splitPosition := edges[split.edge].positionOnAxis
+	var n0, n1 int
+	for i := 0; i < split.edge; i++ {
+		if edges[i].isStart() {
+			builder.wideTrianglesBuffer[offset0+n0] = edges[i].triangleIndex()
+			n0++
+		}
+	}
+	for i := split.edge + 1; i < len(edges); i++ {
+		if edges[i].isEnd() {
+			builder.wideTrianglesBuffer[offset1+n1] = edges[i].triangleIndex()
+			n1++
+		}
+	}
+	for i := split.edge; i < len(edges) && edges[i].positionOnAxis == splitPosition; i++ {
+		if edges[i].isStart() {
+			builder.recordDroppedTriangle(int32(edges[i].triangleIndex()), split.axis,
+				splitPosition)
+		}
+	}
+
+	below, above = builder.newChildTasks(task, split.axis, splitPosition, n0, n1)
+	return below, above, true
+}
+
+// newWideLeaf is newLeaf of the wide index build.
+func (builder *KdTreeBuilder) newWideLeaf(nodeTriangles []int64) node {
+	var n node
+	if len(nodeTriangles) == 0 {
+		n.initEmptyLeaf()
+		return n
+	}
+	if len(nodeTriangles) > maxLeafTrianglesCount {
+		common.RuntimeError(fmt.Sprintf(
+			"exceeded the maximum number of kdtree leaf triangles: %d, leaf triangles count: %d",
+			maxLeafTrianglesCount, len(nodeTriangles)))
+	}
+	n.initWideLeaf(int32(len(nodeTriangles)), int32(len(builder.wideLeafOffsets)))
+	builder.wideLeafOffsets = append(builder.wideLeafOffsets,
+		int64(len(builder.wideTriangleIndices)))
+	builder.wideTriangleIndices = append(builder.wideTriangleIndices, nodeTriangles...)
+	return n
+}
+
+func (builder *KdTreeBuilder) initWideEdgePairs(nodeTriangles []int64, axis int) {
+	for i, triangle := range nodeTriangles {
+		builder.wideEdgesBuffer[2*i+0] = wideBoundEdge{
+			builder.triangleBounds[triangle].minPoint[axis],
+			uint64(triangle) | 0}
+
+		builder.wideEdgesBuffer[2*i+1] = wideBoundEdge{
+			builder.triangleBounds[triangle].maxPoint[axis],
+			uint64(triangle) | wideEdgeEndMask}
+	}
+}
+
+// selectWideSplit is selectSplit of the wide index build.
+func (builder *KdTreeBuilder) selectWideSplit(nodeBounds BBox32,
+	nodeTriangles []int64, emptyBonus float32) split {
+	edges := builder.wideEdgesBuffer[0 : len(nodeTriangles)*2]
+	bestSplit, lastAxis := builder.selectSplitOverAxes(nodeBounds, func(axis int) split {
+		builder.initWideEdgePairs(nodeTriangles, axis)
+		builder.sortWideEdges(edges)
+		return builder.selectBalancedSplit(func(maxTieCost float32) split {
+			return builder.findWideSplitForAxis(edges, nodeBounds, axis, emptyBonus,
+				maxTieCost)
+		})
+	})
+
+	// the edges of the split axis are used by the classification
+	if bestSplit.edge != -1 && bestSplit.axis != lastAxis {
+		builder.initWideEdgePairs(nodeTriangles, bestSplit.axis)
+		builder.sortWideEdges(edges)
+	}
+	return bestSplit
+}
+
+// findWideSplitForAxis is findSplitForAxis of the wide index build, the
+// groups of edges are evaluated by the same splitSweep.
+func (builder *KdTreeBuilder) findWideSplitForAxis(edges []wideBoundEdge,
+	nodeBounds BBox32, axis int, emptyBonus float32, maxTieCost float32) split {
+	nodeTrianglesCount := len(edges) / 2
+	sweep := builder.newSplitSweep(nodeBounds, nodeTrianglesCount, axis,
+		emptyBonus, maxTieCost)
+	numBelow := 0
+	numAbove := nodeTrianglesCount
+
+	for i := 0; i < len(edges); {
+		edge := edges[i]
+		groupEnd := i + 1
+		for groupEnd < len(edges) &&
+			edge.positionOnAxis == edges[groupEnd].positionOnAxis {
+			groupEnd++
+		}
+		middleEdge := i
+		for middleEdge != groupEnd && edges[middleEdge].isEnd() {
+			middleEdge++
+		}
+
+		numAbove -= middleEdge - i
+		sweep.addSplit(edge.positionOnAxis, numBelow, numAbove, middleEdge, groupEnd)
+		numBelow += groupEnd - middleEdge
+		i = groupEnd
+	}
+	return sweep.bestSplit
+}
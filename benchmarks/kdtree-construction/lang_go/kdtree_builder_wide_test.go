@@ -0,0 +1,278 @@
+package main
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// setNarrowIndexLimits lowers the limits of the narrow index build, so the
+// builder selects the wide index path for small meshes.
+func setNarrowIndexLimits(t *testing.T, trianglesCount, triangleReferences int) {
+	t.Helper()
+	savedTrianglesCount := maxNarrowTrianglesCount
+	savedTriangleReferences := maxNarrowTriangleReferences
+	maxNarrowTrianglesCount = trianglesCount
+	maxNarrowTriangleReferences = triangleReferences
+	t.Cleanup(func() {
+		maxNarrowTrianglesCount = savedTrianglesCount
+		maxNarrowTriangleReferences = savedTriangleReferences
+	})
+}
+
+// checkWideKdTreeMatches checks that the wide index tree has the nodes of
+// the narrow tree and the same triangles in every leaf.
+func checkWideKdTreeMatches(t *testing.T, name string, wideKdTree, kdTree *KdTree) {
+	t.Helper()
+	if !wideKdTree.wide || kdTree.wide {
+		t.Fatalf("%s: tree is wide: %v, reference tree is wide: %v", name,
+			wideKdTree.wide, kdTree.wide)
+	}
+	if len(wideKdTree.nodes) != len(kdTree.nodes) {
+		t.Fatalf("%s: wide tree has %d nodes, expected %d", name,
+			len(wideKdTree.nodes), len(kdTree.nodes))
+	}
+	for i, n := range kdTree.nodes {
+		wideNode := wideKdTree.nodes[i]
+		if n.isInteriorNode() {
+			if wideNode != n {
+				t.Fatalf("%s: node %d is %v, expected %v", name, i, wideNode, n)
+			}
+			continue
+		}
+		if !wideNode.isLeaf() || wideNode.trianglesCount() != n.trianglesCount() {
+			t.Fatalf("%s: node %d is %v, expected leaf with %d triangles", name, i,
+				wideNode, n.trianglesCount())
+		}
+		triangles := wideKdTree.appendLeafTriangles(nil, wideNode)
+		if expected := kdTree.appendLeafTriangles(nil, n); !reflect.DeepEqual(triangles, expected) {
+			t.Fatalf("%s: leaf %d triangles are %v, expected %v", name, i, triangles,
+				expected)
+		}
+	}
+	if err := wideKdTree.Validate(); err != nil {
+		t.Errorf("%s: %v", name, err)
+	}
+}
+
+func TestWideIndexBuildMatchesNarrowBuild(t *testing.T) {
+	mesh := LoadTriangleMesh(teapotStl)
+	variants := []struct {
+		name      string
+		configure func(buildParams *BuildParams)
+	}{
+		{"default", func(buildParams *BuildParams) {}},
+		{"comparison sort", func(buildParams *BuildParams) { buildParams.UseRadixSort = false }},
+		{"canonical order", func(buildParams *BuildParams) { buildParams.CanonicalEdgeOrder = true }},
+		{"balance tie break", func(buildParams *BuildParams) { buildParams.BalanceTieBreak = true }},
+		{"longest axis", func(buildParams *BuildParams) { buildParams.SplitAlongTheLongestAxis = true }},
+		{"shuffle", func(buildParams *BuildParams) { buildParams.ShuffleSeed = 7 }},
+		{"node budget", func(buildParams *BuildParams) { buildParams.MaxNodes = 500 }},
+	}
+	for _, variant := range variants {
+		t.Run(variant.name, func(t *testing.T) {
+			buildParams := NewBuildParams()
+			variant.configure(&buildParams)
+			builder := NewKdTreeBuilder(mesh, buildParams)
+			kdTree := builder.BuildKdTree()
+			stats := builder.GetBuildStats()
+
+			setNarrowIndexLimits(t, 0, maxNarrowTriangleReferences)
+			wideBuilder := NewKdTreeBuilder(mesh, buildParams)
+			wideKdTree := wideBuilder.BuildKdTree()
+			checkWideKdTreeMatches(t, variant.name, wideKdTree, kdTree)
+			wideStats := wideBuilder.GetBuildStats()
+			if wideStats.LeafCount != stats.LeafCount ||
+				wideStats.FailedSplitCount != stats.FailedSplitCount ||
+				wideStats.NodeBudgetLeafCount != stats.NodeBudgetLeafCount ||
+				wideStats.AverageDepth != stats.AverageDepth {
+				t.Errorf("wide build stats %+v differ from %+v", wideStats, stats)
+			}
+		})
+	}
+
+	// the options that the wide path does not implement are ignored and
+	// reported
+	setNarrowIndexLimits(t, 0, maxNarrowTriangleReferences)
+	buildParams := NewBuildParams()
+	buildParams.SAHBinCount = 16
+	buildParams.OptimizeTree = true
+	builder := NewKdTreeBuilder(mesh, buildParams)
+	resolvedParams := builder.GetBuildParams()
+	if _, ok := resolvedParams.SplitStrategy.(SAHSplit); !ok || resolvedParams.OptimizeTree {
+		t.Errorf("wide build uses split strategy %T and optimization %v",
+			resolvedParams.SplitStrategy, resolvedParams.OptimizeTree)
+	}
+	stats := builder.GetBuildStats()
+	if expected := []string{"SAHBinCount", "OptimizeTree"}; !stats.WideIndices ||
+		!reflect.DeepEqual(stats.IgnoredOptions, expected) {
+		t.Errorf("wide build stats report wide indices %v and ignored options %v, "+
+			"expected %v", stats.WideIndices, stats.IgnoredOptions, expected)
+	}
+	buildParams = NewBuildParams()
+	buildParams.SplitStrategy = SpatialMedianSplit{}
+	buildParams.ClipTriangles = true
+	buildParams.PresortEdges = true
+	buildParams.CompactLargeLeaves = true
+	expected := []string{"SplitStrategy", "ClipTriangles", "PresortEdges",
+		"CompactLargeLeaves"}
+	if ignored := NewKdTreeBuilder(mesh, buildParams).GetBuildStats().IgnoredOptions; !reflect.DeepEqual(ignored, expected) {
+		t.Errorf("ignored options are %v, expected %v", ignored, expected)
+	}
+	if ignored := NewKdTreeBuilder(mesh, NewBuildParams()).GetBuildStats().IgnoredOptions; ignored != nil {
+		t.Errorf("the default options are reported as ignored: %v", ignored)
+	}
+}
+
+func TestWideIndexBuildIntersect(t *testing.T) {
+	mesh := LoadTriangleMesh(teapotStl)
+	kdTree := NewKdTreeBuilder(mesh, NewBuildParams()).BuildKdTree()
+	setNarrowIndexLimits(t, 0, maxNarrowTriangleReferences)
+	wideKdTree := NewKdTreeBuilder(mesh, NewBuildParams()).BuildKdTree()
+
+	camera := NewCameraForBounds(kdTree.meshBounds)
+	const width, height = 32, 32
+	hitsCount := 0
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			ray := camera.GenerateRay(x, y, width, height)
+			hitFound, intersection := kdTree.Intersect(&ray)
+			wideHitFound, wideIntersection := wideKdTree.Intersect(&ray)
+			if wideHitFound != hitFound || wideIntersection != intersection {
+				t.Fatalf("pixel (%d, %d): wide tree hit %v %+v, expected %v %+v", x, y,
+					wideHitFound, wideIntersection, hitFound, intersection)
+			}
+			if hitFound {
+				hitsCount++
+			}
+			all := kdTree.IntersectAll(&ray, 0, intersection.t*2)
+			if wideAll := wideKdTree.IntersectAll(&ray, 0, intersection.t*2); !reflect.DeepEqual(wideAll, all) {
+				t.Fatalf("pixel (%d, %d): wide tree intersections %v, expected %v", x, y,
+					wideAll, all)
+			}
+		}
+	}
+	if hitsCount == 0 {
+		t.Fatalf("no rays hit the mesh")
+	}
+
+	// refit keeps the tree wide and distributes the triangles as for the
+	// narrow tree
+	vertices := append([]Vector32(nil), mesh.vertices...)
+	for i := range vertices {
+		vertices[i][2] += 0.1 * vertices[i][0]
+	}
+	mesh.SetVertices(vertices)
+	kdTree.Refit()
+	wideKdTree.Refit()
+	checkWideKdTreeMatches(t, "refit", wideKdTree, kdTree)
+}
+
+func TestWideIndexBuildAfterReferencesOverflow(t *testing.T) {
+	mesh := LoadTriangleMesh(teapotStl)
+	buildParams := NewBuildParams()
+	builder := NewKdTreeBuilder(mesh, buildParams)
+	kdTree := builder.BuildKdTree()
+	stats := builder.GetBuildStats()
+
+	// the narrow build is stopped when the leaf triangles do not fit the
+	// references limit and the tree is built again with wide indices
+	setNarrowIndexLimits(t, maxNarrowTrianglesCount, len(kdTree.triangleIndices)/2)
+	wideBuilder := NewKdTreeBuilder(mesh, buildParams)
+	wideKdTree := wideBuilder.BuildKdTree()
+	checkWideKdTreeMatches(t, "references overflow", wideKdTree, kdTree)
+	if wideStats := wideBuilder.GetBuildStats(); wideStats.LeafCount != stats.LeafCount {
+		t.Errorf("wide build has %d leaves, expected %d", wideStats.LeafCount,
+			stats.LeafCount)
+	}
+	if wideBuilder.GetBuildStats().PeakWorkingBytes == 0 {
+		t.Errorf("wide build working memory is not measured")
+	}
+
+	// the options are reported after the restart of the build
+	buildParams.OptimizeTree = true
+	wideBuilder = NewKdTreeBuilder(mesh, buildParams)
+	if wideStats := wideBuilder.GetBuildStats(); wideStats.WideIndices ||
+		wideStats.IgnoredOptions != nil {
+		t.Errorf("narrow build reports wide indices %v and ignored options %v",
+			wideStats.WideIndices, wideStats.IgnoredOptions)
+	}
+	wideBuilder.BuildKdTree()
+	if wideStats := wideBuilder.GetBuildStats(); !wideStats.WideIndices ||
+		!reflect.DeepEqual(wideStats.IgnoredOptions, []string{"OptimizeTree"}) {
+		t.Errorf("restarted build reports wide indices %v and ignored options %v",
+			wideStats.WideIndices, wideStats.IgnoredOptions)
+	}
+}
+
+func TestWideKdTreeFile(t *testing.T) {
+	mesh := LoadTriangleMesh(teapotStl)
+	kdTree := NewKdTreeBuilder(mesh, NewBuildParams()).BuildKdTree()
+	setNarrowIndexLimits(t, 0, maxNarrowTriangleReferences)
+	wideKdTree := NewKdTreeBuilder(mesh, NewBuildParams()).BuildKdTree()
+	if wideKdTree.GetHash() == kdTree.GetHash() {
+		t.Errorf("wide tree has the hash of the narrow tree: %#x", kdTree.GetHash())
+	}
+
+	dir := t.TempDir()
+	fileName := filepath.Join(dir, "teapot.kdtree")
+	if err := wideKdTree.saveToFile(fileName); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if magic := binary.LittleEndian.Uint32(data); magic != wideKdTreeFileMagic {
+		t.Errorf("file starts with %#x, expected wide file magic", magic)
+	}
+	if version := binary.LittleEndian.Uint32(data[4:]); version != wideKdTreeFileVersion {
+		t.Errorf("file version is %d, expected %d", version, wideKdTreeFileVersion)
+	}
+	if size := wideKdTree.SizeInBytes() + 8 + 3*8; size != int64(len(data)) {
+		t.Errorf("file size is %d, expected %d", len(data), size)
+	}
+
+	loadedKdTree, err := loadKdTree(fileName, mesh)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !loadedKdTree.wide || loadedKdTree.GetHash() != wideKdTree.GetHash() {
+		t.Errorf("loaded tree is wide: %v, hash %#x, expected hash %#x",
+			loadedKdTree.wide, loadedKdTree.GetHash(), wideKdTree.GetHash())
+	}
+	checkWideKdTreeMatches(t, "loaded", loadedKdTree, kdTree)
+
+	// the legacy file of the same tree is still detected
+	legacyFileName := filepath.Join(dir, "legacy.kdtree")
+	if err := kdTree.saveToFile(legacyFileName); err != nil {
+		t.Fatal(err)
+	}
+	if legacyKdTree, err := loadKdTree(legacyFileName, mesh); err != nil ||
+		legacyKdTree.wide || legacyKdTree.GetHash() != kdTree.GetHash() {
+		t.Errorf("legacy file is not loaded as the narrow tree: %v", err)
+	}
+
+	binary.LittleEndian.PutUint32(data[4:], wideKdTreeFileVersion+1)
+	unsupportedFileName := filepath.Join(dir, "unsupported.kdtree")
+	if err := os.WriteFile(unsupportedFileName, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	_, err = loadKdTree(unsupportedFileName, mesh)
+	if err == nil || !strings.Contains(err.Error(), "unsupported wide kdtree file version") {
+		t.Errorf("unexpected error for the next file version: %v", err)
+	}
+
+	// the leaf offset is out of range
+	corrupted := &KdTree{nodes: wideKdTree.nodes, mesh: mesh,
+		meshBounds: wideKdTree.meshBounds, wide: true,
+		wideLeafOffsets:     wideKdTree.wideLeafOffsets[:1],
+		wideTriangleIndices: wideKdTree.wideTriangleIndices}
+	if err := corrupted.Verify(); err == nil ||
+		!strings.Contains(err.Error(), "leaf offset index") {
+		t.Errorf("unexpected error for the truncated leaf offsets: %v", err)
+	}
+}
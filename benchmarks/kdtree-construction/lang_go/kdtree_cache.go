@@ -0,0 +1,30 @@
+package main
+
+// LoadOrBuildKdTree loads the mesh and the kdtree from the cache file. If
+// the cache is missing or stale then the kdtree is built with the given
+// parameters and saved to the cache file.
+//
+// The kdtree file format does not store build parameters or the mesh
+// identity, so the cache is considered stale if it is older than the mesh
+// file, can't be read or does not pass KdTree.Verify for the loaded mesh.
+// The cache should be removed manually when build parameters change.
+func LoadOrBuildKdTree(meshPath, cachePath string,
+	buildParams BuildParams) (*KdTree, error) {
+	mesh, err := LoadMesh(meshPath)
+	if err != nil {
+		return nil, err
+	}
+
+	if isCacheUpToDate(meshPath, cachePath) {
+		kdTree, err := loadKdTree(cachePath, mesh)
+		if err == nil && kdTree.Verify() == nil {
+			return kdTree, nil
+		}
+	}
+
+	kdTree := NewKdTreeBuilder(mesh, buildParams).BuildKdTree()
+	if err := kdTree.saveToFile(cachePath); err != nil {
+		return nil, err
+	}
+	return kdTree, nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLoadOrBuildKdTree(t *testing.T) {
+	dir := t.TempDir()
+	meshPath := filepath.Join(dir, "teapot.stl")
+	cachePath := filepath.Join(dir, "teapot.kdtree")
+	data, err := os.ReadFile(teapotStl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(meshPath, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	mesh := LoadTriangleMesh(meshPath)
+	buildParams := NewBuildParams()
+	expectedHash := NewKdTreeBuilder(mesh, buildParams).BuildKdTree().GetHash()
+
+	// the cache built with other parameters is distinguishable from the
+	// kdtree built by LoadOrBuildKdTree
+	otherBuildParams := NewBuildParams()
+	otherBuildParams.LeafTrianglesLimit = 8
+	otherKdTree := NewKdTreeBuilder(mesh, otherBuildParams).BuildKdTree()
+	if otherKdTree.GetHash() == expectedHash {
+		t.Fatal("kdtrees built with different parameters are the same")
+	}
+
+	loadOrBuild := func(name string) uint64 {
+		t.Helper()
+		kdTree, err := LoadOrBuildKdTree(meshPath, cachePath, buildParams)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if _, err := os.Stat(cachePath); err != nil {
+			t.Fatalf("%s: cache file is not written: %v", name, err)
+		}
+		return kdTree.GetHash()
+	}
+
+	// miss: the kdtree is built and saved
+	if hash := loadOrBuild("miss"); hash != expectedHash {
+		t.Errorf("miss: kdtree hash is %x, expected %x", hash, expectedHash)
+	}
+	if cachedKdTree, err := loadKdTree(cachePath, mesh); err != nil ||
+		cachedKdTree.GetHash() != expectedHash {
+		t.Errorf("miss: the cache does not contain the built kdtree: %v", err)
+	}
+
+	// hit: the cache is used as is
+	if err := otherKdTree.saveToFile(cachePath); err != nil {
+		t.Fatal(err)
+	}
+	if hash := loadOrBuild("hit"); hash != otherKdTree.GetHash() {
+		t.Errorf("hit: kdtree hash is %x, expected the cached kdtree %x", hash,
+			otherKdTree.GetHash())
+	}
+
+	// stale: the mesh is modified after the cache was written
+	future := time.Now().Add(time.Hour)
+	if err := os.Chtimes(meshPath, future, future); err != nil {
+		t.Fatal(err)
+	}
+	if hash := loadOrBuild("stale"); hash != expectedHash {
+		t.Errorf("stale: kdtree hash is %x, expected rebuilt kdtree %x", hash,
+			expectedHash)
+	}
+
+	// broken: the cache is newer than the mesh but can't be loaded
+	if err := os.WriteFile(cachePath, []byte{1, 2, 3}, 0644); err != nil {
+		t.Fatal(err)
+	}
+	later := future.Add(time.Hour)
+	if err := os.Chtimes(cachePath, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if hash := loadOrBuild("broken"); hash != expectedHash {
+		t.Errorf("broken: kdtree hash is %x, expected rebuilt kdtree %x", hash,
+			expectedHash)
+	}
+}
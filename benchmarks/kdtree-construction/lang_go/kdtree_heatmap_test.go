@@ -0,0 +1,51 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestGetTriangleTestsHeatmap(t *testing.T) {
+	mesh := LoadTriangleMesh(teapotStl)
+	kdTree := NewKdTreeBuilder(mesh, NewBuildParams()).BuildKdTree()
+	camera := NewCameraForBounds(kdTree.meshBounds)
+	const width, height = 32, 32
+	heatmap := kdTree.GetTriangleTestsHeatmap(&camera, width, height)
+
+	if len(heatmap) != height {
+		t.Fatalf("heatmap has %d rows, expected %d", len(heatmap), height)
+	}
+	// rays that hit the mesh perform triangle tests, rays that miss the
+	// mesh bounds and go into the empty space perform none
+	hitCount, emptyCount := 0, 0
+	for y := 0; y < height; y++ {
+		if len(heatmap[y]) != width {
+			t.Fatalf("heatmap row %d has %d values, expected %d", y, len(heatmap[y]), width)
+		}
+		for x := 0; x < width; x++ {
+			ray := camera.GenerateRay(x, y, width, height)
+			if hit, _ := kdTree.Intersect(&ray); hit {
+				hitCount++
+				if heatmap[y][x] == 0 {
+					t.Errorf("pixel (%d, %d): the ray hits the mesh without triangle tests",
+						x, y)
+				}
+				continue
+			}
+			if _, _, hitBounds := kdTree.meshBounds.Intersect(&ray); !hitBounds {
+				emptyCount++
+				if heatmap[y][x] != 0 {
+					t.Errorf("pixel (%d, %d): %d triangle tests for the ray that misses "+
+						"the mesh bounds", x, y, heatmap[y][x])
+				}
+			}
+		}
+	}
+	if hitCount == 0 || emptyCount == 0 {
+		t.Fatalf("%d rays hit the mesh and %d rays miss the mesh bounds, "+
+			"expected both kinds", hitCount, emptyCount)
+	}
+	// the center pixel looks at the teapot body
+	if center := heatmap[height/2][width/2]; center == 0 {
+		t.Errorf("no triangle tests for the center pixel")
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"math"
+	"sync"
+	"sync/atomic"
+)
+
+// LazyKdTree builds only the top levels of the kdtree eagerly. Leaves of
+// the top tree that reach the eager depth and have more than
+// LeafTrianglesLimit triangles are lazy: their triangles are stored and the
+// subtree is built on the first traversal that reaches the leaf. The build
+// latency is traded for slower first rays, which suits workloads that need
+// the first image quickly or touch only a part of the scene.
+type LazyKdTree struct {
+	top         *KdTree
+	buildParams BuildParams
+
+	// subtrees of lazy leaves by leaf node index of the top tree, the map
+	// is not modified after the build
+	subtrees      map[int32]*lazySubtree
+	expandedCount int32 // accessed atomically
+}
+
+type lazySubtree struct {
+	once      sync.Once
+	triangles []int32 // triangle indices of the original mesh
+	depth     int     // depth of the lazy leaf in the top tree
+	kdTree    *KdTree // built for the cell mesh, see expand
+}
+
+// BuildLazyKdTree builds the top tree up to eagerDepth levels with the
+// given parameters. The same parameters are used for the lazy subtrees.
+func BuildLazyKdTree(mesh *TriangleMesh, buildParams BuildParams,
+	eagerDepth int) *LazyKdTree {
+	if eagerDepth < 0 {
+		eagerDepth = 0
+	}
+	// the leaf triangles are addressed by the top tree leaves
+	buildParams.CompactLargeLeaves = false
+	topBuildParams := buildParams
+	topBuildParams.MaxDepth = eagerDepth
+	if eagerDepth == 0 {
+		// zero MaxDepth selects the depth automatically
+		topBuildParams.LeafTrianglesLimit = math.MaxInt32
+		topBuildParams.LeafTrianglesLimitFn = nil
+	}
+
+	tree := &LazyKdTree{
+		top:         NewKdTreeBuilder(mesh, topBuildParams).BuildKdTree(),
+		buildParams: buildParams,
+		subtrees:    make(map[int32]*lazySubtree),
+	}
+
+	type nodeInfo struct {
+		index int32
+		depth int
+	}
+	stack := []nodeInfo{{0, 0}}
+	for len(stack) > 0 {
+		info := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		n := tree.top.nodes[info.index]
+
+		if n.isInteriorNode() {
+			stack = append(stack, nodeInfo{n.aboveChild(), info.depth + 1})
+			stack = append(stack, nodeInfo{info.index + 1, info.depth + 1})
+		} else if info.depth >= eagerDepth && n.trianglesCount() > 1 &&
+			int(n.trianglesCount()) > buildParams.getLeafTrianglesLimit(info.depth) {
+			tree.subtrees[info.index] = &lazySubtree{
+				triangles: tree.top.appendLeafTriangles(nil, n),
+				depth:     info.depth,
+			}
+		}
+	}
+	return tree
+}
+
+// expand builds the subtree for the cell mesh that shares vertices with
+// the original mesh.
+func (subtree *lazySubtree) expand(tree *LazyKdTree) *KdTree {
+	subtree.once.Do(func() {
+		mesh := tree.top.mesh
+		cellMesh := &TriangleMesh{
+			vertices:  mesh.vertices,
+			triangles: make([][3]int32, len(subtree.triangles)),
+		}
+		for i, triangleIndex := range subtree.triangles {
+			cellMesh.triangles[i] = mesh.triangles[triangleIndex]
+		}
+		buildParams := tree.buildParams
+		buildParams.CollectStats = false
+		buildParams.ProgressFn = nil // subtrees can be built concurrently
+		if leafTrianglesLimitFn := buildParams.LeafTrianglesLimitFn; leafTrianglesLimitFn != nil {
+			// the subtree root is at the depth of the lazy leaf
+			buildParams.LeafTrianglesLimitFn = func(depth int) int {
+				return leafTrianglesLimitFn(subtree.depth + depth)
+			}
+		}
+		subtree.kdTree = NewKdTreeBuilder(cellMesh, buildParams).BuildKdTree()
+		atomic.AddInt32(&tree.expandedCount, 1)
+	})
+	return subtree.kdTree
+}
+
+// GetLazySubtreesCount returns the number of lazy leaves of the top tree.
+func (tree *LazyKdTree) GetLazySubtreesCount() int {
+	return len(tree.subtrees)
+}
+
+// GetExpandedSubtreesCount returns the number of lazy subtrees built so
+// far. It is safe to call it concurrently with Intersect.
+func (tree *LazyKdTree) GetExpandedSubtreesCount() int {
+	return int(atomic.LoadInt32(&tree.expandedCount))
+}
+
+// ExpandAll builds all lazy subtrees that are not built yet.
+func (tree *LazyKdTree) ExpandAll() {
+	for _, subtree := range tree.subtrees {
+		subtree.expand(tree)
+	}
+}
+
+// GetNodesCount returns the number of nodes of the top tree and the
+// subtrees built so far.
+func (tree *LazyKdTree) GetNodesCount() int {
+	nodesCount := len(tree.top.nodes)
+	for _, subtree := range tree.subtrees {
+		if subtree.kdTree != nil {
+			nodesCount += len(subtree.kdTree.nodes)
+		}
+	}
+	return nodesCount
+}
+
+// Intersect walks the leaves of the top tree and builds lazy subtrees
+// reached by the ray. The subtree contains whole triangles that can extend
+// outside of the leaf, so the hit is accepted when it is not farther than
+// the end of the ray segment inside the current leaf. It is safe to call
+// Intersect concurrently.
+func (tree *LazyKdTree) Intersect(ray *Ray) (bool, KdTreeIntersection) {
+	closestIntersection := TriangleIntersection{t: math.Inf(+1)}
+
+	tree.top.walkLeaves(ray, 0, math.Inf(+1), func(leafIndex int32, tLeafMax float64) bool {
+		if subtree := tree.subtrees[leafIndex]; subtree != nil {
+			hitFound, intersection := subtree.expand(tree).Intersect(ray)
+			if hitFound && intersection.t < closestIntersection.t {
+				closestIntersection = TriangleIntersection{
+					t:             intersection.t,
+					epsilon:       intersection.epsilon,
+					b1:            intersection.b1,
+					b2:            intersection.b2,
+					triangleIndex: subtree.triangles[intersection.triangleIndex],
+				}
+			}
+		} else {
+			tree.top.IntersectLeafTriangles(ray, tree.top.nodes[leafIndex],
+				&closestIntersection)
+		}
+		return closestIntersection.t <= tLeafMax
+	})
+
+	if closestIntersection.t == math.Inf(+1) {
+		return false, KdTreeIntersection{t: math.Inf(+1)}
+	}
+	return true, KdTreeIntersection{
+		t:             closestIntersection.t,
+		epsilon:       closestIntersection.epsilon,
+		b1:            closestIntersection.b1,
+		b2:            closestIntersection.b2,
+		triangleIndex: closestIntersection.triangleIndex,
+		materialID:    tree.top.mesh.GetMaterialID(closestIntersection.triangleIndex),
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"sort"
+)
+
+// compactLargeLeaves rebuilds the tree so that leaves with more than
+// CompactLeafTrianglesLimit triangles are split further using median split.
+// Large leaves appear because triangles that straddle split planes are
+// duplicated into both children. The total depth is still limited by
+// MaxDepth, so traversal stack size is not exceeded.
+func (builder *KdTreeBuilder) compactLargeLeaves(meshBounds BBox32) {
+	oldNodes := builder.nodes
+	oldTriangleIndices := builder.triangleIndices
+
+	builder.nodes = make([]node, 0, len(oldNodes))
+	builder.triangleIndices = make([]int32, 0, len(oldTriangleIndices))
+
+	// leaf statistics are collected again for the new layout
+	builder.buildStats.resetLeafStats()
+
+	builder.copyNode(oldNodes, oldTriangleIndices, 0, meshBounds, 0)
+}
+
+func (builder *KdTreeBuilder) copyNode(oldNodes []node,
+	oldTriangleIndices []int32, nodeIndex int32, nodeBounds BBox32, depth int) {
+	n := oldNodes[nodeIndex]
+
+	if n.isLeaf() {
+		var triangles []int32
+		switch n.trianglesCount() {
+		case 0:
+		case 1:
+			triangles = []int32{n.index()}
+		default:
+			triangles = append(triangles,
+				oldTriangleIndices[n.index():n.index()+n.trianglesCount()]...)
+		}
+		builder.splitLeaf(triangles, nodeBounds, depth)
+		return
+	}
+
+	axis := n.splitAxis()
+	splitPosition := n.splitPosition()
+
+	thisNodeIndex := len(builder.nodes)
+	builder.nodes = append(builder.nodes, node{})
+
+	bounds0 := nodeBounds
+	bounds0.maxPoint[axis] = splitPosition
+	builder.copyNode(oldNodes, oldTriangleIndices, nodeIndex+1, bounds0, depth+1)
+
+	builder.nodes[thisNodeIndex].initInteriorNode(axis,
+		int32(len(builder.nodes)), splitPosition)
+
+	bounds1 := nodeBounds
+	bounds1.minPoint[axis] = splitPosition
+	builder.copyNode(oldNodes, oldTriangleIndices, n.aboveChild(), bounds1,
+		depth+1)
+}
+
+func (builder *KdTreeBuilder) splitLeaf(triangles []int32, nodeBounds BBox32,
+	depth int) {
+	createLeaf := func() {
+		builder.createLeaf(triangles)
+		builder.buildStats.newLeaf(len(triangles), depth)
+	}
+
+	if len(triangles) <= builder.buildParams.CompactLeafTrianglesLimit ||
+		depth >= builder.buildParams.MaxDepth {
+		createLeaf()
+		return
+	}
+
+	// split along the longest axis at the median of triangle centers
+	diag := VSub32(nodeBounds.maxPoint, nodeBounds.minPoint)
+	axis := 0
+	if diag[1] > diag[axis] {
+		axis = 1
+	}
+	if diag[2] > diag[axis] {
+		axis = 2
+	}
+
+	centers := make([]float32, len(triangles))
+	for i, triangle := range triangles {
+		bounds := &builder.triangleBounds[triangle]
+		centers[i] = 0.5 * (bounds.minPoint[axis] + bounds.maxPoint[axis])
+	}
+	sort.Slice(centers, func(i, j int) bool { return centers[i] < centers[j] })
+
+	splitPosition := centers[len(centers)/2]
+	if splitPosition <= nodeBounds.minPoint[axis] ||
+		splitPosition >= nodeBounds.maxPoint[axis] {
+		splitPosition = 0.5 * (nodeBounds.minPoint[axis] + nodeBounds.maxPoint[axis])
+		if splitPosition <= nodeBounds.minPoint[axis] ||
+			splitPosition >= nodeBounds.maxPoint[axis] {
+			createLeaf()
+			return
+		}
+	}
+
+	// triangles that cross the split plane go to both children
+	var below, above []int32
+	for _, triangle := range triangles {
+		bounds := &builder.triangleBounds[triangle]
+		if bounds.minPoint[axis] < splitPosition ||
+			bounds.maxPoint[axis] == splitPosition {
+			below = append(below, triangle)
+		}
+		if bounds.maxPoint[axis] > splitPosition {
+			above = append(above, triangle)
+		}
+	}
+
+	// stop if split does not reduce the number of triangles
+	if len(below) == len(triangles) || len(above) == len(triangles) {
+		createLeaf()
+		return
+	}
+
+	thisNodeIndex := len(builder.nodes)
+	builder.nodes = append(builder.nodes, node{})
+
+	bounds0 := nodeBounds
+	bounds0.maxPoint[axis] = splitPosition
+	builder.splitLeaf(below, bounds0, depth+1)
+
+	builder.nodes[thisNodeIndex].initInteriorNode(axis,
+		int32(len(builder.nodes)), splitPosition)
+
+	bounds1 := nodeBounds
+	bounds1.minPoint[axis] = splitPosition
+	builder.splitLeaf(above, bounds1, depth+1)
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"testing"
+)
+
+func getMaxLeafTrianglesCount(kdTree *KdTree) int32 {
+	maxCount := int32(0)
+	for _, n := range kdTree.nodes {
+		if n.isLeaf() && n.trianglesCount() > maxCount {
+			maxCount = n.trianglesCount()
+		}
+	}
+	return maxCount
+}
+
+func TestCompactLargeLeaves(t *testing.T) {
+	mesh := LoadTriangleMesh(teapotStl)
+	// expensive traversal steps produce large leaves
+	buildParams := NewBuildParams()
+	buildParams.TraversalCost = 40
+	kdTree := NewKdTreeBuilder(mesh, buildParams).BuildKdTree()
+
+	const leafTrianglesLimit = 4
+	buildParams.CompactLargeLeaves = true
+	buildParams.CompactLeafTrianglesLimit = leafTrianglesLimit
+	compactedKdTree := NewKdTreeBuilder(mesh, buildParams).BuildKdTree()
+
+	maxCount := getMaxLeafTrianglesCount(kdTree)
+	compactedMaxCount := getMaxLeafTrianglesCount(compactedKdTree)
+	if maxCount <= leafTrianglesLimit {
+		t.Fatalf("the largest leaf has only %d triangles, the test needs larger leaves",
+			maxCount)
+	}
+	if compactedMaxCount >= maxCount {
+		t.Errorf("the largest leaf has %d triangles after compaction, %d before",
+			compactedMaxCount, maxCount)
+	}
+	if err := compactedKdTree.Verify(); err != nil {
+		t.Fatal(err)
+	}
+
+	camera := NewCameraForBounds(kdTree.meshBounds)
+	const width, height = 32, 32
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			ray := camera.GenerateRay(x, y, width, height)
+			hitFound, intersection := kdTree.Intersect(&ray)
+			compactedHitFound, compactedIntersection := compactedKdTree.Intersect(&ray)
+			if hitFound != compactedHitFound || intersection.t != compactedIntersection.t {
+				t.Errorf("pixel (%d, %d): hit %v at t = %g, %v at t = %g after compaction",
+					x, y, hitFound, intersection.t, compactedHitFound,
+					compactedIntersection.t)
+			}
+		}
+	}
+}
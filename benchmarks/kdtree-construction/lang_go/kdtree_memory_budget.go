@@ -0,0 +1,115 @@
+package main
+
+import (
+	"common"
+	"fmt"
+	"unsafe"
+)
+
+// buildMemoryEstimate is the working set of the build in bytes. The output
+// arrays are estimated from the expected number of nodes and one triangle
+// reference per triangle, the actual tree can be larger. The wide index
+// build uses larger edges and indices and does not use the options it
+// ignores, see resolveBuildParams.
+type buildMemoryEstimate struct {
+	triangleBounds  int64 // triangle bounds and clipped bounds
+	edges           int64 // edges buffer and radix sort scratch buffer
+	trianglesBuffer int64
+	presortedEdges  int64 // sorted edges arena and triangle sides
+	output          int64 // nodes and triangle indices
+}
+
+func estimateBuildMemory(trianglesCount int, buildParams *BuildParams,
+	wideIndices bool) buildMemoryEstimate {
+	n := int64(trianglesCount)
+	bboxSize := int64(unsafe.Sizeof(BBox32{}))
+	edgeSize := int64(unsafe.Sizeof(boundEdge{}))
+	if wideIndices {
+		edgeSize = int64(unsafe.Sizeof(wideBoundEdge{}))
+	}
+	indexSize := getBuildIndexSize(wideIndices)
+
+	var estimate buildMemoryEstimate
+	estimate.triangleBounds = n * bboxSize
+	if buildParams.ClipTriangles {
+		estimate.triangleBounds += n * bboxSize
+	}
+	estimate.edges = 2 * n * edgeSize
+	if buildParams.UseRadixSort {
+		estimate.edges += 2 * n * edgeSize
+	}
+	estimate.trianglesBuffer = n * int64(buildParams.MaxDepth+1) * indexSize
+	if buildParams.PresortEdges {
+		// see initSortedEdges
+		estimate.presortedEdges = 3*6*n*edgeSize + n
+	}
+	expectedNodes := int64(buildParams.ExpectedNodes)
+	if expectedNodes <= 0 {
+		expectedNodes = 2 * n
+	}
+	estimate.output = expectedNodes*int64(unsafe.Sizeof(node{})) + n*indexSize
+	if wideIndices {
+		// about half of the nodes are leaves with the offset
+		estimate.output += expectedNodes / 2 * indexSize
+	}
+	return estimate
+}
+
+func (estimate buildMemoryEstimate) total() int64 {
+	return estimate.triangleBounds + estimate.edges + estimate.trianglesBuffer +
+		estimate.presortedEdges + estimate.output
+}
+
+// fitMemoryBudget changes the build parameters to fit the working set into
+// BuildParams.MaxMemoryBytes. The options that only speed up the build are
+// disabled first: PresortEdges and then UseRadixSort. Then MaxDepth is
+// reduced, but not below the half of the original depth since the tree
+// would be too shallow. If the budget still can't be met the runtime error
+// that lists the estimated working set is reported before any memory is
+// allocated.
+func fitMemoryBudget(trianglesCount int, buildParams *BuildParams, wideIndices bool) {
+	budget := buildParams.MaxMemoryBytes
+	fits := func() bool {
+		return estimateBuildMemory(trianglesCount, buildParams, wideIndices).total() <= budget
+	}
+	if fits() {
+		return
+	}
+
+	if buildParams.PresortEdges {
+		buildParams.PresortEdges = false
+		fmt.Printf("kdtree presorted edges are disabled to fit memory limit of %d bytes\n",
+			budget)
+		if fits() {
+			return
+		}
+	}
+	if buildParams.UseRadixSort {
+		buildParams.UseRadixSort = false
+		fmt.Printf("kdtree radix sort is disabled to fit memory limit of %d bytes\n",
+			budget)
+		if fits() {
+			return
+		}
+	}
+
+	originalDepth := buildParams.MaxDepth
+	minDepth := originalDepth / 2
+	for buildParams.MaxDepth > minDepth && !fits() {
+		buildParams.MaxDepth--
+	}
+	if fits() {
+		fmt.Printf("kdtree max depth is reduced from %d to %d to fit "+
+			"memory limit of %d bytes\n", originalDepth, buildParams.MaxDepth, budget)
+		return
+	}
+
+	estimate := estimateBuildMemory(trianglesCount, buildParams, wideIndices)
+	common.RuntimeError(fmt.Sprintf(
+		"kdtree build for %d triangles does not fit memory limit of %d bytes: "+
+			"estimated working set is %d bytes at max depth %d (triangle bounds %d, "+
+			"edges %d, triangles buffer %d, output %d)",
+		trianglesCount, budget, estimate.total(), buildParams.MaxDepth,
+		estimate.triangleBounds, estimate.edges, estimate.trianglesBuffer,
+		estimate.output))
+}
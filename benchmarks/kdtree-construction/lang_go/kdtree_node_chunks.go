@@ -0,0 +1,68 @@
+package main
+
+// Nodes are added in chunks of this size after the first chunk. The chunk
+// is 8 MB, large enough to make chunk allocation cost negligible.
+const nodeChunkSize = 1 << 20
+
+// nodeChunks stores nodes during the build. Unlike append to a single
+// slice it never copies the nodes that are already created, so the build of
+// a large scene does not need the memory for both the old and the grown
+// array. The nodes are copied to a single array once at the end of the
+// build, see flatten.
+type nodeChunks struct {
+	chunks         [][]node
+	firstChunkSize int
+	count          int
+}
+
+// newNodeChunks creates the storage with the first chunk capacity set to
+// the expected number of nodes. Good estimate avoids additional chunks. If
+// expectedNodes is not positive then it is estimated from the number of
+// triangles, the tree has at least one node.
+func newNodeChunks(expectedNodes, trianglesCount int) *nodeChunks {
+	if expectedNodes <= 0 {
+		expectedNodes = 2 * trianglesCount
+	}
+	if expectedNodes < 1 {
+		expectedNodes = 1
+	}
+	return &nodeChunks{
+		chunks:         [][]node{make([]node, 0, expectedNodes)},
+		firstChunkSize: expectedNodes,
+	}
+}
+
+func (chunks *nodeChunks) len() int {
+	return chunks.count
+}
+
+func (chunks *nodeChunks) append(n node) {
+	last := &chunks.chunks[len(chunks.chunks)-1]
+	if len(*last) == cap(*last) {
+		chunks.chunks = append(chunks.chunks, make([]node, 0, nodeChunkSize))
+		last = &chunks.chunks[len(chunks.chunks)-1]
+	}
+	*last = append(*last, n)
+	chunks.count++
+}
+
+func (chunks *nodeChunks) at(index int) *node {
+	if index < chunks.firstChunkSize {
+		return &chunks.chunks[0][index]
+	}
+	index -= chunks.firstChunkSize
+	return &chunks.chunks[1+index/nodeChunkSize][index%nodeChunkSize]
+}
+
+// flatten returns all nodes in a single array. Chunks are released as soon
+// as they are copied, the storage can't be used after the call.
+func (chunks *nodeChunks) flatten() []node {
+	nodes := make([]node, 0, chunks.count)
+	for i := range chunks.chunks {
+		nodes = append(nodes, chunks.chunks[i]...)
+		chunks.chunks[i] = nil
+	}
+	chunks.chunks = nil
+	chunks.count = 0
+	return nodes
+}
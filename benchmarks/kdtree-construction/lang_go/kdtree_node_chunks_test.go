@@ -0,0 +1,49 @@
+package main
+
+import "testing"
+
+func TestNodeChunks(t *testing.T) {
+	if chunks := newNodeChunks(0, 100); cap(chunks.chunks[0]) != 200 {
+		t.Errorf("first chunk capacity is %d, expected 200 for 100 triangles",
+			cap(chunks.chunks[0]))
+	}
+	if chunks := newNodeChunks(0, 0); cap(chunks.chunks[0]) != 1 {
+		t.Errorf("first chunk capacity is %d, expected 1 for empty mesh",
+			cap(chunks.chunks[0]))
+	}
+
+	// the nodes fill the first chunk, two full chunks and a part of the
+	// third one
+	const firstChunkSize = 5
+	chunks := newNodeChunks(firstChunkSize, 0)
+	count := firstChunkSize + 2*nodeChunkSize + 3
+	for i := 0; i < count; i++ {
+		chunks.append(node{uint32(i), ^uint32(i)})
+	}
+	if chunks.len() != count || len(chunks.chunks) != 4 {
+		t.Fatalf("%d nodes in %d chunks, expected %d nodes in 4 chunks",
+			chunks.len(), len(chunks.chunks), count)
+	}
+	for _, i := range []int{0, firstChunkSize - 1, firstChunkSize,
+		firstChunkSize + nodeChunkSize - 1, firstChunkSize + nodeChunkSize,
+		firstChunkSize + 2*nodeChunkSize, count - 1} {
+		if n := *chunks.at(i); n != (node{uint32(i), ^uint32(i)}) {
+			t.Errorf("node %d is %v", i, n)
+		}
+	}
+	chunks.at(firstChunkSize + nodeChunkSize)[1] = 42
+
+	nodes := chunks.flatten()
+	if len(nodes) != count || chunks.len() != 0 {
+		t.Fatalf("flatten returned %d nodes, expected %d", len(nodes), count)
+	}
+	for i, n := range nodes {
+		expected := node{uint32(i), ^uint32(i)}
+		if i == firstChunkSize+nodeChunkSize {
+			expected[1] = 42
+		}
+		if n != expected {
+			t.Fatalf("flattened node %d is %v, expected %v", i, n, expected)
+		}
+	}
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"math"
+)
+
+// Leaves are split again with this number of levels below the leaf even if
+// each split increases the cost locally. The new subtree is kept only if
+// its cost is lower than the cost of the leaf.
+const optimizationLookaheadDepth = 3
+
+type treeOptimizer struct {
+	builder            *KdTreeBuilder
+	oldNodes           []node
+	oldTriangleIndices []int32
+
+	// triangleStamps[i] == stamp marks triangle i as already seen while
+	// the triangles of the subtree are collected
+	triangleStamps []int32
+	stamp          int32
+}
+
+// optimizeTree rebuilds the tree bottom-up and evaluates the SAH cost of
+// each subtree: the cost of the leaf is IntersectionCost per triangle, the
+// cost of the interior node is TraversalCost plus the costs of the children
+// weighted by the surface area ratio. The empty bonus is not used. The
+// subtree is collapsed into a leaf if the leaf with the subtree triangles
+// is cheaper. The leaves that have more triangles than the leaf triangles
+// limit are re-split with optimizationLookaheadDepth levels of lookahead,
+// which finds splits rejected by the greedy build.
+func (builder *KdTreeBuilder) optimizeTree(meshBounds BBox32) {
+	stats := &builder.buildStats
+	stats.CostBeforeOptimization = builder.getSubtreeCost(builder.nodes, 0, meshBounds)
+
+	optimizer := &treeOptimizer{
+		builder:            builder,
+		oldNodes:           builder.nodes,
+		oldTriangleIndices: builder.triangleIndices,
+		triangleStamps:     make([]int32, builder.mesh.GetTrianglesCount()),
+	}
+	builder.nodes = make([]node, 0, len(optimizer.oldNodes))
+	builder.triangleIndices = make([]int32, 0, len(optimizer.oldTriangleIndices))
+	builder.splitBounds = builder.triangleBounds
+
+	cost, _ := optimizer.optimizeNode(0, meshBounds, 0)
+	stats.CostAfterOptimization = cost
+	builder.splitBounds = nil
+
+	// leaf statistics are collected again for the new layout
+	stats.resetLeafStats()
+	builder.collectLeafStats(0, 0)
+}
+
+// getSubtreeCost returns SAH cost of the subtree, see optimizeTree.
+func (builder *KdTreeBuilder) getSubtreeCost(nodes []node, nodeIndex int32,
+	nodeBounds BBox32) float64 {
+	return getSubtreeSAHCost(nodes, nodeIndex, nodeBounds,
+		builder.buildParams.IntersectionCost, builder.buildParams.TraversalCost)
+}
+
+func (builder *KdTreeBuilder) getInteriorNodeCost(nodeBounds, bounds0, bounds1 BBox32,
+	cost0, cost1 float64) float64 {
+	return getInteriorNodeSAHCost(nodeBounds, bounds0, bounds1, cost0, cost1,
+		builder.buildParams.TraversalCost)
+}
+
+func (builder *KdTreeBuilder) collectLeafStats(nodeIndex int32, depth int) {
+	n := builder.nodes[nodeIndex]
+	if n.isLeaf() {
+		builder.buildStats.newLeaf(int(n.trianglesCount()), depth)
+		return
+	}
+	builder.collectLeafStats(nodeIndex+1, depth+1)
+	builder.collectLeafStats(n.aboveChild(), depth+1)
+}
+
+// optimizeNode copies the subtree of the old tree and returns its cost and
+// the lower bound of the number of distinct triangles in the subtree.
+func (optimizer *treeOptimizer) optimizeNode(nodeIndex int32, nodeBounds BBox32,
+	depth int) (cost float64, minTrianglesCount int) {
+	builder := optimizer.builder
+	n := optimizer.oldNodes[nodeIndex]
+
+	if n.isLeaf() {
+		var triangles []int32
+		switch n.trianglesCount() {
+		case 0:
+		case 1:
+			triangles = []int32{n.index()}
+		default:
+			triangles = optimizer.oldTriangleIndices[n.index() : n.index()+n.trianglesCount()]
+		}
+		cost = optimizer.splitLeaf(triangles, nodeBounds, depth, optimizationLookaheadDepth)
+		if cost < float64(builder.buildParams.IntersectionCost)*float64(len(triangles)) {
+			builder.buildStats.ResplitLeafCount++
+		}
+		return cost, len(triangles)
+	}
+
+	axis := n.splitAxis()
+	splitPosition := n.splitPosition()
+	bounds0, bounds1 := getChildBounds(nodeBounds, axis, splitPosition)
+
+	nodesMark := len(builder.nodes)
+	triangleIndicesMark := len(builder.triangleIndices)
+	builder.nodes = append(builder.nodes, node{})
+	cost0, count0 := optimizer.optimizeNode(nodeIndex+1, bounds0, depth+1)
+	builder.nodes[nodesMark].initInteriorNode(axis, int32(len(builder.nodes)), splitPosition)
+	cost1, count1 := optimizer.optimizeNode(n.aboveChild(), bounds1, depth+1)
+
+	cost = builder.getInteriorNodeCost(nodeBounds, bounds0, bounds1, cost0, cost1)
+	minTrianglesCount = count0
+	if count1 > minTrianglesCount {
+		minTrianglesCount = count1
+	}
+
+	// the leaf has at least as many triangles as each child, so the
+	// triangles are collected only if the leaf can be cheaper
+	intersectionCost := float64(builder.buildParams.IntersectionCost)
+	if cost <= intersectionCost*float64(minTrianglesCount) {
+		return cost, minTrianglesCount
+	}
+	triangles := optimizer.collectTriangles(nodesMark)
+	leafCost := intersectionCost * float64(len(triangles))
+	if leafCost < cost {
+		builder.nodes = builder.nodes[:nodesMark]
+		builder.triangleIndices = builder.triangleIndices[:triangleIndicesMark]
+		builder.createLeaf(triangles)
+		builder.buildStats.CollapsedSubtreeCount++
+		return leafCost, len(triangles)
+	}
+	return cost, len(triangles)
+}
+
+// collectTriangles returns distinct triangles of the leaves of the new
+// tree starting from the given node. The subtree is the last one added,
+// so its nodes are at the end of the nodes array.
+func (optimizer *treeOptimizer) collectTriangles(firstNode int) []int32 {
+	builder := optimizer.builder
+	optimizer.stamp++
+	var triangles []int32
+	add := func(triangle int32) {
+		if optimizer.triangleStamps[triangle] != optimizer.stamp {
+			optimizer.triangleStamps[triangle] = optimizer.stamp
+			triangles = append(triangles, triangle)
+		}
+	}
+	for _, n := range builder.nodes[firstNode:] {
+		if !n.isLeaf() {
+			continue
+		}
+		switch n.trianglesCount() {
+		case 0:
+		case 1:
+			add(n.index())
+		default:
+			for _, triangle := range builder.triangleIndices[n.index() : n.index()+n.trianglesCount()] {
+				add(triangle)
+			}
+		}
+	}
+	return triangles
+}
+
+// splitLeaf creates the subtree for leaf triangles with the given number
+// of lookahead levels and returns its cost. The subtree is replaced with
+// the leaf if it is not cheaper than the leaf.
+func (optimizer *treeOptimizer) splitLeaf(triangles []int32, nodeBounds BBox32,
+	depth, lookahead int) float64 {
+	builder := optimizer.builder
+	buildParams := &builder.buildParams
+	leafCost := float64(buildParams.IntersectionCost) * float64(len(triangles))
+
+	createLeaf := func() float64 {
+		builder.createLeaf(triangles)
+		return leafCost
+	}
+	if len(triangles) <= buildParams.getLeafTrianglesLimit(depth) || depth >= buildParams.MaxDepth ||
+		lookahead == 0 {
+		return createLeaf()
+	}
+	axis, splitPosition, found := optimizer.findSplit(triangles, nodeBounds)
+	if !found {
+		return createLeaf()
+	}
+
+	var below, above []int32
+	for _, triangle := range triangles {
+		bounds := &builder.triangleBounds[triangle]
+		if bounds.minPoint[axis] < splitPosition || bounds.maxPoint[axis] == splitPosition {
+			below = append(below, triangle)
+		}
+		if bounds.maxPoint[axis] > splitPosition {
+			above = append(above, triangle)
+		}
+	}
+	if len(below) == len(triangles) && len(above) == len(triangles) {
+		return createLeaf()
+	}
+
+	bounds0, bounds1 := getChildBounds(nodeBounds, axis, splitPosition)
+	nodesMark := len(builder.nodes)
+	triangleIndicesMark := len(builder.triangleIndices)
+	builder.nodes = append(builder.nodes, node{})
+	cost0 := optimizer.splitLeaf(below, bounds0, depth+1, lookahead-1)
+	builder.nodes[nodesMark].initInteriorNode(axis, int32(len(builder.nodes)), splitPosition)
+	cost1 := optimizer.splitLeaf(above, bounds1, depth+1, lookahead-1)
+
+	cost := builder.getInteriorNodeCost(nodeBounds, bounds0, bounds1, cost0, cost1)
+	if cost >= leafCost {
+		builder.nodes = builder.nodes[:nodesMark]
+		builder.triangleIndices = builder.triangleIndices[:triangleIndicesMark]
+		return createLeaf()
+	}
+	return cost
+}
+
+// findSplit returns the split with the lowest SAH cost with children
+// considered as leaves. Unlike the build the split is not rejected when it
+// is more expensive than the leaf.
+func (optimizer *treeOptimizer) findSplit(triangles []int32,
+	nodeBounds BBox32) (axis int, splitPosition float32, found bool) {
+	builder := optimizer.builder
+	buildParams := &builder.buildParams
+	area := nodeBounds.GetSurfaceArea()
+	if area <= 0 {
+		return 0, 0, false
+	}
+	bestCost := math.Inf(+1)
+
+	for k := 0; k < 3; k++ {
+		edges := builder.edgesBuffer[0 : 2*len(triangles)]
+		builder.initEdgePairs(triangles, k)
+		builder.sortEdges(edges)
+
+		numBelow, numAbove := 0, len(triangles)
+		for i := 0; i < len(edges); {
+			t := edges[i].positionOnAxis
+			groupEnd := i
+			startsCount := 0
+			for groupEnd < len(edges) && edges[groupEnd].positionOnAxis == t {
+				if edges[groupEnd].isEnd() {
+					numAbove--
+				} else {
+					startsCount++
+				}
+				groupEnd++
+			}
+
+			if t > nodeBounds.minPoint[k] && t < nodeBounds.maxPoint[k] {
+				bounds0, bounds1 := getChildBounds(nodeBounds, k, t)
+				cost := float64(buildParams.TraversalCost) +
+					float64(buildParams.IntersectionCost)*
+						(float64(bounds0.GetSurfaceArea())*float64(numBelow)+
+							float64(bounds1.GetSurfaceArea())*float64(numAbove))/float64(area)
+				if cost < bestCost {
+					bestCost = cost
+					axis, splitPosition, found = k, t, true
+				}
+			}
+			numBelow += startsCount
+			i = groupEnd
+		}
+	}
+	return
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"sort"
+	"time"
+)
+
+// TunerParams defines the grid of build parameters swept by
+// TuneBuildParams. The other parameters are taken from NewBuildParams. The
+// raycast throughput is measured on primary rays of the camera frame that
+// sees the whole mesh, the frame is traced RayPasses times and the fastest
+// pass is used.
+type TunerParams struct {
+	IntersectionCosts   []float32
+	EmptyBonuses        []float32
+	LeafTrianglesLimits []int
+	FrameWidth          int
+	FrameHeight         int
+	RayPasses           int
+}
+
+func NewTunerParams() TunerParams {
+	return TunerParams{
+		IntersectionCosts:   []float32{20, 40, 80, 160},
+		EmptyBonuses:        []float32{0, 0.3, 0.6},
+		LeafTrianglesLimits: []int{1, 2, 4},
+		FrameWidth:          128,
+		FrameHeight:         128,
+		RayPasses:           3,
+	}
+}
+
+// TunerResult is the measurement for one parameter set.
+type TunerResult struct {
+	IntersectionCost   float32
+	EmptyBonus         float32
+	LeafTrianglesLimit int
+	BuildTime          time.Duration
+	RaysPerSecond      float64
+	NodesCount         int
+	SizeInBytes        int64
+}
+
+// dominates returns true if the result is not worse than other in both
+// build time and raycast throughput and better in one of them.
+func (result *TunerResult) dominates(other *TunerResult) bool {
+	return result.BuildTime <= other.BuildTime && result.RaysPerSecond >= other.RaysPerSecond &&
+		(result.BuildTime < other.BuildTime || result.RaysPerSecond > other.RaysPerSecond)
+}
+
+// TuneBuildParams builds the kdtree for every parameter set of the grid
+// and returns all results and the Pareto-best results, the sets that are
+// not dominated by other sets in build time and raycast throughput. The
+// Pareto-best results are sorted by build time, so the last one has the
+// best throughput.
+func TuneBuildParams(mesh *TriangleMesh, tunerParams TunerParams) (results,
+	paretoResults []TunerResult) {
+	camera := NewCameraForBounds(NewBBox64FromBBox32(mesh.GetBounds()))
+	rays := make([]Ray, 0, tunerParams.FrameWidth*tunerParams.FrameHeight)
+	for y := 0; y < tunerParams.FrameHeight; y++ {
+		for x := 0; x < tunerParams.FrameWidth; x++ {
+			rays = append(rays, camera.GenerateRay(x, y, tunerParams.FrameWidth,
+				tunerParams.FrameHeight))
+		}
+	}
+
+	for _, intersectionCost := range tunerParams.IntersectionCosts {
+		for _, emptyBonus := range tunerParams.EmptyBonuses {
+			for _, leafTrianglesLimit := range tunerParams.LeafTrianglesLimits {
+				buildParams := NewBuildParams()
+				buildParams.IntersectionCost = intersectionCost
+				buildParams.EmptyBonus = emptyBonus
+				buildParams.LeafTrianglesLimit = leafTrianglesLimit
+				buildParams.CollectStats = false
+
+				start := time.Now()
+				kdTree := NewKdTreeBuilder(mesh, buildParams).BuildKdTree()
+				buildTime := time.Since(start)
+
+				var raysTime time.Duration
+				for pass := 0; pass < tunerParams.RayPasses; pass++ {
+					start = time.Now()
+					for i := range rays {
+						kdTree.Intersect(&rays[i])
+					}
+					passTime := time.Since(start)
+					if pass == 0 || passTime < raysTime {
+						raysTime = passTime
+					}
+				}
+				raysPerSecond := 0.0
+				if raysTime > 0 {
+					raysPerSecond = float64(len(rays)) / raysTime.Seconds()
+				}
+
+				results = append(results, TunerResult{
+					IntersectionCost:   intersectionCost,
+					EmptyBonus:         emptyBonus,
+					LeafTrianglesLimit: leafTrianglesLimit,
+					BuildTime:          buildTime,
+					RaysPerSecond:      raysPerSecond,
+					NodesCount:         len(kdTree.nodes),
+					SizeInBytes:        kdTree.SizeInBytes(),
+				})
+			}
+		}
+	}
+
+	for i := range results {
+		dominated := false
+		for k := range results {
+			if k != i && results[k].dominates(&results[i]) {
+				dominated = true
+				break
+			}
+		}
+		if !dominated {
+			paretoResults = append(paretoResults, results[i])
+		}
+	}
+	sort.SliceStable(paretoResults, func(i, k int) bool {
+		return paretoResults[i].BuildTime < paretoResults[k].BuildTime
+	})
+	return results, paretoResults
+}
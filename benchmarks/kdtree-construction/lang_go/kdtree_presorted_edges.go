@@ -0,0 +1,104 @@
+package main
+
+const (
+	sideBelow uint8 = 1
+	sideAbove uint8 = 2
+)
+
+// sortedEdgesArena is a stack allocator for the sorted edge lists of the
+// nodes on the current build path. Lists are released by restoring the
+// previously saved arena value. If the buffer is full a new one is
+// allocated, lists in the old buffer stay valid.
+type sortedEdgesArena struct {
+	buffer []boundEdge
+	top    int
+}
+
+func (arena *sortedEdgesArena) alloc(n int) []boundEdge {
+	if arena.top+n > len(arena.buffer) {
+		size := 2 * len(arena.buffer)
+		if size < n {
+			size = n
+		}
+		arena.buffer = make([]boundEdge, size)
+		arena.top = 0
+	}
+	edges := arena.buffer[arena.top : arena.top+n : arena.top+n]
+	arena.top += n
+	return edges
+}
+
+func (arena *sortedEdgesArena) allocAxes(trianglesCount int) *[3][]boundEdge {
+	var edges [3][]boundEdge
+	for axis := range edges {
+		edges[axis] = arena.alloc(2 * trianglesCount)
+	}
+	return &edges
+}
+
+// initSortedEdges sorts bound edges of the root node triangles along each
+// axis. Children lists are produced from these lists by stable filtering,
+// so the edges are sorted only once per build.
+func (builder *KdTreeBuilder) initSortedEdges(rootTriangles []int32) *[3][]boundEdge {
+	trianglesCount := len(rootTriangles)
+	builder.triangleSides = make([]uint8, builder.mesh.GetTrianglesCount())
+
+	// the root lists and a few levels of children lists, the arena
+	// grows if the tree has more duplicated triangles
+	builder.sortedEdgesArena = sortedEdgesArena{
+		buffer: make([]boundEdge, 3*6*trianglesCount),
+	}
+	rootEdges := builder.sortedEdgesArena.allocAxes(trianglesCount)
+	for axis := range rootEdges {
+		builder.initEdgePairs(rootTriangles, axis)
+		builder.sortEdges(builder.edgesBuffer[0 : 2*trianglesCount])
+		copy(rootEdges[axis], builder.edgesBuffer)
+	}
+	return rootEdges
+}
+
+// selectPresortedSplit is the same as selectSplit but uses sorted edge
+// lists of the node instead of sorting the edges.
+func (builder *KdTreeBuilder) selectPresortedSplit(nodeBounds BBox32,
+	sortedEdges *[3][]boundEdge, emptyBonus float32) split {
+	nodeTrianglesCount := len(sortedEdges[0]) / 2
+	bestSplit, _ := builder.selectSplitOverAxes(nodeBounds, func(axis int) split {
+		return builder.selectSplitForAxis(sortedEdges[axis], nodeBounds,
+			nodeTrianglesCount, axis, emptyBonus)
+	})
+	return bestSplit
+}
+
+// partitionSortedEdges distributes node edges between children lists
+// according to the classified children triangles. Triangles that
+// overlap the split plane keep their edges in both lists. The order of
+// the edges is preserved, so children lists are sorted.
+func (builder *KdTreeBuilder) partitionSortedEdges(sortedEdges *[3][]boundEdge,
+	belowTriangles, aboveTriangles []int32, below, above *[3][]boundEdge) {
+	sides := builder.triangleSides
+	for _, edge := range sortedEdges[0] {
+		sides[edge.triangleIndex()] = 0
+	}
+	for _, triangle := range belowTriangles {
+		sides[triangle] |= sideBelow
+	}
+	for _, triangle := range aboveTriangles {
+		sides[triangle] |= sideAbove
+	}
+
+	for axis := 0; axis < 3; axis++ {
+		n0, n1 := 0, 0
+		belowEdges, aboveEdges := below[axis], above[axis]
+		for _, edge := range sortedEdges[axis] {
+			side := sides[edge.triangleIndex()]
+			if side&sideBelow != 0 {
+				belowEdges[n0] = edge
+				n0++
+			}
+			if side&sideAbove != 0 {
+				aboveEdges[n1] = edge
+				n1++
+			}
+		}
+	}
+}
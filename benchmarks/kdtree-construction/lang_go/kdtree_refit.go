@@ -0,0 +1,109 @@
+package main
+
+type kdTreeRefitter struct {
+	kdTree          *KdTree
+	triangleBounds  []BBox32
+	buffer          []int32 // triangles of the nodes on the current path
+	triangleIndices []int32
+
+	// the leaves of the wide index tree
+	wideLeafOffsets     []int64
+	wideTriangleIndices []int64
+}
+
+// Refit updates the tree after mesh vertices are moved. The tree structure
+// and split planes are kept, the triangles are distributed again to the
+// leaves they overlap with the same rule as the builder uses: the triangle
+// goes below the split if it starts below the split or lies in the split
+// plane and goes above if it ends above the split. The tree bounds only
+// grow, so split planes stay inside of the node bounds.
+//
+// Refit is much faster than the full build, the result is valid kdtree for
+// the new vertex positions but its quality degrades with deformation and
+// the tree should be rebuilt from time to time. The wide index tree stays
+// wide.
+func (kdTree *KdTree) Refit() {
+	mesh := kdTree.mesh
+	trianglesCount := mesh.GetTrianglesCount()
+	if trianglesCount > 0 {
+		kdTree.meshBounds = BBox64Union(kdTree.meshBounds,
+			NewBBox64FromBBox32(mesh.GetBounds()))
+	}
+
+	refitter := &kdTreeRefitter{
+		kdTree:          kdTree,
+		triangleBounds:  make([]BBox32, trianglesCount),
+		buffer:          make([]int32, trianglesCount, 4*trianglesCount),
+		triangleIndices: make([]int32, 0, len(kdTree.triangleIndices)),
+	}
+	for i := int32(0); i < trianglesCount; i++ {
+		refitter.triangleBounds[i] = mesh.GetTriangleBounds(i)
+		refitter.buffer[i] = i
+	}
+	if kdTree.wide {
+		refitter.triangleIndices = nil
+		refitter.wideLeafOffsets = make([]int64, 0, len(kdTree.wideLeafOffsets))
+		refitter.wideTriangleIndices = make([]int64, 0, len(kdTree.wideTriangleIndices))
+	}
+	refitter.refitNode(0, 0, int(trianglesCount))
+	kdTree.triangleIndices = refitter.triangleIndices
+	kdTree.wideLeafOffsets = refitter.wideLeafOffsets
+	kdTree.wideTriangleIndices = refitter.wideTriangleIndices
+	// the triangles in the split plane are added to the below child
+	kdTree.droppedTriangles = nil
+}
+
+// refitNode distributes triangles buffer[begin:end] to the leaves of the
+// subtree. Children triangles are appended to the buffer and removed when
+// the subtree is done, the buffer can be reallocated, so it is accessed
+// by indices only.
+func (refitter *kdTreeRefitter) refitNode(nodeIndex int32, begin, end int) {
+	n := &refitter.kdTree.nodes[nodeIndex]
+	if n.isLeaf() {
+		switch {
+		case end == begin:
+			n.initEmptyLeaf()
+		case refitter.kdTree.wide:
+			n.initWideLeaf(int32(end-begin), int32(len(refitter.wideLeafOffsets)))
+			refitter.wideLeafOffsets = append(refitter.wideLeafOffsets,
+				int64(len(refitter.wideTriangleIndices)))
+			for _, triangle := range refitter.buffer[begin:end] {
+				refitter.wideTriangleIndices = append(refitter.wideTriangleIndices,
+					int64(triangle))
+			}
+		case end-begin == 1:
+			n.initLeafWithSingleTriangle(refitter.buffer[begin])
+		default:
+			n.initLeafWithMultipleTriangles(int32(end-begin),
+				int32(len(refitter.triangleIndices)))
+			refitter.triangleIndices = append(refitter.triangleIndices,
+				refitter.buffer[begin:end]...)
+		}
+		return
+	}
+
+	axis := n.splitAxis()
+	split := n.splitPosition()
+	aboveChild := n.aboveChild()
+
+	belowBegin := len(refitter.buffer)
+	for i := begin; i < end; i++ {
+		triangle := refitter.buffer[i]
+		bounds := &refitter.triangleBounds[triangle]
+		if bounds.minPoint[axis] < split || bounds.maxPoint[axis] == split {
+			refitter.buffer = append(refitter.buffer, triangle)
+		}
+	}
+	aboveBegin := len(refitter.buffer)
+	for i := begin; i < end; i++ {
+		triangle := refitter.buffer[i]
+		if refitter.triangleBounds[triangle].maxPoint[axis] > split {
+			refitter.buffer = append(refitter.buffer, triangle)
+		}
+	}
+	aboveEnd := len(refitter.buffer)
+
+	refitter.refitNode(nodeIndex+1, belowBegin, aboveBegin)
+	refitter.refitNode(aboveChild, aboveBegin, aboveEnd)
+	refitter.buffer = refitter.buffer[:belowBegin]
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+)
+
+// SplitStrategy selects the split of the kdtree node. The returned split
+// has edge == -1 if no useful split is found and the node should become a
+// leaf.
+type SplitStrategy interface {
+	selectSplit(builder *KdTreeBuilder, nodeBounds BBox32,
+		nodeTriangles []int32, emptyBonus float32) split
+}
+
+// SAHSplit evaluates SAH cost at every triangle bound edge. This is the
+// default strategy.
+type SAHSplit struct{}
+
+// BinnedSAHSplit evaluates SAH cost only at bin boundaries, which avoids
+// sorting of bound edges at the cost of slightly worse tree.
+type BinnedSAHSplit struct {
+	BinCount int
+}
+
+// SpatialMedianSplit splits the node in the middle of the longest axis.
+// Like other strategies, it creates a leaf if the split does not improve
+// SAH cost.
+type SpatialMedianSplit struct{}
+
+// ObjectMedianSplit splits the node along the longest axis at the median
+// of triangle bound centers, so both children get about the same number
+// of triangles. It creates a leaf if the split does not improve SAH cost.
+type ObjectMedianSplit struct{}
+
+// NewSplitStrategy returns split strategy by name: sah, binned,
+// spatial-median or object-median. binCount is used by the binned
+// strategy.
+func NewSplitStrategy(name string, binCount int) (SplitStrategy, error) {
+	switch name {
+	case "sah":
+		return SAHSplit{}, nil
+	case "binned":
+		if binCount < 1 {
+			return nil, fmt.Errorf("invalid bin count for binned split: %d", binCount)
+		}
+		return BinnedSAHSplit{binCount}, nil
+	case "spatial-median":
+		return SpatialMedianSplit{}, nil
+	case "object-median":
+		return ObjectMedianSplit{}, nil
+	}
+	return nil, fmt.Errorf("unknown split strategy: %q", name)
+}
+
+func (SAHSplit) selectSplit(builder *KdTreeBuilder, nodeBounds BBox32,
+	nodeTriangles []int32, emptyBonus float32) split {
+	return builder.selectSplit(nodeBounds, nodeTriangles, emptyBonus)
+}
+
+func (strategy BinnedSAHSplit) selectSplit(builder *KdTreeBuilder, nodeBounds BBox32,
+	nodeTriangles []int32, emptyBonus float32) split {
+	return builder.selectBinnedSplit(nodeBounds, nodeTriangles, emptyBonus,
+		strategy.BinCount)
+}
+
+func (SpatialMedianSplit) selectSplit(builder *KdTreeBuilder, nodeBounds BBox32,
+	nodeTriangles []int32, emptyBonus float32) split {
+	axis := getLongestAxis(nodeBounds)
+	position := 0.5 * (nodeBounds.minPoint[axis] + nodeBounds.maxPoint[axis])
+	return builder.selectSplitByPosition(nodeBounds, nodeTriangles, axis, position,
+		emptyBonus)
+}
+
+func (ObjectMedianSplit) selectSplit(builder *KdTreeBuilder, nodeBounds BBox32,
+	nodeTriangles []int32, emptyBonus float32) split {
+	axis := getLongestAxis(nodeBounds)
+	centers := make([]float32, len(nodeTriangles))
+	for i, triangle := range nodeTriangles {
+		bounds := &builder.splitBounds[triangle]
+		centers[i] = 0.5 * (bounds.minPoint[axis] + bounds.maxPoint[axis])
+	}
+	sort.Slice(centers, func(i, j int) bool { return centers[i] < centers[j] })
+
+	// the median can be on the node boundary if many triangles are there,
+	// the spatial median is used in this case
+	position := centers[len(centers)/2]
+	if position <= nodeBounds.minPoint[axis] || position >= nodeBounds.maxPoint[axis] {
+		position = 0.5 * (nodeBounds.minPoint[axis] + nodeBounds.maxPoint[axis])
+	}
+	return builder.selectSplitByPosition(nodeBounds, nodeTriangles, axis, position,
+		emptyBonus)
+}
+
+// selectSplitByPosition returns the split at the given position if the
+// position is inside the node and the SAH cost of the split is lower than
+// the cost of the leaf. Without the cost check nodes with large triangles
+// that overlap all split positions would be subdivided until MaxDepth.
+func (builder *KdTreeBuilder) selectSplitByPosition(nodeBounds BBox32,
+	nodeTriangles []int32, axis int, position float32, emptyBonus float32) split {
+	buildParams := &builder.buildParams
+	if position <= nodeBounds.minPoint[axis] || position >= nodeBounds.maxPoint[axis] {
+		return split{edge: -1, axis: -1}
+	}
+	builder.initEdgePairs(nodeTriangles, axis)
+
+	numBelow, numAbove := int32(0), int32(0)
+	for i := range nodeTriangles {
+		start := builder.edgesBuffer[2*i+0]
+		end := builder.edgesBuffer[2*i+1]
+		if start.positionOnAxis < position || end.positionOnAxis == position {
+			numBelow++
+		}
+		if end.positionOnAxis > position {
+			numAbove++
+		}
+	}
+
+	bounds0, bounds1 := nodeBounds, nodeBounds
+	bounds0.maxPoint[axis] = position
+	bounds1.minPoint[axis] = position
+	invTotalS := 1.0 / nodeBounds.GetSurfaceArea()
+	pBelow := bounds0.GetSurfaceArea() * invTotalS
+	pAbove := bounds1.GetSurfaceArea() * invTotalS
+	cost := builder.getSplitCost(pBelow, pAbove, int64(numBelow), int64(numAbove),
+		emptyBonus)
+	leafCost := buildParams.IntersectionCost * float32(len(nodeTriangles))
+	if cost >= leafCost {
+		return split{edge: -1, axis: -1}
+	}
+	return split{edge: 0, axis: axis, cost: cost, byPosition: true, position: position}
+}
+
+// initEdgePairs fills edgesBuffer with unsorted start/end edge pairs of
+// the node triangles for the given axis.
+func (builder *KdTreeBuilder) initEdgePairs(nodeTriangles []int32, axis int) {
+	for i, triangle := range nodeTriangles {
+		builder.edgesBuffer[2*i+0] = boundEdge{
+			builder.splitBounds[triangle].minPoint[axis],
+			uint32(triangle) | 0}
+
+		builder.edgesBuffer[2*i+1] = boundEdge{
+			builder.splitBounds[triangle].maxPoint[axis],
+			uint32(triangle) | edgeEndMask}
+	}
+}
+
+// classifySplitByPosition distributes node triangles between children
+// using edge pairs prepared by initEdgePairs. Triangle goes below if it
+// starts below the split and above if it ends above the split. Triangle
+// that lies in the split plane goes below.
+func (builder *KdTreeBuilder) classifySplitByPosition(splitPosition float32,
+	nodeTrianglesCount int, offset0, offset1 int) (n0, n1 int) {
+	for i := 0; i < nodeTrianglesCount; i++ {
+		start := builder.edgesBuffer[2*i+0]
+		end := builder.edgesBuffer[2*i+1]
+
+		if start.positionOnAxis < splitPosition ||
+			end.positionOnAxis == splitPosition {
+			builder.trianglesBuffer[offset0+n0] = start.triangleIndex()
+			n0++
+		}
+		if end.positionOnAxis > splitPosition {
+			builder.trianglesBuffer[offset1+n1] = start.triangleIndex()
+			n1++
+		}
+	}
+	return n0, n1
+}
@@ -0,0 +1,573 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// newHandBuiltKdTree returns the tree with the leaves at depths 1, 2 and 3:
+//
+//	0: interior, above child 6
+//	1:   interior, above child 3
+//	2:     leaf (depth 2)
+//	3:     interior, above child 5
+//	4:       leaf (depth 3)
+//	5:       leaf (depth 3)
+//	6:   leaf (depth 1)
+func newHandBuiltKdTree() *KdTree {
+	nodes := make([]node, 7)
+	nodes[0].initInteriorNode(0, 6, 0.5)
+	nodes[1].initInteriorNode(1, 3, 0.5)
+	nodes[2].initEmptyLeaf()
+	nodes[3].initInteriorNode(2, 5, 0.5)
+	nodes[4].initEmptyLeaf()
+	nodes[5].initEmptyLeaf()
+	nodes[6].initEmptyLeaf()
+	return &KdTree{
+		nodes:      nodes,
+		mesh:       &TriangleMesh{},
+		meshBounds: NewBBox64FromPoints(Vector64{0, 0, 0}, Vector64{1, 1, 1}),
+	}
+}
+
+func TestDepthHistogram(t *testing.T) {
+	histogram := newHandBuiltKdTree().DepthHistogram()
+	if expected := []int{0, 1, 1, 2}; !reflect.DeepEqual(histogram, expected) {
+		t.Errorf("depth histogram is %v, expected %v", histogram, expected)
+	}
+
+	singleLeaf := &KdTree{nodes: make([]node, 1)}
+	singleLeaf.nodes[0].initEmptyLeaf()
+	histogram = singleLeaf.DepthHistogram()
+	if expected := []int{1}; !reflect.DeepEqual(histogram, expected) {
+		t.Errorf("depth histogram of single leaf tree is %v, expected %v",
+			histogram, expected)
+	}
+}
+
+// swapWordsByteOrder converts the file of 32-bit words between little and
+// big endian byte order.
+func swapWordsByteOrder(t *testing.T, fileName, swappedFileName string) {
+	t.Helper()
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data)%4 != 0 {
+		t.Fatalf("%s: file size %d is not a multiple of 4", fileName, len(data))
+	}
+	for i := 0; i < len(data); i += 4 {
+		data[i], data[i+1], data[i+2], data[i+3] = data[i+3], data[i+2], data[i+1], data[i]
+	}
+	if err := os.WriteFile(swappedFileName, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestKdTreeFileByteOrder(t *testing.T) {
+	mesh := LoadTriangleMesh(teapotStl)
+	kdTree := NewKdTreeBuilder(mesh, NewBuildParams()).BuildKdTree()
+	dir := t.TempDir()
+	fileName := filepath.Join(dir, "teapot.kdtree")
+	if err := kdTree.saveToFile(fileName); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nodesCount := binary.LittleEndian.Uint32(data); nodesCount != uint32(len(kdTree.nodes)) {
+		t.Errorf("nodes count is not stored as little-endian: %d, expected %d",
+			nodesCount, len(kdTree.nodes))
+	}
+	loadedKdTree, err := loadKdTree(fileName, mesh)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loadedKdTree.GetHash() != kdTree.GetHash() {
+		t.Errorf("loaded kdtree differs from the saved one")
+	}
+
+	// the file written with big-endian byte order has wrong counters and
+	// is rejected
+	bigEndianFileName := filepath.Join(dir, "big_endian.kdtree")
+	swapWordsByteOrder(t, fileName, bigEndianFileName)
+	if _, err := loadKdTree(bigEndianFileName, mesh); err == nil {
+		t.Errorf("big-endian kdtree file is loaded without error")
+	}
+}
+
+func TestIntersectAllThinBox(t *testing.T) {
+	mesh := newCubeMesh(Vector32{0, 0, 0}, 1)
+	scale := NewScaleMatrix4(Vector64{1, 1, 0.01})
+	mesh.Transform(&scale)
+	buildParams := NewBuildParams()
+	buildParams.LeafTrianglesLimit = 1
+	kdTree := NewKdTreeBuilder(mesh, buildParams).BuildKdTree()
+
+	ray := RayFromOriginAndDirection(Vector64{0.3, 0.6, -1}, Vector64{0, 0, 1})
+	intersections := kdTree.IntersectAll(&ray, 0, math.Inf(+1))
+	if len(intersections) != 2 {
+		t.Fatalf("found %d intersections, expected 2", len(intersections))
+	}
+	if intersections[0].t >= intersections[1].t {
+		t.Errorf("intersections are not sorted: t = %g, %g", intersections[0].t,
+			intersections[1].t)
+	}
+	if intersections[0].triangleIndex == intersections[1].triangleIndex {
+		t.Errorf("triangle %d is reported twice", intersections[0].triangleIndex)
+	}
+	if math.Abs(intersections[0].t-1) > 1e-6 || math.Abs(intersections[1].t-1.01) > 1e-6 {
+		t.Errorf("intersections at t = %g, %g, expected 1, 1.01", intersections[0].t,
+			intersections[1].t)
+	}
+
+	// the closest hit reported by Intersect is the first one
+	hitFound, intersection := kdTree.Intersect(&ray)
+	if !hitFound || intersection.triangleIndex != intersections[0].triangleIndex {
+		t.Errorf("Intersect returned %v %+v, expected triangle %d", hitFound,
+			intersection, intersections[0].triangleIndex)
+	}
+
+	if intersections := kdTree.IntersectAll(&ray, 0, 1.005); len(intersections) != 1 {
+		t.Errorf("found %d intersections before t = 1.005, expected 1", len(intersections))
+	}
+}
+
+func TestRayEpsilonSkipsOriginatingTriangle(t *testing.T) {
+	mesh := newCubeMesh(Vector32{0, 0, 0}, 1)
+	kdTree := NewKdTreeBuilder(mesh, NewBuildParams()).BuildKdTree()
+
+	primaryRay := RayFromOriginAndDirection(Vector64{0.3, 0.6, -1}, Vector64{0, 0, 1})
+	hitFound, primaryIntersection := kdTree.Intersect(&primaryRay)
+	if !hitFound {
+		t.Fatal("primary ray misses the cube")
+	}
+
+	// the secondary ray starts on the -z face and continues in the same
+	// direction, with the epsilon set it skips the originating triangle and
+	// hits the +z face
+	origin := primaryRay.GetPoint(primaryIntersection.t)
+	ray := RayFromOriginAndDirection(origin, Vector64{0, 0, 1})
+	hitFound, intersection := kdTree.Intersect(&ray)
+	if !hitFound || intersection.triangleIndex != primaryIntersection.triangleIndex {
+		t.Errorf("ray without epsilon does not hit originating triangle %d: %v %+v",
+			primaryIntersection.triangleIndex, hitFound, intersection)
+	}
+
+	ray.SetEpsilon(1e-6)
+	hitFound, intersection = kdTree.Intersect(&ray)
+	if !hitFound {
+		t.Fatal("ray with epsilon misses the cube")
+	}
+	if intersection.triangleIndex == primaryIntersection.triangleIndex {
+		t.Errorf("ray with epsilon hits originating triangle %d",
+			intersection.triangleIndex)
+	}
+	if math.Abs(intersection.t-1) > 1e-6 {
+		t.Errorf("ray with epsilon hits at t = %g, expected 1", intersection.t)
+	}
+}
+
+func TestOccludedAgreesWithIntersect(t *testing.T) {
+	mesh := LoadTriangleMesh(teapotStl)
+	kdTree := NewKdTreeBuilder(mesh, NewBuildParams()).BuildKdTree()
+	camera := NewCameraForBounds(kdTree.meshBounds)
+	const width, height = 24, 24
+
+	hitCount := 0
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			ray := camera.GenerateRay(x, y, width, height)
+			hitFound, intersection := kdTree.Intersect(&ray)
+			if occluded := kdTree.Occluded(&ray, 0, math.Inf(+1)); occluded != hitFound {
+				t.Errorf("pixel (%d, %d): occluded %v, hit found %v", x, y, occluded, hitFound)
+			}
+			if !hitFound {
+				continue
+			}
+			hitCount++
+			// the segment that ends before the closest hit is not occluded
+			if kdTree.Occluded(&ray, 0, 0.999*intersection.t) {
+				t.Errorf("pixel (%d, %d): occluded before the closest hit at t = %g",
+					x, y, intersection.t)
+			}
+			if !kdTree.Occluded(&ray, 0, 1.001*intersection.t) {
+				t.Errorf("pixel (%d, %d): not occluded after the closest hit at t = %g",
+					x, y, intersection.t)
+			}
+		}
+	}
+	if hitCount == 0 {
+		t.Errorf("no rays hit the mesh")
+	}
+}
+
+// walkRayClosestHit finds the closest hit by testing the triangles of the
+// leaves visited by walkLeaves. The walk stops at the leaf that contains the
+// hit like the traversal of Intersect.
+func walkRayClosestHit(kdTree *KdTree, ray *Ray) (bool, float64) {
+	closestT := math.Inf(+1)
+	var leafTriangles []int32
+	kdTree.walkLeaves(ray, 0, math.Inf(+1), func(leafIndex int32, tLeafMax float64) bool {
+		leafTriangles = kdTree.appendLeafTriangles(leafTriangles[:0], kdTree.nodes[leafIndex])
+		for _, triangleIndex := range leafTriangles {
+			v0, v1, v2 := kdTree.mesh.GetTriangle(triangleIndex)
+			triangle := Triangle{[3]Vector64{
+				NewVector64FromVector32(v0),
+				NewVector64FromVector32(v1),
+				NewVector64FromVector32(v2),
+			}}
+			if hitFound, intersection := IntersectTriangle(ray, &triangle); hitFound {
+				closestT = math.Min(closestT, intersection.t)
+			}
+		}
+		return closestT <= tLeafMax
+	})
+	return closestT != math.Inf(+1), closestT
+}
+
+// TestWalkRayAgreesWithIntersect checks that walkLeaves, which WalkRay,
+// IntersectAll and Occluded are built on, finds the same closest hit as the
+// traversal of Intersect. They handle the ray segment and the ray epsilon
+// separately.
+func TestWalkRayAgreesWithIntersect(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		mesh *TriangleMesh
+	}{
+		{"teapot", LoadTriangleMesh(teapotStl)},
+		{"bunny", LoadTriangleMesh("../data/bunny.stl")},
+		{"cubes row", newCubesRowMesh(8, 1)},
+		{"pathological", GenerateRandomMesh(5000, 3, newPathologicalGenOpts(8))},
+	} {
+		kdTree := NewKdTreeBuilder(test.mesh, NewBuildParams()).BuildKdTree()
+		camera := NewCameraForBounds(kdTree.meshBounds)
+		const width, height = 48, 48
+		rays := make([]Ray, 0, width*height)
+		for y := 0; y < height; y++ {
+			for x := 0; x < width; x++ {
+				rays = append(rays, camera.GenerateRay(x, y, width, height))
+			}
+		}
+		// the rays that start inside the mesh bounds
+		center := VMul64(VAdd64(kdTree.meshBounds.minPoint, kdTree.meshBounds.maxPoint), 0.5)
+		r := &splitMix64{1}
+		for i := 0; i < 256; i++ {
+			direction := Vector64{float64(r.float32()) - 0.5, float64(r.float32()) - 0.5,
+				float64(r.float32()) - 0.5}
+			rays = append(rays, RayFromOriginAndDirection(center, direction))
+		}
+
+		hitsCount := 0
+		for i := range rays {
+			hitFound, intersection := kdTree.Intersect(&rays[i])
+			walkHitFound, walkT := walkRayClosestHit(kdTree, &rays[i])
+			if hitFound != walkHitFound {
+				t.Errorf("%s: ray %d: WalkRay hit is %v, Intersect hit is %v",
+					test.name, i, walkHitFound, hitFound)
+				continue
+			}
+			if !hitFound {
+				continue
+			}
+			hitsCount++
+			if walkT != intersection.t {
+				t.Errorf("%s: ray %d: WalkRay hit at t = %g, Intersect hit at t = %g",
+					test.name, i, walkT, intersection.t)
+			}
+			if i >= width*height {
+				continue
+			}
+			// the secondary ray continues from the hit point of the camera
+			// ray, the traversal starts at the ray epsilon
+			secondaryRay := RayFromOriginAndDirection(
+				rays[i].GetPoint(intersection.t), rays[i].GetDirection())
+			secondaryRay.SetEpsilon(intersection.epsilon)
+			hitFound, intersection = kdTree.Intersect(&secondaryRay)
+			walkHitFound, walkT = walkRayClosestHit(kdTree, &secondaryRay)
+			if hitFound != walkHitFound || (hitFound && walkT != intersection.t) {
+				t.Errorf("%s: secondary ray %d: WalkRay hit %v at t = %g, "+
+					"Intersect hit %v at t = %g", test.name, i, walkHitFound, walkT,
+					hitFound, intersection.t)
+			}
+		}
+		if hitsCount == 0 {
+			t.Errorf("%s: no rays hit the mesh", test.name)
+		}
+	}
+}
+
+// newCubesRowMesh returns unit cubes placed along x axis with the given
+// step. Triangles of the i-th cube have indices [12*i, 12*i + 12).
+func newCubesRowMesh(cubesCount int, step float32) *TriangleMesh {
+	mesh := &TriangleMesh{}
+	for i := 0; i < cubesCount; i++ {
+		cube := newCubeMesh(Vector32{float32(i) * step, 0, 0}, 1)
+		vertexOffset := int32(len(mesh.vertices))
+		mesh.vertices = append(mesh.vertices, cube.vertices...)
+		mesh.normals = append(mesh.normals, cube.normals...)
+		for _, indices := range cube.triangles {
+			mesh.triangles = append(mesh.triangles, [3]int32{indices[0] + vertexOffset,
+				indices[1] + vertexOffset, indices[2] + vertexOffset})
+		}
+	}
+	return mesh
+}
+
+func TestWalkRayFrontToBack(t *testing.T) {
+	const cubesCount = 4
+	mesh := newCubesRowMesh(cubesCount, 3)
+	buildParams := NewBuildParams()
+	buildParams.LeafTrianglesLimit = 1
+	kdTree := NewKdTreeBuilder(mesh, buildParams).BuildKdTree()
+
+	for _, direction := range []float64{1, -1} {
+		origin := Vector64{-5, 0.3, 0.6}
+		if direction < 0 {
+			origin[0] = 3*cubesCount + 5
+		}
+		ray := RayFromOriginAndDirection(origin, Vector64{direction, 0, 0})
+
+		// the cubes are separated, so each leaf references triangles of a
+		// single cube and the cubes are visited in the ray order
+		var visitedCubes []int
+		kdTree.WalkRay(&ray, 0, math.Inf(+1), func(triangleIndices []int32) bool {
+			cube := int(triangleIndices[0]) / 12
+			for _, triangleIndex := range triangleIndices {
+				if int(triangleIndex)/12 != cube {
+					t.Fatalf("leaf references triangles of cubes %d and %d", cube,
+						triangleIndex/12)
+				}
+			}
+			if len(visitedCubes) == 0 || visitedCubes[len(visitedCubes)-1] != cube {
+				visitedCubes = append(visitedCubes, cube)
+			}
+			return false
+		})
+
+		var expected []int
+		for i := 0; i < cubesCount; i++ {
+			if direction > 0 {
+				expected = append(expected, i)
+			} else {
+				expected = append(expected, cubesCount-1-i)
+			}
+		}
+		if !reflect.DeepEqual(visitedCubes, expected) {
+			t.Errorf("direction %g: cubes are visited in order %v, expected %v",
+				direction, visitedCubes, expected)
+		}
+
+		visitCount := 0
+		kdTree.WalkRay(&ray, 0, math.Inf(+1), func(triangleIndices []int32) bool {
+			visitCount++
+			return true
+		})
+		if visitCount != 1 {
+			t.Errorf("direction %g: %d leaves are visited after the stop", direction,
+				visitCount-1)
+		}
+	}
+}
+
+func TestVerifyDetectsCorruptedNodes(t *testing.T) {
+	if err := newHandBuiltKdTree().Verify(); err != nil {
+		t.Fatalf("valid kdtree is reported as corrupted: %v", err)
+	}
+
+	tests := []struct {
+		name          string
+		corrupt       func(nodes []node)
+		expectedError string
+	}{
+		{"above child past the end", func(nodes []node) {
+			nodes[0].initInteriorNode(0, 7, 0.5)
+		}, "node 0: above child index 7 is out of range"},
+		{"above child before the parent", func(nodes []node) {
+			nodes[3].initInteriorNode(2, 1, 0.5)
+		}, "node 3: above child index 1 is out of range"},
+		{"split outside of node bounds", func(nodes []node) {
+			nodes[1].initInteriorNode(1, 3, 2)
+		}, "node 1: split position 2 is outside of node bounds"},
+		{"node with two parents", func(nodes []node) {
+			nodes[0].initInteriorNode(0, 2, 0.5)
+		}, "node 2 is referenced more than once"},
+		{"unreachable nodes", func(nodes []node) {
+			nodes[3].initEmptyLeaf()
+		}, "node 4 is not reachable from the root"},
+		{"triangle index out of range", func(nodes []node) {
+			nodes[2].initLeafWithSingleTriangle(0)
+		}, "node 2: triangle index 0 is out of range"},
+		{"triangle indices out of range", func(nodes []node) {
+			nodes[6].initLeafWithMultipleTriangles(2, 0)
+		}, "node 6: triangle indices range [0, 2) is out of range"},
+	}
+
+	for _, test := range tests {
+		kdTree := newHandBuiltKdTree()
+		test.corrupt(kdTree.nodes)
+		err := kdTree.Verify()
+		if err == nil {
+			t.Errorf("%s: corrupted kdtree is not detected", test.name)
+			continue
+		}
+		if !strings.Contains(err.Error(), test.expectedError) {
+			t.Errorf("%s: unexpected error %q, expected %q", test.name, err,
+				test.expectedError)
+		}
+	}
+}
+
+func TestSizeInBytesMatchesFileSize(t *testing.T) {
+	mesh := LoadTriangleMesh(teapotStl)
+	kdTree := NewKdTreeBuilder(mesh, NewBuildParams()).BuildKdTree()
+	fileName := filepath.Join(t.TempDir(), "teapot.kdtree")
+	if err := kdTree.saveToFile(fileName); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the file has additional int32 counters of nodes and triangle indices
+	if size := kdTree.SizeInBytes(); size != info.Size()-8 {
+		t.Errorf("kdtree size is %d bytes, file size is %d bytes", size, info.Size())
+	}
+}
+
+func TestValidatePostBuildPasses(t *testing.T) {
+	mesh := GenerateRandomMesh(4000, 11, newPathologicalGenOpts(4))
+	for _, setup := range []struct {
+		name      string
+		configure func(buildParams *BuildParams)
+	}{
+		{"default", func(buildParams *BuildParams) {}},
+		{"optimize tree", func(buildParams *BuildParams) {
+			buildParams.OptimizeTree = true
+		}},
+		{"compact large leaves", func(buildParams *BuildParams) {
+			buildParams.CompactLargeLeaves = true
+		}},
+	} {
+		buildParams := NewBuildParams()
+		setup.configure(&buildParams)
+		kdTree := NewKdTreeBuilder(mesh, buildParams).BuildKdTree()
+		if err := kdTree.Validate(); err != nil {
+			t.Errorf("%s: %v", setup.name, err)
+		}
+	}
+
+	// the cube faces lie on the mesh bounds, they can't be dropped by the
+	// builder
+	kdTree := NewKdTreeBuilder(newCubeMesh(Vector32{0, 0, 0}, 1), NewBuildParams()).BuildKdTree()
+	for i := range kdTree.nodes {
+		if kdTree.nodes[i].isLeaf() {
+			kdTree.nodes[i].initEmptyLeaf()
+		}
+	}
+	if err := kdTree.Validate(); err == nil ||
+		!strings.Contains(err.Error(), "triangle 0 is not referenced by any leaf") {
+		t.Errorf("unreferenced triangle is not detected: %v", err)
+	}
+}
+
+// removeTriangleFromLeaves rewrites the narrow tree leaves without the
+// triangle.
+func removeTriangleFromLeaves(kdTree *KdTree, triangleIndex int32) {
+	var triangleIndices []int32
+	for i, n := range kdTree.nodes {
+		if n.isInteriorNode() {
+			continue
+		}
+		var triangles []int32
+		for _, triangle := range kdTree.appendLeafTriangles(nil, n) {
+			if triangle != triangleIndex {
+				triangles = append(triangles, triangle)
+			}
+		}
+		switch len(triangles) {
+		case 0:
+			kdTree.nodes[i].initEmptyLeaf()
+		case 1:
+			kdTree.nodes[i].initLeafWithSingleTriangle(triangles[0])
+		default:
+			kdTree.nodes[i].initLeafWithMultipleTriangles(int32(len(triangles)),
+				int32(len(triangleIndices)))
+			triangleIndices = append(triangleIndices, triangles...)
+		}
+	}
+	kdTree.triangleIndices = triangleIndices
+}
+
+func TestValidateUnreferencedInteriorFlatTriangle(t *testing.T) {
+	// the single split can't lie in the planes of all inner cube faces
+	mesh := newCubesRowMesh(4, 3)
+	buildParams := NewBuildParams()
+	buildParams.MaxDepth = 1
+	kdTree := NewKdTreeBuilder(mesh, buildParams).BuildKdTree()
+	if err := kdTree.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	// every cube face is axis-aligned, the x faces of the inner cubes
+	// (the first 4 triangles of the cube) are inside the mesh bounds
+	dropped := make(map[int32]bool)
+	for _, triangleIndex := range kdTree.droppedTriangles {
+		dropped[triangleIndex] = true
+	}
+	triangleIndex := int32(-1)
+	for i := int32(12); i < mesh.GetTrianglesCount()-12; i++ {
+		if i%12 < 4 && !dropped[i] && !kdTree.liesInSplitPlane(i) {
+			triangleIndex = i
+			break
+		}
+	}
+	if triangleIndex == -1 {
+		t.Fatalf("all inner triangles lie in the split planes")
+	}
+
+	removeTriangleFromLeaves(kdTree, triangleIndex)
+	expected := fmt.Sprintf("triangle %d is not referenced by any leaf", triangleIndex)
+	if err := kdTree.Validate(); err == nil || err.Error() != expected {
+		t.Errorf("unexpected error for removed triangle %d: %v", triangleIndex, err)
+	}
+}
+
+func TestValidateDroppedTriangles(t *testing.T) {
+	// the split between the cubes lies in the plane of the cube faces, the
+	// builder drops them from both children
+	mesh := newCubesRowMesh(2, 1)
+	buildParams := NewBuildParams()
+	buildParams.LeafTrianglesLimit = 1
+	kdTree := NewKdTreeBuilder(mesh, buildParams).BuildKdTree()
+	if len(kdTree.droppedTriangles) == 0 {
+		t.Fatalf("no triangles are dropped from the split planes")
+	}
+	if err := kdTree.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	// without the record the triangle has to lie in the split plane that is
+	// present in the tree
+	droppedTriangle := kdTree.droppedTriangles[0]
+	if !kdTree.liesInSplitPlane(droppedTriangle) {
+		t.Errorf("dropped triangle %d does not lie in the split plane", droppedTriangle)
+	}
+	kdTree.droppedTriangles = nil
+	if err := kdTree.Validate(); err != nil {
+		t.Errorf("tree without the record: %v", err)
+	}
+	kdTree.nodes = []node{{}}
+	kdTree.nodes[0].initEmptyLeaf()
+	if err := kdTree.Validate(); err == nil {
+		t.Errorf("unreferenced triangle %d is not detected", droppedTriangle)
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"math"
+)
+
+// clipNodeTriangles computes clippedBounds for the node triangles and
+// removes triangles that do not intersect the node. The triangles are
+// compacted in place and the remaining part of nodeTriangles is returned.
+func (builder *KdTreeBuilder) clipNodeTriangles(nodeBounds BBox32,
+	nodeTriangles []int32) []int32 {
+	count := 0
+	for _, triangle := range nodeTriangles {
+		bounds := builder.triangleBounds[triangle]
+		if !bboxContains32(nodeBounds, bounds) {
+			var intersects bool
+			bounds, intersects = builder.clipTriangle(triangle, nodeBounds)
+			if !intersects {
+				continue
+			}
+		}
+		builder.clippedBounds[triangle] = bounds
+		nodeTriangles[count] = triangle
+		count++
+	}
+	return nodeTriangles[:count]
+}
+
+// clipTriangle returns the bounds of the triangle part inside the box.
+// The triangle is clipped by the box planes (Sutherland-Hodgman) in double
+// precision and the result is rounded outwards, so the bounds are
+// conservative. The bounds are also limited by the triangle bounds, which
+// keeps BoundsPadding effect, and by the box itself.
+func (builder *KdTreeBuilder) clipTriangle(triangle int32,
+	box BBox32) (bounds BBox32, intersects bool) {
+	v0, v1, v2 := builder.mesh.GetTriangle(triangle)
+
+	// at most 3 + 6 vertices after clipping by 6 planes
+	var buffers [2][9]Vector64
+	polygon := buffers[0][:0]
+	polygon = append(polygon, NewVector64FromVector32(v0),
+		NewVector64FromVector32(v1), NewVector64FromVector32(v2))
+
+	for axis := 0; axis < 3; axis++ {
+		for side := 0; side < 2; side++ {
+			plane := float64(box.minPoint[axis])
+			sign := 1.0 // inside if sign * (p[axis] - plane) >= 0
+			if side == 1 {
+				plane = float64(box.maxPoint[axis])
+				sign = -1.0
+			}
+
+			clipped := buffers[(2*axis+side+1)%2][:0]
+			for i := range polygon {
+				a, b := polygon[i], polygon[(i+1)%len(polygon)]
+				da := sign * (a[axis] - plane)
+				db := sign * (b[axis] - plane)
+				if da >= 0 {
+					clipped = append(clipped, a)
+				}
+				if (da > 0 && db < 0) || (da < 0 && db > 0) {
+					p := VAdd64(a, VMul64(VSub64(b, a), da/(da-db)))
+					p[axis] = plane
+					clipped = append(clipped, p)
+				}
+			}
+			polygon = clipped
+			if len(polygon) == 0 {
+				return NewBBox32(), false
+			}
+		}
+	}
+
+	bounds = NewBBox32()
+	for _, p := range polygon {
+		for k := 0; k < 3; k++ {
+			bounds.minPoint[k] = f32Min(bounds.minPoint[k], roundDown32(p[k]))
+			bounds.maxPoint[k] = f32Max(bounds.maxPoint[k], roundUp32(p[k]))
+		}
+	}
+	triangleBounds := &builder.triangleBounds[triangle]
+	for k := 0; k < 3; k++ {
+		bounds.minPoint[k] = f32Max(bounds.minPoint[k],
+			f32Max(triangleBounds.minPoint[k], box.minPoint[k]))
+		bounds.maxPoint[k] = f32Min(bounds.maxPoint[k],
+			f32Min(triangleBounds.maxPoint[k], box.maxPoint[k]))
+	}
+	return bounds, true
+}
+
+// bboxContains32 returns true if bbox2 lies inside bbox.
+func bboxContains32(bbox, bbox2 BBox32) bool {
+	for k := 0; k < 3; k++ {
+		if bbox2.minPoint[k] < bbox.minPoint[k] || bbox2.maxPoint[k] > bbox.maxPoint[k] {
+			return false
+		}
+	}
+	return true
+}
+
+// roundDown32 returns the largest float32 value not greater than x.
+func roundDown32(x float64) float32 {
+	f := float32(x)
+	if float64(f) > x {
+		f = math.Nextafter32(f, float32(math.Inf(-1)))
+	}
+	return f
+}
+
+// roundUp32 returns the smallest float32 value not less than x.
+func roundUp32(x float64) float32 {
+	f := float32(x)
+	if float64(f) < x {
+		f = math.Nextafter32(f, float32(math.Inf(+1)))
+	}
+	return f
+}
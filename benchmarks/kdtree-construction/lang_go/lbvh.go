@@ -0,0 +1,389 @@
+package main
+
+import (
+	"math/bits"
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+// Morton codes use 10 bits per axis.
+const (
+	mortonBitsPerAxis = 10
+	mortonGridRes     = 1 << mortonBitsPerAxis
+
+	// subtrees with fewer triangles are emitted by the current goroutine
+	lbvhParallelEmitMinTriangles = 1 << 14
+
+	lbvhLeafFlag = int32(-0x80000000)
+)
+
+// lbvhInternalNode is the node of the binary radix tree built over Morton
+// sorted triangles. Children with lbvhLeafFlag reference single triangles
+// in sorted order, other children reference internal nodes.
+type lbvhInternalNode struct {
+	children    [2]int32
+	first, last int32 // range of sorted triangles covered by the node
+	axis        int32 // axis of the highest differing Morton code bit
+}
+
+type lbvhBuilder struct {
+	buildParams     BVHBuildParams
+	mortonKeys      []uint64 // Morton code in high 32 bits, sorted position in low bits
+	triangleBounds  []BBox32 // in sorted order
+	internalNodes   []lbvhInternalNode
+	internalParents []int32
+	leafParents     []int32
+	visits          []int32
+	internalBounds  []BBox32
+	internalCount   []int32 // number of BVH nodes in the subtree
+	nodes           []bvhNode
+}
+
+// BuildLBVH builds linear BVH: triangles are sorted by Morton codes of
+// their centroids and the hierarchy is the binary radix tree of the codes
+// (Karras, "Maximizing Parallelism in the Construction of BVHs, Octrees,
+// and k-d Trees"). All internal nodes of the radix tree are computed
+// independently, node bounds are computed with bottom-up propagation and
+// the nodes are emitted in parallel. The build is much faster than the
+// SAH build but the tree is worse for ray tracing. Only LeafTrianglesLimit
+// is used from the build parameters, subtrees with no more triangles than
+// the limit are collapsed into leaves.
+func BuildLBVH(mesh *TriangleMesh, buildParams BVHBuildParams) *BVH {
+	if buildParams.LeafTrianglesLimit < 1 {
+		buildParams.LeafTrianglesLimit = 1
+	}
+
+	trianglesCount := int(mesh.GetTrianglesCount())
+	if trianglesCount == 0 {
+		return &BVH{
+			nodes: []bvhNode{{bounds: NewBBox32()}},
+			mesh:  mesh,
+		}
+	}
+
+	builder := &lbvhBuilder{buildParams: buildParams}
+	var triangleIndices []int32
+	builder.mortonKeys, triangleIndices, builder.triangleBounds =
+		sortTrianglesByMortonCode(mesh)
+
+	if trianglesCount > 1 {
+		builder.buildRadixTree()
+		builder.computeBounds()
+	}
+	builder.emitNodes()
+
+	return &BVH{
+		nodes:           builder.nodes,
+		triangleIndices: triangleIndices,
+		mesh:            mesh,
+	}
+}
+
+// parallelFor calls body for subranges of [0, n) from multiple goroutines.
+func parallelFor(n int, body func(begin, end int)) {
+	workers := runtime.NumCPU()
+	chunkSize := (n + workers - 1) / workers
+	if chunkSize < 1024 {
+		chunkSize = 1024
+	}
+	var wg sync.WaitGroup
+	for begin := 0; begin < n; begin += chunkSize {
+		end := begin + chunkSize
+		if end > n {
+			end = n
+		}
+		wg.Add(1)
+		go func(begin, end int) {
+			defer wg.Done()
+			body(begin, end)
+		}(begin, end)
+	}
+	wg.Wait()
+}
+
+// expandMortonBits inserts two zero bits before each of the lower 10 bits.
+func expandMortonBits(v uint32) uint32 {
+	v = (v * 0x00010001) & 0xFF0000FF
+	v = (v * 0x00000101) & 0x0F00F00F
+	v = (v * 0x00000011) & 0xC30C30C3
+	v = (v * 0x00000005) & 0x49249249
+	return v
+}
+
+// getMortonCode returns 30 bit Morton code of the point quantized in the
+// bounds. The x coordinate has the highest bit of each triple.
+func getMortonCode(point Vector32, bounds BBox32) uint32 {
+	var code uint32
+	for k := 0; k < 3; k++ {
+		extent := bounds.maxPoint[k] - bounds.minPoint[k]
+		cell := 0
+		if extent > 0 {
+			cell = int(float64(point[k]-bounds.minPoint[k]) / float64(extent) * mortonGridRes)
+		}
+		if cell < 0 {
+			cell = 0
+		} else if cell >= mortonGridRes {
+			cell = mortonGridRes - 1
+		}
+		code |= expandMortonBits(uint32(cell)) << uint(2-k)
+	}
+	return code
+}
+
+// sortTrianglesByMortonCode sorts triangles by Morton code of their
+// centroids, triangles with the same code keep their mesh order. Returns
+// sorted keys with Morton code in the high 32 bits and sorted position in
+// the low bits, triangle indices and triangle bounds in sorted order.
+func sortTrianglesByMortonCode(mesh *TriangleMesh) ([]uint64, []int32, []BBox32) {
+	trianglesCount := int(mesh.GetTrianglesCount())
+	bounds := make([]BBox32, trianglesCount)
+	computeTriangleBoundsBatch(mesh, bounds)
+
+	centroidBounds := NewBBox32()
+	for i := range bounds {
+		centroidBounds.Extend(bounds[i].GetCenter())
+	}
+
+	keys := make([]uint64, trianglesCount)
+	parallelFor(trianglesCount, func(begin, end int) {
+		for i := begin; i < end; i++ {
+			code := getMortonCode(bounds[i].GetCenter(), centroidBounds)
+			keys[i] = uint64(code)<<32 | uint64(i)
+		}
+	})
+	radixSortMortonKeys(keys)
+
+	triangleIndices := make([]int32, trianglesCount)
+	sortedBounds := make([]BBox32, trianglesCount)
+	for i, key := range keys {
+		triangle := int32(key & 0xffffffff)
+		triangleIndices[i] = triangle
+		sortedBounds[i] = bounds[triangle]
+		// the low bits make the keys unique, the sorted position is used
+		// instead of the triangle index so keys are increasing
+		keys[i] = key&^0xffffffff | uint64(i)
+	}
+	return keys, triangleIndices, sortedBounds
+}
+
+// radixSortMortonKeys sorts keys by the Morton code in the high 32 bits.
+// The low bits are already increasing, so the result is fully sorted.
+func radixSortMortonKeys(keys []uint64) {
+	const passBits = mortonBitsPerAxis
+	const buckets = 1 << passBits
+
+	src := keys
+	dst := make([]uint64, len(keys))
+	var counts [buckets]int
+	for pass := uint(0); pass < 3; pass++ {
+		shift := 32 + pass*passBits
+		for i := range counts {
+			counts[i] = 0
+		}
+		for _, key := range src {
+			counts[(key>>shift)&(buckets-1)]++
+		}
+		offset := 0
+		for i, count := range counts {
+			counts[i] = offset
+			offset += count
+		}
+		for _, key := range src {
+			digit := (key >> shift) & (buckets - 1)
+			dst[counts[digit]] = key
+			counts[digit]++
+		}
+		src, dst = dst, src
+	}
+	// odd number of passes, the result is in the temporary buffer
+	copy(keys, src)
+}
+
+// delta returns the length of the common prefix of keys i and j or -1 if
+// j is out of range.
+func (builder *lbvhBuilder) delta(i, j int) int {
+	if j < 0 || j >= len(builder.mortonKeys) {
+		return -1
+	}
+	return bits.LeadingZeros64(builder.mortonKeys[i] ^ builder.mortonKeys[j])
+}
+
+// buildRadixTree computes all internal nodes in parallel. Internal node i
+// covers the range of keys that starts or ends at key i.
+func (builder *lbvhBuilder) buildRadixTree() {
+	trianglesCount := len(builder.mortonKeys)
+	builder.internalNodes = make([]lbvhInternalNode, trianglesCount-1)
+	builder.internalParents = make([]int32, trianglesCount-1)
+	builder.leafParents = make([]int32, trianglesCount)
+	builder.internalParents[0] = -1
+
+	parallelFor(trianglesCount-1, func(begin, end int) {
+		for i := begin; i < end; i++ {
+			builder.buildInternalNode(i)
+		}
+	})
+}
+
+func (builder *lbvhBuilder) buildInternalNode(i int) {
+	// direction of the range
+	d := 1
+	if builder.delta(i, i+1) < builder.delta(i, i-1) {
+		d = -1
+	}
+
+	// upper bound of the range length and then the exact length
+	minDelta := builder.delta(i, i-d)
+	maxLength := 2
+	for builder.delta(i, i+maxLength*d) > minDelta {
+		maxLength *= 2
+	}
+	length := 0
+	for t := maxLength / 2; t >= 1; t /= 2 {
+		if builder.delta(i, i+(length+t)*d) > minDelta {
+			length += t
+		}
+	}
+	j := i + length*d
+
+	// split position is where the common prefix of the range ends
+	nodeDelta := builder.delta(i, j)
+	s := 0
+	for divisor := 2; ; divisor *= 2 {
+		t := (length + divisor - 1) / divisor
+		if builder.delta(i, i+(s+t)*d) > nodeDelta {
+			s += t
+		}
+		if t == 1 {
+			break
+		}
+	}
+	gamma := i + s*d
+	if d < 0 {
+		gamma--
+	}
+
+	first, last := i, j
+	if d < 0 {
+		first, last = j, i
+	}
+	n := &builder.internalNodes[i]
+	n.first, n.last = int32(first), int32(last)
+
+	// the bit is in the code part of the key for ranges of different
+	// codes, x/y/z bits alternate from the highest bit
+	n.axis = 0
+	if nodeDelta < 32 {
+		n.axis = int32((nodeDelta - (32 - 3*mortonBitsPerAxis)) % 3)
+	}
+
+	if first == gamma {
+		n.children[0] = int32(gamma) | lbvhLeafFlag
+		builder.leafParents[gamma] = int32(i)
+	} else {
+		n.children[0] = int32(gamma)
+		builder.internalParents[gamma] = int32(i)
+	}
+	if last == gamma+1 {
+		n.children[1] = int32(gamma+1) | lbvhLeafFlag
+		builder.leafParents[gamma+1] = int32(i)
+	} else {
+		n.children[1] = int32(gamma + 1)
+		builder.internalParents[gamma+1] = int32(i)
+	}
+}
+
+// childInfo returns bounds and the number of BVH nodes of the subtree.
+func (builder *lbvhBuilder) childInfo(child int32) (BBox32, int32) {
+	if child < 0 {
+		return builder.triangleBounds[child&^lbvhLeafFlag], 1
+	}
+	return builder.internalBounds[child], builder.internalCount[child]
+}
+
+// computeBounds propagates bounds from leaves to the root. The first
+// goroutine that reaches the node stops, the second one has both children
+// ready and continues to the parent.
+func (builder *lbvhBuilder) computeBounds() {
+	internalCount := len(builder.internalNodes)
+	builder.visits = make([]int32, internalCount)
+	builder.internalBounds = make([]BBox32, internalCount)
+	builder.internalCount = make([]int32, internalCount)
+	leafLimit := int32(builder.buildParams.LeafTrianglesLimit)
+
+	parallelFor(len(builder.leafParents), func(begin, end int) {
+		for leaf := begin; leaf < end; leaf++ {
+			nodeIndex := builder.leafParents[leaf]
+			for nodeIndex >= 0 && atomic.AddInt32(&builder.visits[nodeIndex], 1) == 2 {
+				n := &builder.internalNodes[nodeIndex]
+				bounds0, count0 := builder.childInfo(n.children[0])
+				bounds1, count1 := builder.childInfo(n.children[1])
+				builder.internalBounds[nodeIndex] = BBox32Union(bounds0, bounds1)
+				if n.last-n.first+1 <= leafLimit {
+					builder.internalCount[nodeIndex] = 1
+				} else {
+					builder.internalCount[nodeIndex] = 1 + count0 + count1
+				}
+				nodeIndex = builder.internalParents[nodeIndex]
+			}
+		}
+	})
+}
+
+// emitNodes writes BVH nodes in depth-first order. The position of every
+// subtree is known from the subtree sizes, so large subtrees are emitted
+// by separate goroutines.
+func (builder *lbvhBuilder) emitNodes() {
+	if len(builder.internalNodes) == 0 {
+		builder.nodes = []bvhNode{{
+			bounds:         builder.triangleBounds[0],
+			index:          0,
+			trianglesCount: 1,
+		}}
+		return
+	}
+	builder.nodes = make([]bvhNode, builder.internalCount[0])
+	var wg sync.WaitGroup
+	builder.emitNode(0, 0, &wg)
+	wg.Wait()
+}
+
+func (builder *lbvhBuilder) emitNode(child int32, position int32, wg *sync.WaitGroup) {
+	for {
+		n := &builder.nodes[position]
+		if child < 0 {
+			leaf := child &^ lbvhLeafFlag
+			*n = bvhNode{bounds: builder.triangleBounds[leaf], index: leaf, trianglesCount: 1}
+			return
+		}
+		internal := &builder.internalNodes[child]
+		n.bounds = builder.internalBounds[child]
+		if builder.internalCount[child] == 1 {
+			n.index = internal.first
+			n.trianglesCount = internal.last - internal.first + 1
+			return
+		}
+		n.axis = internal.axis
+
+		// the left child follows the parent, the right child follows the
+		// left subtree
+		_, leftCount := builder.childInfo(internal.children[0])
+		rightPosition := position + 1 + leftCount
+		n.index = rightPosition
+
+		right := internal.children[1]
+		if right >= 0 &&
+			builder.internalNodes[right].last-builder.internalNodes[right].first+1 >=
+				lbvhParallelEmitMinTriangles {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				builder.emitNode(right, rightPosition, wg)
+			}()
+		} else {
+			builder.emitNode(right, rightPosition, wg)
+		}
+		child = internal.children[0]
+		position++
+	}
+}
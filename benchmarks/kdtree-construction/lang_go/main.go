@@ -2,43 +2,639 @@ package main
 
 import (
 	"common"
+	"context"
+	"flag"
+	"fmt"
 	"os"
+	"os/signal"
 	"path"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"time"
 )
 
 func main() {
+	registerBuilderAccelerators()
+
+	checkBaseline := flag.Bool("check-baseline", false,
+		"compare results against stored baselines")
+	updateBaseline := flag.Bool("update-baseline", false,
+		"store results as new baselines")
+	baselineTolerance := flag.Float64("baseline-tolerance", 10,
+		"allowed timing regression in percent")
+	iterations := flag.Int("iterations", 1,
+		"number of runs per model, the minimum time is reported")
+	hybridGridRes := flag.Int("hybrid-grid-res", 0,
+		"additionally build grid+kdtree hybrid with the given grid resolution")
+	compareBVH := flag.Bool("bvh", false,
+		"additionally build BVH for each model and report build time")
+	sahBinCount := flag.Int("sah-bins", 0,
+		"additionally build kdtree using binned SAH with the given number of bins")
+	printStats := flag.Bool("stats", false,
+		"print kdtree build statistics for each model")
+	validateMeshes := flag.Bool("validate-meshes", false,
+		"print mesh validation report for each model and stop on errors")
+	useMmap := flag.Bool("mmap", false,
+		"load models using memory-mapped files")
+	streamingChunk := flag.Int("stl-chunk", 0,
+		"load models in chunks of the given number of facets")
+	sceneFileName := flag.String("scene", "",
+		"json scene file with the models to use instead of the standard models")
+	decimationTiers := flag.String("decimate", "",
+		"comma separated triangle counts, additionally build kdtree for each model "+
+			"decimated to the given triangle counts")
+	saveModelsDir := flag.String("save-models", "",
+		"write models as stl files and their kdtrees to the given directory "+
+			"together with scene.json that references them")
+	useMeshCache := flag.Bool("mesh-cache", false,
+		"load models from meshbin cache files, the cache is created on the first run")
+	fixWinding := flag.Bool("fix-winding", false,
+		"make triangle winding consistent and closed models facing outward")
+	removeDuplicates := flag.Bool("remove-duplicates", false,
+		"remove duplicate triangles from models before building kdtrees")
+	printPhaseTimings := flag.Bool("phase-timings", false,
+		"additionally build kdtree for each model and report time of build phases")
+	manifestFileName := flag.String("manifest", "",
+		"sha256sum file, check that model files match the listed checksums")
+	assetCacheDir := flag.String("asset-cache", "",
+		"download missing model files to the given directory, "+
+			"the scene file or the manifest provides the checksums")
+	subdivisionLevels := flag.Int("subdivide", 0,
+		"refine models with the given number of Loop subdivision steps before "+
+			"building, each step multiplies triangles count by 4")
+	bvhSpatialAlpha := flag.Float64("bvh-spatial-alpha", 0,
+		"enable BVH spatial splits (SBVH) with the given overlap threshold, used with -bvh")
+	clipTriangles := flag.Bool("clip-triangles", false,
+		"additionally build kdtree with triangles clipped to node bounds (perfect splits)")
+	splitStrategyName := flag.String("split-strategy", "",
+		"additionally build kdtree with the given split strategy: sah, binned "+
+			"(uses -sah-bins or 32 bins), spatial-median or object-median")
+	compareLBVH := flag.Bool("lbvh", false,
+		"additionally build linear BVH (Morton code order) for each model and report build time")
+	compareHLBVH := flag.Bool("hlbvh", false,
+		"additionally build hierarchical linear BVH (SAH treelets) for each model and "+
+			"report build time")
+	compareBIH := flag.Bool("bih", false,
+		"additionally build bounding interval hierarchy for each model and report build time")
+	acceleratorNames := flag.String("accel", "",
+		"additionally build the given comma separated accelerators and report build time, "+
+			"available accelerators: "+strings.Join(GetAcceleratorNames(), ", "))
+	presortEdges := flag.Bool("presort-edges", false,
+		"additionally build kdtree with bound edges sorted once per axis instead of per node")
+	comparisonSort := flag.Bool("comparison-sort", false,
+		"additionally build kdtree with bound edges sorted by sort.Stable instead of radix sort "+
+			"and check that the tree is identical")
+	tuneParams := flag.Bool("tune", false,
+		"sweep intersection cost, empty bonus and leaf triangles limit for each model and "+
+			"report the Pareto-best parameter sets in build time and raycast throughput")
+	maxMemoryBytes := flag.Int64("max-memory", 0,
+		"additionally build kdtree with the given limit of build working set in bytes")
+	printProgress := flag.Bool("progress", false,
+		"additionally build kdtree for each model and print build progress, "+
+			"the build can be cancelled with interrupt signal")
+	buildParamsFileName := flag.String("build-params", "",
+		"additionally build kdtree with build parameters per model from the given json file, "+
+			"KDTREE_<PARAMETER> environment variables override the file parameters")
+	buildPreset := flag.String("preset", "",
+		"additionally build kdtree with the given build parameters preset: "+
+			strings.Join(GetBuildPresetNames(), ", "))
+	leafLimitSchedule := flag.String("leaf-limit-schedule", "",
+		"additionally build kdtree with the given comma separated leaf triangles limits "+
+			"per depth, the last limit is used for the deeper nodes")
+	maxNodes := flag.Int("max-nodes", 0,
+		"additionally build kdtree with the given node budget and report the number of "+
+			"leaves forced by the budget")
+	canonicalOrder := flag.Bool("canonical-order", false,
+		"additionally build kdtree with canonical bound edge order and check that the sorted "+
+			"and presorted edges produce the same tree")
+	dynamicFrames := flag.Int("dynamic-frames", 0,
+		"animate each model for the given number of frames and compare kdtree and BVH "+
+			"refit with rebuild")
+	lazyDepth := flag.Int("lazy-depth", 0,
+		"additionally build kdtree with only the given number of top levels built eagerly, "+
+			"report build time and the time of the first camera frame that builds "+
+			"the remaining subtrees on demand")
+	optimizeTree := flag.Bool("optimize", false,
+		"additionally build kdtree with post-build optimization pass and report SAH cost "+
+			"before and after the pass")
+	flag.Parse()
+	if *iterations < 1 {
+		*iterations = 1
+	}
+	dataDir := flag.Arg(0)
+
 	// prepare input data
-	modelFiles := []string{
-		path.Join(os.Args[1], "teapot.stl"),
-		path.Join(os.Args[1], "bunny.stl"),
-		path.Join(os.Args[1], "dragon.stl"),
+	var sceneFile *SceneFile
+	if *sceneFileName != "" {
+		sceneFile = LoadSceneFile(*sceneFileName)
+	} else {
+		sceneFile = NewDefaultSceneFile(dataDir)
+	}
+	models := sceneFile.Models
+	var manifest *AssetManifest
+	if *manifestFileName != "" {
+		manifest = LoadAssetManifest(*manifestFileName)
+	}
+	if *assetCacheDir != "" {
+		NewAssetFetcher(*assetCacheDir, manifest).FetchSceneAssets(sceneFile, false)
+	} else if manifest != nil {
+		manifest.VerifySceneAssets(sceneFile, false)
 	}
 
 	var meshes []*TriangleMesh
-	for _, modelFile := range modelFiles {
-		meshes = append(meshes, LoadTriangleMesh(modelFile))
+	for i := range models {
+		model := &models[i]
+		isStl := strings.ToLower(filepath.Ext(model.Mesh)) == ".stl"
+		var mesh *TriangleMesh
+		if *useMmap && isStl {
+			mesh = LoadStlMapped(model.Mesh)
+			model.ApplyTransform(mesh)
+		} else if *streamingChunk > 0 && isStl {
+			mesh = LoadStlStreaming(model.Mesh, *streamingChunk)
+			model.ApplyTransform(mesh)
+		} else if *useMeshCache {
+			mesh = model.LoadCachedMesh()
+		} else {
+			mesh = model.LoadMesh()
+		}
+		if *removeDuplicates {
+			if removedCount := mesh.RemoveDuplicateTriangles(); removedCount > 0 {
+				fmt.Printf("mesh [%-6s]: %d duplicate triangles removed\n",
+					model.Name, removedCount)
+			}
+		}
+		if *fixWinding {
+			if flippedCount := mesh.FixWinding(true); flippedCount > 0 {
+				fmt.Printf("mesh [%-6s]: %d triangles flipped\n", model.Name, flippedCount)
+			}
+		}
+		if *subdivisionLevels > 0 {
+			mesh = mesh.Subdivide(*subdivisionLevels)
+			fmt.Printf("mesh [%-6s]: subdivided to %d triangles\n",
+				model.Name, mesh.GetTrianglesCount())
+		}
+		meshes = append(meshes, mesh)
+	}
+
+	if *validateMeshes {
+		for i, mesh := range meshes {
+			report := ValidateMesh(mesh)
+			winding := mesh.CheckWinding()
+			fmt.Printf("mesh [%-6s]: %v, %d inconsistent winding edges\n",
+				models[i].Name, &report, winding.InconsistentEdgesCount)
+			if report.HasErrors() {
+				common.RuntimeError("invalid mesh: " + models[i].Mesh)
+			}
+		}
 	}
 
 	// run benchmark
-	start := time.Now()
+	elapsedTime := 0
 	var kdTrees []*KdTree
+	var timings []int
+	var allBuildStats []BuildStats
+	buildParams := NewBuildParams()
 	for _, mesh := range meshes {
-		builder := NewKdTreeBuilder(mesh, NewBuildParams())
-		kdTrees = append(kdTrees, builder.BuildKdTree())
+		var kdTree *KdTree
+		var buildStats BuildStats
+		minTime := 0
+		for i := 0; i < *iterations; i++ {
+			start := time.Now()
+			builder := NewKdTreeBuilder(mesh, buildParams)
+			kdTree = builder.BuildKdTree()
+			buildStats = builder.GetBuildStats()
+			timeMsec := int(time.Since(start) / time.Millisecond)
+			if i == 0 || timeMsec < minTime {
+				minTime = timeMsec
+			}
+		}
+		elapsedTime += minTime
+		kdTrees = append(kdTrees, kdTree)
+		timings = append(timings, minTime)
+		allBuildStats = append(allBuildStats, buildStats)
 	}
 
 	// communicate time to master
-	elapsedTime := int(time.Since(start) / time.Millisecond)
 	timingStorage := path.Join(filepath.Dir(os.Args[0]), "timing")
 	common.StoreBenchmarkTiming(timingStorage, elapsedTime)
 
-	// validation
-	common.AssertEqualsHex(kdTrees[0].GetHash(), 0xe044c3a15bbf0fe4,
-		"model 0: invalid kdtree hash")
-	common.AssertEqualsHex(kdTrees[1].GetHash(), 0xc3491ba1f8689922,
-		"model 1: invalid kdtree hash")
-	common.AssertEqualsHex(kdTrees[2].GetHash(), 0x255732f17a964439,
-		"model 2: invalid kdtree hash")
+	// validation, expected hashes are known only for the standard models
+	if *sceneFileName == "" && *subdivisionLevels == 0 {
+		common.AssertEqualsHex(kdTrees[0].GetHash(), 0xe044c3a15bbf0fe4,
+			"model 0: invalid kdtree hash")
+		common.AssertEqualsHex(kdTrees[1].GetHash(), 0xc3491ba1f8689922,
+			"model 1: invalid kdtree hash")
+		common.AssertEqualsHex(kdTrees[2].GetHash(), 0x255732f17a964439,
+			"model 2: invalid kdtree hash")
+	}
+
+	// the models are stored after loading, generation and transformation,
+	// so the raycast benchmark or other implementations can use them
+	if *saveModelsDir != "" {
+		savedScene := &SceneFile{}
+		for i, mesh := range meshes {
+			meshFile := models[i].Name + ".stl"
+			kdTreeFile := models[i].Name + ".kdtree"
+			mesh.SaveStl(path.Join(*saveModelsDir, meshFile))
+			kdTrees[i].SaveToFile(path.Join(*saveModelsDir, kdTreeFile))
+			savedScene.Models = append(savedScene.Models, SceneFileModel{
+				Name:   models[i].Name,
+				Mesh:   meshFile,
+				KdTree: kdTreeFile,
+			})
+		}
+		savedScene.SaveToFile(path.Join(*saveModelsDir, "scene.json"))
+	}
+
+	// build statistics, the tree cost is computed after the timed builds
+	if *printStats {
+		for i, stats := range allBuildStats {
+			stats.SAHCost = kdTrees[i].GetSAHCost(buildParams.IntersectionCost,
+				buildParams.TraversalCost)
+			fmt.Printf("stats [%-6s]: %d leaves (%d empty), %.2f triangles per leaf, "+
+				"average depth %.2f (perfect %d), %d failed splits\n",
+				models[i].Name,
+				stats.LeafCount, stats.EmptyLeafCount, stats.TrianglesPerLeaf,
+				stats.AverageDepth, stats.PerfectDepth, stats.FailedSplitCount)
+			fmt.Printf("stats [%-6s]: SAH cost %.2f, %d KB nodes, %d KB triangle indices, "+
+				"%d KB peak working memory\n",
+				models[i].Name, stats.SAHCost, stats.NodesBytes/1024,
+				stats.TriangleIndicesBytes/1024, stats.PeakWorkingBytes/1024)
+			fmt.Printf("stats [%-6s]: leaf triangles %s\n", models[i].Name,
+				formatHistogram(stats.LeafTrianglesHistogram, leafTrianglesHistogramSize-1))
+			fmt.Printf("stats [%-6s]: leaf depth %s\n", models[i].Name,
+				formatHistogram(stats.LeafDepthHistogram, -1))
+		}
+	}
+
+	// build phases, separate build is used to keep timer overhead out of
+	// the benchmark
+	if *printPhaseTimings {
+		for i, mesh := range meshes {
+			buildParams := NewBuildParams()
+			buildParams.CollectTimings = true
+			builder := NewKdTreeBuilder(mesh, buildParams)
+			builder.BuildKdTree()
+			t := builder.GetBuildTimings()
+			msec := func(d time.Duration) float64 {
+				return float64(d) / float64(time.Millisecond)
+			}
+			fmt.Printf("phases [%-6s]: total %.1f ms, triangle bounds %.1f ms, "+
+				"buffers init %.1f ms, nodes build %.1f ms (edge sort %.1f ms), "+
+				"leaf compaction %.1f ms\n",
+				models[i].Name,
+				msec(t.Total), msec(t.TriangleBounds), msec(t.BuffersInit),
+				msec(t.NodesBuild), msec(t.EdgeSort), msec(t.LeafCompaction))
+		}
+	}
+
+	// hybrid structure comparison
+	if *hybridGridRes > 0 {
+		for i, mesh := range meshes {
+			start := time.Now()
+			hybridTree := BuildHybrid(mesh, *hybridGridRes, NewBuildParams())
+			timeMsec := int(time.Since(start) / time.Millisecond)
+			fmt.Printf("hybrid [%-6s]: %d ms, %d nodes (kdtree: %d ms, %d nodes)\n",
+				models[i].Name,
+				timeMsec, hybridTree.GetNodesCount(),
+				timings[i], len(kdTrees[i].nodes))
+		}
+	}
+
+	// buildVariant builds kdtree for each model with the build parameters
+	// changed by configure and prints it next to the default kdtree. The
+	// optional details function returns variant specific statistics.
+	buildVariant := func(name string, configure func(i int, buildParams *BuildParams),
+		details func(i int, builder *KdTreeBuilder, kdTree *KdTree) string) {
+		for i, mesh := range meshes {
+			buildParams := NewBuildParams()
+			configure(i, &buildParams)
+			start := time.Now()
+			builder := NewKdTreeBuilder(mesh, buildParams)
+			kdTree := builder.BuildKdTree()
+			timeMsec := int(time.Since(start) / time.Millisecond)
+			stats := builder.GetBuildStats()
+			var variantDetails string
+			if details != nil {
+				variantDetails = ", " + details(i, builder, kdTree)
+			}
+			fmt.Printf("%s [%-6s]: %d ms, %d nodes, %.2f triangles per leaf, "+
+				"average depth %.2f%s (kdtree: %d ms, %d nodes, %.2f triangles per leaf, "+
+				"average depth %.2f)\n",
+				name, models[i].Name,
+				timeMsec, len(kdTree.nodes), stats.TrianglesPerLeaf, stats.AverageDepth,
+				variantDetails, timings[i], len(kdTrees[i].nodes),
+				allBuildStats[i].TrianglesPerLeaf, allBuildStats[i].AverageDepth)
+		}
+	}
+
+	if *sahBinCount > 0 {
+		buildVariant("binned sah", func(i int, buildParams *BuildParams) {
+			buildParams.SAHBinCount = *sahBinCount
+		}, nil)
+	}
+
+	if *splitStrategyName != "" {
+		binCount := *sahBinCount
+		if binCount <= 0 {
+			binCount = 32
+		}
+		strategy, err := NewSplitStrategy(*splitStrategyName, binCount)
+		common.Check(err)
+		buildVariant(*splitStrategyName, func(i int, buildParams *BuildParams) {
+			buildParams.SplitStrategy = strategy
+		}, nil)
+	}
+
+	if *clipTriangles {
+		buildVariant("clipped triangles", func(i int, buildParams *BuildParams) {
+			buildParams.ClipTriangles = true
+		}, nil)
+	}
+
+	if *presortEdges {
+		buildVariant("presorted edges", func(i int, buildParams *BuildParams) {
+			buildParams.PresortEdges = true
+		}, nil)
+	}
+
+	if *comparisonSort {
+		buildVariant("comparison sort", func(i int, buildParams *BuildParams) {
+			buildParams.UseRadixSort = false
+		}, func(i int, builder *KdTreeBuilder, kdTree *KdTree) string {
+			if kdTree.GetHash() != kdTrees[i].GetHash() {
+				common.RuntimeError(fmt.Sprintf(
+					"comparison sort [%s]: kdtree differs from the radix sort kdtree",
+					models[i].Name))
+			}
+			return "same kdtree"
+		})
+	}
+
+	if *tuneParams {
+		for i, mesh := range meshes {
+			results, paretoResults := TuneBuildParams(mesh, NewTunerParams())
+			fmt.Printf("tune [%-6s]: %d of %d parameter sets are Pareto-best\n",
+				models[i].Name, len(paretoResults), len(results))
+			for _, result := range paretoResults {
+				fmt.Printf("tune [%-6s]: intersection cost %g, empty bonus %g, "+
+					"leaf triangles limit %d: %d ms, %.2f Mrays/s, %d nodes, %d bytes\n",
+					models[i].Name, result.IntersectionCost, result.EmptyBonus,
+					result.LeafTrianglesLimit, int(result.BuildTime/time.Millisecond),
+					result.RaysPerSecond/1e6, result.NodesCount, result.SizeInBytes)
+			}
+		}
+	}
+
+	if *maxMemoryBytes > 0 {
+		buildVariant("memory limit", func(i int, buildParams *BuildParams) {
+			buildParams.MaxMemoryBytes = *maxMemoryBytes
+		}, func(i int, builder *KdTreeBuilder, kdTree *KdTree) string {
+			return fmt.Sprintf("max depth %d", builder.GetBuildParams().MaxDepth)
+		})
+	}
+
+	if *printProgress {
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+		for i, mesh := range meshes {
+			buildParams := NewBuildParams()
+			buildParams.ProgressFn = func(progress BuildProgress) {
+				fmt.Printf("progress [%-6s]: %d nodes, %d triangles remaining\n",
+					models[i].Name, progress.NodesCount, progress.TrianglesRemaining)
+			}
+			start := time.Now()
+			kdTree, err := NewKdTreeBuilder(mesh, buildParams).BuildKdTreeContext(ctx)
+			timeMsec := int(time.Since(start) / time.Millisecond)
+			if err != nil {
+				fmt.Printf("progress [%-6s]: build cancelled after %d ms: %v\n",
+					models[i].Name, timeMsec, err)
+				break
+			}
+			fmt.Printf("progress [%-6s]: %d ms, %d nodes (kdtree: %d ms, %d nodes)\n",
+				models[i].Name,
+				timeMsec, len(kdTree.nodes), timings[i], len(kdTrees[i].nodes))
+		}
+		stop()
+	}
+
+	if *buildParamsFileName != "" {
+		buildParamsFile := LoadBuildParamsFile(*buildParamsFileName)
+		buildVariant("build params file", func(i int, buildParams *BuildParams) {
+			var err error
+			*buildParams, err = buildParamsFile.GetBuildParams(models[i].Name, meshes[i])
+			common.Check(err)
+		}, nil)
+	}
+
+	if *buildPreset != "" {
+		buildVariant(*buildPreset+" preset", func(i int, buildParams *BuildParams) {
+			var err error
+			*buildParams, err = NewBuildParamsPreset(*buildPreset, meshes[i])
+			common.Check(err)
+		}, nil)
+	}
+
+	if *leafLimitSchedule != "" {
+		var limits []int
+		for _, limit := range strings.Split(*leafLimitSchedule, ",") {
+			value, err := strconv.Atoi(strings.TrimSpace(limit))
+			common.Check(err)
+			limits = append(limits, value)
+		}
+		buildVariant("leaf limit schedule", func(i int, buildParams *BuildParams) {
+			buildParams.LeafTrianglesLimitFn = NewLeafTrianglesLimitSchedule(limits)
+		}, func(i int, builder *KdTreeBuilder, kdTree *KdTree) string {
+			stats := builder.GetBuildStats()
+			return fmt.Sprintf("%d earlier leaves, %d additional splits",
+				stats.AdaptiveLeafCount, stats.AdaptiveSplitCount)
+		})
+	}
+
+	if *maxNodes > 0 {
+		buildVariant("node budget", func(i int, buildParams *BuildParams) {
+			buildParams.MaxNodes = *maxNodes
+		}, func(i int, builder *KdTreeBuilder, kdTree *KdTree) string {
+			return fmt.Sprintf("%d budget leaves", builder.GetBuildStats().NodeBudgetLeafCount)
+		})
+	}
+
+	if *canonicalOrder {
+		buildVariant("canonical order", func(i int, buildParams *BuildParams) {
+			buildParams.CanonicalEdgeOrder = true
+		}, func(i int, builder *KdTreeBuilder, kdTree *KdTree) string {
+			buildParams := builder.GetBuildParams()
+			buildParams.PresortEdges = true
+			presortedKdTree := NewKdTreeBuilder(meshes[i], buildParams).BuildKdTree()
+			if kdTree.GetHash() != presortedKdTree.GetHash() {
+				common.RuntimeError(fmt.Sprintf(
+					"canonical order [%s]: presorted edges kdtree differs", models[i].Name))
+			}
+			return fmt.Sprintf("hash %#x", kdTree.GetHash())
+		})
+	}
+
+	if *optimizeTree {
+		buildVariant("optimized", func(i int, buildParams *BuildParams) {
+			buildParams.OptimizeTree = true
+		}, func(i int, builder *KdTreeBuilder, kdTree *KdTree) string {
+			stats := builder.GetBuildStats()
+			return fmt.Sprintf("SAH cost %.2f -> %.2f, %d subtrees collapsed, %d leaves split",
+				stats.CostBeforeOptimization, stats.CostAfterOptimization,
+				stats.CollapsedSubtreeCount, stats.ResplitLeafCount)
+		})
+	}
+
+	// decimated models, the tiers are generated before the timing starts
+	if *decimationTiers != "" {
+		for _, tier := range strings.Split(*decimationTiers, ",") {
+			trianglesCount, err := strconv.Atoi(strings.TrimSpace(tier))
+			common.Check(err)
+			for i, mesh := range meshes {
+				decimated := mesh.DecimateToTrianglesCount(trianglesCount)
+				start := time.Now()
+				kdTree := NewKdTreeBuilder(decimated, NewBuildParams()).BuildKdTree()
+				timeMsec := int(time.Since(start) / time.Millisecond)
+				fmt.Printf("decimated [%-6s]: %d triangles, %d ms, %d nodes "+
+					"(kdtree: %d triangles, %d ms, %d nodes)\n",
+					models[i].Name, decimated.GetTrianglesCount(), timeMsec,
+					len(kdTree.nodes), mesh.GetTrianglesCount(), timings[i],
+					len(kdTrees[i].nodes))
+			}
+		}
+	}
+
+	// BVH comparison
+	if *compareBVH {
+		for i, mesh := range meshes {
+			start := time.Now()
+			bvhParams := NewBVHBuildParams()
+			bvhParams.SpatialSplitAlpha = float32(*bvhSpatialAlpha)
+			bvh := BuildBVH(mesh, bvhParams)
+			timeMsec := int(time.Since(start) / time.Millisecond)
+			fmt.Printf("bvh [%-6s]: %d ms, %d nodes, %d triangle references "+
+				"(kdtree: %d ms, %d nodes)\n",
+				models[i].Name,
+				timeMsec, bvh.GetNodesCount(), bvh.GetReferencesCount(),
+				timings[i], len(kdTrees[i].nodes))
+		}
+	}
+
+	// linear BVH comparison
+	if *compareLBVH {
+		for i, mesh := range meshes {
+			start := time.Now()
+			lbvh := BuildLBVH(mesh, NewBVHBuildParams())
+			timeMsec := int(time.Since(start) / time.Millisecond)
+			fmt.Printf("lbvh [%-6s]: %d ms, %d nodes (kdtree: %d ms, %d nodes)\n",
+				models[i].Name,
+				timeMsec, lbvh.GetNodesCount(), timings[i], len(kdTrees[i].nodes))
+		}
+	}
+
+	// hierarchical linear BVH comparison
+	if *compareHLBVH {
+		for i, mesh := range meshes {
+			start := time.Now()
+			hlbvh := BuildHLBVH(mesh, NewBVHBuildParams())
+			timeMsec := int(time.Since(start) / time.Millisecond)
+			fmt.Printf("hlbvh [%-6s]: %d ms, %d nodes (kdtree: %d ms, %d nodes)\n",
+				models[i].Name,
+				timeMsec, hlbvh.GetNodesCount(), timings[i], len(kdTrees[i].nodes))
+		}
+	}
+
+	// bounding interval hierarchy comparison
+	if *compareBIH {
+		for i, mesh := range meshes {
+			start := time.Now()
+			bih := BuildBIH(mesh, NewBIHBuildParams())
+			timeMsec := int(time.Since(start) / time.Millisecond)
+			fmt.Printf("bih [%-6s]: %d ms, %d nodes (kdtree: %d ms, %d nodes)\n",
+				models[i].Name,
+				timeMsec, bih.GetNodesCount(), timings[i], len(kdTrees[i].nodes))
+		}
+	}
+
+	// accelerators selected by name
+	if *acceleratorNames != "" {
+		for _, name := range strings.Split(*acceleratorNames, ",") {
+			name = strings.TrimSpace(name)
+			for i, mesh := range meshes {
+				accelerator, err := NewAccelerator(name)
+				common.Check(err)
+				start := time.Now()
+				accelerator.Build(mesh)
+				timeMsec := int(time.Since(start) / time.Millisecond)
+				stats := accelerator.Stats()
+				fmt.Printf("%s [%-6s]: %d ms, %d nodes, %d triangle references "+
+					"(kdtree: %d ms, %d nodes)\n",
+					name, models[i].Name, timeMsec, stats.NodesCount, stats.ReferencesCount,
+					timings[i], len(kdTrees[i].nodes))
+			}
+		}
+	}
+
+	// lazy subtree construction, the first frame pays for the subtrees
+	// reached by the camera rays
+	if *lazyDepth > 0 {
+		const frameWidth, frameHeight = 256, 256
+		for i, mesh := range meshes {
+			start := time.Now()
+			lazyTree := BuildLazyKdTree(mesh, NewBuildParams(), *lazyDepth)
+			buildTimeMsec := int(time.Since(start) / time.Millisecond)
+
+			camera := NewCameraForBounds(kdTrees[i].meshBounds)
+			start = time.Now()
+			for y := 0; y < frameHeight; y++ {
+				for x := 0; x < frameWidth; x++ {
+					ray := camera.GenerateRay(x, y, frameWidth, frameHeight)
+					lazyTree.Intersect(&ray)
+				}
+			}
+			frameTimeMsec := int(time.Since(start) / time.Millisecond)
+			fmt.Printf("lazy [%-6s]: %d ms, first frame %d ms, %d of %d subtrees built, "+
+				"%d nodes (kdtree: %d ms, %d nodes)\n",
+				models[i].Name, buildTimeMsec, frameTimeMsec,
+				lazyTree.GetExpandedSubtreesCount(), lazyTree.GetLazySubtreesCount(),
+				lazyTree.GetNodesCount(), timings[i], len(kdTrees[i].nodes))
+		}
+	}
+
+	// dynamic scene, refit of the trees after mesh deformation
+	if *dynamicFrames > 0 {
+		msec := func(d time.Duration) float64 {
+			return float64(d) / float64(time.Millisecond)
+		}
+		for i, mesh := range meshes {
+			stats := RunDynamicScene(mesh, *dynamicFrames)
+			fmt.Printf("dynamic [%-6s]: %d frames, kdtree refit %.1f ms, %d triangle references "+
+				"(rebuild: %.1f ms, %d triangle references), bvh refit %.1f ms "+
+				"(rebuild: %.1f ms)\n",
+				models[i].Name, *dynamicFrames,
+				msec(stats.KdTreeRefitTime), stats.KdTreeRefitReferences,
+				msec(stats.KdTreeBuildTime), stats.KdTreeBuildReferences,
+				msec(stats.BVHRefitTime), msec(stats.BVHBuildTime))
+		}
+	}
+
+	// baselines
+	if *checkBaseline || *updateBaseline {
+		passed := true
+		for i, model := range models {
+			name := model.Name
+			baselineFile := path.Join(sceneFile.Dir, name+".baseline.json")
+			actual := NewBaseline(kdTrees[i], timings[i])
+
+			if *updateBaseline {
+				actual.SaveToFile(baselineFile)
+			} else if !CheckBaseline(name, actual, LoadBaseline(baselineFile),
+				*baselineTolerance) {
+				passed = false
+			}
+		}
+		if !passed {
+			common.ValidationError("baseline check failed")
+		}
+	}
 }
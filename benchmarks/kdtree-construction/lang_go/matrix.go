@@ -0,0 +1,128 @@
+package main
+
+import (
+	"math"
+)
+
+// Matrix4 is a 4x4 row-major affine transform. Points are treated as column
+// vectors, so the translation is stored in elements 3, 7 and 11.
+type Matrix4 [16]float64
+
+func NewIdentityMatrix4() Matrix4 {
+	return Matrix4{
+		1, 0, 0, 0,
+		0, 1, 0, 0,
+		0, 0, 1, 0,
+		0, 0, 0, 1,
+	}
+}
+
+func NewTranslationMatrix4(translation Vector64) Matrix4 {
+	m := NewIdentityMatrix4()
+	m[3] = translation[0]
+	m[7] = translation[1]
+	m[11] = translation[2]
+	return m
+}
+
+func NewScaleMatrix4(scale Vector64) Matrix4 {
+	m := NewIdentityMatrix4()
+	m[0] = scale[0]
+	m[5] = scale[1]
+	m[10] = scale[2]
+	return m
+}
+
+// NewRotationMatrix4 returns rotation around the axis by the angle in
+// radians. The rotation is counterclockwise when looking against the axis.
+func NewRotationMatrix4(axis Vector64, angle float64) Matrix4 {
+	a := VNormalized64(axis)
+	sin, cos := math.Sincos(angle)
+	k := 1.0 - cos
+
+	m := NewIdentityMatrix4()
+	m[0] = cos + a[0]*a[0]*k
+	m[1] = a[0]*a[1]*k - a[2]*sin
+	m[2] = a[0]*a[2]*k + a[1]*sin
+	m[4] = a[1]*a[0]*k + a[2]*sin
+	m[5] = cos + a[1]*a[1]*k
+	m[6] = a[1]*a[2]*k - a[0]*sin
+	m[8] = a[2]*a[0]*k - a[1]*sin
+	m[9] = a[2]*a[1]*k + a[0]*sin
+	m[10] = cos + a[2]*a[2]*k
+	return m
+}
+
+// Matrix4Mul returns m1 * m2, i.e. the transform that applies m2 first.
+func Matrix4Mul(m1, m2 Matrix4) Matrix4 {
+	var m Matrix4
+	for row := 0; row < 4; row++ {
+		for col := 0; col < 4; col++ {
+			sum := 0.0
+			for k := 0; k < 4; k++ {
+				sum += m1[row*4+k] * m2[k*4+col]
+			}
+			m[row*4+col] = sum
+		}
+	}
+	return m
+}
+
+func (m *Matrix4) TransformPoint(p Vector64) Vector64 {
+	return Vector64{
+		m[0]*p[0] + m[1]*p[1] + m[2]*p[2] + m[3],
+		m[4]*p[0] + m[5]*p[1] + m[6]*p[2] + m[7],
+		m[8]*p[0] + m[9]*p[1] + m[10]*p[2] + m[11],
+	}
+}
+
+// TransformVector transforms direction vector, translation is not applied.
+func (m *Matrix4) TransformVector(v Vector64) Vector64 {
+	return Vector64{
+		m[0]*v[0] + m[1]*v[1] + m[2]*v[2],
+		m[4]*v[0] + m[5]*v[1] + m[6]*v[2],
+		m[8]*v[0] + m[9]*v[1] + m[10]*v[2],
+	}
+}
+
+// Determinant returns the determinant of the upper-left 3x3 block. It is
+// negative for transforms that mirror the geometry.
+func (m *Matrix4) Determinant() float64 {
+	return m[0]*(m[5]*m[10]-m[6]*m[9]) -
+		m[1]*(m[4]*m[10]-m[6]*m[8]) +
+		m[2]*(m[4]*m[9]-m[5]*m[8])
+}
+
+// Inverse returns the inverse of the affine transform. The second value is
+// false if the matrix is singular.
+func (m *Matrix4) Inverse() (Matrix4, bool) {
+	// inverse of the upper-left 3x3 block via cofactors
+	a := [3][3]float64{
+		{m[0], m[1], m[2]},
+		{m[4], m[5], m[6]},
+		{m[8], m[9], m[10]},
+	}
+	c := [3][3]float64{
+		{a[1][1]*a[2][2] - a[1][2]*a[2][1], a[0][2]*a[2][1] - a[0][1]*a[2][2], a[0][1]*a[1][2] - a[0][2]*a[1][1]},
+		{a[1][2]*a[2][0] - a[1][0]*a[2][2], a[0][0]*a[2][2] - a[0][2]*a[2][0], a[0][2]*a[1][0] - a[0][0]*a[1][2]},
+		{a[1][0]*a[2][1] - a[1][1]*a[2][0], a[0][1]*a[2][0] - a[0][0]*a[2][1], a[0][0]*a[1][1] - a[0][1]*a[1][0]},
+	}
+	det := a[0][0]*c[0][0] + a[0][1]*c[1][0] + a[0][2]*c[2][0]
+	if det == 0.0 {
+		return Matrix4{}, false
+	}
+	invDet := 1.0 / det
+
+	var inv Matrix4
+	for row := 0; row < 3; row++ {
+		for col := 0; col < 3; col++ {
+			inv[row*4+col] = c[row][col] * invDet
+		}
+	}
+	translation := inv.TransformVector(Vector64{m[3], m[7], m[11]})
+	inv[3] = -translation[0]
+	inv[7] = -translation[1]
+	inv[11] = -translation[2]
+	inv[15] = 1
+	return inv, true
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestQBVHAgreesWithKdTree(t *testing.T) {
+	mesh := LoadTriangleMesh(teapotStl)
+	kdTree := NewKdTreeBuilder(mesh, NewBuildParams()).BuildKdTree()
+	bvh := BuildBVH(mesh, NewBVHBuildParams())
+	qbvh := NewQBVH(bvh)
+	if qbvh.GetNodesCount() >= bvh.GetNodesCount() {
+		t.Errorf("qbvh has %d nodes, binary bvh has %d nodes", qbvh.GetNodesCount(),
+			bvh.GetNodesCount())
+	}
+
+	camera := NewCameraForBounds(kdTree.meshBounds)
+	const width, height = 64, 64
+	hitsCount := 0
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			ray := camera.GenerateRay(x, y, width, height)
+			hitFound, intersection := kdTree.Intersect(&ray)
+			qbvhHitFound, qbvhIntersection := qbvh.Intersect(&ray)
+			if hitFound != qbvhHitFound {
+				t.Errorf("pixel (%d, %d): qbvh hit is %v, kdtree hit is %v", x, y,
+					qbvhHitFound, hitFound)
+				continue
+			}
+			if !hitFound {
+				continue
+			}
+			hitsCount++
+			// the closest hit is the same, several triangles can share it
+			// on edges, so only the distance is compared
+			if math.Abs(qbvhIntersection.t-intersection.t) > 1e-9*intersection.t {
+				t.Errorf("pixel (%d, %d): qbvh hit at t = %g, kdtree hit at t = %g",
+					x, y, qbvhIntersection.t, intersection.t)
+			}
+		}
+	}
+	if hitsCount == 0 {
+		t.Fatalf("no rays hit the mesh")
+	}
+}
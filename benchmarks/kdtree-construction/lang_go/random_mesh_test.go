@@ -0,0 +1,93 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func newPathologicalGenOpts(clustersCount int) GenOpts {
+	opts := NewGenOpts()
+	opts.ClustersCount = clustersCount
+	opts.CoincidentFraction = 0.05
+	opts.SliverFraction = 0.05
+	opts.DegenerateFraction = 0.05
+	opts.TinyFraction = 0.05
+	opts.HugeFraction = 0.01
+	return opts
+}
+
+func TestGenerateRandomMeshIsDeterministic(t *testing.T) {
+	opts := newPathologicalGenOpts(4)
+	mesh := GenerateRandomMesh(1000, 7, opts)
+	sameMesh := GenerateRandomMesh(1000, 7, opts)
+	if !reflect.DeepEqual(mesh.vertices, sameMesh.vertices) ||
+		!reflect.DeepEqual(mesh.triangles, sameMesh.triangles) {
+		t.Errorf("meshes generated with the same seed differ")
+	}
+	otherMesh := GenerateRandomMesh(1000, 8, opts)
+	if reflect.DeepEqual(mesh.vertices, otherMesh.vertices) {
+		t.Errorf("meshes generated with different seeds are equal")
+	}
+
+	buildParams := NewBuildParams()
+	hash := NewKdTreeBuilder(mesh, buildParams).BuildKdTree().GetHash()
+	if sameHash := NewKdTreeBuilder(sameMesh, buildParams).BuildKdTree().GetHash(); hash != sameHash {
+		t.Errorf("kdtrees of the same generated mesh differ: %x, %x", hash, sameHash)
+	}
+}
+
+func FuzzBuildKdTree(f *testing.F) {
+	f.Add(uint64(1), uint16(1), uint8(0))
+	f.Add(uint64(2), uint16(100), uint8(0))
+	f.Add(uint64(3), uint16(2000), uint8(1))
+	f.Add(uint64(11), uint16(4000), uint8(4))
+
+	f.Fuzz(func(t *testing.T, seed uint64, trianglesCount uint16, clustersCount uint8) {
+		mesh := GenerateRandomMesh(int(trianglesCount)%5000+1, seed,
+			newPathologicalGenOpts(int(clustersCount)%8))
+		// Verify checks that the triangle indices are in range and the
+		// tree is finite and acyclic
+		kdTree := NewKdTreeBuilder(mesh, NewBuildParams()).BuildKdTree()
+		if err := kdTree.Verify(); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestGenerateRandomMeshClusters(t *testing.T) {
+	opts := NewGenOpts()
+	uniformBounds := GenerateRandomMesh(2000, 5, opts).GetBounds()
+
+	// regular triangles start within ClusterRadius from the center and
+	// extend by up to TriangleSize
+	opts.ClustersCount = 1
+	mesh := GenerateRandomMesh(2000, 5, opts)
+	clusteredBounds := mesh.GetBounds()
+	maxExtent := 2*opts.Extent*opts.ClusterRadius + opts.Extent*opts.TriangleSize
+	for k := 0; k < 3; k++ {
+		extent := clusteredBounds.maxPoint[k] - clusteredBounds.minPoint[k]
+		if extent > maxExtent {
+			t.Errorf("axis %d: clustered mesh extent is %g, expected at most %g",
+				k, extent, maxExtent)
+		}
+		if uniformExtent := uniformBounds.maxPoint[k] - uniformBounds.minPoint[k]; uniformExtent < 0.9*opts.Extent {
+			t.Errorf("axis %d: uniform mesh extent is %g, expected about %g",
+				k, uniformExtent, opts.Extent)
+		}
+	}
+
+	for _, generator := range []string{"random", "random-clustered"} {
+		mesh, err := GenerateMesh(generator, 1234)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if mesh.GetTrianglesCount() != 1234 {
+			t.Errorf("%s: generated %d triangles, expected 1234", generator,
+				mesh.GetTrianglesCount())
+		}
+		sameMesh, _ := GenerateMesh(generator, 1234)
+		if !reflect.DeepEqual(mesh.vertices, sameMesh.vertices) {
+			t.Errorf("%s: generated meshes differ", generator)
+		}
+	}
+}
@@ -1,9 +1,21 @@
 package main
 
+import "math"
+
 type Ray struct {
 	origin       Vector64
 	direction    Vector64
 	invDirection Vector64
+
+	// Intersections closer than epsilon are ignored. Secondary rays that
+	// start on the surface should use non-zero epsilon to avoid reporting
+	// intersection with the originating triangle due to floating point error.
+	epsilon float64
+
+	// If cullBackfaces is set then intersections with triangles which are
+	// back-facing with respect to the ray are ignored. Front face has
+	// counter-clockwise vertex order when viewed from the ray origin.
+	cullBackfaces bool
 }
 
 func RayFromOriginAndDirection(origin, direction Vector64) Ray {
@@ -35,6 +47,35 @@ func (ray *Ray) SetDirection(direction Vector64) {
 	ray.invDirection = Vector64{1.0 / direction[0], 1.0 / direction[1], 1.0 / direction[2]}
 }
 
+// HasValidDirection returns false if the direction is a zero vector or has
+// non-finite components. Such rays do not intersect anything. Zero
+// direction components are valid, the inverse direction has signed infinity
+// for them.
+func (ray *Ray) HasValidDirection() bool {
+	for _, c := range ray.direction {
+		if math.IsNaN(c) || math.IsInf(c, 0) {
+			return false
+		}
+	}
+	return ray.direction != Vector64{}
+}
+
+func (ray *Ray) GetEpsilon() float64 {
+	return ray.epsilon
+}
+
+func (ray *Ray) SetEpsilon(epsilon float64) {
+	ray.epsilon = epsilon
+}
+
+func (ray *Ray) GetCullBackfaces() bool {
+	return ray.cullBackfaces
+}
+
+func (ray *Ray) SetCullBackfaces(cullBackfaces bool) {
+	ray.cullBackfaces = cullBackfaces
+}
+
 func (ray *Ray) Advance(t float64) {
 	ray.origin = ray.GetPoint(t)
 }
@@ -42,3 +83,28 @@ func (ray *Ray) Advance(t float64) {
 func (ray *Ray) GetPoint(t float64) Vector64 {
 	return VAdd64(ray.origin, VMul64(ray.direction, t))
 }
+
+// Transformed returns the ray transformed by the given matrix. It is used to
+// intersect an instance of the kdtree in the tree's local space, in this
+// case inverse is the inverse of the instance transform.
+//
+// The transformed direction is intentionally not normalized. The point at
+// parameter t of the transformed ray is the local space image of the point
+// at the same t of the original ray, so the hit parameter found in local
+// space can be used with the original ray directly. Use GetHitDistance of
+// the original ray to convert the parameter to the world space distance.
+func (ray *Ray) Transformed(inverse *Matrix4) Ray {
+	transformed := Ray{
+		origin:        inverse.TransformPoint(ray.origin),
+		epsilon:       ray.epsilon,
+		cullBackfaces: ray.cullBackfaces,
+	}
+	transformed.SetDirection(inverse.TransformVector(ray.direction))
+	return transformed
+}
+
+// GetHitDistance converts the ray parameter to the distance from the ray
+// origin. The conversion is the identity for the normalized direction.
+func (ray *Ray) GetHitDistance(t float64) float64 {
+	return t * VLength64(ray.direction)
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestIntersectTransformedInstances(t *testing.T) {
+	// unit cube kdtree referenced by translated and scaled instances
+	kdTree := NewKdTreeBuilder(newCubeMesh(Vector32{0, 0, 0}, 1), NewBuildParams()).BuildKdTree()
+
+	tests := []struct {
+		name          string
+		transform     Matrix4
+		origin        Vector64
+		direction     Vector64
+		expectedT     float64
+		expectedPoint Vector64
+	}{
+		{"translated", NewTranslationMatrix4(Vector64{5, 0, 0}),
+			Vector64{5.3, 0.6, -2}, Vector64{0, 0, 1}, 2, Vector64{5.3, 0.6, 0}},
+		// the local direction has length 0.5, the hit parameter is still
+		// the world space one
+		{"scaled", NewScaleMatrix4(Vector64{2, 2, 2}),
+			Vector64{0.6, 1.2, -2}, Vector64{0, 0, 1}, 2, Vector64{0.6, 1.2, 0}},
+		// not normalized world direction, the distance is 2 but t is 1
+		{"scaled, long direction", NewScaleMatrix4(Vector64{2, 2, 2}),
+			Vector64{0.6, 1.2, -2}, Vector64{0, 0, 2}, 1, Vector64{0.6, 1.2, 0}},
+	}
+
+	for _, test := range tests {
+		inverse, ok := test.transform.Inverse()
+		if !ok {
+			t.Fatalf("%s: transform is singular", test.name)
+		}
+		ray := RayFromOriginAndDirection(test.origin, test.direction)
+		localRay := ray.Transformed(&inverse)
+		hitFound, intersection := kdTree.Intersect(&localRay)
+		if !hitFound {
+			t.Errorf("%s: ray misses the instance", test.name)
+			continue
+		}
+		if math.Abs(intersection.t-test.expectedT) > 1e-9 {
+			t.Errorf("%s: hit at t = %g, expected %g", test.name, intersection.t,
+				test.expectedT)
+		}
+		if distance := ray.GetHitDistance(intersection.t); math.Abs(distance-2) > 1e-9 {
+			t.Errorf("%s: hit distance is %g, expected 2", test.name, distance)
+		}
+		point := ray.GetPoint(intersection.t)
+		if VLength64(VSub64(point, test.expectedPoint)) > 1e-9 {
+			t.Errorf("%s: hit point is %v, expected %v", test.name, point,
+				test.expectedPoint)
+		}
+	}
+
+	// the direction is transformed without normalization
+	scale := NewScaleMatrix4(Vector64{0.5, 0.5, 0.5})
+	ray := RayFromOriginAndDirection(Vector64{}, Vector64{0, 0, 1})
+	localRay := ray.Transformed(&scale)
+	if direction := localRay.GetDirection(); direction != (Vector64{0, 0, 0.5}) {
+		t.Errorf("transformed direction is %v, expected (0, 0, 0.5)", direction)
+	}
+}
+
+func TestRayDirections(t *testing.T) {
+	kdTree := NewKdTreeBuilder(newCubeMesh(Vector32{0, 0, 0}, 1), NewBuildParams()).BuildKdTree()
+	center := Vector64{0.5, 0.5, 0.5}
+
+	tests := []struct {
+		name      string
+		origin    Vector64
+		direction Vector64
+		valid     bool
+	}{
+		{"zero", Vector64{0.5, 0.5, -1}, Vector64{0, 0, 0}, false},
+		{"NaN", Vector64{0.5, 0.5, -1}, Vector64{0, 0, math.NaN()}, false},
+		{"infinite", Vector64{0.5, 0.5, -1}, Vector64{0, 0, math.Inf(+1)}, false},
+		{"axis-parallel", Vector64{0.3, 0.6, -1}, Vector64{0, 0, 1}, true},
+		{"axis-parallel negative", Vector64{0.3, 0.6, 2}, Vector64{0, 0, -1}, true},
+		{"general", Vector64{-1, -2, -3}, VNormalized64(VSub64(center, Vector64{-1, -2, -3})), true},
+	}
+
+	for _, test := range tests {
+		ray := RayFromOriginAndDirection(test.origin, test.direction)
+		if ray.HasValidDirection() != test.valid {
+			t.Errorf("%s: valid direction %v, expected %v", test.name,
+				ray.HasValidDirection(), test.valid)
+		}
+		// rays with invalid direction are not intersected, valid rays hit
+		// the cube
+		if hitFound, _ := kdTree.Intersect(&ray); hitFound != test.valid {
+			t.Errorf("%s: hit found %v, expected %v", test.name, hitFound, test.valid)
+		}
+		if occluded := kdTree.Occluded(&ray, 0, math.Inf(+1)); occluded != test.valid {
+			t.Errorf("%s: occluded %v, expected %v", test.name, occluded, test.valid)
+		}
+		expectedHits := 0
+		if test.valid {
+			expectedHits = 2
+		}
+		if hits := len(kdTree.IntersectAll(&ray, 0, math.Inf(+1))); hits != expectedHits {
+			t.Errorf("%s: %d intersections, expected %d", test.name, hits, expectedHits)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"math"
+	"sort"
+)
+
+type SceneMesh struct {
+	Mesh      *TriangleMesh
+	Transform Matrix4
+}
+
+// Scene holds multiple meshes with per-mesh transforms and builds a single
+// kdtree over all their triangles. The kdtree is built for a combined mesh
+// with transformed vertices. Global triangle index is a local triangle index
+// plus the offset of the mesh's first triangle.
+type Scene struct {
+	meshes          []SceneMesh
+	triangleOffsets []int32
+	combinedMesh    *TriangleMesh
+	kdTree          *KdTree
+}
+
+type SceneIntersection struct {
+	t             float64
+	epsilon       float64
+	b1            float64 // barycentric coordinates of the hit point
+	b2            float64
+	meshIndex     int
+	triangleIndex int32 // local to the mesh
+	materialID    int32 // -1 if the mesh does not have material assignments
+}
+
+func NewScene() *Scene {
+	return &Scene{}
+}
+
+// AddMesh adds the mesh to the scene and returns its index. Build should be
+// called after all meshes are added.
+func (scene *Scene) AddMesh(mesh *TriangleMesh, transform Matrix4) int {
+	scene.meshes = append(scene.meshes, SceneMesh{mesh, transform})
+	return len(scene.meshes) - 1
+}
+
+func (scene *Scene) Build(buildParams BuildParams) {
+	combinedMesh := new(TriangleMesh)
+	scene.triangleOffsets = scene.triangleOffsets[:0]
+
+	hasMaterials := false
+	for _, sceneMesh := range scene.meshes {
+		hasMaterials = hasMaterials || sceneMesh.Mesh.materialIDs != nil
+	}
+
+	for _, sceneMesh := range scene.meshes {
+		vertexOffset := int32(len(combinedMesh.vertices))
+		scene.triangleOffsets = append(scene.triangleOffsets,
+			combinedMesh.GetTrianglesCount())
+
+		for _, v := range sceneMesh.Mesh.vertices {
+			p := sceneMesh.Transform.TransformPoint(NewVector64FromVector32(v))
+			combinedMesh.vertices = append(combinedMesh.vertices,
+				Vector32{float32(p[0]), float32(p[1]), float32(p[2])})
+		}
+		for _, indices := range sceneMesh.Mesh.triangles {
+			combinedMesh.triangles = append(combinedMesh.triangles, [3]int32{
+				indices[0] + vertexOffset,
+				indices[1] + vertexOffset,
+				indices[2] + vertexOffset,
+			})
+		}
+		if hasMaterials {
+			for i := int32(0); i < sceneMesh.Mesh.GetTrianglesCount(); i++ {
+				combinedMesh.materialIDs = append(combinedMesh.materialIDs,
+					sceneMesh.Mesh.GetMaterialID(i))
+			}
+		}
+	}
+
+	scene.combinedMesh = combinedMesh
+	scene.kdTree = NewKdTreeBuilder(combinedMesh, buildParams).BuildKdTree()
+}
+
+// GetMeshTriangle converts global triangle index to mesh index and local
+// triangle index.
+func (scene *Scene) GetMeshTriangle(globalTriangleIndex int32) (meshIndex int,
+	triangleIndex int32) {
+	meshIndex = sort.Search(len(scene.triangleOffsets), func(i int) bool {
+		return scene.triangleOffsets[i] > globalTriangleIndex
+	}) - 1
+	return meshIndex, globalTriangleIndex - scene.triangleOffsets[meshIndex]
+}
+
+func (scene *Scene) Intersect(ray *Ray) (bool, SceneIntersection) {
+	hitFound, intersection := scene.kdTree.Intersect(ray)
+	if !hitFound {
+		return false, SceneIntersection{t: math.Inf(+1), meshIndex: -1}
+	}
+
+	meshIndex, triangleIndex := scene.GetMeshTriangle(intersection.triangleIndex)
+	return true, SceneIntersection{
+		t:             intersection.t,
+		epsilon:       intersection.epsilon,
+		b1:            intersection.b1,
+		b2:            intersection.b2,
+		meshIndex:     meshIndex,
+		triangleIndex: triangleIndex,
+		materialID:    intersection.materialID,
+	}
+}
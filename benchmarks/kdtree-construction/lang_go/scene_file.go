@@ -0,0 +1,200 @@
+package main
+
+import (
+	"common"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// SceneFileModel describes a single benchmark model. The mesh is either
+// loaded from the file or created by the procedural generator (see
+// GenerateMesh) with the given number of triangles. The transform is
+// either the full row-major matrix or the composition of translation,
+// rotation and scale (scale is applied first). Rotation is the axis and the
+// angle in degrees. Missing mesh and kdtree files can be downloaded from
+// the given URLs, see AssetFetcher.
+type SceneFileModel struct {
+	Name         string      `json:"name,omitempty"` // mesh file name without extension by default
+	Mesh         string      `json:"mesh,omitempty"`
+	MeshURL      string      `json:"mesh_url,omitempty"`
+	MeshSHA256   string      `json:"mesh_sha256,omitempty"`
+	Generator    string      `json:"generator,omitempty"`
+	Triangles    int         `json:"triangles,omitempty"`
+	KdTree       string      `json:"kdtree,omitempty"`
+	KdTreeURL    string      `json:"kdtree_url,omitempty"`
+	KdTreeSHA256 string      `json:"kdtree_sha256,omitempty"`
+	Matrix       *Matrix4    `json:"matrix,omitempty"`
+	Translation  *Vector64   `json:"translation,omitempty"`
+	Rotation     *[4]float64 `json:"rotation,omitempty"`
+	Scale        *Vector64   `json:"scale,omitempty"`
+}
+
+// SceneFile lists the models used by the benchmarks:
+//
+//	{
+//	    "models": [
+//	        {"mesh": "teapot.stl", "kdtree": "teapot.kdtree"},
+//	        {"mesh": "bunny.obj", "scale": [10, 10, 10]},
+//	        {"generator": "sphere", "triangles": 100000},
+//	        {"mesh": "buddha.stl", "mesh_url": "https://...", "mesh_sha256": "..."}
+//	    ]
+//	}
+//
+// Relative file paths are resolved against the scene file directory.
+type SceneFile struct {
+	Models []SceneFileModel `json:"models"`
+	Dir    string           `json:"-"` // directory for relative paths and baselines
+}
+
+// NewDefaultSceneFile returns the scene with the standard benchmark models
+// from the data directory.
+func NewDefaultSceneFile(dataDir string) *SceneFile {
+	scene := &SceneFile{Dir: dataDir}
+	for _, name := range []string{"teapot", "bunny", "dragon"} {
+		scene.Models = append(scene.Models, SceneFileModel{
+			Name:   name,
+			Mesh:   filepath.Join(dataDir, name+".stl"),
+			KdTree: filepath.Join(dataDir, name+".kdtree"),
+		})
+	}
+	return scene
+}
+
+func LoadSceneFile(fileName string) *SceneFile {
+	scene, err := loadSceneFile(fileName)
+	common.Check(err)
+	return scene
+}
+
+// loadSceneFile is the same as LoadSceneFile but returns an error instead
+// of reporting it.
+func loadSceneFile(fileName string) (*SceneFile, error) {
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	scene := new(SceneFile)
+	if err := json.Unmarshal(data, scene); err != nil {
+		return nil, fmt.Errorf("%s: %v", fileName, err)
+	}
+	if len(scene.Models) == 0 {
+		return nil, errors.New("scene file does not contain models: " + fileName)
+	}
+
+	scene.Dir = filepath.Dir(fileName)
+	resolvePath := func(p string) string {
+		if p == "" || filepath.IsAbs(p) {
+			return p
+		}
+		return filepath.Join(scene.Dir, p)
+	}
+
+	for i := range scene.Models {
+		model := &scene.Models[i]
+		if (model.Mesh == "") == (model.Generator == "") {
+			return nil, fmt.Errorf("%s: model %d: either mesh file or generator "+
+				"should be specified", fileName, i)
+		}
+		if model.Generator != "" && model.Triangles <= 0 {
+			return nil, fmt.Errorf("%s: model %d: triangles count is not specified",
+				fileName, i)
+		}
+		if model.Matrix != nil && (model.Translation != nil ||
+			model.Rotation != nil || model.Scale != nil) {
+			return nil, fmt.Errorf("%s: model %d: matrix can't be combined "+
+				"with translation, rotation or scale", fileName, i)
+		}
+		if model.Matrix != nil {
+			if _, ok := model.Matrix.Inverse(); !ok {
+				return nil, fmt.Errorf("%s: model %d: matrix is singular", fileName, i)
+			}
+		}
+		model.Mesh = resolvePath(model.Mesh)
+		model.KdTree = resolvePath(model.KdTree)
+		if model.Name == "" && model.Generator != "" {
+			model.Name = model.Generator
+		} else if model.Name == "" {
+			base := filepath.Base(model.Mesh)
+			base = strings.TrimSuffix(strings.TrimSuffix(base, ".gz"), ".zst")
+			model.Name = strings.TrimSuffix(base, filepath.Ext(base))
+		}
+	}
+	return scene, nil
+}
+
+// SaveToFile writes the scene file. File paths are stored as they are, so
+// they should be relative to the scene file directory or absolute.
+func (scene *SceneFile) SaveToFile(fileName string) {
+	data, err := json.MarshalIndent(scene, "", "    ")
+	common.Check(err)
+	err = os.WriteFile(fileName, append(data, '\n'), 0644)
+	common.Check(err)
+}
+
+// HasTransform returns true if the model declares any transform.
+func (model *SceneFileModel) HasTransform() bool {
+	return model.Matrix != nil || model.Translation != nil ||
+		model.Rotation != nil || model.Scale != nil
+}
+
+// GetTransform returns the model transform, identity if the model does not
+// declare a transform.
+func (model *SceneFileModel) GetTransform() Matrix4 {
+	if model.Matrix != nil {
+		return *model.Matrix
+	}
+	transform := NewIdentityMatrix4()
+	if model.Scale != nil {
+		transform = NewScaleMatrix4(*model.Scale)
+	}
+	if model.Rotation != nil {
+		r := model.Rotation
+		rotation := NewRotationMatrix4(Vector64{r[0], r[1], r[2]}, r[3]*math.Pi/180.0)
+		transform = Matrix4Mul(rotation, transform)
+	}
+	if model.Translation != nil {
+		transform = Matrix4Mul(NewTranslationMatrix4(*model.Translation), transform)
+	}
+	return transform
+}
+
+// LoadMesh loads or generates the model mesh and applies the model
+// transform.
+func (model *SceneFileModel) LoadMesh() *TriangleMesh {
+	return model.loadMesh(LoadMesh)
+}
+
+// LoadCachedMesh is the same as LoadMesh but uses meshbin cache for the
+// mesh file, see LoadMeshCached.
+func (model *SceneFileModel) LoadCachedMesh() *TriangleMesh {
+	return model.loadMesh(LoadMeshCached)
+}
+
+func (model *SceneFileModel) loadMesh(
+	loader func(fileName string) (*TriangleMesh, error)) *TriangleMesh {
+	var mesh *TriangleMesh
+	var err error
+	if model.Generator != "" {
+		mesh, err = GenerateMesh(model.Generator, model.Triangles)
+	} else {
+		mesh, err = loader(model.Mesh)
+	}
+	common.Check(err)
+	model.ApplyTransform(mesh)
+	return mesh
+}
+
+// ApplyTransform transforms the mesh loaded by other means than LoadMesh.
+// The mesh is not modified if the model does not declare a transform.
+func (model *SceneFileModel) ApplyTransform(mesh *TriangleMesh) {
+	if model.HasTransform() {
+		transform := model.GetTransform()
+		mesh.Transform(&transform)
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestSceneIntersect(t *testing.T) {
+	scene := NewScene()
+	cube := newCubeMesh(Vector32{0, 0, 0}, 1)
+	scene.AddMesh(cube, NewTranslationMatrix4(Vector64{-3, 0, 0}))
+	scene.AddMesh(cube, NewTranslationMatrix4(Vector64{3, 0, 0}))
+	scene.Build(NewBuildParams())
+
+	// the rays go down to the +z faces of the cubes, the point with y > x
+	// belongs to the second triangle of the face
+	const topFaceTriangle = 11
+	for meshIndex, x := range []float64{-3, 3} {
+		ray := RayFromOriginAndDirection(Vector64{x + 0.3, 0.6, 5}, Vector64{0, 0, -1})
+		hitFound, intersection := scene.Intersect(&ray)
+		if !hitFound {
+			t.Errorf("ray misses mesh %d", meshIndex)
+			continue
+		}
+		if intersection.meshIndex != meshIndex ||
+			intersection.triangleIndex != topFaceTriangle {
+			t.Errorf("ray hits mesh %d triangle %d, expected mesh %d triangle %d",
+				intersection.meshIndex, intersection.triangleIndex, meshIndex,
+				topFaceTriangle)
+		}
+		if math.Abs(intersection.t-4) > 1e-6 {
+			t.Errorf("mesh %d is hit at t = %g, expected 4", meshIndex, intersection.t)
+		}
+	}
+
+	ray := RayFromOriginAndDirection(Vector64{0.5, 0.5, 5}, Vector64{0, 0, -1})
+	if hitFound, intersection := scene.Intersect(&ray); hitFound {
+		t.Errorf("ray between the cubes hits mesh %d", intersection.meshIndex)
+	}
+
+	for globalTriangleIndex, expected := range map[int32][2]int32{
+		0: {0, 0}, 11: {0, 11}, 12: {1, 0}, 23: {1, 11},
+	} {
+		meshIndex, triangleIndex := scene.GetMeshTriangle(globalTriangleIndex)
+		if int32(meshIndex) != expected[0] || triangleIndex != expected[1] {
+			t.Errorf("global triangle %d maps to mesh %d triangle %d, expected %v",
+				globalTriangleIndex, meshIndex, triangleIndex, expected)
+		}
+	}
+}
@@ -5,10 +5,11 @@ type Triangle struct {
 }
 
 type TriangleIntersection struct {
-	t       float64
-	epsilon float64
-	b1      float64
-	b2      float64
+	t             float64
+	epsilon       float64
+	b1            float64
+	b2            float64
+	triangleIndex int32 // filled by acceleration structures
 }
 
 func IntersectTriangle(ray *Ray, triangle *Triangle) (bool, TriangleIntersection) {
@@ -23,6 +24,12 @@ func IntersectTriangle(ray *Ray, triangle *Triangle) (bool, TriangleIntersection
 		return false, TriangleIntersection{}
 	}
 
+	// divisor is negative dot product of ray direction and triangle normal,
+	// so it is negative for back-facing triangle
+	if divisor < 0.0 && ray.cullBackfaces {
+		return false, TriangleIntersection{}
+	}
+
 	invDivisor := 1.0 / divisor
 
 	// compute barycentric coordinate b1
@@ -41,7 +48,7 @@ func IntersectTriangle(ray *Ray, triangle *Triangle) (bool, TriangleIntersection
 
 	// compute distance from ray origin to intersection point
 	distance := invDivisor * DotProduct64(edge2, q)
-	if distance < 0.0 {
+	if distance < ray.epsilon {
 		return false, TriangleIntersection{}
 	}
 
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"math"
+)
+
+// Decimate simplifies the mesh by vertex clustering and returns the new
+// mesh, the original mesh is not modified. Mesh bounds are divided into
+// cubic cells, gridResolution cells along the longest axis, and all vertices
+// of the cell are replaced by their average position. Triangles that
+// collapse (two or more vertices in the same cell) are removed, so are the
+// duplicates of already added triangles. Triangle normals are recomputed,
+// material ids are preserved.
+//
+// Vertex clustering does not preserve topology, but it is fast and produces
+// predictable triangle counts, which is what scaling studies need.
+func (mesh *TriangleMesh) Decimate(gridResolution int) *TriangleMesh {
+	if gridResolution < 1 {
+		gridResolution = 1
+	}
+
+	bounds := mesh.GetBounds()
+	diagonal := VSub32(bounds.maxPoint, bounds.minPoint)
+	extent := math.Max(float64(diagonal[0]),
+		math.Max(float64(diagonal[1]), float64(diagonal[2])))
+	cellSize := extent / float64(gridResolution)
+	if cellSize == 0.0 {
+		cellSize = 1.0
+	}
+
+	type cellKey [3]int32
+	getCell := func(v Vector32) cellKey {
+		var key cellKey
+		for k := 0; k < 3; k++ {
+			c := int32((float64(v[k]) - float64(bounds.minPoint[k])) / cellSize)
+			if c >= int32(gridResolution) {
+				c = int32(gridResolution) - 1
+			}
+			key[k] = c
+		}
+		return key
+	}
+
+	// cluster vertices, only vertices referenced by triangles are used
+	clusters := make(map[cellKey]int32)
+	var positionSums []Vector64
+	var positionCounts []int
+	remap := make([]int32, len(mesh.vertices))
+	for i := range remap {
+		remap[i] = -1
+	}
+
+	for _, indices := range mesh.triangles {
+		for _, vertexIndex := range indices {
+			if remap[vertexIndex] != -1 {
+				continue
+			}
+			v := mesh.vertices[vertexIndex]
+			key := getCell(v)
+			cluster, found := clusters[key]
+			if !found {
+				cluster = int32(len(positionSums))
+				clusters[key] = cluster
+				positionSums = append(positionSums, Vector64{})
+				positionCounts = append(positionCounts, 0)
+			}
+			positionSums[cluster] = VAdd64(positionSums[cluster], NewVector64FromVector32(v))
+			positionCounts[cluster]++
+			remap[vertexIndex] = cluster
+		}
+	}
+
+	decimated := new(TriangleMesh)
+	decimated.vertices = make([]Vector32, len(positionSums))
+	for i, sum := range positionSums {
+		p := VMul64(sum, 1.0/float64(positionCounts[i]))
+		decimated.vertices[i] = Vector32{float32(p[0]), float32(p[1]), float32(p[2])}
+	}
+
+	// keep triangles that do not collapse, duplicates are detected by the
+	// sorted vertex indices regardless of the winding
+	uniqueTriangles := make(map[[3]int32]bool)
+	for i, indices := range mesh.triangles {
+		triangle := [3]int32{remap[indices[0]], remap[indices[1]], remap[indices[2]]}
+		if triangle[0] == triangle[1] || triangle[1] == triangle[2] ||
+			triangle[0] == triangle[2] {
+			continue
+		}
+
+		key := sortedTriangleKey(triangle)
+		if uniqueTriangles[key] {
+			continue
+		}
+		uniqueTriangles[key] = true
+
+		decimated.triangles = append(decimated.triangles, triangle)
+		if mesh.materialIDs != nil {
+			decimated.materialIDs = append(decimated.materialIDs, mesh.materialIDs[i])
+		}
+	}
+
+	decimated.normals = make([]Vector32, len(decimated.triangles))
+	for i := range decimated.triangles {
+		decimated.normals[i] = decimated.GetTriangleNormal(int32(i))
+	}
+	return decimated
+}
+
+// DecimateToTrianglesCount returns decimated mesh with the triangles count
+// close to but not greater than trianglesCount. The grid resolution is found
+// by binary search, so the result is only approximate. If the mesh already
+// has no more than trianglesCount triangles then the mesh itself is
+// returned.
+func (mesh *TriangleMesh) DecimateToTrianglesCount(trianglesCount int) *TriangleMesh {
+	if len(mesh.triangles) <= trianglesCount {
+		return mesh
+	}
+
+	// clustering result is not strictly monotonic in the resolution but
+	// close enough for the search. Degenerate and duplicate triangles are
+	// always removed, so the search should stop even if the target count is
+	// never exceeded.
+	const maxResolution = 1 << 24
+	low, high := 1, 2
+	best := mesh.Decimate(low)
+	for {
+		decimated := mesh.Decimate(high)
+		if len(decimated.triangles) > trianglesCount {
+			break
+		}
+		low, best = high, decimated
+		if high >= maxResolution {
+			return best
+		}
+		high *= 2
+	}
+	for high-low > 1 {
+		middle := (low + high) / 2
+		decimated := mesh.Decimate(middle)
+		if len(decimated.triangles) > trianglesCount {
+			high = middle
+		} else {
+			low, best = middle, decimated
+		}
+	}
+	return best
+}
@@ -1,92 +1,367 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"common"
+	"compress/gzip"
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"io"
 	"math"
 	"os"
+	"path/filepath"
+	"strings"
+	"zstd"
 )
 
-func LoadTriangleMesh(fileName string) *TriangleMesh {
-	const (
-		headerSize        = 80
-		facetSize         = 50
-		maxVerticesCount  = math.MaxInt32
-		maxTrianglesCount = math.MaxInt32
-	)
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
 
-	file, err := os.Open(fileName)
-	common.Check(err)
-	defer file.Close()
+// isCompressed returns true if the data starts with the magic bytes of
+// supported compression format.
+func isCompressed(data []byte) bool {
+	return bytes.HasPrefix(data, gzipMagic) || bytes.HasPrefix(data, zstdMagic)
+}
 
-	// get file size
-	stat, err := file.Stat()
-	common.Check(err)
-	fileSize := stat.Size()
+// newFileReader returns buffered reader for the given file. Gzip and
+// Zstandard compressed files (detected by the magic bytes) are decompressed
+// transparently.
+func newFileReader(file *os.File) (io.Reader, error) {
+	reader := bufio.NewReader(file)
 
-	// read file content
-	fileContent := make([]byte, fileSize)
-	bytesRead, err := file.Read(fileContent)
+	magic, _ := reader.Peek(len(zstdMagic))
+	if bytes.HasPrefix(magic, gzipMagic) {
+		gzipReader, err := gzip.NewReader(reader)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", file.Name(), err)
+		}
+		return gzipReader, nil
+	}
+	if bytes.HasPrefix(magic, zstdMagic) {
+		return zstd.NewReader(reader), nil
+	}
+	return reader, nil
+}
+
+// LoadTriangleMesh loads binary stl file. Binary stl data is little-endian
+// by specification and is decoded explicitly as such.
+func LoadTriangleMesh(fileName string) *TriangleMesh {
+	mesh, err := loadStl(fileName)
 	common.Check(err)
+	return mesh
+}
 
-	if int64(bytesRead) != fileSize {
-		common.RuntimeError(fmt.Sprintf("failed to read %d bytes from file %s",
-			fileSize, fileName))
+// loadStl is the same as LoadTriangleMesh but returns an error instead of
+// reporting it.
+func loadStl(fileName string) (*TriangleMesh, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
 	}
+	defer file.Close()
 
-	// validate file content
-	asciiStlHeader := []byte{0x73, 0x6f, 0x6c, 0x69, 0x64}
-	if bytes.Equal(fileContent[0:5], asciiStlHeader) {
-		common.RuntimeError("ascii stl files are not supported: " + fileName)
+	// read file content, compressed files are fully decompressed since
+	// the size of the uncompressed data is needed for validation
+	reader, err := newFileReader(file)
+	if err != nil {
+		return nil, err
 	}
-
-	if fileSize < headerSize+4 {
-		common.RuntimeError("invalid binary stl file: " + fileName)
+	fileContent, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, err
 	}
+	return parseStl(fileName, fileContent)
+}
 
-	buffer := bytes.NewBuffer(fileContent[headerSize:])
-
-	var trianglesCount int32
-	err = binary.Read(buffer, binary.LittleEndian, &trianglesCount)
+// LoadStlMapped is the same as LoadTriangleMesh but parses triangles
+// directly from the memory-mapped file instead of reading the file into
+// memory first. This reduces peak memory usage for large models. Gzip
+// files and platforms without mmap support fall back to LoadTriangleMesh.
+func LoadStlMapped(fileName string) *TriangleMesh {
+	mesh, err := loadStlMapped(fileName)
 	common.Check(err)
+	return mesh
+}
 
-	if trianglesCount > maxTrianglesCount {
-		common.RuntimeError("triangles limit exceeded: " + fileName)
+// loadStlMapped is the same as LoadStlMapped but returns an error instead
+// of reporting it.
+func loadStlMapped(fileName string) (*TriangleMesh, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
 	}
+	defer file.Close()
 
-	expectedSize := int64(headerSize + 4 + trianglesCount*facetSize)
-	if fileSize != expectedSize {
-		common.RuntimeError("invalid size of binary stl file: " + fileName)
+	fileContent, err := common.MapFile(file)
+	if err != nil {
+		return nil, err
+	}
+	if fileContent == nil || isCompressed(fileContent) {
+		if fileContent != nil {
+			common.UnmapFile(fileContent)
+		}
+		return loadStl(fileName)
 	}
+	defer common.UnmapFile(fileContent)
+	return parseStl(fileName, fileContent)
+}
+
+const (
+	stlHeaderSize        = 80
+	stlFacetSize         = 50
+	stlMaxVerticesCount  = math.MaxInt32
+	stlMaxTrianglesCount = math.MaxInt32
+)
 
-	// read mesh data
+// stlMeshBuilder creates the mesh from binary stl facets. Equal vertices
+// are merged into a single mesh vertex.
+type stlMeshBuilder struct {
+	fileName       string
+	mesh           *TriangleMesh
+	uniqueVertices map[Vector32]int32
+}
+
+// newStlMeshBuilder creates the builder with preallocated space for
+// capacity triangles.
+func newStlMeshBuilder(fileName string, capacity int) *stlMeshBuilder {
 	mesh := new(TriangleMesh)
-	mesh.normals = make([]Vector32, trianglesCount)
-	mesh.triangles = make([][3]int32, trianglesCount)
+	mesh.normals = make([]Vector32, 0, capacity)
+	mesh.triangles = make([][3]int32, 0, capacity)
+	return &stlMeshBuilder{
+		fileName:       fileName,
+		mesh:           mesh,
+		uniqueVertices: make(map[Vector32]int32),
+	}
+}
 
-	uniqueVertices := make(map[Vector32]int32)
+// addFacets appends triangles from the data that contains whole facets.
+func (builder *stlMeshBuilder) addFacets(data []byte) error {
+	mesh := builder.mesh
+	for offset := 0; offset+stlFacetSize <= len(data); offset += stlFacetSize {
+		facet := data[offset : offset+stlFacetSize]
 
-	for i := 0; i < int(trianglesCount); i++ {
-		binary.Read(buffer, binary.LittleEndian, &mesh.normals[i])
+		readVector := func(index int) Vector32 {
+			var v Vector32
+			for k := 0; k < 3; k++ {
+				bits := binary.LittleEndian.Uint32(facet[(index*3+k)*4:])
+				v[k] = math.Float32frombits(bits)
+			}
+			return v
+		}
 
+		mesh.normals = append(mesh.normals, readVector(0))
+
+		var triangle [3]int32
 		for k := 0; k < 3; k++ {
-			var v Vector32
-			binary.Read(buffer, binary.LittleEndian, &v)
-			vertexIndex, found := uniqueVertices[v]
+			v := readVector(k + 1)
+			vertexIndex, found := builder.uniqueVertices[v]
 			if !found {
-				if len(mesh.vertices) > maxVerticesCount {
-					common.RuntimeError("vertices limit exceeded: " + fileName)
+				if len(mesh.vertices) > stlMaxVerticesCount {
+					return errors.New("vertices limit exceeded: " + builder.fileName)
 				}
 				vertexIndex = int32(len(mesh.vertices))
-				uniqueVertices[v] = vertexIndex
+				builder.uniqueVertices[v] = vertexIndex
 				mesh.vertices = append(mesh.vertices, v)
 			}
-			mesh.triangles[i][k] = vertexIndex
+			triangle[k] = vertexIndex
 		}
-		var attribsCount uint16
-		binary.Read(buffer, binary.LittleEndian, &attribsCount)
+		mesh.triangles = append(mesh.triangles, triangle)
+		// the last 2 bytes are attribute byte count, it is not used
+	}
+	return nil
+}
+
+func (builder *stlMeshBuilder) finish() (*TriangleMesh, error) {
+	if err := builder.mesh.Validate(); err != nil {
+		return nil, errors.New(builder.fileName + ": " + err.Error())
+	}
+	return builder.mesh, nil
+}
+
+// parseStlHeader validates the beginning of binary stl file and returns
+// the number of triangles.
+func parseStlHeader(fileName string, header []byte) (int32, error) {
+	asciiStlHeader := []byte{0x73, 0x6f, 0x6c, 0x69, 0x64}
+	if len(header) >= 5 && bytes.Equal(header[0:5], asciiStlHeader) {
+		return 0, errors.New("ascii stl files are not supported: " + fileName)
+	}
+
+	if len(header) < stlHeaderSize+4 {
+		return 0, errors.New("invalid binary stl file: " + fileName)
+	}
+
+	trianglesCount := binary.LittleEndian.Uint32(header[stlHeaderSize:])
+	if trianglesCount > stlMaxTrianglesCount {
+		return 0, errors.New("triangles limit exceeded: " + fileName)
+	}
+	return int32(trianglesCount), nil
+}
+
+// parseStl creates the mesh from binary stl file content. The mesh does not
+// reference fileContent after the function returns.
+func parseStl(fileName string, fileContent []byte) (*TriangleMesh, error) {
+	trianglesCount, err := parseStlHeader(fileName, fileContent)
+	if err != nil {
+		return nil, err
 	}
+
+	expectedSize := int64(stlHeaderSize + 4 + int64(trianglesCount)*stlFacetSize)
+	if int64(len(fileContent)) != expectedSize {
+		return nil, errors.New("invalid size of binary stl file: " + fileName)
+	}
+
+	builder := newStlMeshBuilder(fileName, int(trianglesCount))
+	if err := builder.addFacets(fileContent[stlHeaderSize+4:]); err != nil {
+		return nil, err
+	}
+	return builder.finish()
+}
+
+// LoadStlStreaming is the same as LoadTriangleMesh but reads the file in
+// chunks of facetsPerChunk facets and appends triangles incrementally, so
+// the file content is never fully loaded into memory. This allows to load
+// meshes which file size is comparable with the available memory.
+func LoadStlStreaming(fileName string, facetsPerChunk int) *TriangleMesh {
+	mesh, err := loadStlStreaming(fileName, facetsPerChunk)
+	common.Check(err)
 	return mesh
 }
+
+// loadStlStreaming is the same as LoadStlStreaming but returns an error
+// instead of reporting it.
+func loadStlStreaming(fileName string, facetsPerChunk int) (*TriangleMesh, error) {
+	if facetsPerChunk < 1 {
+		return nil, fmt.Errorf("invalid facets per chunk value: %d", facetsPerChunk)
+	}
+
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	reader, err := newFileReader(file)
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, stlHeaderSize+4)
+	headerSize, err := io.ReadFull(reader, header)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+	trianglesCount, err := parseStlHeader(fileName, header[:headerSize])
+	if err != nil {
+		return nil, err
+	}
+
+	invalidSize := errors.New("invalid size of binary stl file: " + fileName)
+	// the triangles count is not validated against the file size yet, so
+	// it can't be used to preallocate the mesh
+	builder := newStlMeshBuilder(fileName, 0)
+	chunk := make([]byte, facetsPerChunk*stlFacetSize)
+
+	for remaining := int(trianglesCount); remaining > 0; {
+		count := facetsPerChunk
+		if count > remaining {
+			count = remaining
+		}
+		data := chunk[:count*stlFacetSize]
+		if _, err := io.ReadFull(reader, data); err != nil {
+			if err == io.ErrUnexpectedEOF || err == io.EOF {
+				return nil, invalidSize
+			}
+			return nil, err
+		}
+		if err := builder.addFacets(data); err != nil {
+			return nil, err
+		}
+		remaining -= count
+	}
+
+	// the file should not contain data after the last facet
+	var extra [1]byte
+	if n, _ := reader.Read(extra[:]); n != 0 {
+		return nil, invalidSize
+	}
+	return builder.finish()
+}
+
+// meshLoaders maps lower case file extension to the mesh loader.
+var meshLoaders = map[string]func(fileName string) (*TriangleMesh, error){
+	".stl":  loadStl,
+	".obj":  loadObj,
+	".ply":  loadPly,
+	".gltf": loadGltf,
+	".glb":  loadGltf,
+}
+
+// LoadMesh loads the mesh using the loader selected by the file extension.
+// Compressed files can have additional .gz or .zst extension.
+func LoadMesh(fileName string) (*TriangleMesh, error) {
+	extension := strings.ToLower(filepath.Ext(fileName))
+	if extension == ".gz" || extension == ".zst" {
+		extension = strings.ToLower(
+			filepath.Ext(strings.TrimSuffix(fileName, filepath.Ext(fileName))))
+	}
+
+	loader, found := meshLoaders[extension]
+	if !found {
+		return nil, fmt.Errorf("unsupported mesh file format %q: %s",
+			extension, fileName)
+	}
+	return loader(fileName)
+}
+
+// SaveStl writes the mesh as binary stl file. Facet normals are recomputed
+// from triangle geometry. The file can be loaded by the C++ and D
+// implementations, vertices are merged by position on loading, so the
+// loaded mesh has the same triangles but vertex order can differ.
+func (mesh *TriangleMesh) SaveStl(fileName string) {
+	common.Check(mesh.saveStl(fileName))
+}
+
+// saveStl is the same as SaveStl but returns an error instead of reporting
+// it.
+func (mesh *TriangleMesh) saveStl(fileName string) error {
+	file, err := os.Create(fileName)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	writer := bufio.NewWriter(file)
+
+	var header [stlHeaderSize]byte
+	copy(header[:], "binary stl")
+	if _, err := writer.Write(header[:]); err != nil {
+		return err
+	}
+
+	trianglesCount := uint32(mesh.GetTrianglesCount())
+	if err := binary.Write(writer, binary.LittleEndian, trianglesCount); err != nil {
+		return err
+	}
+
+	for i := int32(0); i < mesh.GetTrianglesCount(); i++ {
+		v0, v1, v2 := mesh.GetTriangle(i)
+		facet := struct {
+			Normal       Vector32
+			Vertices     [3]Vector32
+			AttribsCount uint16
+		}{mesh.GetTriangleNormal(i), [3]Vector32{v0, v1, v2}, 0}
+
+		if err := binary.Write(writer, binary.LittleEndian, &facet); err != nil {
+			return err
+		}
+	}
+
+	if err := writer.Flush(); err != nil {
+		return err
+	}
+	return file.Close()
+}
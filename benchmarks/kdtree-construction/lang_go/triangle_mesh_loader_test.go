@@ -0,0 +1,308 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const teapotStl = "../data/teapot.stl"
+
+func gzipFile(t *testing.T, fileName, compressedFileName string) {
+	t.Helper()
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, err := os.Create(compressedFileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	writer := gzip.NewWriter(file)
+	if _, err := writer.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func checkMeshesEqual(t *testing.T, mesh, expected *TriangleMesh) {
+	t.Helper()
+	if !reflect.DeepEqual(mesh.vertices, expected.vertices) {
+		t.Errorf("vertices differ: %d vertices, expected %d",
+			len(mesh.vertices), len(expected.vertices))
+	}
+	if !reflect.DeepEqual(mesh.triangles, expected.triangles) {
+		t.Errorf("triangles differ: %d triangles, expected %d",
+			len(mesh.triangles), len(expected.triangles))
+	}
+	if !reflect.DeepEqual(mesh.normals, expected.normals) {
+		t.Errorf("normals differ")
+	}
+	if !reflect.DeepEqual(mesh.materialIDs, expected.materialIDs) {
+		t.Errorf("material ids differ: %v, expected %v", mesh.materialIDs,
+			expected.materialIDs)
+	}
+}
+
+func TestLoadGzipCompressedFiles(t *testing.T) {
+	dir := t.TempDir()
+	compressedStl := filepath.Join(dir, "teapot.stl.gz")
+	gzipFile(t, teapotStl, compressedStl)
+
+	mesh, err := loadStl(teapotStl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	compressedMesh, err := loadStl(compressedStl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkMeshesEqual(t, compressedMesh, mesh)
+
+	// the gzip magic bytes are detected regardless of the file name
+	renamedStl := filepath.Join(dir, "compressed.stl")
+	gzipFile(t, teapotStl, renamedStl)
+	renamedMesh, err := loadStl(renamedStl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkMeshesEqual(t, renamedMesh, mesh)
+
+	kdTree := NewKdTreeBuilder(mesh, NewBuildParams()).BuildKdTree()
+	kdTreeFile := filepath.Join(dir, "teapot.kdtree")
+	if err := kdTree.saveToFile(kdTreeFile); err != nil {
+		t.Fatal(err)
+	}
+	compressedKdTreeFile := kdTreeFile + ".gz"
+	gzipFile(t, kdTreeFile, compressedKdTreeFile)
+	loadedKdTree, err := loadKdTree(compressedKdTreeFile, mesh)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loadedKdTree.GetHash() != kdTree.GetHash() {
+		t.Errorf("compressed kdtree hash is %x, expected %x",
+			loadedKdTree.GetHash(), kdTree.GetHash())
+	}
+}
+
+func TestLoadZstdCompressedFiles(t *testing.T) {
+	if _, err := exec.LookPath("zstd"); err != nil {
+		t.Skip("zstd command is not available")
+	}
+	compressed, err := exec.Command("zstd", "-q", "-c", teapotStl).Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fileName := filepath.Join(t.TempDir(), "teapot.stl.zst")
+	if err := os.WriteFile(fileName, compressed, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	mesh, err := LoadMesh(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected, err := loadStl(teapotStl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkMeshesEqual(t, mesh, expected)
+}
+
+func TestStlByteOrder(t *testing.T) {
+	mesh, err := loadStl(teapotStl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	fileName := filepath.Join(dir, "teapot.stl")
+	if err := mesh.saveStl(fileName); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count := binary.LittleEndian.Uint32(data[stlHeaderSize:]); count != uint32(len(mesh.triangles)) {
+		t.Errorf("triangles count is not stored as little-endian: %d, expected %d",
+			count, len(mesh.triangles))
+	}
+
+	// swap the byte order of the triangles count and the facet values, the
+	// facets are 50 bytes long, so the swapped file has to be built field by
+	// field
+	swapped := append([]byte(nil), data[:stlHeaderSize]...)
+	swapped = binary.BigEndian.AppendUint32(swapped, uint32(len(mesh.triangles)))
+	for offset := stlHeaderSize + 4; offset < len(data); offset += stlFacetSize {
+		facet := data[offset : offset+stlFacetSize]
+		for i := 0; i < 48; i += 4 {
+			swapped = binary.BigEndian.AppendUint32(swapped, binary.LittleEndian.Uint32(facet[i:]))
+		}
+		swapped = binary.BigEndian.AppendUint16(swapped, binary.LittleEndian.Uint16(facet[48:]))
+	}
+	bigEndianFileName := filepath.Join(dir, "big_endian.stl")
+	if err := os.WriteFile(bigEndianFileName, swapped, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadStl(bigEndianFileName); err == nil {
+		t.Errorf("big-endian stl file is loaded without error")
+	}
+}
+
+func TestSaveStlRoundTrip(t *testing.T) {
+	mesh := newCubeMesh(Vector32{-1, 2, 0.5}, 1.5)
+	fileName := filepath.Join(t.TempDir(), "cube.stl")
+	if err := mesh.saveStl(fileName); err != nil {
+		t.Fatal(err)
+	}
+	loadedMesh, err := loadStl(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if loadedMesh.GetTrianglesCount() != mesh.GetTrianglesCount() {
+		t.Fatalf("loaded %d triangles, expected %d", loadedMesh.GetTrianglesCount(),
+			mesh.GetTrianglesCount())
+	}
+	// vertices are merged on loading, the triangles keep their geometry
+	if loadedMesh.GetVerticesCount() != 8 {
+		t.Errorf("loaded %d vertices, expected 8", loadedMesh.GetVerticesCount())
+	}
+	for i := int32(0); i < mesh.GetTrianglesCount(); i++ {
+		v0, v1, v2 := mesh.GetTriangle(i)
+		l0, l1, l2 := loadedMesh.GetTriangle(i)
+		if v0 != l0 || v1 != l1 || v2 != l2 {
+			t.Errorf("triangle %d is %v %v %v, expected %v %v %v", i, l0, l1, l2,
+				v0, v1, v2)
+		}
+		if loadedMesh.GetTriangleNormal(i) != mesh.GetTriangleNormal(i) {
+			t.Errorf("triangle %d normal is %v, expected %v", i,
+				loadedMesh.GetTriangleNormal(i), mesh.GetTriangleNormal(i))
+		}
+	}
+}
+
+// singleTriangleFiles returns the contents of the single triangle mesh
+// (0, 0, 0), (1, 0, 0), (0, 1, 0) in the supported file formats by file
+// extension.
+func singleTriangleFiles(t *testing.T) map[string][]byte {
+	t.Helper()
+	vertices := []float32{0, 0, 0, 1, 0, 0, 0, 1, 0}
+	var buffer []byte
+	for _, v := range vertices {
+		buffer = binary.LittleEndian.AppendUint32(buffer, math.Float32bits(v))
+	}
+	document := func(uri string) []byte {
+		buffer := `{"byteLength": 36}`
+		if uri != "" {
+			buffer = fmt.Sprintf(`{"byteLength": 36, "uri": %q}`, uri)
+		}
+		return []byte(`{
+			"asset": {"version": "2.0"},
+			"meshes": [{"primitives": [{"attributes": {"POSITION": 0}}]}],
+			"accessors": [{"bufferView": 0, "componentType": 5126, "count": 3, "type": "VEC3"}],
+			"bufferViews": [{"buffer": 0, "byteLength": 36}],
+			"buffers": [` + buffer + `]
+		}`)
+	}
+
+	// binary gltf: header, json chunk padded with spaces and binary chunk
+	jsonChunk := document("")
+	for len(jsonChunk)%4 != 0 {
+		jsonChunk = append(jsonChunk, ' ')
+	}
+	glb := []byte("glTF")
+	glb = binary.LittleEndian.AppendUint32(glb, 2)
+	glb = binary.LittleEndian.AppendUint32(glb, uint32(12+8+len(jsonChunk)+8+len(buffer)))
+	glb = binary.LittleEndian.AppendUint32(glb, uint32(len(jsonChunk)))
+	glb = binary.LittleEndian.AppendUint32(glb, 0x4e4f534a)
+	glb = append(glb, jsonChunk...)
+	glb = binary.LittleEndian.AppendUint32(glb, uint32(len(buffer)))
+	glb = binary.LittleEndian.AppendUint32(glb, 0x004e4942)
+	glb = append(glb, buffer...)
+
+	mesh := &TriangleMesh{
+		vertices:  []Vector32{{0, 0, 0}, {1, 0, 0}, {0, 1, 0}},
+		triangles: [][3]int32{{0, 1, 2}},
+	}
+	stlFileName := filepath.Join(t.TempDir(), "triangle.stl")
+	if err := finishGeneratedMesh(mesh).saveStl(stlFileName); err != nil {
+		t.Fatal(err)
+	}
+	stl, err := os.ReadFile(stlFileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return map[string][]byte{
+		".stl": stl,
+		".obj": []byte("v 0 0 0\nv 1 0 0\nv 0 1 0\nf 1 2 3\n"),
+		".ply": []byte("ply\nformat ascii 1.0\nelement vertex 3\n" +
+			"property float x\nproperty float y\nproperty float z\n" +
+			"element face 1\nproperty list uchar int vertex_indices\nend_header\n" +
+			"0 0 0\n1 0 0\n0 1 0\n3 0 1 2\n"),
+		".gltf": document("data:application/octet-stream;base64," +
+			base64.StdEncoding.EncodeToString(buffer)),
+		".glb": glb,
+	}
+}
+
+func TestLoadMeshSelectsLoaderByExtension(t *testing.T) {
+	dir := t.TempDir()
+	expectedVertices := [3]Vector32{{0, 0, 0}, {1, 0, 0}, {0, 1, 0}}
+
+	checkMesh := func(fileName string) {
+		t.Helper()
+		mesh, err := LoadMesh(fileName)
+		if err != nil {
+			t.Errorf("%s: %v", filepath.Base(fileName), err)
+			return
+		}
+		if mesh.GetTrianglesCount() != 1 {
+			t.Errorf("%s: loaded %d triangles, expected 1", filepath.Base(fileName),
+				mesh.GetTrianglesCount())
+			return
+		}
+		if v0, v1, v2 := mesh.GetTriangle(0); [3]Vector32{v0, v1, v2} != expectedVertices {
+			t.Errorf("%s: triangle is %v %v %v", filepath.Base(fileName), v0, v1, v2)
+		}
+	}
+
+	for extension, content := range singleTriangleFiles(t) {
+		fileName := filepath.Join(dir, "triangle"+extension)
+		if err := os.WriteFile(fileName, content, 0644); err != nil {
+			t.Fatal(err)
+		}
+		checkMesh(fileName)
+
+		// the extension is case insensitive
+		upperCaseFileName := filepath.Join(dir, "upper"+strings.ToUpper(extension))
+		if err := os.WriteFile(upperCaseFileName, content, 0644); err != nil {
+			t.Fatal(err)
+		}
+		checkMesh(upperCaseFileName)
+
+		// the format extension precedes the compression extension
+		compressedFileName := fileName + ".gz"
+		gzipFile(t, fileName, compressedFileName)
+		checkMesh(compressedFileName)
+	}
+
+	for _, fileName := range []string{"mesh.3ds", "mesh.txt.gz", "mesh"} {
+		_, err := LoadMesh(filepath.Join(dir, fileName))
+		if err == nil || !strings.Contains(err.Error(), "unsupported mesh file format") {
+			t.Errorf("%s: unexpected error %v", fileName, err)
+		}
+	}
+}
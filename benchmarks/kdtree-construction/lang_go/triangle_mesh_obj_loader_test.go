@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// twoGroupsObj has two quads in z = 0 plane, x in [0, 1] and [2, 3].
+const twoGroupsObj = `
+v 0 0 0
+v 1 0 0
+v 1 1 0
+v 0 1 0
+v 2 0 0
+v 3 0 0
+v 3 1 0
+v 2 1 0
+g left
+%s
+f 1 2 3 4
+g right
+%s
+f 5 6 7 8
+`
+
+func loadObjFromString(t *testing.T, content string) *TriangleMesh {
+	t.Helper()
+	fileName := filepath.Join(t.TempDir(), "mesh.obj")
+	if err := os.WriteFile(fileName, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	mesh, err := loadObj(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return mesh
+}
+
+func TestLoadObjMaterialPerHit(t *testing.T) {
+	tests := []struct {
+		name              string
+		leftMaterial      string
+		rightMaterial     string
+		expectedMaterials [2]int32
+	}{
+		{"usemtl per group", "usemtl red", "usemtl blue", [2]int32{0, 1}},
+		{"groups without usemtl", "", "", [2]int32{0, 1}},
+		// the material stays active across groups
+		{"usemtl in first group", "usemtl red", "", [2]int32{0, 0}},
+		{"shared material", "usemtl red", "usemtl red", [2]int32{0, 0}},
+	}
+
+	for _, test := range tests {
+		content := fmt.Sprintf(twoGroupsObj, test.leftMaterial, test.rightMaterial)
+		mesh := loadObjFromString(t, content)
+		kdTree := NewKdTreeBuilder(mesh, NewBuildParams()).BuildKdTree()
+
+		for i, x := range []float64{0.5, 2.5} {
+			ray := RayFromOriginAndDirection(Vector64{x, 0.3, 1}, Vector64{0, 0, -1})
+			hitFound, intersection := kdTree.Intersect(&ray)
+			if !hitFound {
+				t.Errorf("%s: ray misses quad %d", test.name, i)
+				continue
+			}
+			if intersection.materialID != test.expectedMaterials[i] {
+				t.Errorf("%s: quad %d has material %d, expected %d", test.name, i,
+					intersection.materialID, test.expectedMaterials[i])
+			}
+		}
+	}
+
+	mesh := loadObjFromString(t, "v 0 0 0\nv 1 0 0\nv 0 1 0\nf 1 2 3\n")
+	if mesh.materialIDs != nil || mesh.GetMaterialID(0) != -1 {
+		t.Errorf("obj without materials and groups has material ids: %v", mesh.materialIDs)
+	}
+}
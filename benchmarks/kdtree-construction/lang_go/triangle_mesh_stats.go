@@ -0,0 +1,74 @@
+package main
+
+import (
+	"math"
+)
+
+type MeshStats struct {
+	Bounds            BBox32
+	TrianglesCount    int32
+	DegenerateCount   int32 // zero-area triangles, excluded from other values
+	MinTriangleArea   float64
+	MaxTriangleArea   float64
+	MeanTriangleArea  float64
+	SliverFraction    float64 // fraction of triangles with large aspect ratio
+	SliverAspectRatio float64 // aspect ratio threshold used for slivers
+	MaxAspectRatio    float64
+}
+
+// getTriangleAspectRatio returns the ratio of the longest edge to the
+// altitude dropped on it. For equilateral triangle it is 2/sqrt(3) ~ 1.155,
+// for slivers the value is large.
+func getTriangleAspectRatio(v0, v1, v2 Vector64, area float64) float64 {
+	e0 := VLength64(VSub64(v1, v0))
+	e1 := VLength64(VSub64(v2, v1))
+	e2 := VLength64(VSub64(v0, v2))
+	longestEdge := math.Max(e0, math.Max(e1, e2))
+	return longestEdge * longestEdge / (2.0 * area)
+}
+
+// GetStats computes mesh characteristics that affect kdtree construction.
+// Triangles with aspect ratio above sliverAspectRatio are counted as slivers.
+func (mesh *TriangleMesh) GetStats(sliverAspectRatio float64) MeshStats {
+	stats := MeshStats{
+		Bounds:            mesh.GetBounds(),
+		TrianglesCount:    mesh.GetTrianglesCount(),
+		SliverAspectRatio: sliverAspectRatio,
+		MinTriangleArea:   math.Inf(+1),
+	}
+
+	areaAccumulated := 0.0
+	sliversCount := 0
+
+	for i := int32(0); i < stats.TrianglesCount; i++ {
+		p0, p1, p2 := mesh.GetTriangle(i)
+		v0 := NewVector64FromVector32(p0)
+		v1 := NewVector64FromVector32(p1)
+		v2 := NewVector64FromVector32(p2)
+
+		area := 0.5 * VLength64(CrossProduct64(VSub64(v1, v0), VSub64(v2, v0)))
+		if area == 0.0 {
+			stats.DegenerateCount++
+			continue
+		}
+
+		stats.MinTriangleArea = math.Min(stats.MinTriangleArea, area)
+		stats.MaxTriangleArea = math.Max(stats.MaxTriangleArea, area)
+		areaAccumulated += area
+
+		aspectRatio := getTriangleAspectRatio(v0, v1, v2, area)
+		stats.MaxAspectRatio = math.Max(stats.MaxAspectRatio, aspectRatio)
+		if aspectRatio > sliverAspectRatio {
+			sliversCount++
+		}
+	}
+
+	validCount := stats.TrianglesCount - stats.DegenerateCount
+	if validCount > 0 {
+		stats.MeanTriangleArea = areaAccumulated / float64(validCount)
+		stats.SliverFraction = float64(sliversCount) / float64(validCount)
+	} else {
+		stats.MinTriangleArea = 0.0
+	}
+	return stats
+}
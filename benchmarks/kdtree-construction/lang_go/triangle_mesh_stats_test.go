@@ -0,0 +1,52 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestGetStats(t *testing.T) {
+	mesh := &TriangleMesh{
+		vertices: []Vector32{
+			{0, 0, 0}, {1, 0, 0}, {0, 1, 0}, // right triangle, area 0.5
+			{0, 0, 2}, {10, 0, 2}, {0, 0.01, 2}, // sliver, area 0.05
+			{0, 0, 0}, {1, 1, 1}, {2, 2, 2}, // degenerate
+		},
+		triangles: [][3]int32{{0, 1, 2}, {3, 4, 5}, {6, 7, 8}},
+	}
+	stats := mesh.GetStats(10)
+
+	if stats.TrianglesCount != 3 || stats.DegenerateCount != 1 {
+		t.Errorf("%d triangles, %d degenerate, expected 3 and 1",
+			stats.TrianglesCount, stats.DegenerateCount)
+	}
+	checkValue := func(name string, value, expected float64) {
+		t.Helper()
+		// the vertices are float32, the values are not exact
+		if math.Abs(value-expected) > 1e-5*expected {
+			t.Errorf("%s is %g, expected %g", name, value, expected)
+		}
+	}
+	checkValue("min triangle area", stats.MinTriangleArea, 0.05)
+	checkValue("max triangle area", stats.MaxTriangleArea, 0.5)
+	checkValue("mean triangle area", stats.MeanTriangleArea, 0.275)
+	// only the sliver is above the threshold, the degenerate triangle is not
+	// counted
+	checkValue("sliver fraction", stats.SliverFraction, 0.5)
+	checkValue("max aspect ratio", stats.MaxAspectRatio, 100.0/(2*0.05))
+	if stats.Bounds != NewBBox32FromPoints(Vector32{0, 0, 0}, Vector32{10, 2, 2}) {
+		t.Errorf("bounds are %v", stats.Bounds)
+	}
+}
+
+func TestGetStatsDegenerateMesh(t *testing.T) {
+	mesh := &TriangleMesh{
+		vertices:  []Vector32{{0, 0, 0}, {1, 0, 0}, {2, 0, 0}},
+		triangles: [][3]int32{{0, 1, 2}},
+	}
+	stats := mesh.GetStats(10)
+	if stats.DegenerateCount != 1 || stats.MinTriangleArea != 0 ||
+		stats.MeanTriangleArea != 0 || stats.SliverFraction != 0 {
+		t.Errorf("unexpected stats of degenerate mesh: %+v", stats)
+	}
+}
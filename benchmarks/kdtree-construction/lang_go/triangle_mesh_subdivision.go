@@ -0,0 +1,148 @@
+package main
+
+// Subdivide refines the mesh with the given number of Loop subdivision
+// steps and returns the new mesh, the original mesh is not modified. Each
+// step splits every triangle into four, so the triangles count is
+// multiplied by 4^levels. Triangle normals are recomputed, material ids are
+// inherited from the original triangles.
+//
+// Edges are identified by vertex indices, so the mesh should be welded.
+// Boundary and non-manifold edges are treated as creases: their vertices
+// are smoothed only along the crease, and vertices where more than two
+// crease edges meet stay in place. If levels is not positive then the mesh
+// itself is returned.
+func (mesh *TriangleMesh) Subdivide(levels int) *TriangleMesh {
+	result := mesh
+	for i := 0; i < levels; i++ {
+		result = result.subdivideOnce()
+	}
+	return result
+}
+
+type subdivisionEdge struct {
+	opposite       [2]int32 // vertices opposite to the edge in the first two triangles
+	trianglesCount int32
+	newVertex      int32
+}
+
+func (mesh *TriangleMesh) subdivideOnce() *TriangleMesh {
+	// collect edges in the order of the first use, so the vertex order of
+	// the result does not depend on map iteration
+	edgeIndices := make(map[[2]int32]int32, len(mesh.triangles)*3/2)
+	var edgeKeys [][2]int32
+	var edges []subdivisionEdge
+
+	getEdge := func(a, b int32) int32 {
+		if a > b {
+			a, b = b, a
+		}
+		key := [2]int32{a, b}
+		index, found := edgeIndices[key]
+		if !found {
+			index = int32(len(edges))
+			edgeIndices[key] = index
+			edgeKeys = append(edgeKeys, key)
+			edges = append(edges, subdivisionEdge{})
+		}
+		return index
+	}
+
+	triangleEdges := make([][3]int32, len(mesh.triangles))
+	for i, indices := range mesh.triangles {
+		for k := 0; k < 3; k++ {
+			edgeIndex := getEdge(indices[k], indices[(k+1)%3])
+			edge := &edges[edgeIndex]
+			if edge.trianglesCount < 2 {
+				edge.opposite[edge.trianglesCount] = indices[(k+2)%3]
+			}
+			edge.trianglesCount++
+			triangleEdges[i][k] = edgeIndex
+		}
+	}
+
+	position := func(i int32) Vector64 {
+		return NewVector64FromVector32(mesh.vertices[i])
+	}
+
+	// vertex neighborhoods
+	neighborSums := make([]Vector64, len(mesh.vertices))
+	neighborCounts := make([]int, len(mesh.vertices))
+	creaseSums := make([]Vector64, len(mesh.vertices))
+	creaseCounts := make([]int, len(mesh.vertices))
+	for i, key := range edgeKeys {
+		a, b := key[0], key[1]
+		if a == b {
+			continue
+		}
+		neighborSums[a] = VAdd64(neighborSums[a], position(b))
+		neighborSums[b] = VAdd64(neighborSums[b], position(a))
+		neighborCounts[a]++
+		neighborCounts[b]++
+		if edges[i].trianglesCount != 2 {
+			creaseSums[a] = VAdd64(creaseSums[a], position(b))
+			creaseSums[b] = VAdd64(creaseSums[b], position(a))
+			creaseCounts[a]++
+			creaseCounts[b]++
+		}
+	}
+
+	subdivided := new(TriangleMesh)
+	subdivided.vertices = make([]Vector32, len(mesh.vertices), len(mesh.vertices)+len(edges))
+
+	// even vertices, the original ones moved according to the neighbors
+	for i := range mesh.vertices {
+		v := position(int32(i))
+		var p Vector64
+		switch {
+		case creaseCounts[i] == 2:
+			p = VAdd64(VMul64(v, 3.0/4.0), VMul64(creaseSums[i], 1.0/8.0))
+		case creaseCounts[i] > 0 || neighborCounts[i] < 3:
+			p = v
+		default:
+			n := float64(neighborCounts[i])
+			beta := 3.0 / (8.0 * n)
+			if neighborCounts[i] == 3 {
+				beta = 3.0 / 16.0
+			}
+			p = VAdd64(VMul64(v, 1.0-n*beta), VMul64(neighborSums[i], beta))
+		}
+		subdivided.vertices[i] = toVector32(p)
+	}
+
+	// odd vertices, one for each edge
+	for i := range edges {
+		edge := &edges[i]
+		a, b := position(edgeKeys[i][0]), position(edgeKeys[i][1])
+		var p Vector64
+		if edge.trianglesCount == 2 {
+			c, d := position(edge.opposite[0]), position(edge.opposite[1])
+			p = VAdd64(VMul64(VAdd64(a, b), 3.0/8.0), VMul64(VAdd64(c, d), 1.0/8.0))
+		} else {
+			p = VMul64(VAdd64(a, b), 0.5)
+		}
+		edge.newVertex = int32(len(subdivided.vertices))
+		subdivided.vertices = append(subdivided.vertices, toVector32(p))
+	}
+
+	// each triangle is split into three corner triangles and the middle
+	// one, all with the winding of the original triangle
+	subdivided.triangles = make([][3]int32, 0, 4*len(mesh.triangles))
+	if mesh.materialIDs != nil {
+		subdivided.materialIDs = make([]int32, 0, 4*len(mesh.triangles))
+	}
+	for i, indices := range mesh.triangles {
+		e01 := edges[triangleEdges[i][0]].newVertex
+		e12 := edges[triangleEdges[i][1]].newVertex
+		e20 := edges[triangleEdges[i][2]].newVertex
+		subdivided.triangles = append(subdivided.triangles,
+			[3]int32{indices[0], e01, e20},
+			[3]int32{indices[1], e12, e01},
+			[3]int32{indices[2], e20, e12},
+			[3]int32{e01, e12, e20})
+		if mesh.materialIDs != nil {
+			id := mesh.materialIDs[i]
+			subdivided.materialIDs = append(subdivided.materialIDs, id, id, id, id)
+		}
+	}
+	return finishGeneratedMesh(subdivided)
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"math"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+// newCubeMesh returns axis-aligned cube as a triangle soup: 12 triangles
+// with their own vertices, as they are stored in stl file. The triangles
+// are wound counter-clockwise when viewed from outside.
+func newCubeMesh(minPoint Vector32, size float32) *TriangleMesh {
+	var corners [8]Vector32
+	for i := range corners {
+		for k := 0; k < 3; k++ {
+			corners[i][k] = minPoint[k]
+			if i&(1<<uint(k)) != 0 {
+				corners[i][k] += size
+			}
+		}
+	}
+	quads := [6][4]int{
+		{0, 4, 6, 2}, {1, 3, 7, 5}, // -x, +x
+		{0, 1, 5, 4}, {2, 6, 7, 3}, // -y, +y
+		{0, 2, 3, 1}, {4, 5, 7, 6}, // -z, +z
+	}
+	mesh := &TriangleMesh{}
+	for _, quad := range quads {
+		for _, triangle := range [2][3]int{{quad[0], quad[1], quad[2]},
+			{quad[0], quad[2], quad[3]}} {
+			base := int32(len(mesh.vertices))
+			for _, corner := range triangle {
+				mesh.vertices = append(mesh.vertices, corners[corner])
+			}
+			mesh.triangles = append(mesh.triangles, [3]int32{base, base + 1, base + 2})
+		}
+	}
+	return finishGeneratedMesh(mesh)
+}
+
+func TestGetTriangle(t *testing.T) {
+	mesh := &TriangleMesh{
+		vertices:  []Vector32{{0, 0, 0}, {2, 0, 0}, {0, 3, 0}, {0, 0, 4}},
+		triangles: [][3]int32{{0, 1, 2}, {0, 3, 1}},
+	}
+	v0, v1, v2 := mesh.GetTriangle(1)
+	if v0 != (Vector32{0, 0, 0}) || v1 != (Vector32{0, 0, 4}) || v2 != (Vector32{2, 0, 0}) {
+		t.Errorf("triangle 1 vertices are %v %v %v", v0, v1, v2)
+	}
+	if normal := mesh.GetTriangleNormal(0); normal != (Vector32{0, 0, 1}) {
+		t.Errorf("triangle 0 normal is %v, expected (0, 0, 1)", normal)
+	}
+	if normal := mesh.GetTriangleNormal(1); normal != (Vector32{0, 1, 0}) {
+		t.Errorf("triangle 1 normal is %v, expected (0, 1, 0)", normal)
+	}
+
+	for _, triangleIndex := range []int32{-1, 2} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("GetTriangle(%d) does not panic", triangleIndex)
+				}
+			}()
+			mesh.GetTriangle(triangleIndex)
+		}()
+	}
+}
+
+// runtimeErrorEnv selects the case that the subprocess started by
+// checkRuntimeError executes.
+const runtimeErrorEnv = "DIGITALWHIP_TEST_RUNTIME_ERROR"
+
+// checkRuntimeError checks that f reports runtime error with the message
+// that contains expectedMessage. Runtime error terminates the process, so
+// the test is run again in a subprocess that executes only this case.
+func checkRuntimeError(t *testing.T, caseName, expectedMessage string, f func()) {
+	t.Helper()
+	if os.Getenv(runtimeErrorEnv) == caseName {
+		f()
+		os.Exit(0)
+	}
+
+	cmd := exec.Command(os.Args[0], "-test.run=^"+t.Name()+"$")
+	cmd.Env = append(os.Environ(), runtimeErrorEnv+"="+caseName)
+	output, err := cmd.CombinedOutput()
+	exitErr, ok := err.(*exec.ExitError)
+	if !ok || exitErr.ExitCode() != 1 {
+		t.Errorf("%s: expected exit code 1, got %v", caseName, err)
+		return
+	}
+	if !strings.Contains(string(output), "runtime error: "+expectedMessage) {
+		t.Errorf("%s: unexpected output: %s", caseName, output)
+	}
+}
+
+func TestAccessorsOutOfRange(t *testing.T) {
+	mesh := &TriangleMesh{
+		vertices:  []Vector32{{0, 0, 0}, {1, 0, 0}, {0, 1, 0}},
+		triangles: [][3]int32{{0, 1, 2}},
+	}
+	if v := mesh.GetVertex(2); v != (Vector32{0, 1, 0}) {
+		t.Errorf("vertex 2 is %v, expected (0, 1, 0)", v)
+	}
+	if i0, i1, i2 := mesh.GetTriangleIndices(0); i0 != 0 || i1 != 1 || i2 != 2 {
+		t.Errorf("triangle 0 indices are %d %d %d, expected 0 1 2", i0, i1, i2)
+	}
+
+	checkRuntimeError(t, "negative vertex", "vertex index -1 is out of range",
+		func() { mesh.GetVertex(-1) })
+	checkRuntimeError(t, "vertex past the end", "vertex index 3 is out of range",
+		func() { mesh.GetVertex(3) })
+	checkRuntimeError(t, "negative triangle", "triangle index -1 is out of range",
+		func() { mesh.GetTriangleIndices(-1) })
+	checkRuntimeError(t, "triangle past the end", "triangle index 1 is out of range",
+		func() { mesh.GetTriangleIndices(1) })
+}
+
+func TestGetBoundsMatchesBuilderBounds(t *testing.T) {
+	mesh := LoadTriangleMesh(teapotStl)
+	bounds := mesh.GetBounds()
+	kdTree := NewKdTreeBuilder(mesh, NewBuildParams()).BuildKdTree()
+	if expected := NewBBox64FromBBox32(bounds); kdTree.meshBounds != expected {
+		t.Errorf("mesh bounds are %v, kdtree bounds are %v", expected, kdTree.meshBounds)
+	}
+	if cachedBounds := mesh.GetBounds(); cachedBounds != bounds {
+		t.Errorf("second GetBounds call returned %v, expected %v", cachedBounds, bounds)
+	}
+
+	// the cached bounds are updated when the vertices change
+	vertices := append([]Vector32(nil), mesh.vertices...)
+	for i := range vertices {
+		vertices[i] = VAdd32(vertices[i], Vector32{10, 0, 0})
+	}
+	mesh.SetVertices(vertices)
+	expected := bounds
+	expected.minPoint[0] += 10
+	expected.maxPoint[0] += 10
+	if movedBounds := mesh.GetBounds(); movedBounds != expected {
+		t.Errorf("bounds after SetVertices are %v, expected %v", movedBounds, expected)
+	}
+}
+
+// checkNormalsPointOutside checks that geometric and stored normals of the
+// convex mesh point away from the center.
+func checkNormalsPointOutside(t *testing.T, name string, mesh *TriangleMesh,
+	center Vector64) {
+	t.Helper()
+	for i := int32(0); i < mesh.GetTrianglesCount(); i++ {
+		v0, v1, v2 := mesh.GetTriangle(i)
+		centroid := VMul64(VAdd64(VAdd64(NewVector64FromVector32(v0),
+			NewVector64FromVector32(v1)), NewVector64FromVector32(v2)), 1.0/3.0)
+		outside := VSub64(centroid, center)
+		if DotProduct64(NewVector64FromVector32(mesh.GetTriangleNormal(i)), outside) <= 0 {
+			t.Errorf("%s: triangle %d geometric normal points inside", name, i)
+		}
+		if DotProduct64(NewVector64FromVector32(mesh.normals[i]), outside) <= 0 {
+			t.Errorf("%s: triangle %d stored normal points inside", name, i)
+		}
+	}
+}
+
+func TestTransform(t *testing.T) {
+	// scale, then rotate by 90 degrees around z, then translate
+	transform := NewTranslationMatrix4(Vector64{10, 20, 30})
+	rotation := NewRotationMatrix4(Vector64{0, 0, 1}, math.Pi/2)
+	scale := NewScaleMatrix4(Vector64{2, 1, 1})
+	transform = Matrix4Mul(transform, Matrix4Mul(rotation, scale))
+
+	mesh := newCubeMesh(Vector32{0, 0, 0}, 1)
+	mesh.Transform(&transform)
+	// x extent [0, 2] is rotated to y extent [0, 2], y extent [0, 1] to
+	// x extent [-1, 0]
+	expected := NewBBox32FromPoints(Vector32{9, 20, 30}, Vector32{10, 22, 31})
+	bounds := mesh.GetBounds()
+	for k := 0; k < 3; k++ {
+		if math.Abs(float64(bounds.minPoint[k]-expected.minPoint[k])) > 1e-5 ||
+			math.Abs(float64(bounds.maxPoint[k]-expected.maxPoint[k])) > 1e-5 {
+			t.Fatalf("transformed bounds are %v, expected %v", bounds, expected)
+		}
+	}
+	checkNormalsPointOutside(t, "rotation", mesh, Vector64{9.5, 21, 30.5})
+
+	// mirroring reverses the winding, the normals still point outside
+	mirror := NewScaleMatrix4(Vector64{-1, 1, 1})
+	mesh = newCubeMesh(Vector32{0, 0, 0}, 1)
+	mesh.Transform(&mirror)
+	checkNormalsPointOutside(t, "mirror", mesh, Vector64{-0.5, 0.5, 0.5})
+
+	singular := NewScaleMatrix4(Vector64{1, 0, 1})
+	checkRuntimeError(t, "singular", "mesh transform matrix is singular", func() {
+		newCubeMesh(Vector32{0, 0, 0}, 1).Transform(&singular)
+	})
+}
+
+// newInvalidCubeMesh returns the cube mesh with a NaN vertex in triangle 5
+// and an infinite vertex in triangle 9. Every triangle of the cube has its
+// own vertices, so only these two triangles are invalid.
+func newInvalidCubeMesh() *TriangleMesh {
+	mesh := newCubeMesh(Vector32{0, 0, 0}, 1)
+	mesh.vertices[5*3+1][1] = float32(math.NaN())
+	mesh.vertices[9*3+2][2] = float32(math.Inf(-1))
+	mesh.materialIDs = make([]int32, len(mesh.triangles))
+	for i := range mesh.materialIDs {
+		mesh.materialIDs[i] = int32(i)
+	}
+	return mesh
+}
+
+func TestValidate(t *testing.T) {
+	if err := newCubeMesh(Vector32{0, 0, 0}, 1).Validate(); err != nil {
+		t.Errorf("valid mesh: %v", err)
+	}
+
+	mesh := newInvalidCubeMesh()
+	err := mesh.Validate()
+	if err == nil || !strings.Contains(err.Error(), "triangle 5 ") {
+		t.Errorf("NaN vertex: unexpected error %v", err)
+	}
+
+	mesh.vertices[5*3+1][1] = 1
+	err = mesh.Validate()
+	if err == nil || !strings.Contains(err.Error(), "triangle 9 ") {
+		t.Errorf("infinite vertex: unexpected error %v", err)
+	}
+}
+
+func TestDropInvalidTriangles(t *testing.T) {
+	mesh := newInvalidCubeMesh()
+	normals := append([]Vector32(nil), mesh.normals...)
+	if droppedCount := mesh.DropInvalidTriangles(); droppedCount != 2 {
+		t.Fatalf("%d triangles dropped, expected 2", droppedCount)
+	}
+	if err := mesh.Validate(); err != nil {
+		t.Errorf("mesh is invalid after dropping triangles: %v", err)
+	}
+	if len(mesh.triangles) != 10 || len(mesh.normals) != 10 ||
+		len(mesh.materialIDs) != 10 {
+		t.Fatalf("%d triangles, %d normals, %d material ids, expected 10",
+			len(mesh.triangles), len(mesh.normals), len(mesh.materialIDs))
+	}
+
+	// the remaining triangles keep their order, normals and materials
+	i := 0
+	for originalIndex := 0; originalIndex < 12; originalIndex++ {
+		if originalIndex == 5 || originalIndex == 9 {
+			continue
+		}
+		if mesh.triangles[i] != [3]int32{int32(originalIndex * 3),
+			int32(originalIndex*3 + 1), int32(originalIndex*3 + 2)} {
+			t.Errorf("triangle %d is %v, expected original triangle %d",
+				i, mesh.triangles[i], originalIndex)
+		}
+		if mesh.normals[i] != normals[originalIndex] {
+			t.Errorf("triangle %d normal is %v, expected %v",
+				i, mesh.normals[i], normals[originalIndex])
+		}
+		if mesh.materialIDs[i] != int32(originalIndex) {
+			t.Errorf("triangle %d material id is %d, expected %d",
+				i, mesh.materialIDs[i], originalIndex)
+		}
+		i++
+	}
+
+	// the bounds ignore the vertices of the dropped triangles
+	expected := NewBBox32FromPoints(Vector32{0, 0, 0}, Vector32{1, 1, 1})
+	if bounds := mesh.GetBounds(); bounds != expected {
+		t.Errorf("bounds are %v, expected %v", bounds, expected)
+	}
+}
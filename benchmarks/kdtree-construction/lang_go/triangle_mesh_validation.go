@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+)
+
+// MeshValidationReport lists triangles and edges that can cause problems
+// for kdtree construction or traversal.
+type MeshValidationReport struct {
+	NonFiniteTriangles []int32    // triangles with NaN or Inf coordinates
+	ZeroAreaTriangles  []int32    // including triangles with repeated vertex indices
+	DuplicateTriangles []int32    // triangles with the same vertices as a previous triangle
+	NonManifoldEdges   [][2]int32 // vertex index pairs shared by more than two triangles
+	BoundaryEdgesCount int        // edges used by a single triangle, not an error for open meshes
+}
+
+// HasErrors returns true if the mesh is not suitable for kdtree
+// construction. Only non-finite coordinates are errors, other issues are
+// reported for information.
+func (report *MeshValidationReport) HasErrors() bool {
+	return len(report.NonFiniteTriangles) > 0
+}
+
+func (report *MeshValidationReport) String() string {
+	return fmt.Sprintf("%d non-finite triangles, %d zero-area triangles, "+
+		"%d duplicate triangles, %d non-manifold edges, %d boundary edges",
+		len(report.NonFiniteTriangles), len(report.ZeroAreaTriangles),
+		len(report.DuplicateTriangles), len(report.NonManifoldEdges),
+		report.BoundaryEdgesCount)
+}
+
+// ValidateMesh checks mesh triangles and edges. Duplicate triangles are
+// triangles that reference the same set of vertices regardless of the
+// vertex order. Edges are compared by vertex indices, so the mesh should be
+// welded to get meaningful edge information.
+func ValidateMesh(mesh *TriangleMesh) MeshValidationReport {
+	var report MeshValidationReport
+
+	type edgeKey [2]int32
+	newEdgeKey := func(a, b int32) edgeKey {
+		if a > b {
+			a, b = b, a
+		}
+		return edgeKey{a, b}
+	}
+
+	edgeUseCount := make(map[edgeKey]int32)
+	uniqueTriangles := make(map[[3]int32]bool)
+
+	for i := int32(0); i < mesh.GetTrianglesCount(); i++ {
+		if !mesh.isValidTriangle(int(i)) {
+			report.NonFiniteTriangles = append(report.NonFiniteTriangles, i)
+			continue
+		}
+
+		v0, v1, v2 := mesh.GetTriangle(i)
+		if VLength32(CrossProduct32(VSub32(v1, v0), VSub32(v2, v0))) == 0 {
+			report.ZeroAreaTriangles = append(report.ZeroAreaTriangles, i)
+		}
+
+		indices := mesh.triangles[i]
+
+		key := sortedTriangleKey(indices)
+		if uniqueTriangles[key] {
+			report.DuplicateTriangles = append(report.DuplicateTriangles, i)
+		}
+		uniqueTriangles[key] = true
+
+		for k := 0; k < 3; k++ {
+			a, b := indices[k], indices[(k+1)%3]
+			if a != b {
+				edgeUseCount[newEdgeKey(a, b)]++
+			}
+		}
+	}
+
+	for edge, useCount := range edgeUseCount {
+		if useCount == 1 {
+			report.BoundaryEdgesCount++
+		} else if useCount > 2 {
+			report.NonManifoldEdges = append(report.NonManifoldEdges, edge)
+		}
+	}
+
+	// map iteration order is random
+	sort.Slice(report.NonManifoldEdges, func(i, j int) bool {
+		a, b := report.NonManifoldEdges[i], report.NonManifoldEdges[j]
+		return a[0] < b[0] || (a[0] == b[0] && a[1] < b[1])
+	})
+	return report
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestWeldVerticesCube(t *testing.T) {
+	for _, epsilon := range []float32{0, 1e-4} {
+		mesh := newCubeMesh(Vector32{-1, -1, -1}, 2)
+		normals := append([]Vector32(nil), mesh.normals...)
+
+		before, after := mesh.WeldVertices(epsilon)
+		if before != 36 || after != 8 {
+			t.Errorf("epsilon %g: welded %d vertices into %d, expected 36 into 8",
+				epsilon, before, after)
+		}
+		if len(mesh.vertices) != 8 {
+			t.Errorf("epsilon %g: mesh has %d vertices, expected 8", epsilon,
+				len(mesh.vertices))
+		}
+		// welding must not change the geometry of triangles
+		for i := range mesh.triangles {
+			if normal := mesh.GetTriangleNormal(int32(i)); normal != normals[i] {
+				t.Errorf("epsilon %g: triangle %d normal changed from %v to %v",
+					epsilon, i, normals[i], normal)
+			}
+		}
+	}
+}
+
+func TestWeldVerticesAcrossCellBoundary(t *testing.T) {
+	// the vertices are closer than epsilon but fall into different grid
+	// cells, the cell boundary is at 1.0
+	const epsilon = 0.25
+	mesh := &TriangleMesh{
+		vertices: []Vector32{
+			{0.99, 0, 0}, {2, 0, 0}, {0, 2, 0},
+			{1.01, 0, 0}, {2, 0, 1}, {0, 2, 1},
+		},
+		triangles: [][3]int32{{0, 1, 2}, {3, 4, 5}},
+	}
+	if _, after := mesh.WeldVertices(epsilon); after != 5 {
+		t.Errorf("welded into %d vertices, expected 5", after)
+	}
+	if mesh.triangles[0][0] != mesh.triangles[1][0] {
+		t.Errorf("vertices on both sides of the cell boundary are not merged: %v",
+			mesh.triangles)
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+// Triangle winding is consistent if every edge shared by two triangles is
+// traversed in opposite directions by them. Edges are compared by vertex
+// indices, so the mesh should be welded first. Edges shared by more than two
+// triangles are non-manifold and are ignored.
+
+// WindingReport describes winding consistency of the mesh.
+type WindingReport struct {
+	InconsistentEdgesCount int // manifold edges traversed in the same direction
+	ComponentsCount        int // groups of triangles connected by manifold edges
+	ClosedComponentsCount  int // components without boundary or non-manifold edges
+}
+
+type windingEdgeKey [2]int32
+
+func newWindingEdgeKey(a, b int32) windingEdgeKey {
+	if a > b {
+		a, b = b, a
+	}
+	return windingEdgeKey{a, b}
+}
+
+// getEdgeTriangles returns triangles that use each edge.
+func (mesh *TriangleMesh) getEdgeTriangles() map[windingEdgeKey][]int32 {
+	edgeTriangles := make(map[windingEdgeKey][]int32, len(mesh.triangles)*3/2)
+	for i, indices := range mesh.triangles {
+		for k := 0; k < 3; k++ {
+			a, b := indices[k], indices[(k+1)%3]
+			if a != b {
+				key := newWindingEdgeKey(a, b)
+				edgeTriangles[key] = append(edgeTriangles[key], int32(i))
+			}
+		}
+	}
+	return edgeTriangles
+}
+
+// hasDirectedEdge returns true if the triangle traverses the edge from a
+// to b.
+func (mesh *TriangleMesh) hasDirectedEdge(triangleIndex int32, a, b int32) bool {
+	indices := mesh.triangles[triangleIndex]
+	for k := 0; k < 3; k++ {
+		if indices[k] == a && indices[(k+1)%3] == b {
+			return true
+		}
+	}
+	return false
+}
+
+func (mesh *TriangleMesh) flipTriangle(triangleIndex int32) {
+	indices := &mesh.triangles[triangleIndex]
+	indices[1], indices[2] = indices[2], indices[1]
+	if len(mesh.normals) == len(mesh.triangles) {
+		mesh.normals[triangleIndex] = VMul32(mesh.normals[triangleIndex], -1)
+	}
+}
+
+// visitWindingComponents calls visit for each component with the indices
+// of its triangles. If flip is not nil then it is called during the
+// traversal for triangles that don't match the winding of the first
+// triangle of the component.
+func (mesh *TriangleMesh) visitWindingComponents(
+	edgeTriangles map[windingEdgeKey][]int32, flip func(triangleIndex int32),
+	visit func(component []int32, closed bool)) {
+
+	visited := make([]bool, len(mesh.triangles))
+	var component []int32
+
+	for start := range mesh.triangles {
+		if visited[start] {
+			continue
+		}
+		visited[start] = true
+		component = append(component[:0], int32(start))
+		closed := true
+
+		for next := 0; next < len(component); next++ {
+			t := component[next]
+			indices := mesh.triangles[t]
+			for k := 0; k < 3; k++ {
+				a, b := indices[k], indices[(k+1)%3]
+				if a == b {
+					continue
+				}
+				triangles := edgeTriangles[newWindingEdgeKey(a, b)]
+				if len(triangles) != 2 {
+					closed = false
+					continue
+				}
+				neighbor := triangles[0]
+				if neighbor == t {
+					neighbor = triangles[1]
+				}
+				if visited[neighbor] {
+					continue
+				}
+				visited[neighbor] = true
+				if flip != nil && mesh.hasDirectedEdge(neighbor, a, b) {
+					flip(neighbor)
+				}
+				component = append(component, neighbor)
+			}
+		}
+		visit(component, closed)
+	}
+}
+
+// CheckWinding reports winding consistency without modifying the mesh.
+func (mesh *TriangleMesh) CheckWinding() WindingReport {
+	var report WindingReport
+	edgeTriangles := mesh.getEdgeTriangles()
+
+	for edge, triangles := range edgeTriangles {
+		if len(triangles) == 2 &&
+			mesh.hasDirectedEdge(triangles[0], edge[0], edge[1]) ==
+				mesh.hasDirectedEdge(triangles[1], edge[0], edge[1]) {
+			report.InconsistentEdgesCount++
+		}
+	}
+
+	mesh.visitWindingComponents(edgeTriangles, nil, func(component []int32, closed bool) {
+		report.ComponentsCount++
+		if closed {
+			report.ClosedComponentsCount++
+		}
+	})
+	return report
+}
+
+// FixWinding flips triangles so each component has consistent winding and
+// returns the number of flipped triangles. The first triangle of the
+// component defines the orientation. If orientOutward is true then closed
+// components are additionally flipped as a whole if their triangles face
+// inside, i.e. the signed volume is negative.
+//
+// Consistent winding is not always possible (e.g. Moebius strip), in this
+// case some edges stay inconsistent. Stored triangle normals are flipped
+// together with the triangles, vertex normals are discarded if any
+// triangle is flipped.
+func (mesh *TriangleMesh) FixWinding(orientOutward bool) int {
+	edgeTriangles := mesh.getEdgeTriangles()
+
+	flipped := make([]bool, len(mesh.triangles))
+	flip := func(triangleIndex int32) {
+		mesh.flipTriangle(triangleIndex)
+		flipped[triangleIndex] = !flipped[triangleIndex]
+	}
+
+	mesh.visitWindingComponents(edgeTriangles, flip,
+		func(component []int32, closed bool) {
+			if !orientOutward || !closed {
+				return
+			}
+
+			// the volume is computed relative to the first vertex to
+			// reduce precision loss for meshes far from the origin
+			origin := NewVector64FromVector32(mesh.vertices[mesh.triangles[component[0]][0]])
+			volume := 0.0
+			for _, t := range component {
+				v0, v1, v2 := mesh.GetTriangle(t)
+				p0 := VSub64(NewVector64FromVector32(v0), origin)
+				p1 := VSub64(NewVector64FromVector32(v1), origin)
+				p2 := VSub64(NewVector64FromVector32(v2), origin)
+				volume += DotProduct64(p0, CrossProduct64(p1, p2))
+			}
+			if volume < 0.0 {
+				for _, t := range component {
+					flip(t)
+				}
+			}
+		})
+
+	flippedCount := 0
+	for _, f := range flipped {
+		if f {
+			flippedCount++
+		}
+	}
+	if flippedCount > 0 {
+		mesh.vertexNormals = nil
+	}
+	return flippedCount
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestIntersectTriangleBackfaceCulling(t *testing.T) {
+	// counter-clockwise when viewed from +z, the normal is (0, 0, 1)
+	triangle := Triangle{[3]Vector64{{0, 0, 0}, {1, 0, 0}, {0, 1, 0}}}
+
+	tests := []struct {
+		name          string
+		origin        Vector64
+		direction     Vector64
+		cullBackfaces bool
+		expectedHit   bool
+	}{
+		{"front face", Vector64{0.2, 0.2, 1}, Vector64{0, 0, -1}, false, true},
+		{"back face", Vector64{0.2, 0.2, -1}, Vector64{0, 0, 1}, false, true},
+		{"front face with culling", Vector64{0.2, 0.2, 1}, Vector64{0, 0, -1}, true, true},
+		{"back face with culling", Vector64{0.2, 0.2, -1}, Vector64{0, 0, 1}, true, false},
+	}
+
+	for _, test := range tests {
+		ray := RayFromOriginAndDirection(test.origin, test.direction)
+		ray.SetCullBackfaces(test.cullBackfaces)
+		hitFound, intersection := IntersectTriangle(&ray, &triangle)
+		if hitFound != test.expectedHit {
+			t.Errorf("%s: hit found %v, expected %v", test.name, hitFound, test.expectedHit)
+		}
+		if hitFound && intersection.t != 1 {
+			t.Errorf("%s: hit at t = %g, expected 1", test.name, intersection.t)
+		}
+	}
+
+	// the kdtree traversal uses the same test
+	mesh := finishGeneratedMesh(&TriangleMesh{
+		vertices:  []Vector32{{0, 0, 0}, {1, 0, 0}, {0, 1, 0}},
+		triangles: [][3]int32{{0, 1, 2}},
+	})
+	kdTree := NewKdTreeBuilder(mesh, NewBuildParams()).BuildKdTree()
+	ray := RayFromOriginAndDirection(Vector64{0.2, 0.2, -1}, Vector64{0, 0, 1})
+	ray.SetCullBackfaces(true)
+	if hitFound, _ := kdTree.Intersect(&ray); hitFound {
+		t.Errorf("kdtree: back-facing triangle is hit with culling enabled")
+	}
+	ray.SetCullBackfaces(false)
+	if hitFound, _ := kdTree.Intersect(&ray); !hitFound {
+		t.Errorf("kdtree: back-facing triangle is not hit with culling disabled")
+	}
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"math"
+)
+
+const (
+	// DefaultGridDensity is the number of grid cells per triangle used by
+	// the resolution heuristic.
+	DefaultGridDensity = 2.0
+
+	gridMaxResolution = 1024
+	gridMaxCells      = 1 << 24
+)
+
+// UniformGrid is a regular grid over the mesh bounds. Each cell lists
+// triangles which bounds overlap the cell. Rays step through the cells in
+// order with 3D-DDA (Amanatides, Woo).
+type UniformGrid struct {
+	bounds      BBox64
+	resolution  [3]int
+	cellSize    Vector64
+	invCellSize Vector64
+
+	// triangles of cell i are cellTriangles[cellStart[i]:cellStart[i+1]]
+	cellStart     []int32
+	cellTriangles []int32
+	mesh          *TriangleMesh
+}
+
+// BuildUniformGrid builds the grid with about density * trianglesCount
+// cells. If density is not positive then DefaultGridDensity is used. The
+// cells are close to cubes: resolution along each axis is proportional
+// to the mesh extent and is limited by gridMaxResolution.
+func BuildUniformGrid(mesh *TriangleMesh, density float64) *UniformGrid {
+	if density <= 0 {
+		density = DefaultGridDensity
+	}
+	grid := &UniformGrid{
+		bounds: NewBBox64FromBBox32(mesh.GetBounds()),
+		mesh:   mesh,
+	}
+	trianglesCount := mesh.GetTrianglesCount()
+	if trianglesCount == 0 {
+		grid.bounds = NewBBox64FromPoint(Vector64{})
+	}
+	grid.resolution = getGridResolution(grid.bounds, float64(trianglesCount)*density)
+
+	diag := VSub64(grid.bounds.maxPoint, grid.bounds.minPoint)
+	for k := 0; k < 3; k++ {
+		grid.cellSize[k] = diag[k] / float64(grid.resolution[k])
+		if grid.cellSize[k] > 0 {
+			grid.invCellSize[k] = 1.0 / grid.cellSize[k]
+		}
+	}
+
+	// count triangles per cell and then fill cell lists
+	cellsCount := grid.resolution[0] * grid.resolution[1] * grid.resolution[2]
+	grid.cellStart = make([]int32, cellsCount+1)
+	forEachCell := func(triangle int32, fn func(cellIndex int)) {
+		bounds := NewBBox64FromBBox32(mesh.GetTriangleBounds(triangle))
+		minCell := grid.getCell(bounds.minPoint)
+		maxCell := grid.getCell(bounds.maxPoint)
+		for z := minCell[2]; z <= maxCell[2]; z++ {
+			for y := minCell[1]; y <= maxCell[1]; y++ {
+				for x := minCell[0]; x <= maxCell[0]; x++ {
+					fn(grid.getCellIndex([3]int{x, y, z}))
+				}
+			}
+		}
+	}
+	for i := int32(0); i < trianglesCount; i++ {
+		forEachCell(i, func(cellIndex int) {
+			grid.cellStart[cellIndex+1]++
+		})
+	}
+	for i := 0; i < cellsCount; i++ {
+		grid.cellStart[i+1] += grid.cellStart[i]
+	}
+	grid.cellTriangles = make([]int32, grid.cellStart[cellsCount])
+	fill := make([]int32, cellsCount)
+	copy(fill, grid.cellStart[:cellsCount])
+	for i := int32(0); i < trianglesCount; i++ {
+		forEachCell(i, func(cellIndex int) {
+			grid.cellTriangles[fill[cellIndex]] = i
+			fill[cellIndex]++
+		})
+	}
+	return grid
+}
+
+// getGridResolution returns resolution with about cellsCount cells of
+// cubic shape. Flat bounds get a single cell along the flat axis.
+func getGridResolution(bounds BBox64, cellsCount float64) [3]int {
+	if cellsCount > gridMaxCells {
+		cellsCount = gridMaxCells
+	}
+	diag := VSub64(bounds.maxPoint, bounds.minPoint)
+	maxExtent := math.Max(diag[0], math.Max(diag[1], diag[2]))
+
+	var resolution [3]int
+	if maxExtent <= 0 {
+		return [3]int{1, 1, 1}
+	}
+	// the volume of the bounds without flat axes, cells count per
+	// unit of volume gives the cell size
+	volume := 1.0
+	dimensions := 0
+	for k := 0; k < 3; k++ {
+		if diag[k] > 1e-6*maxExtent {
+			volume *= diag[k]
+			dimensions++
+		}
+	}
+	cellSize := math.Pow(volume/math.Max(cellsCount, 1), 1.0/float64(dimensions))
+	for k := 0; k < 3; k++ {
+		res := int(math.Floor(diag[k]/cellSize + 0.5))
+		if res < 1 {
+			res = 1
+		} else if res > gridMaxResolution {
+			res = gridMaxResolution
+		}
+		resolution[k] = res
+	}
+	return resolution
+}
+
+func (grid *UniformGrid) getCell(point Vector64) [3]int {
+	var cell [3]int
+	for k := 0; k < 3; k++ {
+		c := int((point[k] - grid.bounds.minPoint[k]) * grid.invCellSize[k])
+		if c < 0 {
+			c = 0
+		} else if c >= grid.resolution[k] {
+			c = grid.resolution[k] - 1
+		}
+		cell[k] = c
+	}
+	return cell
+}
+
+func (grid *UniformGrid) getCellIndex(cell [3]int) int {
+	return cell[0] + grid.resolution[0]*(cell[1]+grid.resolution[1]*cell[2])
+}
+
+func (grid *UniformGrid) GetResolution() [3]int {
+	return grid.resolution
+}
+
+// GetReferencesCount returns the total number of triangle references in
+// all cells.
+func (grid *UniformGrid) GetReferencesCount() int {
+	return len(grid.cellTriangles)
+}
+
+func (grid *UniformGrid) Intersect(ray *Ray) (bool, KdTreeIntersection) {
+	if len(grid.cellTriangles) == 0 || !ray.HasValidDirection() {
+		return false, KdTreeIntersection{t: math.Inf(+1)}
+	}
+	tEnter, _, hit := grid.bounds.Intersect(ray)
+	if !hit {
+		return false, KdTreeIntersection{t: math.Inf(+1)}
+	}
+
+	// setup of the cell walk
+	origin := ray.GetOrigin()
+	direction := ray.GetDirection()
+	invDirection := ray.GetInvDirection()
+	cell := grid.getCell(ray.GetPoint(tEnter))
+	var step, outCell [3]int
+	var tNext, tDelta Vector64
+	for k := 0; k < 3; k++ {
+		switch {
+		case direction[k] > 0:
+			step[k] = 1
+			outCell[k] = grid.resolution[k]
+			boundary := grid.bounds.minPoint[k] + float64(cell[k]+1)*grid.cellSize[k]
+			tNext[k] = (boundary - origin[k]) * invDirection[k]
+			tDelta[k] = grid.cellSize[k] * invDirection[k]
+		case direction[k] < 0:
+			step[k] = -1
+			outCell[k] = -1
+			boundary := grid.bounds.minPoint[k] + float64(cell[k])*grid.cellSize[k]
+			tNext[k] = (boundary - origin[k]) * invDirection[k]
+			tDelta[k] = -grid.cellSize[k] * invDirection[k]
+		default:
+			outCell[k] = -1
+			tNext[k] = math.Inf(+1)
+			tDelta[k] = math.Inf(+1)
+		}
+	}
+
+	closestIntersection := TriangleIntersection{t: math.Inf(+1)}
+	vertices := grid.mesh.vertices
+	triangles := grid.mesh.triangles
+
+	for {
+		cellIndex := grid.getCellIndex(cell)
+		for _, triangleIndex := range grid.cellTriangles[grid.cellStart[cellIndex]:grid.cellStart[cellIndex+1]] {
+			indices := triangles[triangleIndex]
+			triangle := Triangle{[3]Vector64{
+				NewVector64FromVector32(vertices[indices[0]]),
+				NewVector64FromVector32(vertices[indices[1]]),
+				NewVector64FromVector32(vertices[indices[2]]),
+			}}
+			hitFound, intersection := IntersectTriangle(ray, &triangle)
+			if hitFound && intersection.t < closestIntersection.t {
+				closestIntersection = intersection
+				closestIntersection.triangleIndex = triangleIndex
+			}
+		}
+
+		// the hit can be outside of the current cell since triangles
+		// overlap many cells, it's the closest one only if it is found
+		// before the ray leaves the cell
+		axis := 0
+		if tNext[1] < tNext[axis] {
+			axis = 1
+		}
+		if tNext[2] < tNext[axis] {
+			axis = 2
+		}
+		if closestIntersection.t <= tNext[axis] {
+			break
+		}
+		cell[axis] += step[axis]
+		if cell[axis] == outCell[axis] {
+			break
+		}
+		tNext[axis] += tDelta[axis]
+	}
+
+	if closestIntersection.t == math.Inf(+1) {
+		return false, KdTreeIntersection{t: math.Inf(+1)}
+	}
+	return true, KdTreeIntersection{
+		t:             closestIntersection.t,
+		epsilon:       closestIntersection.epsilon,
+		b1:            closestIntersection.b1,
+		b2:            closestIntersection.b2,
+		triangleIndex: closestIntersection.triangleIndex,
+		materialID:    grid.mesh.GetMaterialID(closestIntersection.triangleIndex),
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+)
+
+// Accelerator is an acceleration structure for ray/mesh intersection.
+// Implementations are registered by name, so benchmarks can select them at
+// runtime.
+type Accelerator interface {
+	// Build creates the structure for the mesh with default build
+	// parameters of the implementation.
+	Build(mesh *TriangleMesh)
+
+	Intersect(ray *Ray) (bool, KdTreeIntersection)
+
+	// IntersectAny returns true if the ray hits any triangle. It is the
+	// query for shadow rays, implementations without dedicated traversal
+	// use Intersect.
+	IntersectAny(ray *Ray) bool
+
+	Stats() AcceleratorStats
+}
+
+type AcceleratorStats struct {
+	NodesCount      int // nodes or cells
+	ReferencesCount int // triangle references stored in leaves or cells
+}
+
+var acceleratorFactories = map[string]func() Accelerator{
+	"bvh":    func() Accelerator { return new(BVH) },
+	"qbvh":   func() Accelerator { return new(QBVH) },
+	"grid":   func() Accelerator { return new(UniformGrid) },
+	"octree": func() Accelerator { return new(Octree) },
+	"bih":    func() Accelerator { return new(BIH) },
+}
+
+// RegisterAccelerator adds accelerator factory with the given name. The
+// factory returns a new accelerator that is not built yet.
+func RegisterAccelerator(name string, factory func() Accelerator) {
+	acceleratorFactories[name] = factory
+}
+
+// NewAccelerator returns a new accelerator registered with the given name.
+// Build should be called before the accelerator is used.
+func NewAccelerator(name string) (Accelerator, error) {
+	factory, ok := acceleratorFactories[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown accelerator %q, available accelerators: %s",
+			name, strings.Join(GetAcceleratorNames(), ", "))
+	}
+	return factory(), nil
+}
+
+// GetAcceleratorNames returns sorted names of registered accelerators.
+func GetAcceleratorNames() []string {
+	names := make([]string, 0, len(acceleratorFactories))
+	for name := range acceleratorFactories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (kdTree *KdTree) IntersectAny(ray *Ray) bool {
+	return kdTree.Occluded(ray, 0, math.Inf(+1))
+}
+
+func (kdTree *KdTree) Stats() AcceleratorStats {
+	stats := AcceleratorStats{NodesCount: len(kdTree.nodes)}
+	for _, n := range kdTree.nodes {
+		if n.isLeaf() {
+			stats.ReferencesCount += int(n.trianglesCount())
+		}
+	}
+	return stats
+}
+
+func (bvh *BVH) Build(mesh *TriangleMesh) {
+	*bvh = *BuildBVH(mesh, NewBVHBuildParams())
+}
+
+func (bvh *BVH) IntersectAny(ray *Ray) bool {
+	hitFound, _ := bvh.Intersect(ray)
+	return hitFound
+}
+
+func (bvh *BVH) Stats() AcceleratorStats {
+	return AcceleratorStats{bvh.GetNodesCount(), bvh.GetReferencesCount()}
+}
+
+func (qbvh *QBVH) Build(mesh *TriangleMesh) {
+	*qbvh = *BuildQBVH(mesh, NewBVHBuildParams())
+}
+
+func (qbvh *QBVH) IntersectAny(ray *Ray) bool {
+	hitFound, _ := qbvh.Intersect(ray)
+	return hitFound
+}
+
+func (qbvh *QBVH) Stats() AcceleratorStats {
+	return AcceleratorStats{qbvh.GetNodesCount(), len(qbvh.triangleIndices)}
+}
+
+func (grid *UniformGrid) Build(mesh *TriangleMesh) {
+	*grid = *BuildUniformGrid(mesh, DefaultGridDensity)
+}
+
+func (grid *UniformGrid) IntersectAny(ray *Ray) bool {
+	hitFound, _ := grid.Intersect(ray)
+	return hitFound
+}
+
+func (grid *UniformGrid) Stats() AcceleratorStats {
+	return AcceleratorStats{len(grid.cellStart) - 1, grid.GetReferencesCount()}
+}
+
+func (octree *Octree) Build(mesh *TriangleMesh) {
+	*octree = *BuildOctree(mesh, NewOctreeBuildParams())
+}
+
+func (octree *Octree) IntersectAny(ray *Ray) bool {
+	hitFound, _ := octree.Intersect(ray)
+	return hitFound
+}
+
+func (octree *Octree) Stats() AcceleratorStats {
+	return AcceleratorStats{octree.GetNodesCount(), octree.GetReferencesCount()}
+}
+
+func (bih *BIH) Build(mesh *TriangleMesh) {
+	*bih = *BuildBIH(mesh, NewBIHBuildParams())
+}
+
+func (bih *BIH) IntersectAny(ray *Ray) bool {
+	hitFound, _ := bih.Intersect(ray)
+	return hitFound
+}
+
+func (bih *BIH) Stats() AcceleratorStats {
+	return AcceleratorStats{bih.GetNodesCount(), len(bih.triangleIndices)}
+}
@@ -73,3 +73,64 @@ func BBox32Union(bbox BBox32, bbox2 BBox32) BBox32 {
 		},
 	}
 }
+
+func (bbox *BBox32) GetSurfaceArea() float32 {
+	diag := VSub32(bbox.maxPoint, bbox.minPoint)
+	return 2.0 * (diag[0]*diag[1] + diag[0]*diag[2] + diag[1]*diag[2])
+}
+
+func (bbox *BBox32) GetCenter() Vector32 {
+	return VMul32(VAdd32(bbox.minPoint, bbox.maxPoint), 0.5)
+}
+
+// getLongestAxis returns the axis of the largest bounds extent.
+func getLongestAxis(bounds BBox32) int {
+	diag := VSub32(bounds.maxPoint, bounds.minPoint)
+	axis := 0
+	if diag[1] > diag[axis] {
+		axis = 1
+	}
+	if diag[2] > diag[axis] {
+		axis = 2
+	}
+	return axis
+}
+
+// Overlaps returns true if bounding boxes have at least one common point.
+func (bbox *BBox32) Overlaps(bbox2 BBox32) bool {
+	for i := 0; i < 3; i++ {
+		if bbox.maxPoint[i] < bbox2.minPoint[i] ||
+			bbox.minPoint[i] > bbox2.maxPoint[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Intersect computes parametric range [t0, t1] of the ray inside the
+// bounding box using slab test. The range is clipped to t >= 0.
+func (bbox *BBox32) Intersect(ray *Ray) (t0, t1 float64, hitFound bool) {
+	t1 = math.Inf(+1)
+	for i := 0; i < 3; i++ {
+		tNear := (float64(bbox.minPoint[i]) - ray.GetOrigin()[i]) * ray.GetInvDirection()[i]
+		tFar := (float64(bbox.maxPoint[i]) - ray.GetOrigin()[i]) * ray.GetInvDirection()[i]
+
+		// for zero direction component the values are signed infinities or
+		// NaN if the origin lies in the slab plane, NaN does not pass the
+		// comparisons below so the slab boundary is inclusive
+		if tNear > tFar {
+			tNear, tFar = tFar, tNear
+		}
+		if tNear > t0 {
+			t0 = tNear
+		}
+		if tFar < t1 {
+			t1 = tFar
+		}
+		if t0 > t1 {
+			return
+		}
+	}
+	hitFound = true
+	return
+}
@@ -4,11 +4,17 @@ import (
 	"common"
 	"fmt"
 	"math"
+	"sync"
 	"time"
 )
 
 const BenchmarkRaysCount = 10000000
 
+// Number of rays in the ray set of the parallel benchmark. The rays are
+// generated before the benchmark, so the count is smaller than
+// BenchmarkRaysCount to limit memory usage.
+const ParallelBenchmarkRaysCount = 1 << 20
+
 func uniformSampleSphere() Vector64 {
 	u1 := RandFloat64()
 	u2 := RandFloat64()
@@ -107,6 +113,122 @@ func BenchmarkKdTree(kdTree *KdTree) int {
 	return int(time.Since(start) / time.Millisecond)
 }
 
+// benchmarkIntersector casts the same kind of rays as BenchmarkKdTree but
+// through an arbitrary intersection function. It is used to compare other
+// acceleration structures with the kdtree.
+func benchmarkIntersector(meshBounds BBox64,
+	intersect func(ray *Ray) (bool, KdTreeIntersection)) int {
+	start := time.Now()
+
+	lastHit := VMul64(VAdd64(meshBounds.minPoint, meshBounds.maxPoint), 0.5)
+	lastHitEpsilon := 0.0
+
+	rg := newRayGenerator(meshBounds)
+
+	for raysTested := 0; raysTested < BenchmarkRaysCount; raysTested++ {
+		ray := rg.generateRay(lastHit, lastHitEpsilon)
+
+		hitFound, intersection := intersect(&ray)
+		if hitFound {
+			lastHit = ray.GetPoint(intersection.t)
+			lastHitEpsilon = intersection.epsilon
+		}
+	}
+	return int(time.Since(start) / time.Millisecond)
+}
+
+func BenchmarkRopedKdTree(ropedTree *RopedKdTree) int {
+	return benchmarkIntersector(ropedTree.kdTree.meshBounds, ropedTree.Intersect)
+}
+
+func BenchmarkBVH(bvh *BVH, meshBounds BBox64) int {
+	return benchmarkIntersector(meshBounds, bvh.Intersect)
+}
+
+func BenchmarkQBVH(qbvh *QBVH, meshBounds BBox64) int {
+	return benchmarkIntersector(meshBounds, qbvh.Intersect)
+}
+
+func BenchmarkUniformGrid(grid *UniformGrid, meshBounds BBox64) int {
+	return benchmarkIntersector(meshBounds, grid.Intersect)
+}
+
+func BenchmarkOctree(octree *Octree, meshBounds BBox64) int {
+	return benchmarkIntersector(meshBounds, octree.Intersect)
+}
+
+func BenchmarkBIH(bih *BIH, meshBounds BBox64) int {
+	return benchmarkIntersector(meshBounds, bih.Intersect)
+}
+
+func BenchmarkAccelerator(accelerator Accelerator, meshBounds BBox64) int {
+	return benchmarkIntersector(meshBounds, accelerator.Intersect)
+}
+
+// generateBenchmarkRays generates the same kind of rays as BenchmarkKdTree.
+// The rays are generated in advance since the origin of the ray can depend
+// on the hit of the previous ray, this makes the ray set independent of
+// the order in which the rays are cast.
+func generateBenchmarkRays(kdTree *KdTree, raysCount int) []Ray {
+	lastHit := VMul64(VAdd64(kdTree.meshBounds.minPoint, kdTree.meshBounds.maxPoint), 0.5)
+	lastHitEpsilon := 0.0
+
+	rg := newRayGenerator(kdTree.meshBounds)
+
+	rays := make([]Ray, raysCount)
+	for i := range rays {
+		rays[i] = rg.generateRay(lastHit, lastHitEpsilon)
+
+		hitFound, intersection := kdTree.Intersect(&rays[i])
+		if hitFound {
+			lastHit = rays[i].GetPoint(intersection.t)
+			lastHitEpsilon = intersection.epsilon
+		}
+	}
+	return rays
+}
+
+// castRaysParallel partitions the rays between the given number of
+// goroutines and returns the total number of hits. The kdtree is not
+// modified during traversal so it is shared by all goroutines.
+func castRaysParallel(kdTree *KdTree, rays []Ray, threadsCount int) int {
+	hitsCount := make([]int, threadsCount)
+	var wg sync.WaitGroup
+
+	for thread := 0; thread < threadsCount; thread++ {
+		first := len(rays) * thread / threadsCount
+		last := len(rays) * (thread + 1) / threadsCount
+
+		wg.Add(1)
+		go func(thread int, rays []Ray) {
+			defer wg.Done()
+			hits := 0
+			for i := range rays {
+				if hitFound, _ := kdTree.Intersect(&rays[i]); hitFound {
+					hits++
+				}
+			}
+			hitsCount[thread] = hits
+		}(thread, rays[first:last])
+	}
+	wg.Wait()
+
+	totalHits := 0
+	for _, hits := range hitsCount {
+		totalHits += hits
+	}
+	return totalHits
+}
+
+// BenchmarkKdTreeParallel casts the rays using the given number of
+// goroutines and returns elapsed time and the number of hits.
+func BenchmarkKdTreeParallel(kdTree *KdTree, rays []Ray,
+	threadsCount int) (timeMsec, hitsCount int) {
+	start := time.Now()
+	hitsCount = castRaysParallel(kdTree, rays, threadsCount)
+	return int(time.Since(start) / time.Millisecond), hitsCount
+}
+
 func ValidateKdTree(kdTree *KdTree, raysCount int) {
 	lastHit := VMul64(VAdd64(kdTree.meshBounds.minPoint, kdTree.meshBounds.maxPoint), 0.5)
 	lastHitEpsilon := 0.0
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestCastRaysParallelHitsCount(t *testing.T) {
+	mesh := LoadTriangleMesh("../data/teapot.stl")
+	kdTree := NewKdTree("../data/teapot.kdtree", mesh)
+	rays := generateBenchmarkRays(kdTree, 20000)
+
+	serialHitsCount := 0
+	for i := range rays {
+		if hitFound, _ := kdTree.Intersect(&rays[i]); hitFound {
+			serialHitsCount++
+		}
+	}
+	if serialHitsCount == 0 {
+		t.Fatal("no rays hit the mesh")
+	}
+
+	// the thread counts that do not divide the rays count check the
+	// partitioning of the ray set
+	for _, threadsCount := range []int{1, 2, 3, 8, 13} {
+		if hitsCount := castRaysParallel(kdTree, rays, threadsCount); hitsCount != serialHitsCount {
+			t.Errorf("%d threads: %d hits, expected %d", threadsCount, hitsCount,
+				serialHitsCount)
+		}
+	}
+}
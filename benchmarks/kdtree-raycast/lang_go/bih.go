@@ -0,0 +1,274 @@
+package main
+
+import (
+	"math"
+)
+
+type BIHBuildParams struct {
+	LeafTrianglesLimit int
+	MaxDepth           int
+}
+
+func NewBIHBuildParams() BIHBuildParams {
+	return BIHBuildParams{
+		LeafTrianglesLimit: 4,
+		MaxDepth:           48,
+	}
+}
+
+// The split box is halved at most this number of times without being able
+// to separate the triangles, then the leaf is created.
+const bihMaxEmptySplits = 32
+
+// bihNode is either an interior node with two children or a leaf that
+// references a range of BIH.triangleIndices. The left child of the interior
+// node immediately follows its parent, index stores the right child. The
+// left child contains triangles below clip[0] along the axis, the right
+// child contains triangles above clip[1].
+type bihNode struct {
+	clip           [2]float32
+	index          int32 // right child for interior node, first triangle for leaf
+	trianglesCount int32 // 0 for interior node
+	axis           int32
+}
+
+// BIH is bounding interval hierarchy (Wächter, Keller). The split planes
+// are selected in the middle of the split box which does not depend on the
+// triangles, the triangles are partitioned by the centers of their bounds
+// and each node stores the extent of both children along the split axis.
+// The build does not evaluate any cost function and is much faster than
+// SAH build.
+type BIH struct {
+	bounds          BBox64
+	nodes           []bihNode
+	triangleIndices []int32
+	mesh            *TriangleMesh
+}
+
+type bihBuilder struct {
+	buildParams    BIHBuildParams
+	triangleBounds []BBox32
+	bih            *BIH
+}
+
+func BuildBIH(mesh *TriangleMesh, buildParams BIHBuildParams) *BIH {
+	if buildParams.LeafTrianglesLimit < 1 {
+		buildParams.LeafTrianglesLimit = 1
+	}
+	if buildParams.MaxDepth < 0 {
+		buildParams.MaxDepth = 0
+	}
+
+	trianglesCount := mesh.GetTrianglesCount()
+	meshBounds := mesh.GetBounds()
+	if trianglesCount == 0 {
+		meshBounds = NewBBox32FromPoint(Vector32{})
+	}
+	bih := &BIH{
+		bounds:          NewBBox64FromBBox32(meshBounds),
+		nodes:           make([]bihNode, 0, 2*trianglesCount/int32(buildParams.LeafTrianglesLimit)+1),
+		triangleIndices: make([]int32, trianglesCount),
+		mesh:            mesh,
+	}
+	builder := &bihBuilder{
+		buildParams:    buildParams,
+		triangleBounds: make([]BBox32, trianglesCount),
+		bih:            bih,
+	}
+	for i := int32(0); i < trianglesCount; i++ {
+		builder.triangleBounds[i] = mesh.GetTriangleBounds(i)
+		bih.triangleIndices[i] = i
+	}
+
+	builder.buildNode(0, int(trianglesCount), meshBounds, 0)
+	return bih
+}
+
+// buildNode builds the subtree for triangles [begin, end) of
+// triangleIndices. The triangles are reordered in place.
+func (builder *bihBuilder) buildNode(begin, end int, splitBox BBox32, depth int) {
+	bih := builder.bih
+	nodeIndex := len(bih.nodes)
+	bih.nodes = append(bih.nodes, bihNode{})
+
+	if end-begin > builder.buildParams.LeafTrianglesLimit &&
+		depth < builder.buildParams.MaxDepth {
+		// halve the split box until the plane separates the triangles
+		for attempt := 0; attempt < bihMaxEmptySplits; attempt++ {
+			axis := getLongestAxis(splitBox)
+			plane := 0.5 * (splitBox.minPoint[axis] + splitBox.maxPoint[axis])
+			if plane <= splitBox.minPoint[axis] || plane >= splitBox.maxPoint[axis] {
+				break
+			}
+			middle, leftMax, rightMin := builder.partition(begin, end, axis, plane)
+			if middle == begin {
+				splitBox.minPoint[axis] = plane
+				continue
+			}
+			if middle == end {
+				splitBox.maxPoint[axis] = plane
+				continue
+			}
+
+			bih.nodes[nodeIndex] = bihNode{
+				clip: [2]float32{leftMax, rightMin},
+				axis: int32(axis),
+			}
+			leftBox, rightBox := splitBox, splitBox
+			leftBox.maxPoint[axis] = plane
+			rightBox.minPoint[axis] = plane
+			builder.buildNode(begin, middle, leftBox, depth+1)
+			bih.nodes[nodeIndex].index = int32(len(bih.nodes))
+			builder.buildNode(middle, end, rightBox, depth+1)
+			return
+		}
+	}
+
+	bih.nodes[nodeIndex] = bihNode{
+		index:          int32(begin),
+		trianglesCount: int32(end - begin),
+	}
+}
+
+// partition moves triangles which bounds center is below the plane to the
+// beginning of the range. Returns the first triangle of the upper part and
+// the extent of both parts along the axis.
+func (builder *bihBuilder) partition(begin, end, axis int,
+	plane float32) (middle int, leftMax, rightMin float32) {
+	triangleIndices := builder.bih.triangleIndices
+	leftMax = float32(math.Inf(-1))
+	rightMin = float32(math.Inf(+1))
+
+	i, j := begin, end-1
+	for i <= j {
+		bounds := &builder.triangleBounds[triangleIndices[i]]
+		if 0.5*(bounds.minPoint[axis]+bounds.maxPoint[axis]) < plane {
+			leftMax = f32Max(leftMax, bounds.maxPoint[axis])
+			i++
+		} else {
+			rightMin = f32Min(rightMin, bounds.minPoint[axis])
+			triangleIndices[i], triangleIndices[j] = triangleIndices[j], triangleIndices[i]
+			j--
+		}
+	}
+	return i, leftMax, rightMin
+}
+
+func (bih *BIH) GetNodesCount() int {
+	return len(bih.nodes)
+}
+
+type bihStackEntry struct {
+	node   int32
+	t0, t1 float64
+}
+
+func (bih *BIH) Intersect(ray *Ray) (bool, KdTreeIntersection) {
+	if len(bih.triangleIndices) == 0 || !ray.HasValidDirection() {
+		return false, KdTreeIntersection{t: math.Inf(+1)}
+	}
+	tEnter, tExit, hit := bih.bounds.Intersect(ray)
+	if !hit {
+		return false, KdTreeIntersection{t: math.Inf(+1)}
+	}
+
+	origin := ray.GetOrigin()
+	direction := ray.GetDirection()
+	invDirection := ray.GetInvDirection()
+
+	stack := make([]bihStackEntry, 0, 64)
+	closestIntersection := TriangleIntersection{t: math.Inf(+1)}
+	vertices := bih.mesh.vertices
+	triangles := bih.mesh.triangles
+
+	nodeIndex, t0, t1 := int32(0), tEnter, tExit
+	for {
+		n := &bih.nodes[nodeIndex]
+		if n.trianglesCount > 0 {
+			for i := n.index; i < n.index+n.trianglesCount; i++ {
+				triangleIndex := bih.triangleIndices[i]
+				indices := triangles[triangleIndex]
+				triangle := Triangle{[3]Vector64{
+					NewVector64FromVector32(vertices[indices[0]]),
+					NewVector64FromVector32(vertices[indices[1]]),
+					NewVector64FromVector32(vertices[indices[2]]),
+				}}
+				hitFound, intersection := IntersectTriangle(ray, &triangle)
+				if hitFound && intersection.t < closestIntersection.t {
+					closestIntersection = intersection
+					closestIntersection.triangleIndex = triangleIndex
+				}
+			}
+		} else {
+			axis := n.axis
+			left, right := nodeIndex+1, n.index
+			visitLeft, visitRight := false, false
+			leftT0, leftT1, rightT0, rightT1 := t0, t1, t0, t1
+
+			if direction[axis] == 0 {
+				visitLeft = origin[axis] <= float64(n.clip[0])
+				visitRight = origin[axis] >= float64(n.clip[1])
+			} else {
+				tLeft := (float64(n.clip[0]) - origin[axis]) * invDirection[axis]
+				tRight := (float64(n.clip[1]) - origin[axis]) * invDirection[axis]
+				if direction[axis] > 0 {
+					// the ray is in the left child before tLeft and in
+					// the right child after tRight
+					leftT1 = math.Min(t1, tLeft)
+					rightT0 = math.Max(t0, tRight)
+				} else {
+					leftT0 = math.Max(t0, tLeft)
+					rightT1 = math.Min(t1, tRight)
+				}
+				visitLeft = leftT0 <= leftT1
+				visitRight = rightT0 <= rightT1
+			}
+
+			// the near child is visited first
+			if direction[axis] < 0 {
+				left, right = right, left
+				visitLeft, visitRight = visitRight, visitLeft
+				leftT0, rightT0 = rightT0, leftT0
+				leftT1, rightT1 = rightT1, leftT1
+			}
+			if visitLeft {
+				if visitRight {
+					stack = append(stack, bihStackEntry{right, rightT0, rightT1})
+				}
+				nodeIndex, t0, t1 = left, leftT0, leftT1
+				continue
+			}
+			if visitRight {
+				nodeIndex, t0, t1 = right, rightT0, rightT1
+				continue
+			}
+		}
+
+		// next node from the stack that can contain closer hit
+		found := false
+		for len(stack) > 0 {
+			entry := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			if entry.t0 <= closestIntersection.t {
+				nodeIndex, t0, t1 = entry.node, entry.t0, entry.t1
+				found = true
+				break
+			}
+		}
+		if !found {
+			break
+		}
+	}
+
+	if closestIntersection.t == math.Inf(+1) {
+		return false, KdTreeIntersection{t: math.Inf(+1)}
+	}
+	return true, KdTreeIntersection{
+		t:             closestIntersection.t,
+		epsilon:       closestIntersection.epsilon,
+		b1:            closestIntersection.b1,
+		b2:            closestIntersection.b2,
+		triangleIndex: closestIntersection.triangleIndex,
+		materialID:    bih.mesh.GetMaterialID(closestIntersection.triangleIndex),
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"math"
+)
+
+// Camera is a pinhole camera. Fov is a vertical field of view in degrees.
+type Camera struct {
+	Position  Vector64
+	Direction Vector64
+	Fov       float64
+}
+
+// NewCameraForBounds returns camera with 45 degrees field of view that
+// looks at the center of the bounds from the front-left-top direction. The
+// distance to the center is 1.5 times the bounds diagonal, so the bounds
+// are fully visible.
+func NewCameraForBounds(bounds BBox64) Camera {
+	center := bounds.GetCenter()
+	diagonal := VLength64(VSub64(bounds.maxPoint, bounds.minPoint))
+	direction := VNormalized64(Vector64{1, -2, -1})
+	return Camera{
+		Position:  VSub64(center, VMul64(direction, 1.5*diagonal)),
+		Direction: direction,
+		Fov:       45,
+	}
+}
+
+// GenerateRay returns ray that goes through the center of the pixel (x, y)
+// of the image with the given resolution. Pixel (0, 0) is the top-left one.
+func (camera *Camera) GenerateRay(x, y, width, height int) Ray {
+	forward := VNormalized64(camera.Direction)
+
+	// choose up vector that is not parallel to the view direction
+	up := Vector64{0, 0, 1}
+	if math.Abs(forward[2]) > 0.999 {
+		up = Vector64{0, 1, 0}
+	}
+	right := VNormalized64(CrossProduct64(forward, up))
+	up = CrossProduct64(right, forward)
+
+	tanHalfFov := math.Tan(0.5 * camera.Fov * math.Pi / 180.0)
+	aspectRatio := float64(width) / float64(height)
+
+	u := (2.0*(float64(x)+0.5)/float64(width) - 1.0) * tanHalfFov * aspectRatio
+	v := (1.0 - 2.0*(float64(y)+0.5)/float64(height)) * tanHalfFov
+
+	direction := VAdd64(forward, VAdd64(VMul64(right, u), VMul64(up, v)))
+	return RayFromOriginAndDirection(camera.Position, VNormalized64(direction))
+}
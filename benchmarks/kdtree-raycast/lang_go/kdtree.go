@@ -4,8 +4,10 @@ import (
 	"bufio"
 	"common"
 	"encoding/binary"
+	"fmt"
 	"math"
 	"os"
+	"sort"
 	"unsafe"
 )
 
@@ -15,11 +17,19 @@ const (
 	leafNodeFlags     uint32 = 3
 )
 
+// node is already a packed 8-byte structure. Interior node stores split axis
+// in the low 2 bits of n[0] and the above child index in the remaining bits,
+// n[1] is the split position as float32 bits. The below child immediately
+// follows its parent. Leaf node has both low bits of n[0] set, the remaining
+// bits store triangles count, n[1] is the triangle index for single triangle
+// leaf or the offset into KdTree.triangleIndices otherwise. The leaves of
+// the wide index tree store in n[1] the index into KdTree.wideLeafOffsets
+// for any triangles count, see initWideLeaf.
 type node [2]uint32
 
 func (n *node) initInteriorNode(axis int, aboveChild int32, split float32) {
 	n[0] = uint32(axis) | uint32(aboveChild)<<2
-	n[1] = *(*uint32)(unsafe.Pointer(&split))
+	n[1] = math.Float32bits(split)
 }
 
 func (n *node) initEmptyLeaf() {
@@ -38,6 +48,11 @@ func (n *node) initLeafWithMultipleTriangles(numTriangles int32,
 	n[1] = uint32(triangleIndicesOffset)
 }
 
+func (n *node) initWideLeaf(numTriangles int32, leafIndex int32) {
+	n[0] = leafNodeFlags | uint32(numTriangles)<<2
+	n[1] = uint32(leafIndex)
+}
+
 func (n node) isLeaf() bool {
 	return n[0]&leafNodeFlags == leafNodeFlags
 }
@@ -59,7 +74,7 @@ func (n node) splitAxis() int {
 }
 
 func (n node) splitPosition() float32 {
-	return *(*float32)(unsafe.Pointer(&n[1]))
+	return math.Float32frombits(n[1])
 }
 
 func (n node) aboveChild() int32 {
@@ -75,75 +90,210 @@ type KdTree struct {
 	triangleIndices []int32
 	mesh            *TriangleMesh
 	meshBounds      BBox64
+
+	// The wide index tree is built for the meshes that exceed the limits of
+	// 32-bit triangle references, see KdTreeBuilder. Its leaves reference
+	// the range of wideTriangleIndices that starts at wideLeafOffsets[n[1]]
+	// and triangleIndices is not used.
+	wide                bool
+	wideLeafOffsets     []int64
+	wideTriangleIndices []int64
+
+	// droppedTriangles are the axis-aligned triangles that the builder
+	// dropped from the split planes, see Validate. They are not stored in
+	// the kdtree file.
+	droppedTriangles []int32
 }
 
 type KdTreeIntersection struct {
-	t       float64
-	epsilon float64
+	t             float64
+	epsilon       float64
+	b1            float64 // barycentric coordinates of the hit point,
+	b2            float64 // see GetShadingNormal
+	triangleIndex int32
+	materialID    int32 // -1 if the mesh does not have material assignments
 }
 
+// The kdtree file is little-endian regardless of the host byte order:
+//
+//	int32 nodesCount
+//	[nodesCount][2]uint32 nodes
+//	int32 triangleIndicesCount
+//	[triangleIndicesCount]int32 triangleIndices
+//
+// The same format is used by C++ and D implementations. The wide index
+// tree is stored in the versioned format described in kdtree_wide.go, the
+// format is detected by the file header.
 func NewKdTree(fileName string, mesh *TriangleMesh) *KdTree {
-	file, err := os.Open(fileName)
+	kdTree, err := loadKdTree(fileName, mesh)
 	common.Check(err)
+	return kdTree
+}
+
+// loadKdTree is the same as NewKdTree but returns an error instead of
+// reporting it.
+func loadKdTree(fileName string, mesh *TriangleMesh) (*KdTree, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
 	defer file.Close()
 
-	reader := bufio.NewReader(file)
+	reader, err := newFileReader(file)
+	if err != nil {
+		return nil, err
+	}
 
-	var nodesCount int32
-	err = binary.Read(reader, binary.LittleEndian, &nodesCount)
-	common.Check(err)
+	// the first value is either nodes count or the wide file magic which
+	// is larger than any valid nodes count
+	var header uint32
+	if err := binary.Read(reader, binary.LittleEndian, &header); err != nil {
+		return nil, err
+	}
+	if header == wideKdTreeFileMagic {
+		return loadWideKdTree(reader, mesh)
+	}
+
+	nodesCount := int32(header)
+	if nodesCount < 0 || nodesCount > maxNodesCount {
+		return nil, fmt.Errorf("invalid number of kdtree nodes: %d", nodesCount)
+	}
 
 	nodes := make([]node, nodesCount)
-	err = binary.Read(reader, binary.LittleEndian, &nodes)
-	common.Check(err)
+	if err := binary.Read(reader, binary.LittleEndian, &nodes); err != nil {
+		return nil, err
+	}
 
 	var triangleIndicesCount int32
-	err = binary.Read(reader, binary.LittleEndian, &triangleIndicesCount)
-	common.Check(err)
+	if err := binary.Read(reader, binary.LittleEndian, &triangleIndicesCount); err != nil {
+		return nil, err
+	}
+	if triangleIndicesCount < 0 {
+		return nil, fmt.Errorf("invalid number of kdtree triangle indices: %d",
+			triangleIndicesCount)
+	}
 
 	triangleIndices := make([]int32, triangleIndicesCount)
-	err = binary.Read(reader, binary.LittleEndian, &triangleIndices)
-	common.Check(err)
+	if err := binary.Read(reader, binary.LittleEndian, &triangleIndices); err != nil {
+		return nil, err
+	}
 
 	return &KdTree{
 		nodes:           nodes,
 		triangleIndices: triangleIndices,
 		mesh:            mesh,
-		meshBounds:      NewBBox64FromBBox32(mesh.GetBounds()),
+		meshBounds:      getLoadedKdTreeBounds(mesh),
+	}, nil
+}
+
+// getLoadedKdTreeBounds returns the bounds of the kdtree loaded for the
+// mesh, they are the same as the bounds used by the builder.
+func getLoadedKdTreeBounds(mesh *TriangleMesh) BBox64 {
+	meshBounds := mesh.GetBounds()
+	if mesh.GetTrianglesCount() == 0 {
+		// degenerate but finite bounds for empty mesh
+		meshBounds = NewBBox32FromPoint(Vector32{})
 	}
+	return NewBBox64FromBBox32(meshBounds)
 }
 
 func (kdTree *KdTree) SaveToFile(fileName string) {
+	common.Check(kdTree.saveToFile(fileName))
+}
+
+// saveToFile is the same as SaveToFile but returns an error instead of
+// reporting it.
+func (kdTree *KdTree) saveToFile(fileName string) error {
 	file, err := os.Create(fileName)
-	common.Check(err)
+	if err != nil {
+		return err
+	}
 	defer file.Close()
 
 	writer := bufio.NewWriter(file)
+	if kdTree.wide {
+		if err := kdTree.writeWide(writer); err != nil {
+			return err
+		}
+		if err := writer.Flush(); err != nil {
+			return err
+		}
+		return file.Close()
+	}
 
 	nodesCount := int32(len(kdTree.nodes))
-	err = binary.Write(writer, binary.LittleEndian, nodesCount)
-	common.Check(err)
-
-	err = binary.Write(writer, binary.LittleEndian, kdTree.nodes)
-	common.Check(err)
+	if err := binary.Write(writer, binary.LittleEndian, nodesCount); err != nil {
+		return err
+	}
+	if err := binary.Write(writer, binary.LittleEndian, kdTree.nodes); err != nil {
+		return err
+	}
 
 	triangleIndicesCount := int32(len(kdTree.triangleIndices))
-	err = binary.Write(writer, binary.LittleEndian, triangleIndicesCount)
-	common.Check(err)
+	if err := binary.Write(writer, binary.LittleEndian, triangleIndicesCount); err != nil {
+		return err
+	}
+	if err := binary.Write(writer, binary.LittleEndian, kdTree.triangleIndices); err != nil {
+		return err
+	}
 
-	err = binary.Write(writer, binary.LittleEndian, kdTree.triangleIndices)
-	common.Check(err)
+	if err := writer.Flush(); err != nil {
+		return err
+	}
+	return file.Close()
+}
 
-	err = writer.Flush()
-	common.Check(err)
+// SizeInBytes returns the size of the tree's own arrays: nodes and triangle
+// indices. The mesh is shared with other users and is not counted, as well
+// as slice headers and unused slice capacity. The value is equal to the
+// size of the file written by SaveToFile minus two int32 counters, or minus
+// the header and three int64 counters for the wide index tree.
+func (kdTree *KdTree) SizeInBytes() int64 {
+	if kdTree.wide {
+		return int64(len(kdTree.nodes))*int64(unsafe.Sizeof(node{})) +
+			int64(len(kdTree.wideLeafOffsets)+len(kdTree.wideTriangleIndices))*
+				int64(unsafe.Sizeof(int64(0)))
+	}
+	return int64(len(kdTree.nodes))*int64(unsafe.Sizeof(node{})) +
+		int64(len(kdTree.triangleIndices))*int64(unsafe.Sizeof(int32(0)))
+}
+
+// TraversalStats collects information about a single ray traversal.
+type TraversalStats struct {
+	InteriorNodesVisited int
+	LeavesVisited        int
+	TriangleTests        int
 }
 
 func (kdTree *KdTree) Intersect(ray *Ray) (bool, KdTreeIntersection) {
+	return kdTree.intersect(ray, nil)
+}
+
+// IntersectWithStats is the same as Intersect but additionally accumulates
+// traversal statistics.
+func (kdTree *KdTree) IntersectWithStats(ray *Ray,
+	stats *TraversalStats) (bool, KdTreeIntersection) {
+	return kdTree.intersect(ray, stats)
+}
+
+func (kdTree *KdTree) intersect(ray *Ray,
+	stats *TraversalStats) (bool, KdTreeIntersection) {
+	if !ray.HasValidDirection() {
+		return false, KdTreeIntersection{t: math.Inf(+1)}
+	}
 	tMin, tMax, intersectBounds := kdTree.meshBounds.Intersect(ray)
-	if !intersectBounds {
+	if !intersectBounds || len(kdTree.nodes) == 0 {
 		return false, KdTreeIntersection{t: math.Inf(+1)}
 	}
 
+	// skip the part of the ray that is closer than ray epsilon
+	if ray.epsilon > tMin {
+		tMin = ray.epsilon
+		if tMin > tMax {
+			return false, KdTreeIntersection{t: math.Inf(+1)}
+		}
+	}
+
 	type traversalInfo struct {
 		n    *node
 		tMin float64
@@ -158,6 +308,9 @@ func (kdTree *KdTree) Intersect(ray *Ray) (bool, KdTreeIntersection) {
 
 	for closestIntersection.t > tMin {
 		if n.isInteriorNode() {
+			if stats != nil {
+				stats.InteriorNodesVisited++
+			}
 			axis := n.splitAxis()
 
 			distanceToSplitPlane := float64(n.splitPosition()) - ray.GetOrigin()[axis]
@@ -225,6 +378,10 @@ func (kdTree *KdTree) Intersect(ray *Ray) (bool, KdTreeIntersection) {
 				}
 			}
 		} else { // leaf node
+			if stats != nil {
+				stats.LeavesVisited++
+				stats.TriangleTests += int(n.trianglesCount())
+			}
 			kdTree.IntersectLeafTriangles(ray, *n, &closestIntersection)
 
 			if traversalStackSize == 0 {
@@ -244,8 +401,12 @@ func (kdTree *KdTree) Intersect(ray *Ray) (bool, KdTreeIntersection) {
 
 	return true,
 		KdTreeIntersection{
-			t:       closestIntersection.t,
-			epsilon: closestIntersection.epsilon,
+			t:             closestIntersection.t,
+			epsilon:       closestIntersection.epsilon,
+			b1:            closestIntersection.b1,
+			b2:            closestIntersection.b2,
+			triangleIndex: closestIntersection.triangleIndex,
+			materialID:    kdTree.mesh.GetMaterialID(closestIntersection.triangleIndex),
 		}
 }
 
@@ -255,7 +416,26 @@ func (kdTree *KdTree) IntersectLeafTriangles(ray *Ray, leaf node,
 	vertices := kdTree.mesh.vertices
 	triangles := kdTree.mesh.triangles
 
-	if leaf.trianglesCount() == 1 {
+	if kdTree.wide {
+		if leaf.trianglesCount() == 0 {
+			return
+		}
+		offset := kdTree.wideLeafOffsets[leaf.index()]
+		leafTriangles := kdTree.wideTriangleIndices[offset : offset+int64(leaf.trianglesCount())]
+		for _, triangleIndex := range leafTriangles {
+			indices := triangles[triangleIndex]
+			triangle := Triangle{[3]Vector64{
+				NewVector64FromVector32(vertices[indices[0]]),
+				NewVector64FromVector32(vertices[indices[1]]),
+				NewVector64FromVector32(vertices[indices[2]]),
+			}}
+			hitFound, triangleIntersection := IntersectTriangle(ray, &triangle)
+			if hitFound && triangleIntersection.t < closestIntersection.t {
+				*closestIntersection = triangleIntersection
+				closestIntersection.triangleIndex = int32(triangleIndex)
+			}
+		}
+	} else if leaf.trianglesCount() == 1 {
 		triangleIndex := leaf.index()
 		indices := triangles[triangleIndex]
 		triangle := Triangle{[3]Vector64{
@@ -266,6 +446,7 @@ func (kdTree *KdTree) IntersectLeafTriangles(ray *Ray, leaf node,
 		hitFound, triangleIntersection := IntersectTriangle(ray, &triangle)
 		if hitFound && triangleIntersection.t < closestIntersection.t {
 			*closestIntersection = triangleIntersection
+			closestIntersection.triangleIndex = triangleIndex
 		}
 	} else {
 		for i := int32(0); i < leaf.trianglesCount(); i++ {
@@ -279,12 +460,510 @@ func (kdTree *KdTree) IntersectLeafTriangles(ray *Ray, leaf node,
 			hitFound, triangleIntersection := IntersectTriangle(ray, &triangle)
 			if hitFound && triangleIntersection.t < closestIntersection.t {
 				*closestIntersection = triangleIntersection
+				closestIntersection.triangleIndex = triangleIndex
 			}
 		}
 	}
 }
 
+// appendLeafTriangles appends triangle indices of the leaf to buffer.
+func (kdTree *KdTree) appendLeafTriangles(buffer []int32, leaf node) []int32 {
+	switch {
+	case leaf.trianglesCount() == 0:
+	case kdTree.wide:
+		offset := kdTree.wideLeafOffsets[leaf.index()]
+		for _, triangleIndex := range kdTree.wideTriangleIndices[offset : offset+
+			int64(leaf.trianglesCount())] {
+			buffer = append(buffer, int32(triangleIndex))
+		}
+	case leaf.trianglesCount() == 1:
+		buffer = append(buffer, leaf.index())
+	default:
+		buffer = append(buffer, kdTree.triangleIndices[leaf.index():leaf.index()+
+			leaf.trianglesCount()]...)
+	}
+	return buffer
+}
+
+// walkLeaves visits leaves intersected by the ray segment [tMin, tMax] in
+// front-to-back order. visit gets the leaf node index and the end of the
+// segment inside the leaf. Traversal stops when visit returns true.
+func (kdTree *KdTree) walkLeaves(ray *Ray, tMin, tMax float64,
+	visit func(leafIndex int32, tLeafMax float64) (stop bool)) {
+	if !ray.HasValidDirection() {
+		return
+	}
+	boundsMin, boundsMax, intersectBounds := kdTree.meshBounds.Intersect(ray)
+	if !intersectBounds || len(kdTree.nodes) == 0 {
+		return
+	}
+	tMin = math.Max(math.Max(tMin, boundsMin), ray.epsilon)
+	tMax = math.Min(tMax, boundsMax)
+	if tMin > tMax {
+		return
+	}
+
+	type traversalInfo struct {
+		nodeIndex int32
+		tMin      float64
+		tMax      float64
+	}
+
+	var traversalStack [maxTraversalDepth]traversalInfo
+	traversalStackSize := 0
+	nodeIndex := int32(0)
+
+	for {
+		n := kdTree.nodes[nodeIndex]
+
+		if n.isInteriorNode() {
+			axis := n.splitAxis()
+			origin := ray.GetOrigin()[axis]
+			direction := ray.GetDirection()[axis]
+			splitPosition := float64(n.splitPosition())
+
+			belowChild := nodeIndex + 1
+			aboveChild := n.aboveChild()
+
+			if direction == 0.0 {
+				if origin < splitPosition {
+					nodeIndex = belowChild
+				} else if origin > splitPosition {
+					nodeIndex = aboveChild
+				} else { // ray lies in the split plane
+					traversalStack[traversalStackSize] =
+						traversalInfo{aboveChild, tMin, tMax}
+					traversalStackSize++
+					nodeIndex = belowChild
+				}
+				continue
+			}
+
+			firstChild, secondChild := belowChild, aboveChild
+			if origin > splitPosition ||
+				(origin == splitPosition && direction < 0.0) {
+				firstChild, secondChild = aboveChild, belowChild
+			}
+
+			tSplit := (splitPosition - origin) * ray.GetInvDirection()[axis]
+			if tSplit > tMax || tSplit < 0.0 {
+				nodeIndex = firstChild
+			} else if tSplit < tMin {
+				nodeIndex = secondChild
+			} else {
+				traversalStack[traversalStackSize] =
+					traversalInfo{secondChild, tSplit, tMax}
+				traversalStackSize++
+				nodeIndex = firstChild
+				tMax = tSplit
+			}
+		} else { // leaf node
+			if visit(nodeIndex, tMax) {
+				return
+			}
+			if traversalStackSize == 0 {
+				return
+			}
+			traversalStackSize--
+			nodeIndex = traversalStack[traversalStackSize].nodeIndex
+			tMin = traversalStack[traversalStackSize].tMin
+			tMax = traversalStack[traversalStackSize].tMax
+		}
+	}
+}
+
+// WalkRay invokes visit with triangle indices of each non-empty leaf
+// intersected by the ray segment [tMin, tMax] in front-to-back order.
+// Traversal stops when visit returns true. The slice passed to visit is
+// valid only during the call. A triangle referenced by multiple leaves is
+// reported for each of them.
+func (kdTree *KdTree) WalkRay(ray *Ray, tMin, tMax float64,
+	visit func(triangleIndices []int32) (stop bool)) {
+	var singleTriangle [1]int32
+	var wideBuffer []int32
+
+	kdTree.walkLeaves(ray, tMin, tMax, func(leafIndex int32, _ float64) bool {
+		leaf := kdTree.nodes[leafIndex]
+		switch {
+		case leaf.trianglesCount() == 0:
+			return false
+		case kdTree.wide:
+			wideBuffer = kdTree.appendLeafTriangles(wideBuffer[:0], leaf)
+			return visit(wideBuffer)
+		case leaf.trianglesCount() == 1:
+			// single triangle index is stored directly in the node
+			singleTriangle[0] = leaf.index()
+			return visit(singleTriangle[:])
+		default:
+			return visit(kdTree.triangleIndices[leaf.index() : leaf.index()+
+				leaf.trianglesCount()])
+		}
+	})
+}
+
+// IntersectAll returns all intersections of the ray with mesh triangles
+// inside [tMin, tMax] range sorted by distance. A triangle referenced by
+// multiple leaves is reported once.
+func (kdTree *KdTree) IntersectAll(ray *Ray, tMin, tMax float64) []KdTreeIntersection {
+	var intersections []KdTreeIntersection
+	testedTriangles := make(map[int32]bool)
+
+	kdTree.WalkRay(ray, tMin, tMax, func(triangleIndices []int32) bool {
+		for _, triangleIndex := range triangleIndices {
+			if testedTriangles[triangleIndex] {
+				continue
+			}
+			testedTriangles[triangleIndex] = true
+
+			v0, v1, v2 := kdTree.mesh.GetTriangle(triangleIndex)
+			triangle := Triangle{[3]Vector64{
+				NewVector64FromVector32(v0),
+				NewVector64FromVector32(v1),
+				NewVector64FromVector32(v2),
+			}}
+			hitFound, intersection := IntersectTriangle(ray, &triangle)
+			if hitFound && intersection.t >= tMin && intersection.t <= tMax {
+				intersections = append(intersections, KdTreeIntersection{
+					t:             intersection.t,
+					epsilon:       intersection.epsilon,
+					b1:            intersection.b1,
+					b2:            intersection.b2,
+					triangleIndex: triangleIndex,
+					materialID:    kdTree.mesh.GetMaterialID(triangleIndex),
+				})
+			}
+		}
+		return false
+	})
+
+	sort.Slice(intersections, func(i, j int) bool {
+		if intersections[i].t == intersections[j].t {
+			return intersections[i].triangleIndex < intersections[j].triangleIndex
+		}
+		return intersections[i].t < intersections[j].t
+	})
+	return intersections
+}
+
+// Occluded returns true if the ray hits any triangle inside [tMin, tMax]
+// range. Unlike Intersect the traversal stops at the first found hit, which
+// is enough for shadow rays.
+func (kdTree *KdTree) Occluded(ray *Ray, tMin, tMax float64) bool {
+	occluded := false
+
+	kdTree.WalkRay(ray, tMin, tMax, func(triangleIndices []int32) bool {
+		for _, triangleIndex := range triangleIndices {
+			v0, v1, v2 := kdTree.mesh.GetTriangle(triangleIndex)
+			triangle := Triangle{[3]Vector64{
+				NewVector64FromVector32(v0),
+				NewVector64FromVector32(v1),
+				NewVector64FromVector32(v2),
+			}}
+			hitFound, intersection := IntersectTriangle(ray, &triangle)
+			if hitFound && intersection.t >= tMin && intersection.t <= tMax {
+				occluded = true
+				return true
+			}
+		}
+		return false
+	})
+	return occluded
+}
+
+// Verify checks structural invariants of the tree: child and triangle
+// indices are in range, split positions lie inside the node bounds and the
+// depth does not exceed the traversal stack size. The first violated
+// invariant is returned as error.
+func (kdTree *KdTree) Verify() error {
+	if len(kdTree.nodes) == 0 {
+		return fmt.Errorf("kdtree has no nodes")
+	}
+
+	type nodeInfo struct {
+		index  int32
+		depth  int
+		bounds BBox64
+	}
+
+	nodesCount := int32(len(kdTree.nodes))
+	trianglesCount := kdTree.mesh.GetTrianglesCount()
+	visited := make([]bool, nodesCount)
+	stack := []nodeInfo{{0, 0, kdTree.meshBounds}}
+
+	for len(stack) > 0 {
+		info := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		if visited[info.index] {
+			return fmt.Errorf("node %d is referenced more than once", info.index)
+		}
+		visited[info.index] = true
+
+		if info.depth > maxTraversalDepth {
+			return fmt.Errorf("node %d: depth %d exceeds maximum traversal depth %d",
+				info.index, info.depth, maxTraversalDepth)
+		}
+
+		n := kdTree.nodes[info.index]
+
+		if n.isLeaf() {
+			if kdTree.wide {
+				if err := kdTree.verifyWideLeaf(info.index, n); err != nil {
+					return err
+				}
+				continue
+			}
+			switch n.trianglesCount() {
+			case 0:
+			case 1:
+				if n.index() < 0 || n.index() >= trianglesCount {
+					return fmt.Errorf("node %d: triangle index %d is out of range [0, %d)",
+						info.index, n.index(), trianglesCount)
+				}
+			default:
+				offset := int64(n.index())
+				count := int64(n.trianglesCount())
+				if offset < 0 || offset+count > int64(len(kdTree.triangleIndices)) {
+					return fmt.Errorf("node %d: triangle indices range [%d, %d) "+
+						"is out of range [0, %d)", info.index, offset, offset+count,
+						len(kdTree.triangleIndices))
+				}
+				for _, triangleIndex := range kdTree.triangleIndices[offset : offset+count] {
+					if triangleIndex < 0 || triangleIndex >= trianglesCount {
+						return fmt.Errorf("node %d: triangle index %d is out of range [0, %d)",
+							info.index, triangleIndex, trianglesCount)
+					}
+				}
+			}
+			continue
+		}
+
+		belowChild := info.index + 1
+		aboveChild := n.aboveChild()
+		if belowChild >= nodesCount {
+			return fmt.Errorf("node %d: below child index %d is out of range [0, %d)",
+				info.index, belowChild, nodesCount)
+		}
+		if aboveChild <= info.index || aboveChild >= nodesCount {
+			return fmt.Errorf("node %d: above child index %d is out of range (%d, %d)",
+				info.index, aboveChild, info.index, nodesCount)
+		}
+
+		axis := n.splitAxis()
+		split := float64(n.splitPosition())
+		if !(split >= info.bounds.minPoint[axis] && split <= info.bounds.maxPoint[axis]) {
+			return fmt.Errorf("node %d: split position %g is outside of node "+
+				"bounds [%g, %g] on axis %d", info.index, split,
+				info.bounds.minPoint[axis], info.bounds.maxPoint[axis], axis)
+		}
+
+		belowBounds := info.bounds
+		belowBounds.maxPoint[axis] = split
+		aboveBounds := info.bounds
+		aboveBounds.minPoint[axis] = split
+
+		stack = append(stack, nodeInfo{aboveChild, info.depth + 1, aboveBounds})
+		stack = append(stack, nodeInfo{belowChild, info.depth + 1, belowBounds})
+	}
+
+	for i, isVisited := range visited {
+		if !isVisited {
+			return fmt.Errorf("node %d is not reachable from the root", i)
+		}
+	}
+	return nil
+}
+
+// Validate checks the invariants of Verify and that every mesh triangle is
+// referenced by at least one leaf which bounds overlap the triangle bounds,
+// so the triangle can be hit by the rays that pass through the leaf.
+// Degenerate triangles are not checked since they can't be hit. The
+// builder drops axis-aligned triangles that lie in the split plane, the end
+// edge of such triangle is sorted before the start edge, so they can be
+// unreferenced too if the builder recorded them in droppedTriangles. The
+// split plane can be removed later by OptimizeTree, so the record is
+// checked instead of the tree. The loaded tree has no record, its
+// unreferenced triangle has to lie in the split plane of the tree.
+func (kdTree *KdTree) Validate() error {
+	if err := kdTree.Verify(); err != nil {
+		return err
+	}
+
+	type nodeInfo struct {
+		index  int32
+		bounds BBox64
+	}
+
+	trianglesCount := kdTree.mesh.GetTrianglesCount()
+	referenced := make([]bool, trianglesCount)
+	covered := make([]bool, trianglesCount)
+	stack := []nodeInfo{{0, kdTree.meshBounds}}
+	var triangles []int32
+
+	for len(stack) > 0 {
+		info := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		n := kdTree.nodes[info.index]
+
+		if n.isInteriorNode() {
+			axis := n.splitAxis()
+			belowBounds := info.bounds
+			belowBounds.maxPoint[axis] = float64(n.splitPosition())
+			aboveBounds := info.bounds
+			aboveBounds.minPoint[axis] = float64(n.splitPosition())
+			stack = append(stack, nodeInfo{n.aboveChild(), aboveBounds})
+			stack = append(stack, nodeInfo{info.index + 1, belowBounds})
+			continue
+		}
+
+		triangles = kdTree.appendLeafTriangles(triangles[:0], n)
+		for _, triangleIndex := range triangles {
+			referenced[triangleIndex] = true
+			triangleBounds := NewBBox64FromBBox32(kdTree.mesh.GetTriangleBounds(triangleIndex))
+			if info.bounds.Overlaps(triangleBounds) {
+				covered[triangleIndex] = true
+			}
+		}
+	}
+
+	dropped := make([]bool, trianglesCount)
+	for _, triangleIndex := range kdTree.droppedTriangles {
+		dropped[triangleIndex] = true
+	}
+
+	for i := range referenced {
+		if kdTree.mesh.GetTriangleNormal(int32(i)) == (Vector32{}) {
+			continue
+		}
+		if !referenced[i] {
+			if dropped[i] || kdTree.liesInSplitPlane(int32(i)) {
+				continue
+			}
+			return fmt.Errorf("triangle %d is not referenced by any leaf", i)
+		}
+		if !covered[i] {
+			return fmt.Errorf("triangle %d is referenced only by leaves that "+
+				"do not overlap the triangle bounds", i)
+		}
+	}
+	return nil
+}
+
+// liesInSplitPlane checks if the triangle is axis-aligned and lies in the
+// split plane of the interior node which bounds overlap the triangle bounds.
+func (kdTree *KdTree) liesInSplitPlane(triangleIndex int32) bool {
+	type nodeInfo struct {
+		index  int32
+		bounds BBox64
+	}
+	triangleBounds := NewBBox64FromBBox32(kdTree.mesh.GetTriangleBounds(triangleIndex))
+	stack := []nodeInfo{{0, kdTree.meshBounds}}
+
+	for len(stack) > 0 {
+		info := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		n := kdTree.nodes[info.index]
+		if n.isLeaf() || !info.bounds.Overlaps(triangleBounds) {
+			continue
+		}
+		axis := n.splitAxis()
+		splitPosition := float64(n.splitPosition())
+		if triangleBounds.minPoint[axis] == splitPosition &&
+			triangleBounds.maxPoint[axis] == splitPosition {
+			return true
+		}
+		belowBounds := info.bounds
+		belowBounds.maxPoint[axis] = splitPosition
+		aboveBounds := info.bounds
+		aboveBounds.minPoint[axis] = splitPosition
+		stack = append(stack, nodeInfo{n.aboveChild(), aboveBounds})
+		stack = append(stack, nodeInfo{info.index + 1, belowBounds})
+	}
+	return false
+}
+
+// GetSAHCost returns the expected cost of tracing a ray through the tree
+// according to the surface area heuristic: the cost of the leaf is
+// intersectionCost per triangle, the cost of the interior node is
+// traversalCost plus the costs of the children weighted by the ratio of
+// the child and the node surface areas. The cost depends only on the tree
+// layout, so trees built by different implementations and loaded from
+// files can be compared. With the costs of NewBuildParams the result is
+// the same as BuildStats.SAHCost. The tree is expected to pass Verify.
+func (kdTree *KdTree) GetSAHCost(intersectionCost, traversalCost float32) float64 {
+	var meshBounds BBox32
+	for i := 0; i < 3; i++ {
+		meshBounds.minPoint[i] = float32(kdTree.meshBounds.minPoint[i])
+		meshBounds.maxPoint[i] = float32(kdTree.meshBounds.maxPoint[i])
+	}
+	return getSubtreeSAHCost(kdTree.nodes, 0, meshBounds, intersectionCost, traversalCost)
+}
+
+func getSubtreeSAHCost(nodes []node, nodeIndex int32, nodeBounds BBox32,
+	intersectionCost, traversalCost float32) float64 {
+	n := nodes[nodeIndex]
+	if n.isLeaf() {
+		return float64(intersectionCost) * float64(n.trianglesCount())
+	}
+	bounds0, bounds1 := getChildBounds(nodeBounds, n.splitAxis(), n.splitPosition())
+	return getInteriorNodeSAHCost(nodeBounds, bounds0, bounds1,
+		getSubtreeSAHCost(nodes, nodeIndex+1, bounds0, intersectionCost, traversalCost),
+		getSubtreeSAHCost(nodes, n.aboveChild(), bounds1, intersectionCost, traversalCost),
+		traversalCost)
+}
+
+func getInteriorNodeSAHCost(nodeBounds, bounds0, bounds1 BBox32,
+	cost0, cost1 float64, traversalCost float32) float64 {
+	area := float64(nodeBounds.GetSurfaceArea())
+	p0, p1 := 1.0, 1.0
+	if area > 0 {
+		p0 = float64(bounds0.GetSurfaceArea()) / area
+		p1 = float64(bounds1.GetSurfaceArea()) / area
+	}
+	return float64(traversalCost) + p0*cost0 + p1*cost1
+}
+
+func getChildBounds(nodeBounds BBox32, axis int, splitPosition float32) (bounds0, bounds1 BBox32) {
+	bounds0, bounds1 = nodeBounds, nodeBounds
+	bounds0.maxPoint[axis] = splitPosition
+	bounds1.minPoint[axis] = splitPosition
+	return
+}
+
+// DepthHistogram returns the number of leaves at each depth. The root
+// node has depth 0.
+func (kdTree *KdTree) DepthHistogram() []int {
+	type nodeInfo struct {
+		index int32
+		depth int
+	}
+
+	var histogram []int
+	stack := []nodeInfo{{0, 0}}
+
+	for len(stack) > 0 {
+		info := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		n := kdTree.nodes[info.index]
+
+		if n.isLeaf() {
+			for len(histogram) <= info.depth {
+				histogram = append(histogram, 0)
+			}
+			histogram[info.depth]++
+		} else {
+			// below child immediately follows its parent
+			stack = append(stack, nodeInfo{n.aboveChild(), info.depth + 1})
+			stack = append(stack, nodeInfo{info.index + 1, info.depth + 1})
+		}
+	}
+	return histogram
+}
+
 func (kdTree *KdTree) GetHash() uint64 {
+	if kdTree.wide {
+		return kdTree.getWideHash()
+	}
 	var hash uint64
 	for _, node := range kdTree.nodes {
 		hash = common.CombineHashes(hash, uint64(node[0]))
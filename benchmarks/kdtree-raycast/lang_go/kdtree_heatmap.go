@@ -0,0 +1,20 @@
+package main
+
+// GetTriangleTestsHeatmap casts a ray through each pixel of the camera image
+// and returns the number of ray-triangle intersection tests performed for
+// each ray, indexed as heatmap[y][x]. It allows to visualize regions where
+// the kdtree performs badly.
+func (kdTree *KdTree) GetTriangleTestsHeatmap(camera *Camera,
+	width, height int) [][]int {
+	heatmap := make([][]int, height)
+	for y := 0; y < height; y++ {
+		heatmap[y] = make([]int, width)
+		for x := 0; x < width; x++ {
+			ray := camera.GenerateRay(x, y, width, height)
+			var stats TraversalStats
+			kdTree.IntersectWithStats(&ray, &stats)
+			heatmap[y][x] = stats.TriangleTests
+		}
+	}
+	return heatmap
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"math"
+)
+
+// The rope of the leaf face k*2+side points to the neighbor across the face
+// along axis k, side 0 is the min face and side 1 is the max face.
+const (
+	ropesPerLeaf = 6
+	noRope       = -1
+)
+
+// RopedKdTree adds ropes (Havran, Popov et al.) to the leaves of the
+// kdtree. Each leaf face is linked to the smallest node that contains the
+// whole face on the other side, or to noRope for faces on the tree bounds.
+// The traversal goes from the leaf to the neighbor through the exit face
+// and descends to the leaf that contains the ray, it does not need the
+// stack. The ray that lies in the split plane visits only one side of the
+// plane, while the stack traversal visits both.
+type RopedKdTree struct {
+	kdTree *KdTree
+
+	// indexed by node index, filled only for leaves
+	ropes      [][ropesPerLeaf]int32
+	leafBounds []BBox64
+}
+
+// NewRopedKdTree builds the ropes for the kdtree. The kdtree nodes are not
+// modified.
+func NewRopedKdTree(kdTree *KdTree) *RopedKdTree {
+	ropedTree := &RopedKdTree{
+		kdTree:     kdTree,
+		ropes:      make([][ropesPerLeaf]int32, len(kdTree.nodes)),
+		leafBounds: make([]BBox64, len(kdTree.nodes)),
+	}
+	var rootRopes [ropesPerLeaf]int32
+	for face := range rootRopes {
+		rootRopes[face] = noRope
+	}
+	ropedTree.buildRopes(0, rootRopes, kdTree.meshBounds)
+	return ropedTree
+}
+
+func (ropedTree *RopedKdTree) buildRopes(nodeIndex int32, ropes [ropesPerLeaf]int32,
+	bounds BBox64) {
+	// ropes are moved down to the child of the neighbor if the child
+	// contains the whole face
+	for face, rope := range ropes {
+		ropes[face] = ropedTree.optimizeRope(rope, face, bounds)
+	}
+
+	n := ropedTree.kdTree.nodes[nodeIndex]
+	if n.isLeaf() {
+		ropedTree.ropes[nodeIndex] = ropes
+		ropedTree.leafBounds[nodeIndex] = bounds
+		return
+	}
+
+	axis := n.splitAxis()
+	split := float64(n.splitPosition())
+	belowChild, aboveChild := nodeIndex+1, n.aboveChild()
+
+	belowRopes, belowBounds := ropes, bounds
+	belowRopes[2*axis+1] = aboveChild
+	belowBounds.maxPoint[axis] = split
+	ropedTree.buildRopes(belowChild, belowRopes, belowBounds)
+
+	aboveRopes, aboveBounds := ropes, bounds
+	aboveRopes[2*axis] = belowChild
+	aboveBounds.minPoint[axis] = split
+	ropedTree.buildRopes(aboveChild, aboveRopes, aboveBounds)
+}
+
+func (ropedTree *RopedKdTree) optimizeRope(rope int32, face int, bounds BBox64) int32 {
+	faceAxis := face / 2
+	for rope != noRope {
+		n := ropedTree.kdTree.nodes[rope]
+		if n.isLeaf() {
+			break
+		}
+		axis := n.splitAxis()
+		split := float64(n.splitPosition())
+		belowChild, aboveChild := rope+1, n.aboveChild()
+
+		if axis == faceAxis {
+			// the child next to the face
+			if face%2 == 1 {
+				rope = aboveChild
+				if split > bounds.maxPoint[axis] {
+					rope = belowChild
+				}
+			} else {
+				rope = belowChild
+				if split < bounds.minPoint[axis] {
+					rope = aboveChild
+				}
+			}
+		} else if split >= bounds.maxPoint[axis] {
+			rope = belowChild
+		} else if split <= bounds.minPoint[axis] {
+			rope = aboveChild
+		} else {
+			break
+		}
+	}
+	return rope
+}
+
+// findLeaf descends from the node to the leaf that contains the ray at
+// distance t. The child is selected by the distance to the split plane,
+// the same computation as in the leaf exit test, so the ray at the exit
+// distance of the leaf goes to the other side of the split.
+func (ropedTree *RopedKdTree) findLeaf(nodeIndex int32, ray *Ray, t float64) int32 {
+	nodes := ropedTree.kdTree.nodes
+	origin := ray.GetOrigin()
+	direction := ray.GetDirection()
+	invDirection := ray.GetInvDirection()
+
+	for {
+		n := nodes[nodeIndex]
+		if n.isLeaf() {
+			return nodeIndex
+		}
+		axis := n.splitAxis()
+		split := float64(n.splitPosition())
+
+		below := false
+		switch {
+		case direction[axis] > 0:
+			below = t < (split-origin[axis])*invDirection[axis]
+		case direction[axis] < 0:
+			below = t >= (split-origin[axis])*invDirection[axis]
+		default:
+			below = origin[axis] <= split
+		}
+		if below {
+			nodeIndex++
+		} else {
+			nodeIndex = n.aboveChild()
+		}
+	}
+}
+
+func (ropedTree *RopedKdTree) Intersect(ray *Ray) (bool, KdTreeIntersection) {
+	kdTree := ropedTree.kdTree
+	if !ray.HasValidDirection() || len(kdTree.nodes) == 0 {
+		return false, KdTreeIntersection{t: math.Inf(+1)}
+	}
+	tMin, tMax, intersectBounds := kdTree.meshBounds.Intersect(ray)
+	if !intersectBounds {
+		return false, KdTreeIntersection{t: math.Inf(+1)}
+	}
+	tMin = math.Max(tMin, ray.epsilon)
+	if tMin > tMax {
+		return false, KdTreeIntersection{t: math.Inf(+1)}
+	}
+
+	origin := ray.GetOrigin()
+	direction := ray.GetDirection()
+	invDirection := ray.GetInvDirection()
+	closestIntersection := TriangleIntersection{t: math.Inf(+1)}
+
+	leaf := ropedTree.findLeaf(0, ray, tMin)
+	for {
+		kdTree.IntersectLeafTriangles(ray, kdTree.nodes[leaf], &closestIntersection)
+
+		// exit face of the leaf
+		bounds := &ropedTree.leafBounds[leaf]
+		tExit := math.Inf(+1)
+		exitFace := -1
+		for k := 0; k < 3; k++ {
+			var t float64
+			var face int
+			if direction[k] > 0 {
+				t = (bounds.maxPoint[k] - origin[k]) * invDirection[k]
+				face = 2*k + 1
+			} else if direction[k] < 0 {
+				t = (bounds.minPoint[k] - origin[k]) * invDirection[k]
+				face = 2 * k
+			} else {
+				continue
+			}
+			if t < tExit {
+				tExit, exitFace = t, face
+			}
+		}
+
+		if closestIntersection.t <= tExit || tExit >= tMax {
+			break
+		}
+		next := ropedTree.ropes[leaf][exitFace]
+		if next == noRope {
+			break
+		}
+		leaf = ropedTree.findLeaf(next, ray, tExit)
+	}
+
+	if closestIntersection.t == math.Inf(+1) {
+		return false, KdTreeIntersection{t: math.Inf(+1)}
+	}
+	return true, KdTreeIntersection{
+		t:             closestIntersection.t,
+		epsilon:       closestIntersection.epsilon,
+		b1:            closestIntersection.b1,
+		b2:            closestIntersection.b2,
+		triangleIndex: closestIntersection.triangleIndex,
+		materialID:    kdTree.mesh.GetMaterialID(closestIntersection.triangleIndex),
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"common"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// The wide index kdtree file is little-endian like the legacy format:
+//
+//	uint32 magic
+//	uint32 version
+//	int64 nodesCount
+//	[nodesCount][2]uint32 nodes
+//	int64 leafOffsetsCount
+//	[leafOffsetsCount]int64 leafOffsets
+//	int64 triangleIndicesCount
+//	[triangleIndicesCount]int64 triangleIndices
+//
+// The magic is larger than maxNodesCount, so it can't be confused with the
+// nodes count that starts the legacy file. The version is incremented when
+// the layout changes, it is also a part of the tree hash.
+const (
+	wideKdTreeFileMagic   uint32 = 0x5744544b // "KTDW"
+	wideKdTreeFileVersion uint32 = 1
+)
+
+// loadWideKdTree reads the wide index tree after the file magic.
+func loadWideKdTree(reader io.Reader, mesh *TriangleMesh) (*KdTree, error) {
+	var version uint32
+	if err := binary.Read(reader, binary.LittleEndian, &version); err != nil {
+		return nil, err
+	}
+	if version != wideKdTreeFileVersion {
+		return nil, fmt.Errorf("unsupported wide kdtree file version: %d", version)
+	}
+
+	var nodesCount int64
+	if err := binary.Read(reader, binary.LittleEndian, &nodesCount); err != nil {
+		return nil, err
+	}
+	if nodesCount < 0 || nodesCount > maxNodesCount {
+		return nil, fmt.Errorf("invalid number of kdtree nodes: %d", nodesCount)
+	}
+	nodes := make([]node, nodesCount)
+	if err := binary.Read(reader, binary.LittleEndian, &nodes); err != nil {
+		return nil, err
+	}
+
+	// every leaf has at most one offset
+	var leafOffsetsCount int64
+	if err := binary.Read(reader, binary.LittleEndian, &leafOffsetsCount); err != nil {
+		return nil, err
+	}
+	if leafOffsetsCount < 0 || leafOffsetsCount > nodesCount {
+		return nil, fmt.Errorf("invalid number of kdtree leaf offsets: %d",
+			leafOffsetsCount)
+	}
+	leafOffsets := make([]int64, leafOffsetsCount)
+	if err := binary.Read(reader, binary.LittleEndian, &leafOffsets); err != nil {
+		return nil, err
+	}
+
+	var triangleIndicesCount int64
+	if err := binary.Read(reader, binary.LittleEndian, &triangleIndicesCount); err != nil {
+		return nil, err
+	}
+	if triangleIndicesCount < 0 {
+		return nil, fmt.Errorf("invalid number of kdtree triangle indices: %d",
+			triangleIndicesCount)
+	}
+	triangleIndices := make([]int64, triangleIndicesCount)
+	if err := binary.Read(reader, binary.LittleEndian, &triangleIndices); err != nil {
+		return nil, err
+	}
+
+	return &KdTree{
+		nodes:               nodes,
+		mesh:                mesh,
+		meshBounds:          getLoadedKdTreeBounds(mesh),
+		wide:                true,
+		wideLeafOffsets:     leafOffsets,
+		wideTriangleIndices: triangleIndices,
+	}, nil
+}
+
+// writeWide writes the wide index tree including the file header.
+func (kdTree *KdTree) writeWide(writer io.Writer) error {
+	values := []interface{}{
+		wideKdTreeFileMagic,
+		wideKdTreeFileVersion,
+		int64(len(kdTree.nodes)),
+		kdTree.nodes,
+		int64(len(kdTree.wideLeafOffsets)),
+		kdTree.wideLeafOffsets,
+		int64(len(kdTree.wideTriangleIndices)),
+		kdTree.wideTriangleIndices,
+	}
+	for _, value := range values {
+		if err := binary.Write(writer, binary.LittleEndian, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// verifyWideLeaf checks that the leaf offset and the triangle indices of
+// the wide index tree leaf are in range.
+func (kdTree *KdTree) verifyWideLeaf(nodeIndex int32, n node) error {
+	if n.trianglesCount() == 0 {
+		return nil
+	}
+	leafIndex := int64(n.index())
+	if leafIndex < 0 || leafIndex >= int64(len(kdTree.wideLeafOffsets)) {
+		return fmt.Errorf("node %d: leaf offset index %d is out of range [0, %d)",
+			nodeIndex, leafIndex, len(kdTree.wideLeafOffsets))
+	}
+	offset := kdTree.wideLeafOffsets[leafIndex]
+	count := int64(n.trianglesCount())
+	if offset < 0 || offset > int64(len(kdTree.wideTriangleIndices))-count {
+		return fmt.Errorf("node %d: triangle indices range [%d, %d) "+
+			"is out of range [0, %d)", nodeIndex, offset, offset+count,
+			len(kdTree.wideTriangleIndices))
+	}
+	trianglesCount := int64(kdTree.mesh.GetTrianglesCount())
+	for _, triangleIndex := range kdTree.wideTriangleIndices[offset : offset+count] {
+		if triangleIndex < 0 || triangleIndex >= trianglesCount {
+			return fmt.Errorf("node %d: triangle index %d is out of range [0, %d)",
+				nodeIndex, triangleIndex, trianglesCount)
+		}
+	}
+	return nil
+}
+
+// getWideHash starts with the file magic and version, so the wide index
+// tree never has the hash of the legacy tree and the hash changes with the
+// format version.
+func (kdTree *KdTree) getWideHash() uint64 {
+	hash := common.CombineHashes(0, uint64(wideKdTreeFileMagic))
+	hash = common.CombineHashes(hash, uint64(wideKdTreeFileVersion))
+	for _, node := range kdTree.nodes {
+		hash = common.CombineHashes(hash, uint64(node[0]))
+		hash = common.CombineHashes(hash, uint64(node[1]))
+	}
+	for _, offset := range kdTree.wideLeafOffsets {
+		hash = common.CombineHashes(hash, uint64(offset))
+	}
+	for _, index := range kdTree.wideTriangleIndices {
+		hash = common.CombineHashes(hash, uint64(index))
+	}
+	return hash
+}
@@ -2,60 +2,313 @@ package main
 
 import (
 	"common"
+	"flag"
 	"fmt"
 	"os"
 	"path"
 	"path/filepath"
+	"strings"
 )
 
 func main() {
-	const modelsCount = 3
+	checkBaseline := flag.Bool("check-baseline", false,
+		"compare results against stored baselines")
+	updateBaseline := flag.Bool("update-baseline", false,
+		"store results as new baselines")
+	baselineTolerance := flag.Float64("baseline-tolerance", 10,
+		"allowed timing regression in percent")
+	iterations := flag.Int("iterations", 1,
+		"number of runs per model, the minimum time is reported")
+	compareRopes := flag.Bool("ropes", false,
+		"additionally benchmark stackless kdtree traversal with ropes for each model")
+	compareBVH := flag.Bool("bvh", false,
+		"additionally benchmark BVH for each model")
+	compareQBVH := flag.Bool("qbvh", false,
+		"additionally benchmark 4-wide BVH for each model")
+	compareGrid := flag.Bool("grid", false,
+		"additionally benchmark uniform grid for each model")
+	gridDensity := flag.Float64("grid-density", DefaultGridDensity,
+		"number of uniform grid cells per triangle, used with -grid")
+	compareOctree := flag.Bool("octree", false,
+		"additionally benchmark octree for each model")
+	compareBIH := flag.Bool("bih", false,
+		"additionally benchmark bounding interval hierarchy for each model")
+	acceleratorNames := flag.String("accel", "",
+		"additionally benchmark the given comma separated accelerators, "+
+			"available accelerators: "+strings.Join(GetAcceleratorNames(), ", "))
+	threadsCount := flag.Int("threads", 0,
+		"additionally benchmark parallel ray casting with the given number of threads")
+	sceneFileName := flag.String("scene", "",
+		"json scene file with the models to use instead of the standard models")
+	useMeshCache := flag.Bool("mesh-cache", false,
+		"load models from meshbin cache files, the cache is created on the first run")
+	fixWinding := flag.Bool("fix-winding", false,
+		"make triangle winding consistent and closed models facing outward")
+	manifestFileName := flag.String("manifest", "",
+		"sha256sum file, check that model and kdtree files match the listed checksums")
+	assetCacheDir := flag.String("asset-cache", "",
+		"download missing model and kdtree files to the given directory, "+
+			"the scene file or the manifest provides the checksums")
+	bvhSpatialAlpha := flag.Float64("bvh-spatial-alpha", 0,
+		"enable BVH spatial splits (SBVH) with the given overlap threshold, used with -bvh "+
+			"and -qbvh")
+	validateKdTrees := flag.Bool("validate", false,
+		"check structure of the loaded kdtrees and that all triangles are reachable")
+	printSAHCost := flag.Bool("sah-cost", false,
+		"print SAH cost of the loaded kdtrees to compare tree quality")
+	flag.Parse()
+	if *iterations < 1 {
+		*iterations = 1
+	}
+	dataDir := flag.Arg(0)
 
 	// prepare input data
-	modelFiles := [modelsCount]string{
-		path.Join(os.Args[1], "teapot.stl"),
-		path.Join(os.Args[1], "bunny.stl"),
-		path.Join(os.Args[1], "dragon.stl"),
+	var sceneFile *SceneFile
+	if *sceneFileName != "" {
+		sceneFile = LoadSceneFile(*sceneFileName)
+	} else {
+		sceneFile = NewDefaultSceneFile(dataDir)
 	}
-
-	kdTreeFiles := [modelsCount]string{
-		path.Join(os.Args[1], "teapot.kdtree"),
-		path.Join(os.Args[1], "bunny.kdtree"),
-		path.Join(os.Args[1], "dragon.kdtree"),
+	models := sceneFile.Models
+	var manifest *AssetManifest
+	if *manifestFileName != "" {
+		manifest = LoadAssetManifest(*manifestFileName)
+	}
+	if *assetCacheDir != "" {
+		NewAssetFetcher(*assetCacheDir, manifest).FetchSceneAssets(sceneFile, true)
+	} else if manifest != nil {
+		manifest.VerifySceneAssets(sceneFile, true)
 	}
 
 	var meshes []*TriangleMesh
 	var kdTrees []*KdTree
 
-	for i := 0; i < modelsCount; i++ {
-		mesh := LoadTriangleMesh(modelFiles[i])
+	for i := range models {
+		if models[i].KdTree == "" {
+			common.RuntimeError("kdtree file is not specified for model " + models[i].Name)
+		}
+		var mesh *TriangleMesh
+		if *useMeshCache {
+			mesh = models[i].LoadCachedMesh()
+		} else {
+			mesh = models[i].LoadMesh()
+		}
+		if *fixWinding {
+			if flippedCount := mesh.FixWinding(true); flippedCount > 0 {
+				fmt.Printf("mesh [%-6s]: %d triangles flipped\n", models[i].Name, flippedCount)
+			}
+		}
 		meshes = append(meshes, mesh)
 
-		kdTree := NewKdTree(kdTreeFiles[i], mesh)
+		kdTree := NewKdTree(models[i].KdTree, mesh)
 		kdTrees = append(kdTrees, kdTree)
 	}
 
+	if *validateKdTrees {
+		for i, kdTree := range kdTrees {
+			if err := kdTree.Validate(); err != nil {
+				common.RuntimeError(fmt.Sprintf("model %s: invalid kdtree: %v",
+					models[i].Name, err))
+			}
+			fmt.Printf("validate [%-6s]: %d nodes, %d triangles ok\n", models[i].Name,
+				len(kdTree.nodes), kdTree.mesh.GetTrianglesCount())
+		}
+	}
+
+	if *printSAHCost {
+		// the costs of the default build parameters of the construction
+		// benchmark, the same for all implementations
+		const intersectionCost, traversalCost = 80, 1
+		for i, kdTree := range kdTrees {
+			fmt.Printf("sah cost [%-6s]: %.2f (%d nodes)\n", models[i].Name,
+				kdTree.GetSAHCost(intersectionCost, traversalCost), len(kdTree.nodes))
+		}
+	}
+
 	// run benchmark
 	elapsedTime := 0
+	timings := make([]int, len(models))
 	for i, kdTree := range kdTrees {
-		timeMsec := BenchmarkKdTree(kdTree)
+		// each iteration casts the same rays
+		randState := SaveRandState()
+		timeMsec := 0
+		for k := 0; k < *iterations; k++ {
+			RestoreRandState(randState)
+			iterationTime := BenchmarkKdTree(kdTree)
+			if k == 0 || iterationTime < timeMsec {
+				timeMsec = iterationTime
+			}
+		}
 		elapsedTime += timeMsec
+		timings[i] = timeMsec
 
 		speed := (float64(BenchmarkRaysCount) / 1000000.0) / (float64(timeMsec) / 1000.0)
-		baseName := path.Base(modelFiles[i])
 		fmt.Printf("raycast performance [%-6s] = %.2f MRays/sec\n",
-			baseName[:len(baseName)-4], speed)
+			models[i].Name, speed)
+	}
+
+	// stackless traversal with the same kdtrees
+	if *compareRopes {
+		randState := SaveRandState()
+		for i, kdTree := range kdTrees {
+			ropedTree := NewRopedKdTree(kdTree)
+			timeMsec := BenchmarkRopedKdTree(ropedTree)
+			speed := (float64(BenchmarkRaysCount) / 1000000.0) / (float64(timeMsec) / 1000.0)
+			fmt.Printf("ropes raycast performance [%-6s] = %.2f MRays/sec\n",
+				models[i].Name, speed)
+		}
+		RestoreRandState(randState)
+	}
+
+	// BVH comparison, random generator state is restored so validation
+	// is not affected
+	if *compareBVH {
+		randState := SaveRandState()
+		for i, mesh := range meshes {
+			bvhParams := NewBVHBuildParams()
+			bvhParams.SpatialSplitAlpha = float32(*bvhSpatialAlpha)
+			bvh := BuildBVH(mesh, bvhParams)
+			timeMsec := BenchmarkBVH(bvh, kdTrees[i].meshBounds)
+			speed := (float64(BenchmarkRaysCount) / 1000000.0) / (float64(timeMsec) / 1000.0)
+			fmt.Printf("bvh raycast performance [%-6s] = %.2f MRays/sec\n",
+				models[i].Name, speed)
+		}
+		RestoreRandState(randState)
+	}
+
+	if *compareQBVH {
+		randState := SaveRandState()
+		for i, mesh := range meshes {
+			bvhParams := NewBVHBuildParams()
+			bvhParams.SpatialSplitAlpha = float32(*bvhSpatialAlpha)
+			qbvh := BuildQBVH(mesh, bvhParams)
+			timeMsec := BenchmarkQBVH(qbvh, kdTrees[i].meshBounds)
+			speed := (float64(BenchmarkRaysCount) / 1000000.0) / (float64(timeMsec) / 1000.0)
+			fmt.Printf("qbvh raycast performance [%-6s] = %.2f MRays/sec (%d nodes)\n",
+				models[i].Name, speed, qbvh.GetNodesCount())
+		}
+		RestoreRandState(randState)
+	}
+
+	if *compareGrid {
+		randState := SaveRandState()
+		for i, mesh := range meshes {
+			grid := BuildUniformGrid(mesh, *gridDensity)
+			timeMsec := BenchmarkUniformGrid(grid, kdTrees[i].meshBounds)
+			speed := (float64(BenchmarkRaysCount) / 1000000.0) / (float64(timeMsec) / 1000.0)
+			resolution := grid.GetResolution()
+			fmt.Printf("grid raycast performance [%-6s] = %.2f MRays/sec (%dx%dx%d cells)\n",
+				models[i].Name, speed, resolution[0], resolution[1], resolution[2])
+		}
+		RestoreRandState(randState)
+	}
+
+	if *compareOctree {
+		randState := SaveRandState()
+		for i, mesh := range meshes {
+			octree := BuildOctree(mesh, NewOctreeBuildParams())
+			timeMsec := BenchmarkOctree(octree, kdTrees[i].meshBounds)
+			speed := (float64(BenchmarkRaysCount) / 1000000.0) / (float64(timeMsec) / 1000.0)
+			fmt.Printf("octree raycast performance [%-6s] = %.2f MRays/sec (%d nodes)\n",
+				models[i].Name, speed, octree.GetNodesCount())
+		}
+		RestoreRandState(randState)
+	}
+
+	if *compareBIH {
+		randState := SaveRandState()
+		for i, mesh := range meshes {
+			bih := BuildBIH(mesh, NewBIHBuildParams())
+			timeMsec := BenchmarkBIH(bih, kdTrees[i].meshBounds)
+			speed := (float64(BenchmarkRaysCount) / 1000000.0) / (float64(timeMsec) / 1000.0)
+			fmt.Printf("bih raycast performance [%-6s] = %.2f MRays/sec (%d nodes)\n",
+				models[i].Name, speed, bih.GetNodesCount())
+		}
+		RestoreRandState(randState)
+	}
+
+	if *acceleratorNames != "" {
+		randState := SaveRandState()
+		for _, name := range strings.Split(*acceleratorNames, ",") {
+			name = strings.TrimSpace(name)
+			for i, mesh := range meshes {
+				accelerator, err := NewAccelerator(name)
+				common.Check(err)
+				accelerator.Build(mesh)
+				timeMsec := BenchmarkAccelerator(accelerator, kdTrees[i].meshBounds)
+				speed := (float64(BenchmarkRaysCount) / 1000000.0) / (float64(timeMsec) / 1000.0)
+				fmt.Printf("%s raycast performance [%-6s] = %.2f MRays/sec (%d nodes)\n",
+					name, models[i].Name, speed, accelerator.Stats().NodesCount)
+			}
+			RestoreRandState(randState)
+		}
+	}
+
+	// parallel ray casting, the rays are cast with a single thread first
+	// to get the scaling and to check that the number of hits is the same
+	if *threadsCount > 0 {
+		randState := SaveRandState()
+		for i, kdTree := range kdTrees {
+			rays := generateBenchmarkRays(kdTree, ParallelBenchmarkRaysCount)
+			serialTime, serialHits := BenchmarkKdTreeParallel(kdTree, rays, 1)
+			parallelTime, parallelHits := BenchmarkKdTreeParallel(kdTree, rays,
+				*threadsCount)
+			if parallelHits != serialHits {
+				common.ValidationError(fmt.Sprintf(
+					"parallel ray casting error: %d hits, expected %d",
+					parallelHits, serialHits))
+			}
+
+			speed := func(timeMsec int) float64 {
+				if timeMsec == 0 {
+					timeMsec = 1
+				}
+				return (float64(len(rays)) / 1000000.0) / (float64(timeMsec) / 1000.0)
+			}
+			fmt.Printf("parallel raycast performance [%-6s] = %.2f MRays/sec "+
+				"(%d threads), %.2f MRays/sec (1 thread), scaling %.2fx\n",
+				models[i].Name, speed(parallelTime), *threadsCount,
+				speed(serialTime), speed(parallelTime)/speed(serialTime))
+		}
+		RestoreRandState(randState)
 	}
 
 	// communicate time to master
 	timingStorage := path.Join(filepath.Dir(os.Args[0]), "timing")
 	common.StoreBenchmarkTiming(timingStorage, elapsedTime)
 
-	// validation
-	common.AssertEquals(uint64(RandUint32()), 3404003823, "error in random generator")
-
-	raysCount := [modelsCount]int{32768, 64, 32}
-	for i := 0; i < modelsCount; i++ {
+	// validation, the random generator state is known only for the
+	// standard models
+	raysCount := []int{32768, 64, 32}
+	if *sceneFileName == "" {
+		common.AssertEquals(uint64(RandUint32()), 3404003823, "error in random generator")
+	} else {
+		raysCount = make([]int, len(models))
+		for i := range raysCount {
+			raysCount[i] = 32
+		}
+	}
+	for i := range kdTrees {
 		ValidateKdTree(kdTrees[i], raysCount[i])
 	}
+
+	// baselines
+	if *checkBaseline || *updateBaseline {
+		passed := true
+		for i, model := range models {
+			name := model.Name
+			baselineFile := path.Join(sceneFile.Dir, name+".baseline.json")
+			actual := NewBaseline(kdTrees[i], timings[i])
+
+			if *updateBaseline {
+				actual.SaveToFile(baselineFile)
+			} else if !CheckBaseline(name, actual, LoadBaseline(baselineFile),
+				*baselineTolerance) {
+				passed = false
+			}
+		}
+		if !passed {
+			common.ValidationError("baseline check failed")
+		}
+	}
 }
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"fmt"
+	"math"
+)
+
+// Procedural meshes allow to run the benchmarks without model files. Each
+// generator takes the desired number of triangles, the generated mesh has
+// approximately that many triangles. The meshes are fully deterministic and
+// closed surfaces have outward facing triangles.
+
+// GenerateMesh creates procedural mesh by generator name: sphere,
+// torus-knot, tetrahedron, grid, random or random-clustered. Random
+// generators produce the exact number of unconnected triangles, see
+// GenerateRandomMesh.
+func GenerateMesh(generator string, trianglesCount int) (*TriangleMesh, error) {
+	switch generator {
+	case "sphere":
+		return GenerateUVSphere(trianglesCount), nil
+	case "torus-knot":
+		return GenerateTorusKnot(trianglesCount, 2, 3), nil
+	case "tetrahedron":
+		return GenerateSierpinskiTetrahedron(trianglesCount), nil
+	case "grid":
+		return GenerateDisplacedGrid(trianglesCount, 1), nil
+	case "random":
+		return finishGeneratedMesh(GenerateRandomMesh(trianglesCount, 1, NewGenOpts())), nil
+	case "random-clustered":
+		opts := NewGenOpts()
+		opts.ClustersCount = 16
+		return finishGeneratedMesh(GenerateRandomMesh(trianglesCount, 1, opts)), nil
+	}
+	return nil, fmt.Errorf("unknown mesh generator: %q", generator)
+}
+
+func toVector32(v Vector64) Vector32 {
+	return Vector32{float32(v[0]), float32(v[1]), float32(v[2])}
+}
+
+// finishGeneratedMesh computes triangle normals from the geometry.
+func finishGeneratedMesh(mesh *TriangleMesh) *TriangleMesh {
+	mesh.normals = make([]Vector32, len(mesh.triangles))
+	for i := range mesh.triangles {
+		mesh.normals[i] = mesh.GetTriangleNormal(int32(i))
+	}
+	return mesh
+}
+
+// generateParametricMesh tessellates the surface point(u, v), u and v in
+// [0, 1], by uCount x vCount grid of quads, two triangles per quad. Wrapped
+// parameters share the vertices at 0 and 1.
+func generateParametricMesh(uCount, vCount int, wrapU, wrapV bool,
+	point func(u, v float64) Vector64) *TriangleMesh {
+
+	uVertices, vVertices := uCount+1, vCount+1
+	if wrapU {
+		uVertices = uCount
+	}
+	if wrapV {
+		vVertices = vCount
+	}
+
+	mesh := new(TriangleMesh)
+	for j := 0; j < vVertices; j++ {
+		for i := 0; i < uVertices; i++ {
+			p := point(float64(i)/float64(uCount), float64(j)/float64(vCount))
+			mesh.vertices = append(mesh.vertices, toVector32(p))
+		}
+	}
+
+	vertexIndex := func(i, j int) int32 {
+		return int32((j%vVertices)*uVertices + i%uVertices)
+	}
+	for j := 0; j < vCount; j++ {
+		for i := 0; i < uCount; i++ {
+			v00, v10 := vertexIndex(i, j), vertexIndex(i+1, j)
+			v01, v11 := vertexIndex(i, j+1), vertexIndex(i+1, j+1)
+			mesh.triangles = append(mesh.triangles,
+				[3]int32{v00, v10, v11}, [3]int32{v00, v11, v01})
+		}
+	}
+	return finishGeneratedMesh(mesh)
+}
+
+// GenerateUVSphere generates unit sphere with rings x 2*rings
+// latitude-longitude tessellation. Each pole is a single vertex.
+func GenerateUVSphere(trianglesCount int) *TriangleMesh {
+	// 2 * segments * (rings - 1) triangles with segments = 2 * rings
+	rings := int(math.Round(0.5 + math.Sqrt(0.25+float64(trianglesCount)/4.0)))
+	if rings < 2 {
+		rings = 2
+	}
+	segments := 2 * rings
+
+	mesh := new(TriangleMesh)
+	mesh.vertices = append(mesh.vertices, Vector32{0, 0, 1})
+	for ring := 1; ring < rings; ring++ {
+		theta := math.Pi * float64(ring) / float64(rings)
+		for segment := 0; segment < segments; segment++ {
+			phi := 2.0 * math.Pi * float64(segment) / float64(segments)
+			mesh.vertices = append(mesh.vertices, toVector32(Vector64{
+				math.Sin(theta) * math.Cos(phi),
+				math.Sin(theta) * math.Sin(phi),
+				math.Cos(theta),
+			}))
+		}
+	}
+	mesh.vertices = append(mesh.vertices, Vector32{0, 0, -1})
+
+	northPole := int32(0)
+	southPole := int32(len(mesh.vertices) - 1)
+	ringVertex := func(ring, segment int) int32 {
+		return int32(1 + (ring-1)*segments + segment%segments)
+	}
+
+	for segment := 0; segment < segments; segment++ {
+		mesh.triangles = append(mesh.triangles,
+			[3]int32{northPole, ringVertex(1, segment), ringVertex(1, segment+1)})
+	}
+	for ring := 1; ring < rings-1; ring++ {
+		for segment := 0; segment < segments; segment++ {
+			v00, v01 := ringVertex(ring, segment), ringVertex(ring, segment+1)
+			v10, v11 := ringVertex(ring+1, segment), ringVertex(ring+1, segment+1)
+			mesh.triangles = append(mesh.triangles,
+				[3]int32{v00, v10, v11}, [3]int32{v00, v11, v01})
+		}
+	}
+	for segment := 0; segment < segments; segment++ {
+		mesh.triangles = append(mesh.triangles,
+			[3]int32{southPole, ringVertex(rings-1, segment+1), ringVertex(rings-1, segment)})
+	}
+	return finishGeneratedMesh(mesh)
+}
+
+// GenerateTorusKnot generates a tube around (p, q) torus knot curve. The
+// tube is tessellated with 8 segments along the curve per segment around
+// the tube.
+func GenerateTorusKnot(trianglesCount, p, q int) *TriangleMesh {
+	const tubeRadius = 0.4
+
+	tubeSegments := int(math.Round(math.Sqrt(float64(trianglesCount) / 16.0)))
+	if tubeSegments < 3 {
+		tubeSegments = 3
+	}
+	curveSegments := 8 * tubeSegments
+
+	curve := func(t float64) Vector64 {
+		angle := 2.0 * math.Pi * t
+		r := 2.0 + math.Cos(float64(q)*angle)
+		return Vector64{
+			r * math.Cos(float64(p)*angle),
+			r * math.Sin(float64(p)*angle),
+			-math.Sin(float64(q) * angle),
+		}
+	}
+
+	return generateParametricMesh(curveSegments, tubeSegments, true, true,
+		func(u, v float64) Vector64 {
+			// the frame is the same for all points of the tube segment
+			p1 := curve(u)
+			p2 := curve(u + 1e-3)
+			tangent := VSub64(p2, p1)
+			binormal := VNormalized64(CrossProduct64(tangent, VAdd64(p2, p1)))
+			normal := VNormalized64(CrossProduct64(binormal, tangent))
+
+			angle := 2.0 * math.Pi * v
+			offset := VSub64(VMul64(normal, tubeRadius*math.Cos(angle)),
+				VMul64(binormal, tubeRadius*math.Sin(angle)))
+			return VAdd64(p1, offset)
+		})
+}
+
+// GenerateSierpinskiTetrahedron generates the recursive tetrahedron
+// fractal. The recursion level is the largest one that does not exceed
+// trianglesCount, level n has 4^(n+1) triangles.
+func GenerateSierpinskiTetrahedron(trianglesCount int) *TriangleMesh {
+	level := 0
+	for count := int64(16); count <= int64(trianglesCount); count *= 4 {
+		level++
+	}
+
+	mesh := new(TriangleMesh)
+
+	var subdivide func(corners [4]Vector64, level int)
+	subdivide = func(corners [4]Vector64, level int) {
+		if level == 0 {
+			base := int32(len(mesh.vertices))
+			for _, corner := range corners {
+				mesh.vertices = append(mesh.vertices, toVector32(corner))
+			}
+			mesh.triangles = append(mesh.triangles,
+				[3]int32{base, base + 1, base + 2},
+				[3]int32{base, base + 3, base + 1},
+				[3]int32{base, base + 2, base + 3},
+				[3]int32{base + 1, base + 3, base + 2})
+			return
+		}
+		for k := 0; k < 4; k++ {
+			var subCorners [4]Vector64
+			for m := 0; m < 4; m++ {
+				subCorners[m] = VMul64(VAdd64(corners[k], corners[m]), 0.5)
+			}
+			subdivide(subCorners, level-1)
+		}
+	}
+
+	subdivide([4]Vector64{
+		{1, 1, 1},
+		{1, -1, -1},
+		{-1, 1, -1},
+		{-1, -1, 1},
+	}, level)
+	return finishGeneratedMesh(mesh)
+}
+
+// GenerateDisplacedGrid generates heightfield over [-1, 1]^2 square. The
+// height is a sum of several sine waves and seeded random noise.
+func GenerateDisplacedGrid(trianglesCount int, seed uint64) *TriangleMesh {
+	resolution := int(math.Round(math.Sqrt(float64(trianglesCount) / 2.0)))
+	if resolution < 1 {
+		resolution = 1
+	}
+
+	r := &splitMix64{seed}
+	noise := make([]float64, (resolution+1)*(resolution+1))
+	for i := range noise {
+		noise[i] = float64(r.float32()) - 0.5
+	}
+
+	return generateParametricMesh(resolution, resolution, false, false,
+		func(u, v float64) Vector64 {
+			i := int(math.Round(u * float64(resolution)))
+			j := int(math.Round(v * float64(resolution)))
+			x, y := 2.0*u-1.0, 2.0*v-1.0
+			height := 0.2*math.Sin(3.0*x)*math.Cos(2.0*y) +
+				0.05*math.Sin(17.0*x+11.0*y) +
+				0.01*noise[j*(resolution+1)+i]
+			return Vector64{x, y, height}
+		})
+}
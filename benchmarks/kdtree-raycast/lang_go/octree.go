@@ -0,0 +1,279 @@
+package main
+
+import (
+	"math"
+)
+
+type OctreeBuildParams struct {
+	// MaxDepth limits the octree depth (root node has depth 0). If not
+	// positive then the depth is estimated from the number of triangles.
+	MaxDepth int
+
+	// LeafTrianglesLimit is the number of triangles below which nodes are
+	// not subdivided.
+	LeafTrianglesLimit int
+}
+
+func NewOctreeBuildParams() OctreeBuildParams {
+	return OctreeBuildParams{
+		MaxDepth:           0,
+		LeafTrianglesLimit: 8,
+	}
+}
+
+const octreeMaxDepth = 16
+
+// octreeNode is either an interior node with eight children stored
+// consecutively starting at firstChild or a leaf that references a range
+// of Octree.triangleIndices. Node bounds are not stored, they are computed
+// from the root bounds during traversal. Bit k of the child index selects
+// the upper half of the parent along axis k.
+type octreeNode struct {
+	firstChild     int32 // -1 for leaf
+	firstTriangle  int32
+	trianglesCount int32
+}
+
+// Octree subdivides the mesh bounds into eight equal boxes recursively.
+// Triangles are referenced from all leaves that overlap triangle bounds.
+// The node is subdivided if it has more than LeafTrianglesLimit triangles
+// and subdivision reduces the expected number of triangle tests.
+type Octree struct {
+	bounds          BBox64
+	nodes           []octreeNode
+	triangleIndices []int32
+	mesh            *TriangleMesh
+}
+
+type octreeBuilder struct {
+	buildParams    OctreeBuildParams
+	triangleBounds []BBox64
+	octree         *Octree
+}
+
+func BuildOctree(mesh *TriangleMesh, buildParams OctreeBuildParams) *Octree {
+	trianglesCount := mesh.GetTrianglesCount()
+	if buildParams.MaxDepth <= 0 {
+		// a few levels more than the fully balanced tree
+		depth := 0
+		if trianglesCount > 0 {
+			depth = int(math.Ceil(math.Log2(float64(trianglesCount)) / 3.0))
+		}
+		buildParams.MaxDepth = depth + 3
+	}
+	if buildParams.MaxDepth > octreeMaxDepth {
+		buildParams.MaxDepth = octreeMaxDepth
+	}
+	if buildParams.LeafTrianglesLimit < 1 {
+		buildParams.LeafTrianglesLimit = 1
+	}
+
+	octree := &Octree{
+		bounds: NewBBox64FromBBox32(mesh.GetBounds()),
+		mesh:   mesh,
+	}
+	if trianglesCount == 0 {
+		octree.bounds = NewBBox64FromPoint(Vector64{})
+	}
+	builder := &octreeBuilder{
+		buildParams:    buildParams,
+		triangleBounds: make([]BBox64, trianglesCount),
+		octree:         octree,
+	}
+	triangles := make([]int32, trianglesCount)
+	for i := int32(0); i < trianglesCount; i++ {
+		builder.triangleBounds[i] = NewBBox64FromBBox32(mesh.GetTriangleBounds(i))
+		triangles[i] = i
+	}
+
+	octree.nodes = append(octree.nodes, octreeNode{})
+	builder.buildNode(0, octree.bounds, triangles, 0)
+	return octree
+}
+
+func getOctreeChildBounds(bounds BBox64, center Vector64, child int) BBox64 {
+	childBounds := bounds
+	for k := 0; k < 3; k++ {
+		if child&(1<<uint(k)) != 0 {
+			childBounds.minPoint[k] = center[k]
+		} else {
+			childBounds.maxPoint[k] = center[k]
+		}
+	}
+	return childBounds
+}
+
+func (builder *octreeBuilder) buildNode(nodeIndex int32, bounds BBox64,
+	triangles []int32, depth int) {
+	octree := builder.octree
+	if len(triangles) > builder.buildParams.LeafTrianglesLimit &&
+		depth < builder.buildParams.MaxDepth {
+		center := bounds.GetCenter()
+		var childTriangles [8][]int32
+		childReferences := 0
+		for child := 0; child < 8; child++ {
+			childBounds := getOctreeChildBounds(bounds, center, child)
+			for _, triangle := range triangles {
+				if childBounds.Overlaps(builder.triangleBounds[triangle]) {
+					childTriangles[child] = append(childTriangles[child], triangle)
+				}
+			}
+			childReferences += len(childTriangles[child])
+		}
+
+		// the surface area of the child is 1/4 of the node surface area,
+		// so the expected number of triangle tests decreases only if the
+		// children have less than 4 references per node triangle. This
+		// stops subdivision of nodes with large triangles that overlap
+		// most of the children.
+		if childReferences < 4*len(triangles) {
+			firstChild := int32(len(octree.nodes))
+			octree.nodes[nodeIndex].firstChild = firstChild
+			for child := 0; child < 8; child++ {
+				octree.nodes = append(octree.nodes, octreeNode{})
+			}
+			for child := 0; child < 8; child++ {
+				builder.buildNode(firstChild+int32(child),
+					getOctreeChildBounds(bounds, center, child),
+					childTriangles[child], depth+1)
+				childTriangles[child] = nil
+			}
+			return
+		}
+	}
+
+	octree.nodes[nodeIndex] = octreeNode{
+		firstChild:     -1,
+		firstTriangle:  int32(len(octree.triangleIndices)),
+		trianglesCount: int32(len(triangles)),
+	}
+	octree.triangleIndices = append(octree.triangleIndices, triangles...)
+}
+
+func (octree *Octree) GetNodesCount() int {
+	return len(octree.nodes)
+}
+
+// GetReferencesCount returns the total number of triangle references in
+// all leaves.
+func (octree *Octree) GetReferencesCount() int {
+	return len(octree.triangleIndices)
+}
+
+type octreeTraversal struct {
+	ray                 *Ray
+	closestIntersection TriangleIntersection
+}
+
+func (octree *Octree) Intersect(ray *Ray) (bool, KdTreeIntersection) {
+	if len(octree.triangleIndices) == 0 || !ray.HasValidDirection() {
+		return false, KdTreeIntersection{t: math.Inf(+1)}
+	}
+	t0, t1, hit := octree.bounds.Intersect(ray)
+	if !hit {
+		return false, KdTreeIntersection{t: math.Inf(+1)}
+	}
+
+	traversal := octreeTraversal{
+		ray:                 ray,
+		closestIntersection: TriangleIntersection{t: math.Inf(+1)},
+	}
+	octree.intersectNode(&traversal, 0, octree.bounds, t0, t1)
+
+	closestIntersection := &traversal.closestIntersection
+	if closestIntersection.t == math.Inf(+1) {
+		return false, KdTreeIntersection{t: math.Inf(+1)}
+	}
+	return true, KdTreeIntersection{
+		t:             closestIntersection.t,
+		epsilon:       closestIntersection.epsilon,
+		b1:            closestIntersection.b1,
+		b2:            closestIntersection.b2,
+		triangleIndex: closestIntersection.triangleIndex,
+		materialID:    octree.mesh.GetMaterialID(closestIntersection.triangleIndex),
+	}
+}
+
+// intersectNode visits the node for the ray interval [t0, t1] inside the
+// node bounds. Children are visited front to back: the ray starts in the
+// child determined by the direction of the ray relative to the center
+// planes and each crossing of the center plane along axis k flips bit k
+// of the child index.
+func (octree *Octree) intersectNode(traversal *octreeTraversal, nodeIndex int32,
+	bounds BBox64, t0, t1 float64) {
+	n := &octree.nodes[nodeIndex]
+	ray := traversal.ray
+
+	if n.firstChild == -1 {
+		vertices := octree.mesh.vertices
+		triangles := octree.mesh.triangles
+		closestIntersection := &traversal.closestIntersection
+		for i := n.firstTriangle; i < n.firstTriangle+n.trianglesCount; i++ {
+			triangleIndex := octree.triangleIndices[i]
+			indices := triangles[triangleIndex]
+			triangle := Triangle{[3]Vector64{
+				NewVector64FromVector32(vertices[indices[0]]),
+				NewVector64FromVector32(vertices[indices[1]]),
+				NewVector64FromVector32(vertices[indices[2]]),
+			}}
+			hitFound, intersection := IntersectTriangle(ray, &triangle)
+			if hitFound && intersection.t < closestIntersection.t {
+				*closestIntersection = intersection
+				closestIntersection.triangleIndex = triangleIndex
+			}
+		}
+		return
+	}
+
+	center := bounds.GetCenter()
+	origin := ray.GetOrigin()
+	direction := ray.GetDirection()
+	invDirection := ray.GetInvDirection()
+
+	// center plane crossings inside the interval, sorted by distance
+	child := 0
+	var crossingAxes [3]int
+	var crossingT [3]float64
+	crossingsCount := 0
+	for k := 0; k < 3; k++ {
+		tPlane := (center[k] - origin[k]) * invDirection[k]
+		var upper bool
+		switch {
+		case direction[k] == 0:
+			upper = origin[k] >= center[k]
+		case tPlane <= t0:
+			upper = direction[k] > 0
+		case tPlane >= t1:
+			upper = direction[k] < 0
+		default:
+			upper = direction[k] < 0
+			i := crossingsCount
+			for i > 0 && crossingT[i-1] > tPlane {
+				crossingT[i] = crossingT[i-1]
+				crossingAxes[i] = crossingAxes[i-1]
+				i--
+			}
+			crossingT[i] = tPlane
+			crossingAxes[i] = k
+			crossingsCount++
+		}
+		if upper {
+			child |= 1 << uint(k)
+		}
+	}
+
+	childT0 := t0
+	for i := 0; ; i++ {
+		childT1 := t1
+		if i < crossingsCount {
+			childT1 = crossingT[i]
+		}
+		octree.intersectNode(traversal, n.firstChild+int32(child),
+			getOctreeChildBounds(bounds, center, child), childT0, childT1)
+		if traversal.closestIntersection.t <= childT1 || i == crossingsCount {
+			return
+		}
+		child ^= 1 << uint(crossingAxes[i])
+		childT0 = childT1
+	}
+}
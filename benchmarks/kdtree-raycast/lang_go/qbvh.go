@@ -0,0 +1,227 @@
+package main
+
+import (
+	"math"
+)
+
+const qbvhWidth = 4
+
+// qbvhNode stores bounds of up to four children in SoA layout, so the ray
+// is tested against all child boxes in one loop. bounds[0] are min points,
+// bounds[1] are max points, bounds[s][axis][lane]. Unused lanes have
+// inverted bounds which are never hit.
+type qbvhNode struct {
+	bounds [2][3][qbvhWidth]float32
+
+	// child node index if trianglesCount is zero, otherwise the first
+	// triangle of the leaf in QBVH.triangleIndices
+	children       [qbvhWidth]int32
+	trianglesCount [qbvhWidth]int32
+}
+
+// QBVH is 4-ary BVH created by collapsing the binary BVH: each node
+// replaces its binary children with their children, the child with the
+// largest surface area is opened first, until there are four children or
+// no interior children left.
+type QBVH struct {
+	nodes           []qbvhNode
+	triangleIndices []int32
+	mesh            *TriangleMesh
+}
+
+// BuildQBVH builds binary BVH with the given parameters and collapses it
+// to QBVH.
+func BuildQBVH(mesh *TriangleMesh, buildParams BVHBuildParams) *QBVH {
+	return NewQBVH(BuildBVH(mesh, buildParams))
+}
+
+// NewQBVH collapses the binary BVH to QBVH. Leaves and triangle indices
+// are shared with the binary BVH.
+func NewQBVH(bvh *BVH) *QBVH {
+	qbvh := &QBVH{
+		nodes:           make([]qbvhNode, 0, len(bvh.nodes)/3+1),
+		triangleIndices: bvh.triangleIndices,
+		mesh:            bvh.mesh,
+	}
+	if bvh.nodes[0].isLeaf() {
+		// the root node should be interior node, it gets single child
+		qbvh.nodes = append(qbvh.nodes, newQBVHNode())
+		qbvh.setChild(0, 0, bvh, 0)
+	} else if len(bvh.triangleIndices) > 0 {
+		qbvh.collapseNode(bvh, 0)
+	} else {
+		qbvh.nodes = append(qbvh.nodes, newQBVHNode())
+	}
+	return qbvh
+}
+
+func newQBVHNode() qbvhNode {
+	var n qbvhNode
+	for axis := 0; axis < 3; axis++ {
+		for lane := 0; lane < qbvhWidth; lane++ {
+			n.bounds[0][axis][lane] = float32(math.Inf(+1))
+			n.bounds[1][axis][lane] = float32(math.Inf(-1))
+		}
+	}
+	return n
+}
+
+// collapseNode creates QBVH node for the binary interior node and returns
+// its index.
+func (qbvh *QBVH) collapseNode(bvh *BVH, binaryNode int32) int32 {
+	children := make([]int32, 0, qbvhWidth)
+	children = append(children, binaryNode+1, bvh.nodes[binaryNode].index)
+	for len(children) < qbvhWidth {
+		largest := -1
+		largestArea := float32(-1)
+		for i, child := range children {
+			n := &bvh.nodes[child]
+			if !n.isLeaf() && n.bounds.GetSurfaceArea() > largestArea {
+				largest = i
+				largestArea = n.bounds.GetSurfaceArea()
+			}
+		}
+		if largest == -1 {
+			break
+		}
+		child := children[largest]
+		children[largest] = child + 1
+		children = append(children, bvh.nodes[child].index)
+	}
+
+	nodeIndex := int32(len(qbvh.nodes))
+	qbvh.nodes = append(qbvh.nodes, newQBVHNode())
+	for lane, child := range children {
+		qbvh.setChild(nodeIndex, lane, bvh, child)
+	}
+	return nodeIndex
+}
+
+func (qbvh *QBVH) setChild(nodeIndex int32, lane int, bvh *BVH, binaryNode int32) {
+	child := &bvh.nodes[binaryNode]
+	var childIndex, trianglesCount int32
+	if child.isLeaf() {
+		childIndex = child.index
+		trianglesCount = child.trianglesCount
+	} else {
+		childIndex = qbvh.collapseNode(bvh, binaryNode)
+	}
+
+	// the nodes array can be reallocated by collapseNode
+	n := &qbvh.nodes[nodeIndex]
+	for axis := 0; axis < 3; axis++ {
+		n.bounds[0][axis][lane] = child.bounds.minPoint[axis]
+		n.bounds[1][axis][lane] = child.bounds.maxPoint[axis]
+	}
+	n.children[lane] = childIndex
+	n.trianglesCount[lane] = trianglesCount
+}
+
+func (qbvh *QBVH) GetNodesCount() int {
+	return len(qbvh.nodes)
+}
+
+type qbvhStackEntry struct {
+	child          int32
+	trianglesCount int32
+	t              float64 // distance to the child bounds
+}
+
+func (qbvh *QBVH) Intersect(ray *Ray) (bool, KdTreeIntersection) {
+	if len(qbvh.triangleIndices) == 0 || !ray.HasValidDirection() {
+		return false, KdTreeIntersection{t: math.Inf(+1)}
+	}
+
+	// the near plane of the slab is selected by the direction sign, so
+	// the inverted bounds of unused lanes are never hit
+	origin := ray.GetOrigin()
+	invDirection := ray.GetInvDirection()
+	var nearSide [3]int
+	for axis := 0; axis < 3; axis++ {
+		if invDirection[axis] < 0 {
+			nearSide[axis] = 1
+		}
+	}
+
+	stack := make([]qbvhStackEntry, 0, 64)
+	stack = append(stack, qbvhStackEntry{child: 0})
+
+	closestIntersection := TriangleIntersection{t: math.Inf(+1)}
+	vertices := qbvh.mesh.vertices
+	triangles := qbvh.mesh.triangles
+
+	for len(stack) > 0 {
+		entry := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if entry.t > closestIntersection.t {
+			continue
+		}
+
+		if entry.trianglesCount > 0 {
+			for i := entry.child; i < entry.child+entry.trianglesCount; i++ {
+				triangleIndex := qbvh.triangleIndices[i]
+				indices := triangles[triangleIndex]
+				triangle := Triangle{[3]Vector64{
+					NewVector64FromVector32(vertices[indices[0]]),
+					NewVector64FromVector32(vertices[indices[1]]),
+					NewVector64FromVector32(vertices[indices[2]]),
+				}}
+				hitFound, intersection := IntersectTriangle(ray, &triangle)
+				if hitFound && intersection.t < closestIntersection.t {
+					closestIntersection = intersection
+					closestIntersection.triangleIndex = triangleIndex
+				}
+			}
+			continue
+		}
+
+		n := &qbvh.nodes[entry.child]
+		var t0 [qbvhWidth]float64
+		var t1 [qbvhWidth]float64
+		for lane := 0; lane < qbvhWidth; lane++ {
+			t1[lane] = closestIntersection.t
+		}
+		for axis := 0; axis < 3; axis++ {
+			near := &n.bounds[nearSide[axis]][axis]
+			far := &n.bounds[1-nearSide[axis]][axis]
+			for lane := 0; lane < qbvhWidth; lane++ {
+				tNear := (float64(near[lane]) - origin[axis]) * invDirection[axis]
+				tFar := (float64(far[lane]) - origin[axis]) * invDirection[axis]
+				if tNear > t0[lane] {
+					t0[lane] = tNear
+				}
+				if tFar < t1[lane] {
+					t1[lane] = tFar
+				}
+			}
+		}
+
+		// push hit children so the nearest one is on the top of the stack
+		base := len(stack)
+		for lane := 0; lane < qbvhWidth; lane++ {
+			if t0[lane] > t1[lane] {
+				continue
+			}
+			hit := qbvhStackEntry{n.children[lane], n.trianglesCount[lane], t0[lane]}
+			stack = append(stack, hit)
+			i := len(stack) - 1
+			for i > base && stack[i-1].t < hit.t {
+				stack[i] = stack[i-1]
+				i--
+			}
+			stack[i] = hit
+		}
+	}
+
+	if closestIntersection.t == math.Inf(+1) {
+		return false, KdTreeIntersection{t: math.Inf(+1)}
+	}
+	return true, KdTreeIntersection{
+		t:             closestIntersection.t,
+		epsilon:       closestIntersection.epsilon,
+		b1:            closestIntersection.b1,
+		b2:            closestIntersection.b2,
+		triangleIndex: closestIntersection.triangleIndex,
+		materialID:    qbvh.mesh.GetMaterialID(closestIntersection.triangleIndex),
+	}
+}
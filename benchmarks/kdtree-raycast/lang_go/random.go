@@ -57,3 +57,17 @@ func RandFloat64() float64 {
 func RandForRange(a, b float64) float64 {
 	return a + (b-a)*RandFloat64()
 }
+
+type RandState struct {
+	mt  [n]uint32
+	mti int
+}
+
+func SaveRandState() RandState {
+	return RandState{mt, mti}
+}
+
+func RestoreRandState(state RandState) {
+	mt = state.mt
+	mti = state.mti
+}
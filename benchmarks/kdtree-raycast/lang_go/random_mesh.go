@@ -0,0 +1,137 @@
+package main
+
+// GenOpts configures GenerateRandomMesh. Fractions define the probability
+// for each generated triangle to be of the corresponding pathological kind.
+type GenOpts struct {
+	Extent float32 // triangles are placed inside [0, Extent]^3
+
+	TriangleSize float32 // size of regular triangles relative to Extent
+
+	// If ClustersCount is positive then triangles are placed around
+	// ClustersCount random centers instead of uniformly. The distance from
+	// the center is up to ClusterRadius relative to Extent and the density
+	// grows towards the center. Huge triangles are not clustered.
+	ClustersCount int
+	ClusterRadius float32
+
+	CoincidentFraction float32 // exact copy of the previous triangle
+	SliverFraction     float32 // long and very thin triangle
+	DegenerateFraction float32 // zero-area triangle (collinear or repeated points)
+	TinyFraction       float32 // triangle with extent ~1e-6 of the regular size
+	HugeFraction       float32 // triangle that spans the whole Extent
+}
+
+func NewGenOpts() GenOpts {
+	return GenOpts{
+		Extent:        100,
+		TriangleSize:  0.01,
+		ClusterRadius: 0.05,
+	}
+}
+
+// splitMix64 is a small deterministic random generator, so generated meshes
+// depend only on the seed.
+type splitMix64 struct {
+	state uint64
+}
+
+func (r *splitMix64) next() uint64 {
+	r.state += 0x9e3779b97f4a7c15
+	z := r.state
+	z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+	z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+	return z ^ (z >> 31)
+}
+
+// float32 returns a value in [0, 1).
+func (r *splitMix64) float32() float32 {
+	return float32(r.next()>>40) / float32(1<<24)
+}
+
+func (r *splitMix64) vector(scale float32) Vector32 {
+	return Vector32{r.float32() * scale, r.float32() * scale, r.float32() * scale}
+}
+
+// GenerateRandomMesh generates reproducible mesh for builder stress tests.
+// Each triangle has its own vertices except coincident triangles that
+// reference vertices of the previous triangle.
+func GenerateRandomMesh(trianglesCount int, seed uint64, opts GenOpts) *TriangleMesh {
+	r := &splitMix64{seed}
+	mesh := &TriangleMesh{
+		normals:   make([]Vector32, trianglesCount),
+		triangles: make([][3]int32, trianglesCount),
+	}
+
+	addVertex := func(v Vector32) int32 {
+		mesh.vertices = append(mesh.vertices, v)
+		return int32(len(mesh.vertices) - 1)
+	}
+
+	size := opts.Extent * opts.TriangleSize
+
+	centers := make([]Vector32, opts.ClustersCount)
+	for i := range centers {
+		centers[i] = r.vector(opts.Extent)
+	}
+	clusterRadius := opts.Extent * opts.ClusterRadius
+
+	for i := 0; i < trianglesCount; i++ {
+		kind := r.float32()
+		var base Vector32
+		if len(centers) > 0 {
+			center := centers[r.next()%uint64(len(centers))]
+			offset := VSub32(r.vector(2), Vector32{1, 1, 1})
+			distance := r.float32()
+			base = VAdd32(center, VMul32(offset, clusterRadius*distance*distance))
+		} else {
+			base = r.vector(opts.Extent)
+		}
+		var v [3]Vector32
+
+		switch {
+		case i > 0 && kind < opts.CoincidentFraction:
+			mesh.triangles[i] = mesh.triangles[i-1]
+			continue
+
+		case kind < opts.CoincidentFraction+opts.SliverFraction:
+			direction := r.vector(size * 100)
+			v[0] = base
+			v[1] = VAdd32(base, direction)
+			v[2] = VAdd32(base, VAdd32(VMul32(direction, 0.5),
+				Vector32{size * 1e-4, 0, 0}))
+
+		case kind < opts.CoincidentFraction+opts.SliverFraction+
+			opts.DegenerateFraction:
+			direction := r.vector(size)
+			v[0] = base
+			v[1] = VAdd32(base, direction)
+			if r.float32() < 0.5 {
+				v[2] = VAdd32(base, VMul32(direction, 0.25))
+			} else {
+				v[2] = base
+			}
+
+		case kind < opts.CoincidentFraction+opts.SliverFraction+
+			opts.DegenerateFraction+opts.TinyFraction:
+			v[0] = base
+			v[1] = VAdd32(base, r.vector(size*1e-6))
+			v[2] = VAdd32(base, r.vector(size*1e-6))
+
+		case kind < opts.CoincidentFraction+opts.SliverFraction+
+			opts.DegenerateFraction+opts.TinyFraction+opts.HugeFraction:
+			v[0] = r.vector(opts.Extent)
+			v[1] = r.vector(opts.Extent)
+			v[2] = r.vector(opts.Extent)
+
+		default:
+			v[0] = base
+			v[1] = VAdd32(base, r.vector(size))
+			v[2] = VAdd32(base, r.vector(size))
+		}
+
+		for k := 0; k < 3; k++ {
+			mesh.triangles[i][k] = addVertex(v[k])
+		}
+	}
+	return mesh
+}
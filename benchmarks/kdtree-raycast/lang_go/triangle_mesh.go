@@ -1,15 +1,99 @@
 package main
 
+import (
+	"common"
+	"fmt"
+	"math"
+	"sync"
+)
+
 type TriangleMesh struct {
 	vertices  []Vector32
 	normals   []Vector32
 	triangles [][3]int32
+
+	// optional smooth vertex normals, see ComputeNormals
+	vertexNormals []Vector32
+
+	// optional per-triangle material or group ids, nil if the mesh
+	// does not have material assignments
+	materialIDs []int32
+
+	// mesh bounds are computed on the first GetBounds call, modifying
+	// methods call invalidateBounds
+	boundsOnce sync.Once
+	bounds     BBox32
 }
 
 func (mesh *TriangleMesh) GetTrianglesCount() int32 {
 	return int32(len(mesh.triangles))
 }
 
+func (mesh *TriangleMesh) GetVerticesCount() int32 {
+	return int32(len(mesh.vertices))
+}
+
+// GetVertex returns vertex position. Out of range index is reported as
+// runtime error.
+func (mesh *TriangleMesh) GetVertex(vertexIndex int32) Vector32 {
+	if vertexIndex < 0 || vertexIndex >= mesh.GetVerticesCount() {
+		common.RuntimeError(fmt.Sprintf(
+			"vertex index %d is out of range, vertices count: %d",
+			vertexIndex, mesh.GetVerticesCount()))
+	}
+	return mesh.vertices[vertexIndex]
+}
+
+// GetTriangleIndices returns vertex indices of the triangle. Out of range
+// index is reported as runtime error.
+func (mesh *TriangleMesh) GetTriangleIndices(triangleIndex int32) (i0, i1, i2 int32) {
+	if triangleIndex < 0 || triangleIndex >= mesh.GetTrianglesCount() {
+		common.RuntimeError(fmt.Sprintf(
+			"triangle index %d is out of range, triangles count: %d",
+			triangleIndex, mesh.GetTrianglesCount()))
+	}
+	indices := mesh.triangles[triangleIndex]
+	return indices[0], indices[1], indices[2]
+}
+
+func (mesh *TriangleMesh) GetTriangle(triangleIndex int32) (v0, v1, v2 Vector32) {
+	indices := mesh.triangles[triangleIndex]
+	return mesh.vertices[indices[0]], mesh.vertices[indices[1]],
+		mesh.vertices[indices[2]]
+}
+
+// GetTriangleNormal returns geometric normal of the triangle, the normal
+// of degenerate triangle is a zero vector.
+func (mesh *TriangleMesh) GetTriangleNormal(triangleIndex int32) Vector32 {
+	v0, v1, v2 := mesh.GetTriangle(triangleIndex)
+	normal := CrossProduct32(VSub32(v1, v0), VSub32(v2, v0))
+	length := VLength32(normal)
+	if length == 0.0 {
+		return Vector32{}
+	}
+	return VMul32(normal, 1.0/length)
+}
+
+// GetMaterialID returns material id of the triangle or -1 if the mesh
+// does not have material assignments.
+func (mesh *TriangleMesh) GetMaterialID(triangleIndex int32) int32 {
+	if mesh.materialIDs == nil {
+		return -1
+	}
+	return mesh.materialIDs[triangleIndex]
+}
+
+// SetMaterialIDs assigns material ids to mesh triangles. The slice should
+// contain one id per triangle, nil removes material assignments.
+func (mesh *TriangleMesh) SetMaterialIDs(materialIDs []int32) {
+	if materialIDs != nil && len(materialIDs) != len(mesh.triangles) {
+		common.RuntimeError(fmt.Sprintf(
+			"invalid number of material ids: %d, triangles count: %d",
+			len(materialIDs), len(mesh.triangles)))
+	}
+	mesh.materialIDs = materialIDs
+}
+
 func (mesh *TriangleMesh) GetTriangleBounds(triangleIndex int32) BBox32 {
 	indices := mesh.triangles[triangleIndex]
 	bbox := NewBBox32FromPoint(mesh.vertices[indices[0]])
@@ -18,10 +102,194 @@ func (mesh *TriangleMesh) GetTriangleBounds(triangleIndex int32) BBox32 {
 	return bbox
 }
 
+// GetBounds returns union of triangle bounds. The result is cached, it is
+// safe to call GetBounds concurrently as long as the mesh is not modified.
 func (mesh *TriangleMesh) GetBounds() BBox32 {
-	meshBounds := NewBBox32()
-	for i := 0; i < len(mesh.triangles); i++ {
-		meshBounds = BBox32Union(meshBounds, mesh.GetTriangleBounds(int32(i)))
+	mesh.boundsOnce.Do(func() {
+		meshBounds := NewBBox32()
+		for i := 0; i < len(mesh.triangles); i++ {
+			meshBounds = BBox32Union(meshBounds, mesh.GetTriangleBounds(int32(i)))
+		}
+		mesh.bounds = meshBounds
+	})
+	return mesh.bounds
+}
+
+func (mesh *TriangleMesh) invalidateBounds() {
+	mesh.boundsOnce = sync.Once{}
+}
+
+// SetVertices replaces vertex positions, it is used to animate the mesh.
+// The number of vertices should not change, otherwise runtime error is
+// reported. Triangle normals are recomputed, smooth vertex normals are
+// kept as is.
+func (mesh *TriangleMesh) SetVertices(vertices []Vector32) {
+	if len(vertices) != len(mesh.vertices) {
+		common.RuntimeError(fmt.Sprintf(
+			"invalid number of vertices: %d, mesh vertices count: %d",
+			len(vertices), len(mesh.vertices)))
+	}
+	copy(mesh.vertices, vertices)
+	if len(mesh.normals) == len(mesh.triangles) {
+		for i := range mesh.triangles {
+			mesh.normals[i] = mesh.GetTriangleNormal(int32(i))
+		}
+	}
+	mesh.invalidateBounds()
+}
+
+func isFiniteVector32(v Vector32) bool {
+	for _, c := range v {
+		if math.IsNaN(float64(c)) || math.IsInf(float64(c), 0) {
+			return false
+		}
+	}
+	return true
+}
+
+func (mesh *TriangleMesh) isValidTriangle(triangleIndex int) bool {
+	for _, vertexIndex := range mesh.triangles[triangleIndex] {
+		if !isFiniteVector32(mesh.vertices[vertexIndex]) {
+			return false
+		}
+	}
+	return true
+}
+
+// Validate checks that all triangle vertices have finite coordinates.
+// The returned error names the first invalid triangle.
+func (mesh *TriangleMesh) Validate() error {
+	for i := range mesh.triangles {
+		if !mesh.isValidTriangle(i) {
+			return fmt.Errorf("triangle %d has non-finite vertex coordinates", i)
+		}
+	}
+	return nil
+}
+
+// DropInvalidTriangles removes triangles with non-finite vertex coordinates
+// and returns the number of removed triangles. Unreferenced vertices are
+// not removed.
+func (mesh *TriangleMesh) DropInvalidTriangles() int {
+	validCount := 0
+	for i := range mesh.triangles {
+		if mesh.isValidTriangle(i) {
+			mesh.triangles[validCount] = mesh.triangles[i]
+			if len(mesh.normals) == len(mesh.triangles) {
+				mesh.normals[validCount] = mesh.normals[i]
+			}
+			if mesh.materialIDs != nil {
+				mesh.materialIDs[validCount] = mesh.materialIDs[i]
+			}
+			validCount++
+		}
+	}
+
+	droppedCount := len(mesh.triangles) - validCount
+	if len(mesh.normals) == len(mesh.triangles) {
+		mesh.normals = mesh.normals[:validCount]
+	}
+	if mesh.materialIDs != nil {
+		mesh.materialIDs = mesh.materialIDs[:validCount]
+	}
+	mesh.triangles = mesh.triangles[:validCount]
+	mesh.invalidateBounds()
+	return droppedCount
+}
+
+// sortedTriangleKey returns sorted vertex indices of the triangle. The key
+// is the same for triangles that reference the same vertices regardless of
+// the vertex order.
+func sortedTriangleKey(indices [3]int32) [3]int32 {
+	key := indices
+	if key[0] > key[1] {
+		key[0], key[1] = key[1], key[0]
+	}
+	if key[1] > key[2] {
+		key[1], key[2] = key[2], key[1]
+	}
+	if key[0] > key[1] {
+		key[0], key[1] = key[1], key[0]
+	}
+	return key
+}
+
+// RemoveDuplicateTriangles removes triangles that reference the same
+// vertices as a previous triangle, regardless of the vertex order, and
+// returns the number of removed triangles. Triangle indices change, so it
+// should be called before building acceleration structures. The mesh
+// should be welded to detect duplicates with coincident but not shared
+// vertices.
+func (mesh *TriangleMesh) RemoveDuplicateTriangles() int {
+	uniqueTriangles := make(map[[3]int32]bool, len(mesh.triangles))
+	uniqueCount := 0
+	for i, indices := range mesh.triangles {
+		key := sortedTriangleKey(indices)
+		if uniqueTriangles[key] {
+			continue
+		}
+		uniqueTriangles[key] = true
+
+		mesh.triangles[uniqueCount] = indices
+		if len(mesh.normals) == len(mesh.triangles) {
+			mesh.normals[uniqueCount] = mesh.normals[i]
+		}
+		if mesh.materialIDs != nil {
+			mesh.materialIDs[uniqueCount] = mesh.materialIDs[i]
+		}
+		uniqueCount++
+	}
+
+	removedCount := len(mesh.triangles) - uniqueCount
+	if len(mesh.normals) == len(mesh.triangles) {
+		mesh.normals = mesh.normals[:uniqueCount]
+	}
+	if mesh.materialIDs != nil {
+		mesh.materialIDs = mesh.materialIDs[:uniqueCount]
+	}
+	mesh.triangles = mesh.triangles[:uniqueCount]
+	return removedCount
+}
+
+// Transform applies the affine transform to mesh vertices. Stored normals
+// are transformed by the inverse transpose matrix. Transforms that mirror
+// the geometry also reverse the triangles winding, so the geometric normals
+// keep pointing to the same side of the surface. Singular transform is
+// reported as runtime error.
+func (mesh *TriangleMesh) Transform(m *Matrix4) {
+	inverse, ok := m.Inverse()
+	if !ok {
+		common.RuntimeError("mesh transform matrix is singular")
+	}
+
+	for i, v := range mesh.vertices {
+		p := m.TransformPoint(NewVector64FromVector32(v))
+		mesh.vertices[i] = Vector32{float32(p[0]), float32(p[1]), float32(p[2])}
+	}
+
+	transformNormals := func(normals []Vector32) {
+		for i, n := range normals {
+			// multiplication by the transposed inverse matrix
+			n64 := NewVector64FromVector32(n)
+			t := Vector64{
+				inverse[0]*n64[0] + inverse[4]*n64[1] + inverse[8]*n64[2],
+				inverse[1]*n64[0] + inverse[5]*n64[1] + inverse[9]*n64[2],
+				inverse[2]*n64[0] + inverse[6]*n64[1] + inverse[10]*n64[2],
+			}
+			if length := VLength64(t); length > 0.0 {
+				t = VMul64(t, 1.0/length)
+			}
+			normals[i] = Vector32{float32(t[0]), float32(t[1]), float32(t[2])}
+		}
+	}
+	transformNormals(mesh.normals)
+	transformNormals(mesh.vertexNormals)
+
+	if m.Determinant() < 0.0 {
+		for i := range mesh.triangles {
+			indices := &mesh.triangles[i]
+			indices[1], indices[2] = indices[2], indices[1]
+		}
 	}
-	return meshBounds
+	mesh.invalidateBounds()
 }
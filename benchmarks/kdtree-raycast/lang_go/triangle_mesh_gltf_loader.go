@@ -0,0 +1,461 @@
+package main
+
+import (
+	"common"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Subset of glTF 2.0 document that is needed to extract triangle geometry.
+type gltfDocument struct {
+	Scene  *int `json:"scene"`
+	Scenes []struct {
+		Nodes []int `json:"nodes"`
+	} `json:"scenes"`
+	Nodes []struct {
+		Children    []int     `json:"children"`
+		Mesh        *int      `json:"mesh"`
+		Matrix      []float64 `json:"matrix"`
+		Translation []float64 `json:"translation"`
+		Rotation    []float64 `json:"rotation"`
+		Scale       []float64 `json:"scale"`
+	} `json:"nodes"`
+	Meshes []struct {
+		Primitives []struct {
+			Attributes map[string]int `json:"attributes"`
+			Indices    *int           `json:"indices"`
+			Material   *int           `json:"material"`
+			Mode       *int           `json:"mode"`
+		} `json:"primitives"`
+	} `json:"meshes"`
+	Accessors []struct {
+		BufferView    *int            `json:"bufferView"`
+		ByteOffset    int             `json:"byteOffset"`
+		ComponentType int             `json:"componentType"`
+		Count         int             `json:"count"`
+		Type          string          `json:"type"`
+		Sparse        json.RawMessage `json:"sparse"`
+	} `json:"accessors"`
+	BufferViews []struct {
+		Buffer     int `json:"buffer"`
+		ByteOffset int `json:"byteOffset"`
+		ByteLength int `json:"byteLength"`
+		ByteStride int `json:"byteStride"`
+	} `json:"bufferViews"`
+	Buffers []struct {
+		URI        string `json:"uri"`
+		ByteLength int    `json:"byteLength"`
+	} `json:"buffers"`
+}
+
+const (
+	gltfComponentUnsignedByte  = 5121
+	gltfComponentUnsignedShort = 5123
+	gltfComponentUnsignedInt   = 5125
+	gltfComponentFloat         = 5126
+
+	gltfModeTriangles     = 4
+	gltfModeTriangleStrip = 5
+	gltfModeTriangleFan   = 6
+)
+
+// LoadGltf loads triangle primitives from glTF 2.0 file (.gltf with
+// embedded or external buffers or binary .glb). Node transforms of the
+// default scene are applied to vertex positions. If the document has no
+// scenes then all meshes are loaded without transforms. Primitive material
+// index is stored as triangle material id. Points and lines primitives are
+// skipped.
+func LoadGltf(fileName string) *TriangleMesh {
+	mesh, err := loadGltf(fileName)
+	common.Check(err)
+	return mesh
+}
+
+// loadGltf is the same as LoadGltf but returns an error instead of
+// reporting it.
+func loadGltf(fileName string) (*TriangleMesh, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	reader, err := newFileReader(file)
+	if err != nil {
+		return nil, err
+	}
+	content, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	invalidFile := func(message string) error {
+		return errors.New("invalid gltf file: " + fileName + ": " + message)
+	}
+
+	// binary container consists of header and json and binary chunks
+	jsonContent := content
+	var binaryChunk []byte
+	if len(content) >= 4 && string(content[0:4]) == "glTF" {
+		if len(content) < 12 || binary.LittleEndian.Uint32(content[4:8]) != 2 {
+			return nil, invalidFile("unsupported glb version")
+		}
+		jsonContent = nil
+		for offset := 12; offset+8 <= len(content); {
+			chunkLength := int(binary.LittleEndian.Uint32(content[offset:]))
+			chunkType := binary.LittleEndian.Uint32(content[offset+4:])
+			if chunkLength < 0 || offset+8+chunkLength > len(content) {
+				return nil, invalidFile("invalid glb chunk length")
+			}
+			chunk := content[offset+8 : offset+8+chunkLength]
+			switch chunkType {
+			case 0x4e4f534a: // JSON
+				jsonContent = chunk
+			case 0x004e4942: // BIN
+				binaryChunk = chunk
+			}
+			offset += 8 + chunkLength
+		}
+		if jsonContent == nil {
+			return nil, invalidFile("glb file without json chunk")
+		}
+	}
+
+	var document gltfDocument
+	if err := json.Unmarshal(jsonContent, &document); err != nil {
+		return nil, invalidFile(err.Error())
+	}
+
+	// load buffers
+	buffers := make([][]byte, len(document.Buffers))
+	for i, buffer := range document.Buffers {
+		switch {
+		case buffer.URI == "":
+			if i != 0 || binaryChunk == nil {
+				return nil, invalidFile(fmt.Sprintf("buffer %d has no data", i))
+			}
+			buffers[i] = binaryChunk
+		case strings.HasPrefix(buffer.URI, "data:"):
+			comma := strings.IndexByte(buffer.URI, ',')
+			if comma == -1 || !strings.HasSuffix(buffer.URI[:comma], ";base64") {
+				return nil, invalidFile(fmt.Sprintf("buffer %d: unsupported data uri", i))
+			}
+			data, err := base64.StdEncoding.DecodeString(buffer.URI[comma+1:])
+			if err != nil {
+				return nil, invalidFile(fmt.Sprintf("buffer %d: %v", i, err))
+			}
+			buffers[i] = data
+		default:
+			data, err := os.ReadFile(filepath.Join(filepath.Dir(fileName), buffer.URI))
+			if err != nil {
+				return nil, err
+			}
+			buffers[i] = data
+		}
+		if len(buffers[i]) < buffer.ByteLength {
+			return nil, invalidFile(fmt.Sprintf("buffer %d is too short", i))
+		}
+	}
+
+	loader := gltfLoader{document: &document, buffers: buffers, mesh: new(TriangleMesh)}
+
+	if len(document.Scenes) == 0 {
+		for meshIndex := range document.Meshes {
+			if err := loader.addMesh(meshIndex, NewIdentityMatrix4()); err != nil {
+				return nil, invalidFile(err.Error())
+			}
+		}
+	} else {
+		scene := 0
+		if document.Scene != nil {
+			scene = *document.Scene
+		}
+		if scene < 0 || scene >= len(document.Scenes) {
+			return nil, invalidFile(fmt.Sprintf("invalid scene index %d", scene))
+		}
+		for _, node := range document.Scenes[scene].Nodes {
+			if err := loader.addNode(node, NewIdentityMatrix4(), 0); err != nil {
+				return nil, invalidFile(err.Error())
+			}
+		}
+	}
+
+	mesh := loader.mesh
+	if !loader.hasMaterials {
+		mesh.materialIDs = nil
+	}
+	mesh.normals = make([]Vector32, len(mesh.triangles))
+	for i := range mesh.triangles {
+		mesh.normals[i] = mesh.GetTriangleNormal(int32(i))
+	}
+
+	if len(mesh.triangles) > math.MaxInt32 || len(mesh.vertices) > math.MaxInt32 {
+		return nil, invalidFile("mesh size limit exceeded")
+	}
+	if err := mesh.Validate(); err != nil {
+		return nil, fmt.Errorf("%s: %v", fileName, err)
+	}
+	return mesh, nil
+}
+
+type gltfLoader struct {
+	document     *gltfDocument
+	buffers      [][]byte
+	mesh         *TriangleMesh
+	hasMaterials bool
+}
+
+// Node hierarchy is a tree by specification, the depth limit protects
+// against cycles in invalid files.
+const gltfMaxNodeDepth = 256
+
+func (loader *gltfLoader) addNode(nodeIndex int, parentTransform Matrix4,
+	depth int) error {
+	if nodeIndex < 0 || nodeIndex >= len(loader.document.Nodes) {
+		return fmt.Errorf("invalid node index %d", nodeIndex)
+	}
+	if depth > gltfMaxNodeDepth {
+		return fmt.Errorf("node hierarchy is too deep")
+	}
+	node := &loader.document.Nodes[nodeIndex]
+
+	transform := NewIdentityMatrix4()
+	if len(node.Matrix) == 16 {
+		// gltf matrix is stored in column-major order
+		for row := 0; row < 4; row++ {
+			for col := 0; col < 4; col++ {
+				transform[row*4+col] = node.Matrix[col*4+row]
+			}
+		}
+	} else {
+		if len(node.Translation) == 3 {
+			transform = Matrix4Mul(transform, NewTranslationMatrix4(
+				Vector64{node.Translation[0], node.Translation[1], node.Translation[2]}))
+		}
+		if len(node.Rotation) == 4 {
+			transform = Matrix4Mul(transform, newRotationMatrix4FromQuaternion(
+				node.Rotation[0], node.Rotation[1], node.Rotation[2], node.Rotation[3]))
+		}
+		if len(node.Scale) == 3 {
+			transform = Matrix4Mul(transform, NewScaleMatrix4(
+				Vector64{node.Scale[0], node.Scale[1], node.Scale[2]}))
+		}
+	}
+	transform = Matrix4Mul(parentTransform, transform)
+
+	if node.Mesh != nil {
+		if err := loader.addMesh(*node.Mesh, transform); err != nil {
+			return err
+		}
+	}
+	for _, child := range node.Children {
+		if err := loader.addNode(child, transform, depth+1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// newRotationMatrix4FromQuaternion converts unit quaternion (x, y, z, w)
+// to rotation matrix.
+func newRotationMatrix4FromQuaternion(x, y, z, w float64) Matrix4 {
+	return Matrix4{
+		1 - 2*(y*y+z*z), 2 * (x*y - z*w), 2 * (x*z + y*w), 0,
+		2 * (x*y + z*w), 1 - 2*(x*x+z*z), 2 * (y*z - x*w), 0,
+		2 * (x*z - y*w), 2 * (y*z + x*w), 1 - 2*(x*x+y*y), 0,
+		0, 0, 0, 1,
+	}
+}
+
+func (loader *gltfLoader) addMesh(meshIndex int, transform Matrix4) error {
+	if meshIndex < 0 || meshIndex >= len(loader.document.Meshes) {
+		return fmt.Errorf("invalid mesh index %d", meshIndex)
+	}
+	mesh := loader.mesh
+
+	for i, primitive := range loader.document.Meshes[meshIndex].Primitives {
+		mode := gltfModeTriangles
+		if primitive.Mode != nil {
+			mode = *primitive.Mode
+		}
+		if mode != gltfModeTriangles && mode != gltfModeTriangleStrip &&
+			mode != gltfModeTriangleFan {
+			continue
+		}
+
+		positionAccessor, found := primitive.Attributes["POSITION"]
+		if !found {
+			return fmt.Errorf("mesh %d primitive %d has no positions", meshIndex, i)
+		}
+		positions, err := loader.readAccessor(positionAccessor, "VEC3")
+		if err != nil {
+			return err
+		}
+
+		vertexOffset := int32(len(mesh.vertices))
+		for k := 0; k+2 < len(positions); k += 3 {
+			p := transform.TransformPoint(Vector64{positions[k], positions[k+1], positions[k+2]})
+			mesh.vertices = append(mesh.vertices,
+				Vector32{float32(p[0]), float32(p[1]), float32(p[2])})
+		}
+		verticesCount := len(positions) / 3
+
+		var indices []float64
+		if primitive.Indices != nil {
+			indices, err = loader.readAccessor(*primitive.Indices, "SCALAR")
+			if err != nil {
+				return err
+			}
+		} else {
+			indices = make([]float64, verticesCount)
+			for k := range indices {
+				indices[k] = float64(k)
+			}
+		}
+		for _, index := range indices {
+			if index < 0 || int(index) >= verticesCount {
+				return fmt.Errorf("mesh %d primitive %d: vertex index %v is out of range",
+					meshIndex, i, index)
+			}
+		}
+
+		materialID := int32(-1)
+		if primitive.Material != nil {
+			materialID = int32(*primitive.Material)
+			loader.hasMaterials = true
+		}
+
+		addTriangle := func(i0, i1, i2 float64) {
+			mesh.triangles = append(mesh.triangles, [3]int32{
+				vertexOffset + int32(i0),
+				vertexOffset + int32(i1),
+				vertexOffset + int32(i2),
+			})
+			mesh.materialIDs = append(mesh.materialIDs, materialID)
+		}
+
+		switch mode {
+		case gltfModeTriangles:
+			for k := 0; k+2 < len(indices); k += 3 {
+				addTriangle(indices[k], indices[k+1], indices[k+2])
+			}
+		case gltfModeTriangleStrip:
+			for k := 0; k+2 < len(indices); k++ {
+				// keep consistent winding for odd triangles
+				if k%2 == 0 {
+					addTriangle(indices[k], indices[k+1], indices[k+2])
+				} else {
+					addTriangle(indices[k+1], indices[k], indices[k+2])
+				}
+			}
+		case gltfModeTriangleFan:
+			for k := 1; k+1 < len(indices); k++ {
+				addTriangle(indices[0], indices[k], indices[k+1])
+			}
+		}
+	}
+	return nil
+}
+
+// readAccessor returns accessor elements as flat array of components.
+func (loader *gltfLoader) readAccessor(accessorIndex int,
+	expectedType string) ([]float64, error) {
+	document := loader.document
+	if accessorIndex < 0 || accessorIndex >= len(document.Accessors) {
+		return nil, fmt.Errorf("invalid accessor index %d", accessorIndex)
+	}
+	accessor := &document.Accessors[accessorIndex]
+
+	if accessor.Type != expectedType {
+		return nil, fmt.Errorf("accessor %d: expected type %s, actual %s",
+			accessorIndex, expectedType, accessor.Type)
+	}
+	if len(accessor.Sparse) != 0 {
+		return nil, fmt.Errorf("accessor %d: sparse accessors are not supported",
+			accessorIndex)
+	}
+
+	componentsCount := 1
+	if expectedType == "VEC3" {
+		componentsCount = 3
+	}
+
+	var componentSize int
+	switch accessor.ComponentType {
+	case gltfComponentUnsignedByte:
+		componentSize = 1
+	case gltfComponentUnsignedShort:
+		componentSize = 2
+	case gltfComponentUnsignedInt, gltfComponentFloat:
+		componentSize = 4
+	default:
+		return nil, fmt.Errorf("accessor %d: unsupported component type %d",
+			accessorIndex, accessor.ComponentType)
+	}
+	if expectedType == "VEC3" && accessor.ComponentType != gltfComponentFloat {
+		return nil, fmt.Errorf("accessor %d: positions should be float", accessorIndex)
+	}
+
+	if accessor.Count < 0 {
+		return nil, fmt.Errorf("accessor %d: invalid count %d",
+			accessorIndex, accessor.Count)
+	}
+	values := make([]float64, accessor.Count*componentsCount)
+	if accessor.BufferView == nil {
+		// accessor without buffer view is initialized with zeros
+		return values, nil
+	}
+
+	viewIndex := *accessor.BufferView
+	if viewIndex < 0 || viewIndex >= len(document.BufferViews) {
+		return nil, fmt.Errorf("accessor %d: invalid buffer view %d",
+			accessorIndex, viewIndex)
+	}
+	view := &document.BufferViews[viewIndex]
+	if view.Buffer < 0 || view.Buffer >= len(loader.buffers) {
+		return nil, fmt.Errorf("buffer view %d: invalid buffer %d", viewIndex, view.Buffer)
+	}
+	buffer := loader.buffers[view.Buffer]
+	if view.ByteOffset < 0 || view.ByteLength < 0 ||
+		view.ByteOffset+view.ByteLength > len(buffer) {
+		return nil, fmt.Errorf("buffer view %d is out of buffer range", viewIndex)
+	}
+	data := buffer[view.ByteOffset : view.ByteOffset+view.ByteLength]
+
+	elementSize := componentSize * componentsCount
+	stride := elementSize
+	if view.ByteStride != 0 {
+		stride = view.ByteStride
+	}
+	if accessor.Count > 0 && (accessor.ByteOffset < 0 ||
+		accessor.ByteOffset+(accessor.Count-1)*stride+elementSize > len(data)) {
+		return nil, fmt.Errorf("accessor %d is out of buffer view range", accessorIndex)
+	}
+
+	for i := 0; i < accessor.Count; i++ {
+		for k := 0; k < componentsCount; k++ {
+			b := data[accessor.ByteOffset+i*stride+k*componentSize:]
+			var value float64
+			switch accessor.ComponentType {
+			case gltfComponentUnsignedByte:
+				value = float64(b[0])
+			case gltfComponentUnsignedShort:
+				value = float64(binary.LittleEndian.Uint16(b))
+			case gltfComponentUnsignedInt:
+				value = float64(binary.LittleEndian.Uint32(b))
+			case gltfComponentFloat:
+				value = float64(math.Float32frombits(binary.LittleEndian.Uint32(b)))
+			}
+			values[i*componentsCount+k] = value
+		}
+	}
+	return values, nil
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bufio"
+	"common"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"unsafe"
+)
+
+// The meshbin file is a cache of the parsed mesh. It stores mesh arrays as
+// they are, so loading does not need vertex merging or text parsing. The
+// data is little-endian regardless of the host byte order:
+//
+//	[8]byte magic "meshbin\x00"
+//	uint32 version
+//	uint32 flags (bit 0: material ids are present)
+//	int32 verticesCount
+//	int32 trianglesCount
+//	[verticesCount][3]float32 vertices
+//	[trianglesCount][3]int32 triangles
+//	[trianglesCount][3]float32 normals
+//	[trianglesCount]int32 materialIDs (if present)
+const (
+	meshBinVersion        = 1
+	meshBinHasMaterialIDs = 1
+	meshBinHeaderSize     = 24
+	meshBinCacheExtension = ".meshbin"
+)
+
+var meshBinMagic = [8]byte{'m', 'e', 's', 'h', 'b', 'i', 'n', 0}
+
+type meshBinHeader struct {
+	Magic          [8]byte
+	Version        uint32
+	Flags          uint32
+	VerticesCount  int32
+	TrianglesCount int32
+}
+
+func (mesh *TriangleMesh) SaveMeshBin(fileName string) {
+	common.Check(mesh.saveMeshBin(fileName))
+}
+
+// saveMeshBin is the same as SaveMeshBin but returns an error instead of
+// reporting it.
+func (mesh *TriangleMesh) saveMeshBin(fileName string) error {
+	file, err := os.Create(fileName)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	writer := bufio.NewWriter(file)
+
+	header := meshBinHeader{
+		Magic:          meshBinMagic,
+		Version:        meshBinVersion,
+		VerticesCount:  mesh.GetVerticesCount(),
+		TrianglesCount: mesh.GetTrianglesCount(),
+	}
+	if mesh.materialIDs != nil {
+		header.Flags |= meshBinHasMaterialIDs
+	}
+
+	normals := mesh.normals
+	if len(normals) != len(mesh.triangles) {
+		normals = make([]Vector32, len(mesh.triangles))
+		for i := range normals {
+			normals[i] = mesh.GetTriangleNormal(int32(i))
+		}
+	}
+
+	data := []interface{}{&header, mesh.vertices, mesh.triangles, normals}
+	if mesh.materialIDs != nil {
+		data = append(data, mesh.materialIDs)
+	}
+	for _, d := range data {
+		if err := binary.Write(writer, binary.LittleEndian, d); err != nil {
+			return err
+		}
+	}
+
+	if err := writer.Flush(); err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+func LoadMeshBin(fileName string) *TriangleMesh {
+	mesh, err := loadMeshBin(fileName)
+	common.Check(err)
+	return mesh
+}
+
+// loadMeshBin is the same as LoadMeshBin but returns an error instead of
+// reporting it.
+func loadMeshBin(fileName string) (*TriangleMesh, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	invalidFile := func(message string) error {
+		return errors.New("invalid meshbin file: " + fileName + ": " + message)
+	}
+
+	reader := bufio.NewReader(file)
+
+	var header meshBinHeader
+	if err := binary.Read(reader, binary.LittleEndian, &header); err != nil {
+		return nil, invalidFile(err.Error())
+	}
+	if header.Magic != meshBinMagic {
+		return nil, invalidFile("missing meshbin signature")
+	}
+	if header.Version != meshBinVersion {
+		return nil, invalidFile(fmt.Sprintf("unsupported version %d", header.Version))
+	}
+	if header.VerticesCount < 0 || header.TrianglesCount < 0 {
+		return nil, invalidFile("negative element count")
+	}
+
+	// check the size before allocating the arrays
+	vertexSize := int64(unsafe.Sizeof(Vector32{}))
+	triangleSize := int64(unsafe.Sizeof([3]int32{})) + vertexSize
+	hasMaterialIDs := header.Flags&meshBinHasMaterialIDs != 0
+	if hasMaterialIDs {
+		triangleSize += 4
+	}
+	expectedSize := meshBinHeaderSize + int64(header.VerticesCount)*vertexSize +
+		int64(header.TrianglesCount)*triangleSize
+	if info.Size() != expectedSize {
+		return nil, invalidFile("invalid file size")
+	}
+
+	mesh := &TriangleMesh{
+		vertices:  make([]Vector32, header.VerticesCount),
+		triangles: make([][3]int32, header.TrianglesCount),
+		normals:   make([]Vector32, header.TrianglesCount),
+	}
+	data := []interface{}{mesh.vertices, mesh.triangles, mesh.normals}
+	if hasMaterialIDs {
+		mesh.materialIDs = make([]int32, header.TrianglesCount)
+		data = append(data, mesh.materialIDs)
+	}
+	for _, d := range data {
+		if err := binary.Read(reader, binary.LittleEndian, d); err != nil {
+			return nil, invalidFile(err.Error())
+		}
+	}
+
+	for i, indices := range mesh.triangles {
+		for _, index := range indices {
+			if index < 0 || index >= header.VerticesCount {
+				return nil, invalidFile(fmt.Sprintf(
+					"triangle %d: vertex index %d is out of range", i, index))
+			}
+		}
+	}
+	if err := mesh.Validate(); err != nil {
+		return nil, errors.New(fileName + ": " + err.Error())
+	}
+	return mesh, nil
+}
+
+// LoadMeshCached loads the mesh from the meshbin cache file which name is
+// the mesh file name plus .meshbin extension. If the cache is missing,
+// older than the mesh file or can't be read, the mesh is loaded with
+// LoadMesh and the cache is written. Failure to write the cache (e.g.
+// read-only data directory) is not an error.
+func LoadMeshCached(fileName string) (*TriangleMesh, error) {
+	cacheFileName := fileName + meshBinCacheExtension
+	if isCacheUpToDate(fileName, cacheFileName) {
+		if mesh, err := loadMeshBin(cacheFileName); err == nil {
+			return mesh, nil
+		}
+	}
+
+	mesh, err := LoadMesh(fileName)
+	if err != nil {
+		return nil, err
+	}
+	if err := mesh.saveMeshBin(cacheFileName); err != nil {
+		os.Remove(cacheFileName)
+	}
+	return mesh, nil
+}
+
+// isCacheUpToDate returns true if the cache file exists and is not older
+// than the source file.
+func isCacheUpToDate(sourcePath, cachePath string) bool {
+	sourceInfo, err := os.Stat(sourcePath)
+	if err != nil {
+		return false
+	}
+	cacheInfo, err := os.Stat(cachePath)
+	if err != nil {
+		return false
+	}
+	return !cacheInfo.ModTime().Before(sourceInfo.ModTime())
+}
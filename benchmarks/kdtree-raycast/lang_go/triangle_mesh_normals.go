@@ -0,0 +1,93 @@
+package main
+
+import (
+	"math"
+)
+
+// NormalWeighting selects how face normals contribute to vertex normals.
+type NormalWeighting int
+
+const (
+	// AreaWeightedNormals weights face normal by the triangle area.
+	AreaWeightedNormals NormalWeighting = iota
+
+	// AngleWeightedNormals weights face normal by the triangle angle at
+	// the vertex. Results do not depend on the tessellation density.
+	AngleWeightedNormals
+)
+
+// ComputeNormals computes smooth vertex normals as the weighted average of
+// normals of the triangles that share the vertex. Vertices that are not
+// referenced by non-degenerate triangles get zero normal. The normals are
+// discarded when mesh vertices are modified.
+func (mesh *TriangleMesh) ComputeNormals(weighting NormalWeighting) {
+	vertexNormals := make([]Vector64, len(mesh.vertices))
+
+	for i := range mesh.triangles {
+		indices := mesh.triangles[i]
+		var p [3]Vector64
+		for k := 0; k < 3; k++ {
+			p[k] = NewVector64FromVector32(mesh.vertices[indices[k]])
+		}
+
+		// the length of the cross product is twice the triangle area
+		faceNormal := CrossProduct64(VSub64(p[1], p[0]), VSub64(p[2], p[0]))
+		if weighting == AreaWeightedNormals {
+			for k := 0; k < 3; k++ {
+				vertexNormals[indices[k]] = VAdd64(vertexNormals[indices[k]], faceNormal)
+			}
+			continue
+		}
+
+		length := VLength64(faceNormal)
+		if length == 0.0 {
+			continue
+		}
+		faceNormal = VMul64(faceNormal, 1.0/length)
+		for k := 0; k < 3; k++ {
+			e1 := VSub64(p[(k+1)%3], p[k])
+			e2 := VSub64(p[(k+2)%3], p[k])
+			angle := math.Atan2(VLength64(CrossProduct64(e1, e2)), DotProduct64(e1, e2))
+			vertexNormals[indices[k]] = VAdd64(vertexNormals[indices[k]],
+				VMul64(faceNormal, angle))
+		}
+	}
+
+	mesh.vertexNormals = make([]Vector32, len(mesh.vertices))
+	for i, normal := range vertexNormals {
+		length := VLength64(normal)
+		if length > 0.0 {
+			normal = VMul64(normal, 1.0/length)
+			mesh.vertexNormals[i] = Vector32{
+				float32(normal[0]), float32(normal[1]), float32(normal[2])}
+		}
+	}
+}
+
+// HasVertexNormals returns true if ComputeNormals was called and the
+// vertices were not modified since then.
+func (mesh *TriangleMesh) HasVertexNormals() bool {
+	return mesh.vertexNormals != nil
+}
+
+// GetShadingNormal returns vertex normal interpolated at the point with
+// barycentric coordinates b1, b2 (as reported by IntersectTriangle). If the
+// mesh does not have vertex normals or the interpolated normal is zero then
+// the geometric normal is returned.
+func (mesh *TriangleMesh) GetShadingNormal(triangleIndex int32, b1, b2 float64) Vector32 {
+	if mesh.vertexNormals == nil {
+		return mesh.GetTriangleNormal(triangleIndex)
+	}
+	indices := mesh.triangles[triangleIndex]
+	n0 := NewVector64FromVector32(mesh.vertexNormals[indices[0]])
+	n1 := NewVector64FromVector32(mesh.vertexNormals[indices[1]])
+	n2 := NewVector64FromVector32(mesh.vertexNormals[indices[2]])
+
+	normal := VAdd64(VAdd64(VMul64(n0, 1.0-b1-b2), VMul64(n1, b1)), VMul64(n2, b2))
+	length := VLength64(normal)
+	if length == 0.0 {
+		return mesh.GetTriangleNormal(triangleIndex)
+	}
+	normal = VMul64(normal, 1.0/length)
+	return Vector32{float32(normal[0]), float32(normal[1]), float32(normal[2])}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bufio"
+	"common"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// LoadObj loads Wavefront obj file. Only geometry is loaded: vertex
+// positions, faces and optional vertex normals. Polygon faces are
+// triangulated as triangle fans, or by ear clipping if the polygon is
+// concave. Triangle normal is the average of its
+// vertex normals or the geometric normal if the face has no normals.
+// Each usemtl statement starts a new material id in the order of
+// appearance. Files without usemtl statements get material ids from the
+// group (g) statements in the same way, so the object parts can be
+// distinguished. The mesh has no material ids if there are neither.
+func LoadObj(fileName string) *TriangleMesh {
+	mesh, err := loadObj(fileName)
+	common.Check(err)
+	return mesh
+}
+
+// loadObj is the same as LoadObj but returns an error instead of
+// reporting it.
+func loadObj(fileName string) (*TriangleMesh, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	mesh := new(TriangleMesh)
+	var vertexNormals []Vector32
+	var materialIDs, groupIDs []int32
+	hasMaterials, hasGroups := false, false
+	materials := make(map[string]int32)
+	groups := make(map[string]int32)
+	materialID := int32(-1) // faces before the first usemtl have no material
+	groupID := int32(-1)
+
+	errorAt := func(lineNumber int, message string) error {
+		return fmt.Errorf("%s:%d: %s", fileName, lineNumber, message)
+	}
+
+	reader, err := newFileReader(file)
+	if err != nil {
+		return nil, err
+	}
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	var face [][2]int32 // position and normal indices, normal index is -1 if absent
+	var points []Vector32
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+
+		switch fields[0] {
+		case "v", "vn":
+			if len(fields) < 4 {
+				return nil, errorAt(lineNumber, "expected 3 coordinates")
+			}
+			var v Vector32
+			for k := 0; k < 3; k++ {
+				c, err := strconv.ParseFloat(fields[1+k], 32)
+				if err != nil {
+					return nil, errorAt(lineNumber, err.Error())
+				}
+				v[k] = float32(c)
+			}
+			if fields[0] == "v" {
+				mesh.vertices = append(mesh.vertices, v)
+			} else {
+				vertexNormals = append(vertexNormals, v)
+			}
+
+		case "usemtl":
+			name := strings.Join(fields[1:], " ")
+			id, found := materials[name]
+			if !found {
+				id = int32(len(materials))
+				materials[name] = id
+			}
+			materialID = id
+			hasMaterials = true
+
+		case "g":
+			// unnamed group is the default group, it has id as well
+			name := strings.Join(fields[1:], " ")
+			id, found := groups[name]
+			if !found {
+				id = int32(len(groups))
+				groups[name] = id
+			}
+			groupID = id
+			hasGroups = true
+
+		case "f":
+			if len(fields) < 4 {
+				return nil, errorAt(lineNumber, "face has less than 3 vertices")
+			}
+			face = face[:0]
+			for _, vertex := range fields[1:] {
+				indices := strings.Split(vertex, "/")
+				position, err := parseObjIndex(indices[0], len(mesh.vertices))
+				if err != nil {
+					return nil, errorAt(lineNumber, err.Error())
+				}
+				normal := int32(-1)
+				if len(indices) == 3 && indices[2] != "" {
+					normal, err = parseObjIndex(indices[2], len(vertexNormals))
+					if err != nil {
+						return nil, errorAt(lineNumber, err.Error())
+					}
+				}
+				face = append(face, [2]int32{position, normal})
+			}
+
+			points = points[:0]
+			for _, corner := range face {
+				points = append(points, mesh.vertices[corner[0]])
+			}
+			for _, triangle := range triangulatePolygon(points) {
+				corners := [3][2]int32{face[triangle[0]], face[triangle[1]], face[triangle[2]]}
+				mesh.triangles = append(mesh.triangles,
+					[3]int32{corners[0][0], corners[1][0], corners[2][0]})
+				mesh.normals = append(mesh.normals, Vector32{})
+				triangleIndex := mesh.GetTrianglesCount() - 1
+
+				normal := Vector32{}
+				hasNormals := true
+				for _, corner := range corners {
+					if corner[1] == -1 {
+						hasNormals = false
+						break
+					}
+					normal = VAdd32(normal, vertexNormals[corner[1]])
+				}
+				if length := VLength32(normal); hasNormals && length > 0 {
+					mesh.normals[triangleIndex] = VMul32(normal, 1.0/length)
+				} else {
+					mesh.normals[triangleIndex] = mesh.GetTriangleNormal(triangleIndex)
+				}
+				materialIDs = append(materialIDs, materialID)
+				groupIDs = append(groupIDs, groupID)
+			}
+		}
+		// other statements (texture coordinates, smoothing groups,
+		// material libraries) do not affect the geometry
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(mesh.triangles) > math.MaxInt32 || len(mesh.vertices) > math.MaxInt32 {
+		return nil, fmt.Errorf("mesh size limit exceeded: %s", fileName)
+	}
+	if hasMaterials {
+		mesh.materialIDs = materialIDs
+	} else if hasGroups {
+		mesh.materialIDs = groupIDs
+	}
+	if err := mesh.Validate(); err != nil {
+		return nil, fmt.Errorf("%s: %v", fileName, err)
+	}
+	return mesh, nil
+}
+
+// parseObjIndex converts 1-based or negative (relative to the end) obj index
+// to 0-based index.
+func parseObjIndex(s string, count int) (int32, error) {
+	index, err := strconv.ParseInt(s, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid index %q", s)
+	}
+	if index < 0 {
+		index += int64(count)
+	} else {
+		index--
+	}
+	if index < 0 || index >= int64(count) {
+		return 0, fmt.Errorf("index %s is out of range, elements count: %d", s, count)
+	}
+	return int32(index), nil
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"bufio"
+	"common"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+)
+
+type plyProperty struct {
+	name      string
+	valueType string
+	countType string // not empty for list property
+}
+
+type plyElement struct {
+	name       string
+	count      int
+	properties []plyProperty
+}
+
+// plyPolygon is a face with more than 3 vertices. The face is added as the
+// triangle fan and is triangulated again when the vertices are known.
+type plyPolygon struct {
+	firstTriangle int
+	indices       []int32
+}
+
+// plyValueReader reads values of ply scalar types from the file body.
+type plyValueReader interface {
+	readValue(valueType string) (float64, error)
+}
+
+type plyAsciiReader struct {
+	scanner *bufio.Scanner
+}
+
+func (r *plyAsciiReader) readValue(valueType string) (float64, error) {
+	if !r.scanner.Scan() {
+		if err := r.scanner.Err(); err != nil {
+			return 0, err
+		}
+		return 0, io.ErrUnexpectedEOF
+	}
+	return strconv.ParseFloat(r.scanner.Text(), 64)
+}
+
+type plyBinaryReader struct {
+	reader    io.Reader
+	byteOrder binary.ByteOrder
+	buffer    [8]byte
+}
+
+func (r *plyBinaryReader) readValue(valueType string) (float64, error) {
+	size := plyValueSize(valueType)
+	b := r.buffer[:size]
+	if _, err := io.ReadFull(r.reader, b); err != nil {
+		return 0, err
+	}
+	switch valueType {
+	case "char", "int8":
+		return float64(int8(b[0])), nil
+	case "uchar", "uint8":
+		return float64(b[0]), nil
+	case "short", "int16":
+		return float64(int16(r.byteOrder.Uint16(b))), nil
+	case "ushort", "uint16":
+		return float64(r.byteOrder.Uint16(b)), nil
+	case "int", "int32":
+		return float64(int32(r.byteOrder.Uint32(b))), nil
+	case "uint", "uint32":
+		return float64(r.byteOrder.Uint32(b)), nil
+	case "float", "float32":
+		return float64(math.Float32frombits(r.byteOrder.Uint32(b))), nil
+	default: // "double", "float64"
+		return math.Float64frombits(r.byteOrder.Uint64(b)), nil
+	}
+}
+
+// plyValueSize returns size of the scalar type in bytes or 0 for unknown type.
+func plyValueSize(valueType string) int {
+	switch valueType {
+	case "char", "int8", "uchar", "uint8":
+		return 1
+	case "short", "int16", "ushort", "uint16":
+		return 2
+	case "int", "int32", "uint", "uint32", "float", "float32":
+		return 4
+	case "double", "float64":
+		return 8
+	}
+	return 0
+}
+
+// LoadPly loads ply file in ascii, binary little-endian or binary big-endian
+// format. Vertex positions are read from x, y, z properties of vertex
+// element, faces from vertex_indices (or vertex_index) list of face
+// element. Polygon faces are triangulated as triangle fans, or by ear
+// clipping if the polygon is concave. Other elements and properties are
+// skipped.
+func LoadPly(fileName string) *TriangleMesh {
+	mesh, err := loadPly(fileName)
+	common.Check(err)
+	return mesh
+}
+
+// loadPly is the same as LoadPly but returns an error instead of
+// reporting it.
+func loadPly(fileName string) (*TriangleMesh, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	fileReader, err := newFileReader(file)
+	if err != nil {
+		return nil, err
+	}
+	reader := bufio.NewReader(fileReader)
+
+	invalidFile := func(message string) error {
+		return errors.New("invalid ply file: " + fileName + ": " + message)
+	}
+
+	// read header
+	var format string
+	var elements []plyElement
+	for lineNumber := 0; ; lineNumber++ {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return nil, invalidFile("unexpected end of header")
+		}
+		fields := strings.Fields(line)
+		if lineNumber == 0 {
+			if len(fields) != 1 || fields[0] != "ply" {
+				return nil, invalidFile("missing ply signature")
+			}
+			continue
+		}
+		if len(fields) == 0 {
+			continue
+		}
+
+		if fields[0] == "end_header" {
+			break
+		}
+		switch fields[0] {
+		case "format":
+			if len(fields) < 2 {
+				return nil, invalidFile("invalid format statement")
+			}
+			format = fields[1]
+		case "element":
+			if len(fields) != 3 {
+				return nil, invalidFile("invalid element statement")
+			}
+			count, err := strconv.Atoi(fields[2])
+			if err != nil || count < 0 {
+				return nil, invalidFile("invalid element count: " + fields[2])
+			}
+			elements = append(elements, plyElement{name: fields[1], count: count})
+		case "property":
+			if len(elements) == 0 {
+				return nil, invalidFile("property without element")
+			}
+			var property plyProperty
+			if len(fields) == 5 && fields[1] == "list" {
+				property = plyProperty{fields[4], fields[3], fields[2]}
+			} else if len(fields) == 3 {
+				property = plyProperty{fields[2], fields[1], ""}
+			} else {
+				return nil, invalidFile("invalid property statement")
+			}
+			if plyValueSize(property.valueType) == 0 ||
+				(property.countType != "" && plyValueSize(property.countType) == 0) {
+				return nil, invalidFile("unknown property type: " + strings.Join(fields[1:], " "))
+			}
+			element := &elements[len(elements)-1]
+			element.properties = append(element.properties, property)
+		}
+		// comment and obj_info statements are ignored
+	}
+
+	var valueReader plyValueReader
+	switch format {
+	case "ascii":
+		scanner := bufio.NewScanner(reader)
+		scanner.Split(bufio.ScanWords)
+		valueReader = &plyAsciiReader{scanner}
+	case "binary_little_endian":
+		valueReader = &plyBinaryReader{reader: reader, byteOrder: binary.LittleEndian}
+	case "binary_big_endian":
+		valueReader = &plyBinaryReader{reader: reader, byteOrder: binary.BigEndian}
+	default:
+		return nil, invalidFile("unsupported format: " + format)
+	}
+
+	// read elements
+	mesh := new(TriangleMesh)
+	var values []float64
+	var polygons []plyPolygon
+
+	for _, element := range elements {
+		positionProperties := [3]int{-1, -1, -1}
+		indicesProperty := -1
+		for i, property := range element.properties {
+			switch {
+			case element.name == "vertex" && property.name == "x":
+				positionProperties[0] = i
+			case element.name == "vertex" && property.name == "y":
+				positionProperties[1] = i
+			case element.name == "vertex" && property.name == "z":
+				positionProperties[2] = i
+			case element.name == "face" && property.countType != "" &&
+				(property.name == "vertex_indices" || property.name == "vertex_index"):
+				indicesProperty = i
+			}
+		}
+		if element.name == "vertex" && (positionProperties[0] == -1 ||
+			positionProperties[1] == -1 || positionProperties[2] == -1) {
+			return nil, invalidFile("vertex element without x, y, z properties")
+		}
+
+		for i := 0; i < element.count; i++ {
+			var position Vector32
+			for k, property := range element.properties {
+				if property.countType == "" {
+					value, err := valueReader.readValue(property.valueType)
+					if err != nil {
+						return nil, invalidFile(err.Error())
+					}
+					for axis, positionProperty := range positionProperties {
+						if k == positionProperty {
+							position[axis] = float32(value)
+						}
+					}
+					continue
+				}
+
+				count, err := valueReader.readValue(property.countType)
+				if err != nil {
+					return nil, invalidFile(err.Error())
+				}
+				values = values[:0]
+				for n := 0; n < int(count); n++ {
+					value, err := valueReader.readValue(property.valueType)
+					if err != nil {
+						return nil, invalidFile(err.Error())
+					}
+					values = append(values, value)
+				}
+				if k == indicesProperty {
+					if err := addPlyFace(mesh, values, &polygons); err != nil {
+						return nil, invalidFile(err.Error())
+					}
+				}
+			}
+			if element.name == "vertex" {
+				mesh.vertices = append(mesh.vertices, position)
+			}
+		}
+	}
+
+	// face indices are validated after all elements are read since
+	// the face element can precede the vertex element
+	verticesCount := int32(len(mesh.vertices))
+	for i, indices := range mesh.triangles {
+		for _, index := range indices {
+			if index < 0 || index >= verticesCount {
+				return nil, invalidFile(fmt.Sprintf(
+					"triangle %d: vertex index %d is out of range", i, index))
+			}
+		}
+	}
+
+	var points []Vector32
+	for _, polygon := range polygons {
+		points = points[:0]
+		for _, index := range polygon.indices {
+			points = append(points, mesh.vertices[index])
+		}
+		for k, triangle := range triangulatePolygon(points) {
+			mesh.triangles[polygon.firstTriangle+k] = [3]int32{
+				polygon.indices[triangle[0]],
+				polygon.indices[triangle[1]],
+				polygon.indices[triangle[2]],
+			}
+		}
+	}
+
+	mesh.normals = make([]Vector32, len(mesh.triangles))
+	for i := range mesh.triangles {
+		mesh.normals[i] = mesh.GetTriangleNormal(int32(i))
+	}
+
+	if err := mesh.Validate(); err != nil {
+		return nil, fmt.Errorf("%s: %v", fileName, err)
+	}
+	return mesh, nil
+}
+
+func addPlyFace(mesh *TriangleMesh, indices []float64, polygons *[]plyPolygon) error {
+	if len(indices) < 3 {
+		return fmt.Errorf("face has less than 3 vertices")
+	}
+	if len(indices) > 3 {
+		polygon := plyPolygon{firstTriangle: len(mesh.triangles)}
+		for _, index := range indices {
+			polygon.indices = append(polygon.indices, int32(index))
+		}
+		*polygons = append(*polygons, polygon)
+	}
+	for i := 1; i+1 < len(indices); i++ {
+		mesh.triangles = append(mesh.triangles, [3]int32{
+			int32(indices[0]), int32(indices[i]), int32(indices[i+1]),
+		})
+	}
+	if len(mesh.triangles) > math.MaxInt32 {
+		return fmt.Errorf("triangles limit exceeded")
+	}
+	return nil
+}
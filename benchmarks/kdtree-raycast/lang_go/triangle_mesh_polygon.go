@@ -0,0 +1,112 @@
+package main
+
+import (
+	"math"
+)
+
+// triangulatePolygon splits planar polygon into len(points)-2 triangles
+// and returns them as indices into points. Convex polygons are split into
+// the triangle fan around the first vertex, concave polygons are
+// triangulated by ear clipping. The result is the same as the fan for
+// convex polygons, so ear clipping does not change meshes that contain
+// only convex faces.
+//
+// Ear clipping works in the plane of the polygon. If the polygon is
+// degenerate or self-intersecting and no ear can be found then the
+// remaining part is split as a fan.
+func triangulatePolygon(points []Vector32) [][3]int {
+	triangles := make([][3]int, 0, len(points)-2)
+
+	fan := func(remaining []int) [][3]int {
+		for i := 1; i+1 < len(remaining); i++ {
+			triangles = append(triangles,
+				[3]int{remaining[0], remaining[i], remaining[i+1]})
+		}
+		return triangles
+	}
+
+	remaining := make([]int, len(points))
+	for i := range remaining {
+		remaining[i] = i
+	}
+	if len(points) <= 3 {
+		return fan(remaining)
+	}
+
+	// project the polygon to the coordinate plane where the polygon has
+	// the largest area, the normal is computed with Newell's method
+	var normal Vector64
+	for i := range points {
+		a := NewVector64FromVector32(points[i])
+		b := NewVector64FromVector32(points[(i+1)%len(points)])
+		normal[0] += (a[1] - b[1]) * (a[2] + b[2])
+		normal[1] += (a[2] - b[2]) * (a[0] + b[0])
+		normal[2] += (a[0] - b[0]) * (a[1] + b[1])
+	}
+	axis := 0
+	for k := 1; k < 3; k++ {
+		if math.Abs(normal[k]) > math.Abs(normal[axis]) {
+			axis = k
+		}
+	}
+	if normal[axis] == 0.0 {
+		return fan(remaining)
+	}
+	uAxis, vAxis := (axis+1)%3, (axis+2)%3
+	if normal[axis] < 0.0 {
+		// keep counterclockwise orientation in the projection plane
+		uAxis, vAxis = vAxis, uAxis
+	}
+
+	point2D := func(i int) [2]float64 {
+		return [2]float64{float64(points[i][uAxis]), float64(points[i][vAxis])}
+	}
+	cross2D := func(o, a, b [2]float64) float64 {
+		return (a[0]-o[0])*(b[1]-o[1]) - (a[1]-o[1])*(b[0]-o[0])
+	}
+
+	isEar := func(position int) bool {
+		prev := remaining[(position+len(remaining)-1)%len(remaining)]
+		current := remaining[position]
+		next := remaining[(position+1)%len(remaining)]
+		a, b, c := point2D(prev), point2D(current), point2D(next)
+		if cross2D(a, b, c) <= 0.0 {
+			return false // reflex or degenerate corner
+		}
+		for _, i := range remaining {
+			if i == prev || i == current || i == next {
+				continue
+			}
+			p := point2D(i)
+			if cross2D(a, b, p) >= 0.0 && cross2D(b, c, p) >= 0.0 &&
+				cross2D(c, a, p) >= 0.0 {
+				return false
+			}
+		}
+		return true
+	}
+
+	// the search starts from the second vertex, so for convex polygon the
+	// ears are clipped in the same order as the fan triangles
+	position := 1
+	for len(remaining) > 3 {
+		earFound := false
+		for attempt := 0; attempt < len(remaining); attempt++ {
+			p := (position + attempt) % len(remaining)
+			if isEar(p) {
+				prev := (p + len(remaining) - 1) % len(remaining)
+				next := (p + 1) % len(remaining)
+				triangles = append(triangles,
+					[3]int{remaining[prev], remaining[p], remaining[next]})
+				remaining = append(remaining[:p], remaining[p+1:]...)
+				position = p % len(remaining)
+				earFound = true
+				break
+			}
+		}
+		if !earFound {
+			return fan(remaining)
+		}
+	}
+	return append(triangles, [3]int{remaining[0], remaining[1], remaining[2]})
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"math"
+)
+
+// WeldVertices merges vertices that are closer than epsilon to each other
+// (per coordinate) and remaps triangle indices to the shared vertices.
+// Returns the number of vertices before and after welding.
+//
+// Vertices are hashed into a uniform grid with cell size epsilon. A vertex
+// can be coincident with a vertex from a neighboring cell if both lie near
+// the cell boundary, so all 27 adjacent cells are searched.
+//
+// If epsilon is not positive then only exactly equal vertices are merged.
+// The stl loader already does this, but other loaders keep vertices as they
+// are stored in the file, e.g. glTF primitives do not share vertices.
+//
+// Welding can collapse small triangles into degenerate ones. Such triangles
+// are not removed in order to preserve triangle indices.
+func (mesh *TriangleMesh) WeldVertices(epsilon float32) (verticesBefore, verticesAfter int) {
+	verticesBefore = len(mesh.vertices)
+	if epsilon <= 0 {
+		mesh.weldEqualVertices()
+		return verticesBefore, len(mesh.vertices)
+	}
+
+	type cellKey [3]int64
+
+	getCell := func(v Vector32) cellKey {
+		return cellKey{
+			int64(math.Floor(float64(v[0] / epsilon))),
+			int64(math.Floor(float64(v[1] / epsilon))),
+			int64(math.Floor(float64(v[2] / epsilon))),
+		}
+	}
+
+	isCoincident := func(a, b Vector32) bool {
+		return math.Abs(float64(a[0]-b[0])) <= float64(epsilon) &&
+			math.Abs(float64(a[1]-b[1])) <= float64(epsilon) &&
+			math.Abs(float64(a[2]-b[2])) <= float64(epsilon)
+	}
+
+	grid := make(map[cellKey][]int32)
+	weldedVertices := make([]Vector32, 0, len(mesh.vertices))
+	remap := make([]int32, len(mesh.vertices))
+
+	for i, v := range mesh.vertices {
+		cell := getCell(v)
+		weldedIndex := int32(-1)
+
+	search:
+		for dx := int64(-1); dx <= 1; dx++ {
+			for dy := int64(-1); dy <= 1; dy++ {
+				for dz := int64(-1); dz <= 1; dz++ {
+					neighbor := cellKey{cell[0] + dx, cell[1] + dy, cell[2] + dz}
+					for _, candidate := range grid[neighbor] {
+						if isCoincident(v, weldedVertices[candidate]) {
+							weldedIndex = candidate
+							break search
+						}
+					}
+				}
+			}
+		}
+
+		if weldedIndex == -1 {
+			weldedIndex = int32(len(weldedVertices))
+			weldedVertices = append(weldedVertices, v)
+			grid[cell] = append(grid[cell], weldedIndex)
+		}
+		remap[i] = weldedIndex
+	}
+
+	mesh.applyVerticesRemap(weldedVertices, remap)
+	return verticesBefore, len(mesh.vertices)
+}
+
+func (mesh *TriangleMesh) weldEqualVertices() {
+	uniqueVertices := make(map[Vector32]int32, len(mesh.vertices))
+	weldedVertices := make([]Vector32, 0, len(mesh.vertices))
+	remap := make([]int32, len(mesh.vertices))
+
+	for i, v := range mesh.vertices {
+		weldedIndex, found := uniqueVertices[v]
+		if !found {
+			weldedIndex = int32(len(weldedVertices))
+			uniqueVertices[v] = weldedIndex
+			weldedVertices = append(weldedVertices, v)
+		}
+		remap[i] = weldedIndex
+	}
+	mesh.applyVerticesRemap(weldedVertices, remap)
+}
+
+// applyVerticesRemap replaces mesh vertices and updates triangle indices,
+// remap maps old vertex index to the index in the new vertices array.
+func (mesh *TriangleMesh) applyVerticesRemap(vertices []Vector32, remap []int32) {
+	for i := range mesh.triangles {
+		for k := 0; k < 3; k++ {
+			mesh.triangles[i][k] = remap[mesh.triangles[i][k]]
+		}
+	}
+	mesh.vertices = vertices
+	mesh.vertexNormals = nil
+	mesh.invalidateBounds()
+}
@@ -23,3 +23,11 @@ func VLength32(v Vector32) float32 {
 func DotProduct32(v1 Vector32, v2 Vector32) float32 {
 	return v1[0]*v2[0] + v1[1]*v2[1] + v1[2]*v2[2]
 }
+
+func CrossProduct32(v1, v2 Vector32) Vector32 {
+	return Vector32{
+		v1[1]*v2[2] - v1[2]*v2[1],
+		v1[2]*v2[0] - v1[0]*v2[2],
+		v1[0]*v2[1] - v1[1]*v2[0],
+	}
+}
@@ -0,0 +1,16 @@
+//go:build !unix
+
+package common
+
+import (
+	"os"
+)
+
+// MapFile is not supported on this platform. Returns nil slice, so the
+// caller should fall back to reading the file.
+func MapFile(file *os.File) ([]byte, error) {
+	return nil, nil
+}
+
+func UnmapFile(data []byte) {
+}
@@ -0,0 +1,29 @@
+//go:build unix
+
+package common
+
+import (
+	"os"
+	"syscall"
+)
+
+// MapFile maps the file content into memory for reading. Returns nil slice
+// without error if the file is empty since empty files can't be mapped.
+func MapFile(file *os.File) ([]byte, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := info.Size()
+	if size == 0 {
+		return nil, nil
+	}
+	if int64(int(size)) != size {
+		return nil, syscall.EFBIG
+	}
+	return syscall.Mmap(int(file.Fd()), 0, int(size), syscall.PROT_READ, syscall.MAP_SHARED)
+}
+
+func UnmapFile(data []byte) {
+	syscall.Munmap(data)
+}
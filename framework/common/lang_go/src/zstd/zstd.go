@@ -0,0 +1,1020 @@
+// Package zstd implements Zstandard decompression as specified by RFC 8878.
+// There is no zstd decoder in the standard library, the reader implements
+// the complete frame format except dictionaries, which are not used for
+// mesh files. The package is shared by the Go benchmarks.
+package zstd
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/bits"
+)
+
+const (
+	frameMagic          = 0xfd2fb528
+	skippableFrameMagic = 0x184d2a50
+	skippableFrameMask  = 0xfffffff0
+	maxBlockSize        = 128 << 10
+	maxWindowLog        = 31
+	maxHuffmanBits      = 11
+
+	maxLiteralsLengthCode = 35
+	maxMatchLengthCode    = 52
+	maxOffsetCode         = 31
+)
+
+var errCorrupted = errors.New("zstd: corrupted data")
+
+// Reader decompresses the concatenated zstd frames read from the
+// underlying reader. Each Read decodes at most one block.
+type Reader struct {
+	reader io.Reader
+	err    error
+
+	// decoded data of the current frame. The data before readPos is
+	// already returned by Read and is kept as the match history.
+	history    []byte
+	readPos    int
+	windowSize int
+
+	inFrame     bool
+	contentSize int64 // -1 if not stored in the frame header
+	frameSize   int64
+	hasChecksum bool
+	checksum    xxHash64
+
+	block          []byte
+	literals       []byte
+	literalsBuffer []byte
+
+	// the tables and the repeat offsets are carried over between the
+	// blocks of the frame
+	huffmanTable    huffmanTable
+	hasHuffmanTable bool
+	tables          [3]*fseTable // literals length, offset, match length
+	tableBuffers    [3]fseTable
+	repeatOffsets   [3]int
+}
+
+// NewReader returns the reader that decompresses the data read from reader.
+func NewReader(reader io.Reader) *Reader {
+	return &Reader{reader: reader}
+}
+
+func (z *Reader) Read(p []byte) (int, error) {
+	for z.readPos == len(z.history) {
+		if z.err != nil {
+			return 0, z.err
+		}
+		if z.inFrame {
+			z.err = z.decodeBlock()
+		} else {
+			z.err = z.readFrameHeader()
+		}
+	}
+	n := copy(p, z.history[z.readPos:])
+	z.readPos += n
+	return n, nil
+}
+
+// readFull reads exactly len(buffer) bytes, the end of the data is
+// unexpected inside of the frame.
+func (z *Reader) readFull(buffer []byte) error {
+	_, err := io.ReadFull(z.reader, buffer)
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+func (z *Reader) readFrameHeader() error {
+	var magic [4]byte
+	if _, err := io.ReadFull(z.reader, magic[:]); err != nil {
+		return err // io.EOF after the last frame
+	}
+	magicNumber := binary.LittleEndian.Uint32(magic[:])
+	if magicNumber&skippableFrameMask == skippableFrameMagic {
+		var size [4]byte
+		if err := z.readFull(size[:]); err != nil {
+			return err
+		}
+		_, err := io.CopyN(io.Discard, z.reader, int64(binary.LittleEndian.Uint32(size[:])))
+		if err == io.EOF {
+			return io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	if magicNumber != frameMagic {
+		return errors.New("zstd: invalid frame magic number")
+	}
+
+	var header [14]byte
+	if err := z.readFull(header[:1]); err != nil {
+		return err
+	}
+	descriptor := header[0]
+	singleSegment := descriptor&0x20 != 0
+	if descriptor&0x08 != 0 {
+		return errors.New("zstd: reserved frame header bit is set")
+	}
+	z.hasChecksum = descriptor&0x04 != 0
+	dictionaryIDSize := [4]int{0, 1, 2, 4}[descriptor&3]
+	contentSizeSize := [4]int{0, 2, 4, 8}[descriptor>>6]
+	if contentSizeSize == 0 && singleSegment {
+		contentSizeSize = 1
+	}
+	windowDescriptorSize := 1
+	if singleSegment {
+		windowDescriptorSize = 0
+	}
+	fields := header[1 : 1+windowDescriptorSize+dictionaryIDSize+contentSizeSize]
+	if err := z.readFull(fields); err != nil {
+		return err
+	}
+
+	if !singleSegment {
+		windowLog := 10 + int(fields[0]>>3)
+		if windowLog > maxWindowLog {
+			return fmt.Errorf("zstd: window size 2^%d is too large", windowLog)
+		}
+		windowBase := 1 << windowLog
+		z.windowSize = windowBase + windowBase/8*int(fields[0]&7)
+		fields = fields[1:]
+	}
+	var dictionaryID uint32
+	for i := dictionaryIDSize - 1; i >= 0; i-- {
+		dictionaryID = dictionaryID<<8 | uint32(fields[i])
+	}
+	if dictionaryID != 0 {
+		return errors.New("zstd: dictionaries are not supported")
+	}
+	fields = fields[dictionaryIDSize:]
+	z.contentSize = -1
+	if contentSizeSize > 0 {
+		var contentSize uint64
+		for i := contentSizeSize - 1; i >= 0; i-- {
+			contentSize = contentSize<<8 | uint64(fields[i])
+		}
+		if contentSizeSize == 2 {
+			contentSize += 256
+		}
+		if contentSize > 1<<62 {
+			return errors.New("zstd: frame content size is too large")
+		}
+		z.contentSize = int64(contentSize)
+	}
+	if singleSegment {
+		// the window is the whole frame content
+		z.windowSize = int(min(z.contentSize, 1<<maxWindowLog))
+	}
+
+	z.inFrame = true
+	z.frameSize = 0
+	z.history = z.history[:0]
+	z.readPos = 0
+	z.checksum.reset()
+	z.hasHuffmanTable = false
+	z.tables = [3]*fseTable{}
+	z.repeatOffsets = [3]int{1, 4, 8}
+	return nil
+}
+
+func (z *Reader) decodeBlock() error {
+	var header [3]byte
+	if err := z.readFull(header[:]); err != nil {
+		return err
+	}
+	value := int(header[0]) | int(header[1])<<8 | int(header[2])<<16
+	lastBlock := value&1 != 0
+	blockType := (value >> 1) & 3
+	blockSize := value >> 3
+	blockSizeLimit := min(z.windowSize, maxBlockSize)
+
+	// only the window is needed for the matches, all the data is returned
+	// by Read at this point
+	if excess := len(z.history) - z.windowSize; excess >= z.windowSize {
+		copy(z.history, z.history[excess:])
+		z.history = z.history[:z.windowSize]
+		z.readPos = len(z.history)
+	}
+	start := len(z.history)
+
+	switch blockType {
+	case 0: // raw
+		if blockSize > blockSizeLimit {
+			return errCorrupted
+		}
+		z.history = append(z.history, make([]byte, blockSize)...)
+		if err := z.readFull(z.history[start:]); err != nil {
+			return err
+		}
+	case 1: // RLE
+		if blockSize > blockSizeLimit {
+			return errCorrupted
+		}
+		var b [1]byte
+		if err := z.readFull(b[:]); err != nil {
+			return err
+		}
+		for i := 0; i < blockSize; i++ {
+			z.history = append(z.history, b[0])
+		}
+	case 2: // compressed, the decoded size is limited by the window
+		if blockSize > maxBlockSize {
+			return errCorrupted
+		}
+		if cap(z.block) < blockSize {
+			z.block = make([]byte, blockSize)
+		}
+		z.block = z.block[:blockSize]
+		if err := z.readFull(z.block); err != nil {
+			return err
+		}
+		if err := z.decodeCompressedBlock(z.block); err != nil {
+			return err
+		}
+		if len(z.history)-start > blockSizeLimit {
+			return errCorrupted
+		}
+	default:
+		return errors.New("zstd: reserved block type")
+	}
+
+	z.frameSize += int64(len(z.history) - start)
+	if z.hasChecksum {
+		z.checksum.write(z.history[start:])
+	}
+	if lastBlock {
+		return z.finishFrame()
+	}
+	return nil
+}
+
+func (z *Reader) finishFrame() error {
+	z.inFrame = false
+	if z.contentSize >= 0 && z.frameSize != z.contentSize {
+		return fmt.Errorf("zstd: decoded %d bytes, frame content size is %d bytes",
+			z.frameSize, z.contentSize)
+	}
+	if z.hasChecksum {
+		var checksum [4]byte
+		if err := z.readFull(checksum[:]); err != nil {
+			return err
+		}
+		if binary.LittleEndian.Uint32(checksum[:]) != uint32(z.checksum.sum64()) {
+			return errors.New("zstd: invalid checksum")
+		}
+	}
+	return nil
+}
+
+func (z *Reader) decodeCompressedBlock(data []byte) error {
+	n, err := z.decodeLiterals(data)
+	if err != nil {
+		return err
+	}
+	data = data[n:]
+	if len(data) == 0 {
+		return errCorrupted
+	}
+
+	var sequencesCount int
+	switch b := int(data[0]); {
+	case b < 128:
+		sequencesCount = b
+		data = data[1:]
+	case b < 255:
+		if len(data) < 2 {
+			return errCorrupted
+		}
+		sequencesCount = (b-128)<<8 + int(data[1])
+		data = data[2:]
+	default:
+		if len(data) < 3 {
+			return errCorrupted
+		}
+		sequencesCount = int(data[1]) + int(data[2])<<8 + 0x7f00
+		data = data[3:]
+	}
+	if sequencesCount == 0 {
+		z.history = append(z.history, z.literals...)
+		return nil
+	}
+
+	if len(data) == 0 {
+		return errCorrupted
+	}
+	modes := data[0]
+	if modes&3 != 0 {
+		return errors.New("zstd: reserved sequences compression mode bits are set")
+	}
+	data = data[1:]
+	for i, setup := range [3]struct {
+		mode           byte
+		predefined     *fseTable
+		maxSymbol      int
+		maxAccuracyLog int
+	}{
+		{modes >> 6, predefinedLiteralsLengthTable, maxLiteralsLengthCode, 9},
+		{modes >> 4 & 3, predefinedOffsetTable, maxOffsetCode, 8},
+		{modes >> 2 & 3, predefinedMatchLengthTable, maxMatchLengthCode, 9},
+	} {
+		switch setup.mode {
+		case 0: // predefined
+			z.tables[i] = setup.predefined
+		case 1: // RLE
+			if len(data) == 0 || int(data[0]) > setup.maxSymbol {
+				return errCorrupted
+			}
+			z.tableBuffers[i].initRLE(data[0])
+			z.tables[i] = &z.tableBuffers[i]
+			data = data[1:]
+		case 2: // FSE compressed
+			n, err := z.tableBuffers[i].readDescription(data, setup.maxSymbol,
+				setup.maxAccuracyLog)
+			if err != nil {
+				return err
+			}
+			z.tables[i] = &z.tableBuffers[i]
+			data = data[n:]
+		case 3: // repeat
+			if z.tables[i] == nil {
+				return errors.New("zstd: repeated sequences table is not defined")
+			}
+		}
+	}
+	return z.executeSequences(data, sequencesCount)
+}
+
+var (
+	literalsLengthBaselines = [maxLiteralsLengthCode + 1]int{
+		0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15,
+		16, 18, 20, 22, 24, 28, 32, 40, 48, 64, 128, 256, 512, 1024, 2048, 4096,
+		8192, 16384, 32768, 65536,
+	}
+	literalsLengthBits = [maxLiteralsLengthCode + 1]uint8{
+		0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+		1, 1, 1, 1, 2, 2, 3, 3, 4, 6, 7, 8, 9, 10, 11, 12,
+		13, 14, 15, 16,
+	}
+	matchLengthBaselines = [maxMatchLengthCode + 1]int{
+		3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18,
+		19, 20, 21, 22, 23, 24, 25, 26, 27, 28, 29, 30, 31, 32, 33, 34,
+		35, 37, 39, 41, 43, 47, 51, 59, 67, 83, 99, 131, 259, 515, 1027, 2051,
+		4099, 8195, 16387, 32771, 65539,
+	}
+	matchLengthBits = [maxMatchLengthCode + 1]uint8{
+		0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+		0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+		1, 1, 1, 1, 2, 2, 3, 3, 4, 4, 5, 7, 8, 9, 10, 11,
+		12, 13, 14, 15, 16,
+	}
+
+	// predefined distributions, RFC 8878 section 3.1.1.3.2.2
+	predefinedLiteralsLengthTable = newPredefinedTable(6, []int16{
+		4, 3, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 1, 1, 1,
+		2, 2, 2, 2, 2, 2, 2, 2, 2, 3, 2, 1, 1, 1, 1, 1,
+		-1, -1, -1, -1,
+	})
+	predefinedMatchLengthTable = newPredefinedTable(6, []int16{
+		1, 4, 3, 2, 2, 2, 2, 2, 2, 1, 1, 1, 1, 1, 1, 1,
+		1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1,
+		1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, -1, -1,
+		-1, -1, -1, -1, -1,
+	})
+	predefinedOffsetTable = newPredefinedTable(5, []int16{
+		1, 1, 1, 1, 1, 1, 2, 2, 2, 1, 1, 1, 1, 1, 1, 1,
+		1, 1, 1, 1, 1, 1, 1, 1, -1, -1, -1, -1, -1,
+	})
+)
+
+func newPredefinedTable(accuracyLog int, counts []int16) *fseTable {
+	table := &fseTable{}
+	if err := table.build(counts, accuracyLog); err != nil {
+		panic(err)
+	}
+	return table
+}
+
+func (z *Reader) executeSequences(data []byte, sequencesCount int) error {
+	var r bitReader
+	if err := r.init(data); err != nil {
+		return err
+	}
+	literalsLengthTable, offsetTable, matchLengthTable := z.tables[0], z.tables[1], z.tables[2]
+	literalsLengthState := int(r.read(literalsLengthTable.accuracyLog))
+	offsetState := int(r.read(offsetTable.accuracyLog))
+	matchLengthState := int(r.read(matchLengthTable.accuracyLog))
+
+	literals := z.literals
+	for i := 0; i < sequencesCount; i++ {
+		literalsLengthCode := literalsLengthTable.entries[literalsLengthState].symbol
+		offsetCode := offsetTable.entries[offsetState].symbol
+		matchLengthCode := matchLengthTable.entries[matchLengthState].symbol
+
+		offsetValue := 1<<offsetCode + int(r.read(offsetCode))
+		matchLength := matchLengthBaselines[matchLengthCode] +
+			int(r.read(matchLengthBits[matchLengthCode]))
+		literalsLength := literalsLengthBaselines[literalsLengthCode] +
+			int(r.read(literalsLengthBits[literalsLengthCode]))
+
+		var offset int
+		if offsetValue > 3 {
+			offset = offsetValue - 3
+			z.repeatOffsets = [3]int{offset, z.repeatOffsets[0], z.repeatOffsets[1]}
+		} else {
+			// the repeat offsets are shifted by one if there are no literals,
+			// the last one means the first repeat offset minus one
+			repeat := offsetValue - 1
+			if literalsLength == 0 {
+				repeat++
+			}
+			if repeat == 3 {
+				offset = z.repeatOffsets[0] - 1
+			} else {
+				offset = z.repeatOffsets[repeat]
+			}
+			switch repeat {
+			case 1:
+				z.repeatOffsets[1] = z.repeatOffsets[0]
+				z.repeatOffsets[0] = offset
+			case 2, 3:
+				z.repeatOffsets = [3]int{offset, z.repeatOffsets[0], z.repeatOffsets[1]}
+			}
+		}
+
+		if i+1 < sequencesCount {
+			literalsLengthState = literalsLengthTable.nextState(literalsLengthState, &r)
+			matchLengthState = matchLengthTable.nextState(matchLengthState, &r)
+			offsetState = offsetTable.nextState(offsetState, &r)
+		}
+
+		if literalsLength > len(literals) {
+			return errCorrupted
+		}
+		z.history = append(z.history, literals[:literalsLength]...)
+		literals = literals[literalsLength:]
+
+		if offset <= 0 || offset > len(z.history) {
+			return fmt.Errorf("zstd: match offset %d is out of range", offset)
+		}
+		// the match can overlap the data it produces
+		for matchLength > 0 {
+			n := min(matchLength, offset)
+			from := len(z.history) - offset
+			z.history = append(z.history, z.history[from:from+n]...)
+			matchLength -= n
+		}
+	}
+	if r.bitsLeft != 0 {
+		return errCorrupted
+	}
+	z.history = append(z.history, literals...)
+	return nil
+}
+
+// decodeLiterals decodes the literals section of the compressed block to
+// z.literals and returns the size of the section.
+func (z *Reader) decodeLiterals(data []byte) (int, error) {
+	if len(data) == 0 {
+		return 0, errCorrupted
+	}
+	blockType := data[0] & 3
+	sizeFormat := (data[0] >> 2) & 3
+
+	if blockType < 2 { // raw or RLE
+		var headerSize, regeneratedSize int
+		switch sizeFormat {
+		case 0, 2:
+			headerSize = 1
+			regeneratedSize = int(data[0] >> 3)
+		case 1:
+			headerSize = 2
+		case 3:
+			headerSize = 3
+		}
+		if len(data) < headerSize {
+			return 0, errCorrupted
+		}
+		if headerSize > 1 {
+			regeneratedSize = int(data[0]>>4) + int(data[1])<<4
+			if headerSize == 3 {
+				regeneratedSize += int(data[2]) << 12
+			}
+		}
+		if regeneratedSize > maxBlockSize {
+			return 0, errCorrupted
+		}
+		if blockType == 0 {
+			if len(data) < headerSize+regeneratedSize {
+				return 0, errCorrupted
+			}
+			z.literals = data[headerSize : headerSize+regeneratedSize]
+			return headerSize + regeneratedSize, nil
+		}
+		if len(data) < headerSize+1 {
+			return 0, errCorrupted
+		}
+		z.literals = z.allocLiterals(regeneratedSize)
+		for i := range z.literals {
+			z.literals[i] = data[headerSize]
+		}
+		return headerSize + 1, nil
+	}
+
+	// Huffman compressed or treeless (the previous Huffman table is used)
+	headerSize := [4]int{3, 3, 4, 5}[sizeFormat]
+	if len(data) < headerSize {
+		return 0, errCorrupted
+	}
+	var header uint64
+	for i := headerSize - 1; i >= 0; i-- {
+		header = header<<8 | uint64(data[i])
+	}
+	sizeBits := [4]uint{10, 10, 14, 18}[sizeFormat]
+	sizeMask := uint64(1)<<sizeBits - 1
+	regeneratedSize := int((header >> 4) & sizeMask)
+	compressedSize := int((header >> (4 + sizeBits)) & sizeMask)
+	if regeneratedSize > maxBlockSize || len(data) < headerSize+compressedSize {
+		return 0, errCorrupted
+	}
+	streams := data[headerSize : headerSize+compressedSize]
+	if blockType == 2 {
+		n, err := z.huffmanTable.readDescription(streams)
+		if err != nil {
+			return 0, err
+		}
+		z.hasHuffmanTable = true
+		streams = streams[n:]
+	} else if !z.hasHuffmanTable {
+		return 0, errors.New("zstd: treeless literals without Huffman table")
+	}
+
+	z.literals = z.allocLiterals(regeneratedSize)
+	if sizeFormat == 0 {
+		if err := z.huffmanTable.decodeStream(streams, z.literals); err != nil {
+			return 0, err
+		}
+		return headerSize + compressedSize, nil
+	}
+
+	// four streams with the jump table of the first three stream sizes
+	if len(streams) < 6 {
+		return 0, errCorrupted
+	}
+	var streamSizes [4]int
+	for i := 0; i < 3; i++ {
+		streamSizes[i] = int(binary.LittleEndian.Uint16(streams[2*i:]))
+	}
+	streams = streams[6:]
+	streamSizes[3] = len(streams) - streamSizes[0] - streamSizes[1] - streamSizes[2]
+	segmentSize := (regeneratedSize + 3) / 4
+	if streamSizes[3] < 0 || 3*segmentSize > regeneratedSize {
+		return 0, errCorrupted
+	}
+	output := z.literals
+	for i, streamSize := range streamSizes {
+		segment := output
+		if i < 3 {
+			segment = output[:segmentSize]
+		}
+		if err := z.huffmanTable.decodeStream(streams[:streamSize], segment); err != nil {
+			return 0, err
+		}
+		streams = streams[streamSize:]
+		output = output[len(segment):]
+	}
+	return headerSize + compressedSize, nil
+}
+
+func (z *Reader) allocLiterals(size int) []byte {
+	if cap(z.literalsBuffer) < size {
+		z.literalsBuffer = make([]byte, size)
+	}
+	return z.literalsBuffer[:size]
+}
+
+// bitReader reads the bitstream backward: from the last byte to the
+// first one and from the high bits to the low ones. The highest set bit of
+// the last byte marks the start of the stream.
+type bitReader struct {
+	data     []byte
+	bitsLeft int // negative if more bits than the stream has were read
+}
+
+func (r *bitReader) init(data []byte) error {
+	if len(data) == 0 || data[len(data)-1] == 0 {
+		return errCorrupted
+	}
+	r.data = data
+	r.bitsLeft = 8*(len(data)-1) + bits.Len8(data[len(data)-1]) - 1
+	return nil
+}
+
+// peek returns the next n bits without consuming them, n is at most 56.
+// The bits past the end of the stream are zeros.
+func (r *bitReader) peek(n uint8) uint64 {
+	if n == 0 {
+		return 0
+	}
+	start := r.bitsLeft - int(n)
+	if start < 0 {
+		if r.bitsLeft <= 0 {
+			return 0
+		}
+		return r.peek(uint8(r.bitsLeft)) << uint(-start)
+	}
+	i := start >> 3
+	var value uint64
+	if i+8 <= len(r.data) {
+		value = binary.LittleEndian.Uint64(r.data[i:])
+	} else {
+		for k := len(r.data) - 1; k >= i; k-- {
+			value = value<<8 | uint64(r.data[k])
+		}
+	}
+	return (value >> uint(start&7)) & (1<<n - 1)
+}
+
+func (r *bitReader) read(n uint8) uint64 {
+	value := r.peek(n)
+	r.bitsLeft -= int(n)
+	return value
+}
+
+type fseEntry struct {
+	symbol   uint8
+	bits     uint8
+	baseline uint16
+}
+
+// fseTable is the decoding table of finite state entropy coder. The
+// state is the index of the entry.
+type fseTable struct {
+	accuracyLog uint8
+	entries     []fseEntry
+}
+
+func (table *fseTable) nextState(state int, r *bitReader) int {
+	entry := table.entries[state]
+	return int(entry.baseline) + int(r.read(entry.bits))
+}
+
+func (table *fseTable) initRLE(symbol byte) {
+	table.accuracyLog = 0
+	table.entries = append(table.entries[:0], fseEntry{symbol: symbol})
+}
+
+// readDescription reads the normalized symbol counts and builds the table,
+// returns the size of the description.
+func (table *fseTable) readDescription(data []byte, maxSymbol, maxAccuracyLog int) (int, error) {
+	if len(data) == 0 {
+		return 0, errCorrupted
+	}
+	// the description is read forward, from the low bits of the first byte
+	bitPos := 0
+	read := func(n int, consume bool) int {
+		value := 0
+		for k := 0; k < n; k++ {
+			pos := bitPos + k
+			if pos>>3 < len(data) && data[pos>>3]>>(pos&7)&1 != 0 {
+				value |= 1 << k
+			}
+		}
+		if consume {
+			bitPos += n
+		}
+		return value
+	}
+
+	accuracyLog := read(4, true) + 5
+	if accuracyLog > maxAccuracyLog {
+		return 0, errCorrupted
+	}
+	var counts [256]int16
+	remaining := 1<<accuracyLog + 1
+	threshold := 1 << accuracyLog
+	bitsCount := accuracyLog + 1
+	symbol := 0
+	for remaining > 1 && symbol <= maxSymbol {
+		maxValue := 2*threshold - 1 - remaining
+		value := read(bitsCount-1, false)
+		if value < maxValue {
+			bitPos += bitsCount - 1
+		} else {
+			value = read(bitsCount, true)
+			if value >= threshold {
+				value -= maxValue
+			}
+		}
+		count := value - 1
+		counts[symbol] = int16(count)
+		symbol++
+		if count < 0 {
+			remaining--
+		} else {
+			remaining -= count
+		}
+		if remaining < 1 {
+			return 0, errCorrupted
+		}
+		if count == 0 {
+			// the number of following zero counts
+			for {
+				repeat := read(2, true)
+				symbol += repeat
+				if repeat != 3 {
+					break
+				}
+			}
+		}
+		for remaining < threshold {
+			bitsCount--
+			threshold >>= 1
+		}
+	}
+	if remaining != 1 || symbol > maxSymbol+1 || bitPos > 8*len(data) {
+		return 0, errCorrupted
+	}
+	if err := table.build(counts[:symbol], accuracyLog); err != nil {
+		return 0, err
+	}
+	return (bitPos + 7) / 8, nil
+}
+
+// build creates the decoding table from the normalized counts, the count
+// -1 means the symbol with the probability less than 1/2^accuracyLog.
+func (table *fseTable) build(counts []int16, accuracyLog int) error {
+	size := 1 << accuracyLog
+	table.accuracyLog = uint8(accuracyLog)
+	if cap(table.entries) < size {
+		table.entries = make([]fseEntry, size)
+	}
+	table.entries = table.entries[:size]
+
+	// the symbols with low probability take the last states
+	var next [256]int
+	highThreshold := size - 1
+	for symbol, count := range counts {
+		if count == -1 {
+			table.entries[highThreshold].symbol = uint8(symbol)
+			highThreshold--
+			next[symbol] = 1
+		} else {
+			next[symbol] = int(count)
+		}
+	}
+	position := 0
+	step := size>>1 + size>>3 + 3
+	for symbol, count := range counts {
+		for i := 0; i < int(count); i++ {
+			table.entries[position].symbol = uint8(symbol)
+			position = (position + step) & (size - 1)
+			for position > highThreshold {
+				position = (position + step) & (size - 1)
+			}
+		}
+	}
+	if position != 0 {
+		return errCorrupted
+	}
+
+	for state := range table.entries {
+		entry := &table.entries[state]
+		nextState := next[entry.symbol]
+		next[entry.symbol]++
+		entry.bits = uint8(accuracyLog - (bits.Len(uint(nextState)) - 1))
+		entry.baseline = uint16(nextState<<entry.bits - size)
+	}
+	return nil
+}
+
+type huffmanEntry struct {
+	symbol uint8
+	bits   uint8
+}
+
+// huffmanTable is indexed by the next maxBits bits of the stream.
+type huffmanTable struct {
+	maxBits uint8
+	entries []huffmanEntry
+}
+
+// readDescription reads the symbol weights and builds the table, returns
+// the size of the description.
+func (table *huffmanTable) readDescription(data []byte) (int, error) {
+	if len(data) == 0 {
+		return 0, errCorrupted
+	}
+	var weights [256]uint8
+	var weightsCount, size int
+	if header := int(data[0]); header >= 128 {
+		// 4 bits per weight
+		weightsCount = header - 127
+		size = 1 + (weightsCount+1)/2
+		if len(data) < size {
+			return 0, errCorrupted
+		}
+		for i := 0; i < weightsCount; i++ {
+			weights[i] = data[1+i/2] >> (4 * uint(1-i%2)) & 0xf
+		}
+	} else {
+		size = 1 + header
+		if len(data) < size {
+			return 0, errCorrupted
+		}
+		var err error
+		if weightsCount, err = decodeHuffmanWeights(data[1:size], weights[:255]); err != nil {
+			return 0, err
+		}
+	}
+
+	// the weight of the last symbol is implied by the sum of 2^(weight-1)
+	// which is a power of two
+	total := 0
+	for _, weight := range weights[:weightsCount] {
+		if weight > maxHuffmanBits {
+			return 0, errCorrupted
+		}
+		if weight > 0 {
+			total += 1 << (weight - 1)
+		}
+	}
+	if total == 0 {
+		return 0, errCorrupted
+	}
+	maxBits := bits.Len(uint(total))
+	leftover := 1<<maxBits - total
+	if maxBits > maxHuffmanBits || leftover&(leftover-1) != 0 {
+		return 0, errCorrupted
+	}
+	weights[weightsCount] = uint8(bits.Len(uint(leftover)))
+	weightsCount++
+
+	// the codes of each weight take consecutive entries, starting from the
+	// lowest weight
+	var rankStart [maxHuffmanBits + 2]int
+	for _, weight := range weights[:weightsCount] {
+		if weight > 0 {
+			rankStart[weight] += 1 << (weight - 1)
+		}
+	}
+	position := 0
+	for weight := 1; weight <= maxBits; weight++ {
+		position, rankStart[weight] = position+rankStart[weight], position
+	}
+	table.maxBits = uint8(maxBits)
+	if cap(table.entries) < 1<<maxBits {
+		table.entries = make([]huffmanEntry, 1<<maxBits)
+	}
+	table.entries = table.entries[:1<<maxBits]
+	for symbol, weight := range weights[:weightsCount] {
+		if weight == 0 {
+			continue
+		}
+		entry := huffmanEntry{uint8(symbol), uint8(maxBits + 1 - int(weight))}
+		start := rankStart[weight]
+		for i := start; i < start+1<<(weight-1); i++ {
+			table.entries[i] = entry
+		}
+		rankStart[weight] += 1 << (weight - 1)
+	}
+	return size, nil
+}
+
+// decodeHuffmanWeights decodes FSE compressed weights, the two states
+// decode the symbols alternately until the stream is consumed.
+func decodeHuffmanWeights(data []byte, weights []uint8) (int, error) {
+	var table fseTable
+	n, err := table.readDescription(data, 255, 6)
+	if err != nil {
+		return 0, err
+	}
+	var r bitReader
+	if err := r.init(data[n:]); err != nil {
+		return 0, err
+	}
+	states := [2]int{int(r.read(table.accuracyLog)), int(r.read(table.accuracyLog))}
+	count := 0
+	for i := 0; ; i ^= 1 {
+		if count+2 > len(weights) {
+			return 0, errCorrupted
+		}
+		weights[count] = table.entries[states[i]].symbol
+		count++
+		states[i] = table.nextState(states[i], &r)
+		if r.bitsLeft < 0 {
+			weights[count] = table.entries[states[i^1]].symbol
+			return count + 1, nil
+		}
+	}
+}
+
+func (table *huffmanTable) decodeStream(data []byte, output []byte) error {
+	var r bitReader
+	if err := r.init(data); err != nil {
+		return err
+	}
+	for i := range output {
+		entry := table.entries[r.peek(table.maxBits)]
+		output[i] = entry.symbol
+		r.bitsLeft -= int(entry.bits)
+	}
+	if r.bitsLeft != 0 {
+		return errCorrupted
+	}
+	return nil
+}
+
+// xxHash64 is the streaming implementation of XXH64 with zero seed, the
+// low 32 bits of the hash are the zstd frame checksum.
+type xxHash64 struct {
+	v        [4]uint64
+	total    uint64
+	buffer   [32]byte
+	buffered int
+}
+
+const (
+	xxPrime1 uint64 = 11400714785074694791
+	xxPrime2 uint64 = 14029467366897019727
+	xxPrime3 uint64 = 1609587929392839161
+	xxPrime4 uint64 = 9650029242287828579
+	xxPrime5 uint64 = 2870177450012600261
+)
+
+func xxRound(acc, input uint64) uint64 {
+	return bits.RotateLeft64(acc+input*xxPrime2, 31) * xxPrime1
+}
+
+func xxMergeRound(acc, value uint64) uint64 {
+	return (acc^xxRound(0, value))*xxPrime1 + xxPrime4
+}
+
+func (h *xxHash64) reset() {
+	prime1 := xxPrime1 // the sums of the constants overflow
+	h.v = [4]uint64{prime1 + xxPrime2, xxPrime2, 0, -prime1}
+	h.total = 0
+	h.buffered = 0
+}
+
+func (h *xxHash64) processStripe(stripe []byte) {
+	for i := range h.v {
+		h.v[i] = xxRound(h.v[i], binary.LittleEndian.Uint64(stripe[8*i:]))
+	}
+}
+
+func (h *xxHash64) write(p []byte) {
+	h.total += uint64(len(p))
+	if h.buffered > 0 {
+		n := copy(h.buffer[h.buffered:], p)
+		h.buffered += n
+		p = p[n:]
+		if h.buffered < len(h.buffer) {
+			return
+		}
+		h.processStripe(h.buffer[:])
+		h.buffered = 0
+	}
+	for ; len(p) >= 32; p = p[32:] {
+		h.processStripe(p)
+	}
+	h.buffered = copy(h.buffer[:], p)
+}
+
+func (h *xxHash64) sum64() uint64 {
+	var hash uint64
+	if h.total >= 32 {
+		hash = bits.RotateLeft64(h.v[0], 1) + bits.RotateLeft64(h.v[1], 7) +
+			bits.RotateLeft64(h.v[2], 12) + bits.RotateLeft64(h.v[3], 18)
+		for _, v := range h.v {
+			hash = xxMergeRound(hash, v)
+		}
+	} else {
+		hash = xxPrime5
+	}
+	hash += h.total
+
+	p := h.buffer[:h.buffered]
+	for ; len(p) >= 8; p = p[8:] {
+		hash ^= xxRound(0, binary.LittleEndian.Uint64(p))
+		hash = bits.RotateLeft64(hash, 27)*xxPrime1 + xxPrime4
+	}
+	if len(p) >= 4 {
+		hash ^= uint64(binary.LittleEndian.Uint32(p)) * xxPrime1
+		hash = bits.RotateLeft64(hash, 23)*xxPrime2 + xxPrime3
+		p = p[4:]
+	}
+	for _, b := range p {
+		hash ^= uint64(b) * xxPrime5
+		hash = bits.RotateLeft64(hash, 11) * xxPrime1
+	}
+	hash ^= hash >> 33
+	hash *= xxPrime2
+	hash ^= hash >> 29
+	hash *= xxPrime3
+	hash ^= hash >> 32
+	return hash
+}
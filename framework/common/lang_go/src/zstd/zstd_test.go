@@ -0,0 +1,226 @@
+package zstd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+// testDataDir contains the benchmark models, they are compressed by the
+// zstd command line tool to test the reader on real data.
+const testDataDir = "../../../../../benchmarks/kdtree-construction/data"
+
+func TestXXHash64(t *testing.T) {
+	for _, test := range []struct {
+		input string
+		hash  uint64
+	}{
+		{"", 0xef46db3751d8e999},
+		{"a", 0xd24ec4f1a98c6e5b},
+		{"abc", 0x44bc2cf5ad770999},
+		{"Nobody inspects the spammish repetition", 0xfbcea83c8a378bf1},
+	} {
+		var h xxHash64
+		h.reset()
+		h.write([]byte(test.input))
+		if hash := h.sum64(); hash != test.hash {
+			t.Errorf("%q: hash is %#x, expected %#x", test.input, hash, test.hash)
+		}
+	}
+
+	// the hash does not depend on how the data is split between writes
+	data := make([]byte, 1000)
+	r := rand.New(rand.NewSource(1))
+	r.Read(data)
+	var h xxHash64
+	h.reset()
+	h.write(data)
+	expected := h.sum64()
+	for _, chunkSize := range []int{1, 7, 31, 32, 33, 100} {
+		h.reset()
+		for p := data; len(p) > 0; {
+			n := min(chunkSize, len(p))
+			h.write(p[:n])
+			p = p[n:]
+		}
+		if hash := h.sum64(); hash != expected {
+			t.Errorf("chunk size %d: hash is %#x, expected %#x", chunkSize, hash, expected)
+		}
+	}
+}
+
+// newFrame returns the frame with the content size and the checksum
+// that consists of the given blocks, the last block flag is set for the
+// last one.
+func newFrame(content []byte, blocks ...[]byte) []byte {
+	frame := binary.LittleEndian.AppendUint32(nil, frameMagic)
+	// 8 byte content size, single segment, checksum
+	frame = append(frame, 0xe4)
+	frame = binary.LittleEndian.AppendUint64(frame, uint64(len(content)))
+	for i, block := range blocks {
+		if i == len(blocks)-1 {
+			block[0] |= 1
+		}
+		frame = append(frame, block...)
+	}
+	var h xxHash64
+	h.reset()
+	h.write(content)
+	return binary.LittleEndian.AppendUint32(frame, uint32(h.sum64()))
+}
+
+func newBlockHeader(blockType, size int) []byte {
+	value := blockType<<1 | size<<3
+	return []byte{byte(value), byte(value >> 8), byte(value >> 16)}
+}
+
+func decompressZstd(data []byte) ([]byte, error) {
+	return io.ReadAll(NewReader(bytes.NewReader(data)))
+}
+
+func TestReaderHandBuiltFrames(t *testing.T) {
+	content := append([]byte("raw block"), bytes.Repeat([]byte{'x'}, 100)...)
+	frame := newFrame(content,
+		append(newBlockHeader(0, 9), "raw block"...),
+		append(newBlockHeader(1, 100), 'x'))
+
+	// skippable frame and the frame with the compressed block that has raw
+	// literals and no sequences
+	skippable := binary.LittleEndian.AppendUint32(nil, skippableFrameMagic+3)
+	skippable = binary.LittleEndian.AppendUint32(skippable, 5)
+	skippable = append(skippable, "12345"...)
+	literals := []byte("literals")
+	compressedBlock := append(newBlockHeader(2, 2+len(literals)),
+		byte(len(literals)<<3))
+	compressedBlock = append(compressedBlock, literals...)
+	compressedBlock = append(compressedBlock, 0)
+	data := append(append(frame, skippable...), newFrame(literals, compressedBlock)...)
+
+	decoded, err := decompressZstd(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := append(append([]byte(nil), content...), literals...); !bytes.Equal(decoded, expected) {
+		t.Errorf("decoded %q, expected %q", decoded, expected)
+	}
+
+	// RLE literals "aaaa" and the sequence from the RLE tables: literals
+	// length code 4, offset code 2 with zero extra bits for the offset 1,
+	// match length code 7 for the match length 10. The bitstream is the two
+	// offset bits after the start marker.
+	rleBlock := append(newBlockHeader(2, 8), 1|4<<3, 'a', 1, 0x54, 4, 2, 7, 0x04)
+	rleContent := bytes.Repeat([]byte{'a'}, 14)
+	if decoded, err := decompressZstd(newFrame(rleContent, rleBlock)); err != nil ||
+		!bytes.Equal(decoded, rleContent) {
+		t.Errorf("rle sequences: decoded %q, error %v", decoded, err)
+	}
+
+	// the largest sequences count of two bytes plus one in three bytes, each
+	// sequence without literals repeats the previous byte 3 times
+	const sequencesCount = 0x7f00
+	manySequences := []byte{0, 0xff, 0, 0, 0x54, 0, 2, 0}
+	manySequences = append(manySequences, make([]byte, 2*sequencesCount/8)...)
+	manySequences = append(manySequences, 0x01)
+	manySequences = append(newBlockHeader(2, len(manySequences)), manySequences...)
+	manyContent := bytes.Repeat([]byte{'a'}, 1+3*sequencesCount)
+	if decoded, err := decompressZstd(newFrame(manyContent,
+		append(newBlockHeader(0, 1), 'a'), manySequences)); err != nil ||
+		!bytes.Equal(decoded, manyContent) {
+		t.Errorf("%d sequences: decoded %d bytes, error %v", sequencesCount, len(decoded), err)
+	}
+
+	corrupted := append([]byte(nil), frame...)
+	corrupted[len(corrupted)-1] ^= 1
+	if _, err := decompressZstd(corrupted); err == nil || err.Error() != "zstd: invalid checksum" {
+		t.Errorf("corrupted checksum: unexpected error %v", err)
+	}
+	if _, err := decompressZstd(frame[:len(frame)-10]); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("truncated frame: unexpected error %v", err)
+	}
+}
+
+// compressZstd compresses the data with zstd command line tool.
+func compressZstd(t *testing.T, data []byte, args ...string) []byte {
+	t.Helper()
+	cmd := exec.Command("zstd", append([]string{"-q", "-c"}, args...)...)
+	cmd.Stdin = bytes.NewReader(data)
+	output, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("zstd %v: %v", args, err)
+	}
+	return output
+}
+
+func TestReaderDecodesCommandLineTool(t *testing.T) {
+	if _, err := exec.LookPath("zstd"); err != nil {
+		t.Skip("zstd command is not available")
+	}
+	teapot, err := os.ReadFile(filepath.Join(testDataDir, "teapot.stl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bunny, err := os.ReadFile(filepath.Join(testDataDir, "bunny.stl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	random := make([]byte, 300000)
+	r := rand.New(rand.NewSource(2))
+	r.Read(random)
+	repeated := bytes.Repeat([]byte("abcd"), 100000)
+	// short matches over the small alphabet give many sequences per block
+	binaryDigits := make([]byte, 500000)
+	for i := range binaryDigits {
+		binaryDigits[i] = '0' + byte(r.Intn(2))
+	}
+	// the literals of a block are the same byte
+	var runs []byte
+	for i := 0; i < 2000; i++ {
+		runs = append(runs, bytes.Repeat([]byte{'a'}, r.Intn(64)+1)...)
+		runs = append(runs, "bcdefgh"[:r.Intn(7)+1]...)
+	}
+
+	for _, test := range []struct {
+		name string
+		data []byte
+		args []string
+	}{
+		{"teapot, level 1", teapot, []string{"-1"}},
+		{"teapot, level 3", teapot, []string{"-3"}},
+		{"teapot, level 19", teapot, []string{"-19"}},
+		{"teapot, level 22", teapot, []string{"--ultra", "-22"}},
+		{"teapot, no checksum", teapot, []string{"--no-check"}},
+		{"teapot, small window", teapot, []string{"--zstd=wlog=10"}},
+		{"bunny, level 3", bunny, []string{"-3"}},
+		{"bunny, long window", bunny, []string{"--long=24", "-9"}},
+		{"teapot, fast level", teapot, []string{"--fast=5"}},
+		{"teapot header", teapot[:300], nil},
+		{"incompressible data", random, nil},
+		{"repeated data", repeated, nil},
+		{"binary digits", binaryDigits, []string{"-19"}},
+		{"runs", runs, []string{"-19"}},
+		{"runs, fast level", runs, []string{"-1"}},
+	} {
+		compressed := compressZstd(t, test.data, test.args...)
+		decoded, err := decompressZstd(compressed)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if !bytes.Equal(decoded, test.data) {
+			t.Errorf("%s: decoded %d bytes differ from %d original bytes", test.name,
+				len(decoded), len(test.data))
+		}
+	}
+
+	// concatenated frames are decoded as one stream
+	concatenated := append(compressZstd(t, teapot[:1000]), compressZstd(t, teapot[1000:])...)
+	if decoded, err := decompressZstd(concatenated); err != nil || !bytes.Equal(decoded, teapot) {
+		t.Errorf("concatenated frames: decoded %d bytes, error %v", len(decoded), err)
+	}
+}
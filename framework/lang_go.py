@@ -26,17 +26,30 @@ def build_go_sources(source_dir, output_dir, compiler_executable):
 
 
 def build_go_sources_with_gccgo(source_dir, output_dir, compiler_executable):
-    common_obj = os.path.join(output_dir, 'common.o')
-    subprocess.call([
-        compiler_executable,
-        '-c',
-        '-g',
-        '-m64',
-        '-O3',
-        '-o',
-        common_obj,
-        os.path.join(common.COMMON_DIR_PATH, 'lang_go', 'src', 'common', 'common.go')
-    ])
+    # gccgo does not evaluate build constraints for the files passed
+    # explicitly, so the platform specific file is selected here
+    packages_dir = os.path.join(common.COMMON_DIR_PATH, 'lang_go', 'src')
+    mmap_source = 'mmap_other.go' if os.name == 'nt' else 'mmap_unix.go'
+    packages = [
+        ('common', ['common.go', mmap_source]),
+        ('zstd', ['zstd.go']),
+    ]
+
+    # the benchmark imports the shared packages, their objects are found
+    # in output_dir by the package name
+    package_objs = []
+    for package_name, package_sources in packages:
+        package_obj = os.path.join(output_dir, package_name + '.o')
+        subprocess.call([
+            compiler_executable,
+            '-c',
+            '-g',
+            '-m64',
+            '-O3',
+            '-o',
+            package_obj,
+        ] + [os.path.join(packages_dir, package_name, f) for f in package_sources])
+        package_objs.append(package_obj)
 
     main_obj = os.path.join(output_dir, 'main.o')
     build_command = [
@@ -49,7 +62,9 @@ def build_go_sources_with_gccgo(source_dir, output_dir, compiler_executable):
         main_obj,
         '-I' + output_dir,
     ]
-    go_source_files = glob.glob(os.path.join(source_dir, '*.go'))
+    # unlike go build, gccgo compiles the test files passed explicitly
+    go_source_files = [f for f in glob.glob(os.path.join(source_dir, '*.go'))
+                       if not f.endswith('_test.go')]
     build_command.extend(go_source_files)
     subprocess.call(build_command)
 
@@ -57,6 +72,4 @@ def build_go_sources_with_gccgo(source_dir, output_dir, compiler_executable):
         compiler_executable,
         '-o',
         os.path.join(output_dir, common.EXECUTABLE_NAME),
-        common_obj,
-        main_obj
-    ])
+    ] + package_objs + [main_obj])